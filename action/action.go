@@ -0,0 +1,299 @@
+// Package action keeps the log of what the actuators of a controller actually did
+// Controllers report each action they executed or skipped, which can then be reconciled with the plan
+package action
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"github.com/google/uuid"
+	"github.com/tPhume/ags-backend/lookup"
+	"github.com/tPhume/ags-backend/session"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func RegisterRoutes(handler *Handler, engine *gin.Engine, sessionHandler *session.Handler) {
+	if err := addValidation(); err != nil {
+		panic("can't register Action endpoint routes")
+	}
+
+	engine.POST("api-controller/v1/action", handler.AddEvents)
+
+	engine.GET("api/v1/controller/:controllerId/actions", sessionHandler.GetUser, handler.ListEvents)
+	engine.GET("api/v1/controller/:controllerId/actions/reconciliation", sessionHandler.GetUser, handler.Reconcile)
+}
+
+// Outcomes of an action
+const (
+	OutcomeCompleted        = "completed"
+	OutcomeInterrupted      = "interrupted"
+	OutcomeSkippedTankEmpty = "skipped_tank_empty"
+	OutcomeSkippedManual    = "skipped_manual"
+	OutcomeFailed           = "failed"
+)
+
+var outcomes = map[string]bool{
+	OutcomeCompleted:        true,
+	OutcomeInterrupted:      true,
+	OutcomeSkippedTankEmpty: true,
+	OutcomeSkippedManual:    true,
+	OutcomeFailed:           true,
+}
+
+// Event is an action reported by a controller
+// A controller reports one event per action and start, so resubmitting an event changes nothing
+type Event struct {
+	EventId      string    `json:"event_id" bson:"_id"`
+	ControllerId string    `json:"controller_id" bson:"controller_id"`
+	UserId       string    `json:"-" bson:"user_id"`
+	Type         string    `json:"type" bson:"type" binding:"oneof=water light"`
+	Level        int       `json:"level" bson:"level" binding:"gte=0,lte=100"`
+	Start        time.Time `json:"start" bson:"start" binding:"required"`
+	Outcome      string    `json:"outcome" bson:"outcome" binding:"outcome"`
+
+	// Duration the actuator actually ran for in seconds, zero when the action was skipped
+	Duration int `json:"duration" bson:"duration" binding:"gte=0"`
+}
+
+// Body of AddEvents
+type eventsBody struct {
+	Events []*Event `json:"events" binding:"required,min=1,max=500,dive"`
+}
+
+func addValidation() error {
+	validate := binding.Validator.Engine().(*validator.Validate)
+	return validate.RegisterValidation("outcome", outcome)
+}
+
+func outcome(fl validator.FieldLevel) bool {
+	return outcomes[fl.Field().String()]
+}
+
+// Controller is what the action log needs to know about a controller
+type Controller struct {
+	ControllerId string `bson:"_id"`
+	UserId       string `bson:"user_id"`
+	Plan         string `bson:"plan"`
+}
+
+// Repo
+type Repo interface {
+	// GetController returns the controller that owns the token
+	GetController(ctx context.Context, token string) (*Controller, error)
+
+	// GetUserController returns the controller if it belongs to userId
+	GetUserController(ctx context.Context, userId string, controllerId string) (*Controller, error)
+
+	lookup.Plans
+	lookup.Timezones
+
+	// AddEvents stores events that weren't stored before and returns how many were added
+	AddEvents(ctx context.Context, events []*Event) (int, error)
+
+	// ListEvents returns the events of a controller that started from one time to another, in order
+	ListEvents(ctx context.Context, userId string, controllerId string, from time.Time, to time.Time) ([]*Event, error)
+}
+
+var (
+	errTokenNotFound      = errors.New("token not found")
+	errControllerNotFound = lookup.ErrControllerNotFound
+	errPlanNotFound       = lookup.ErrPlanNotFound
+)
+
+// Reports from a controller can't be further ahead than this
+const maxClockSkew = 5 * time.Minute
+
+// Longest range of a list or reconciliation
+const maxActionRange = 31 * 24 * time.Hour
+
+// Handler for action REST API
+type Handler struct {
+	Repo Repo
+}
+
+var (
+	// ok message responses for handler
+	resAdd       = "actions added"
+	resList      = "actions retrieved"
+	resReconcile = "actions reconciled"
+
+	// error message responses for handler
+	resInternal      = "not your fault, don't worry"
+	resInvalid       = "invalid values"
+	resNotFound      = "not found"
+	resTokenNotFound = "token not found"
+	resPlanNotFound  = "controller has no plan"
+)
+
+type rangeQuery struct {
+	From time.Time `form:"from" binding:"required" time_format:"2006-01-02T15:04:05Z07:00"`
+	To   time.Time `form:"to" binding:"required" time_format:"2006-01-02T15:04:05Z07:00"`
+}
+
+// This is for the Controller using Token
+func (h *Handler) AddEvents(ctx *gin.Context) {
+	token := ctx.GetHeader("token")
+	if strings.TrimSpace(token) == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	body := &eventsBody{}
+	if err := ctx.ShouldBindJSON(body); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	now := time.Now()
+	for _, event := range body.Events {
+		if event.Start.After(now.Add(maxClockSkew)) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+			return
+		}
+	}
+
+	controller, err := h.Repo.GetController(ctx, token)
+	if err != nil {
+		if err == errTokenNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resTokenNotFound})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	for _, event := range body.Events {
+		event.Start = event.Start.UTC().Truncate(time.Second)
+		event.EventId = eventId(controller.ControllerId, event)
+		event.ControllerId = controller.ControllerId
+		event.UserId = controller.UserId
+	}
+
+	added, err := h.Repo.AddEvents(ctx, body.Events)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, gin.H{"message": resAdd, "added": added, "duplicate": len(body.Events) - added})
+}
+
+// eventId identifies an action by what it was and when it started
+func eventId(controllerId string, event *Event) string {
+	return controllerId + ":" + event.Type + ":" + event.Start.Format(time.RFC3339)
+}
+
+func (h *Handler) ListEvents(ctx *gin.Context) {
+	userId, controllerId, query, ok := h.bindRange(ctx)
+	if !ok {
+		return
+	}
+
+	if _, err := h.Repo.GetUserController(ctx, userId, controllerId); err != nil {
+		h.controllerError(ctx, err)
+		return
+	}
+
+	events, err := h.Repo.ListEvents(ctx, userId, controllerId, query.From, query.To)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resList, "result": events})
+}
+
+// Reconcile matches the occurrences of the plan of the controller with the events it reported
+// The plan currently assigned is used for the whole range
+func (h *Handler) Reconcile(ctx *gin.Context) {
+	userId, controllerId, query, ok := h.bindRange(ctx)
+	if !ok {
+		return
+	}
+
+	controller, err := h.Repo.GetUserController(ctx, userId, controllerId)
+	if err != nil {
+		h.controllerError(ctx, err)
+		return
+	}
+
+	if controller.Plan == "" {
+		ctx.JSON(http.StatusNotFound, gin.H{"message": resPlanNotFound})
+		return
+	}
+
+	entity, err := h.Repo.GetPlan(ctx, userId, controller.Plan)
+	if err != nil {
+		if err == errPlanNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resPlanNotFound})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	timezone, err := h.Repo.GetTimezone(ctx, userId)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		location = time.UTC
+	}
+
+	// Events that started a little before from can still match the first occurrences
+	events, err := h.Repo.ListEvents(ctx, userId, controllerId, query.From.Add(-matchWindow), query.To.Add(matchWindow))
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	reconciliation := reconcile(entity.Occurrences(query.From, query.To, location), events, query.From, query.To)
+	ctx.JSON(http.StatusOK, gin.H{"message": resReconcile, "result": reconciliation})
+}
+
+// bindRange checks the user, controllerId and range of a request, it responds itself when something is wrong
+func (h *Handler) bindRange(ctx *gin.Context) (string, string, *rangeQuery, bool) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return "", "", nil, false
+	}
+
+	// check controllerId
+	controllerId := ctx.Param("controllerId")
+	if _, err := uuid.Parse(controllerId); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return "", "", nil, false
+	}
+
+	query := &rangeQuery{}
+	if err := ctx.ShouldBindQuery(query); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return "", "", nil, false
+	}
+
+	span := query.To.Sub(query.From)
+	if span <= 0 || span > maxActionRange {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return "", "", nil, false
+	}
+
+	return userId, controllerId, query, true
+}
+
+func (h *Handler) controllerError(ctx *gin.Context, err error) {
+	if err == errControllerNotFound {
+		ctx.JSON(http.StatusNotFound, gin.H{"message": resNotFound})
+	} else {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+	}
+}
@@ -0,0 +1,249 @@
+package action
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/tPhume/ags-backend/plan"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+)
+
+type mapping map[string]interface{}
+
+// For our tests the grower has a herb bench, reporting with its token, on a plan that waters every day at 06:00
+// and lights every Monday at 18:00. Any other controller id or token indicates a missing controller
+const (
+	growerId   = "5c000425-efea-4238-8b8f-458a3e88a93c"
+	benchId    = "a2ac92c9-d199-487b-aa14-f8de49383a7d"
+	unknownId  = "d941f8d7-fa66-4682-b5c8-016fe26c1c8e"
+	benchToken = "herb-bench-token"
+)
+
+var herbPlan = plan.Entity{
+	PlanId: "644acc93-1eb0-4fa1-bbab-1f8d74132012",
+	UserId: growerId,
+	Name:   "Herbs",
+	Daily:  []plan.Daily{{DailyTime: "06:00", Action: plan.Action{Type: "water", Level: 50, Duration: 60}}},
+	Weekly: []plan.Weekly{{WeeklyTime: "1:18:00", Action: plan.Action{Type: "light", Level: 100, Duration: 3600}}},
+}
+
+var bench = Controller{ControllerId: benchId, UserId: growerId, Plan: herbPlan.PlanId}
+
+// Repo struct for testing
+type repoStruct struct {
+	events map[string]*Event
+}
+
+func (r *repoStruct) GetController(ctx context.Context, token string) (*Controller, error) {
+	if token != benchToken {
+		return nil, errTokenNotFound
+	}
+
+	return &bench, nil
+}
+
+func (r *repoStruct) GetUserController(ctx context.Context, userId string, controllerId string) (*Controller, error) {
+	if userId != growerId || controllerId != benchId {
+		return nil, errControllerNotFound
+	}
+
+	return &bench, nil
+}
+
+func (r *repoStruct) GetPlan(ctx context.Context, userId string, planId string) (*plan.Entity, error) {
+	if planId != herbPlan.PlanId {
+		return nil, errPlanNotFound
+	}
+
+	return &herbPlan, nil
+}
+
+func (r *repoStruct) GetTimezone(ctx context.Context, user string) (string, error) {
+	return "Asia/Bangkok", nil
+}
+
+func (r *repoStruct) AddEvents(ctx context.Context, events []*Event) (int, error) {
+	added := 0
+	for _, event := range events {
+		if _, ok := r.events[event.EventId]; !ok {
+			r.events[event.EventId] = event
+			added++
+		}
+	}
+
+	return added, nil
+}
+
+func (r *repoStruct) ListEvents(ctx context.Context, user string, id string, from time.Time, to time.Time) ([]*Event, error) {
+	events := make([]*Event, 0)
+	for _, event := range r.events {
+		if !event.Start.Before(from) && event.Start.Before(to) {
+			events = append(events, event)
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Start.Before(events[j].Start)
+	})
+
+	return events, nil
+}
+
+// Setup func for handler testing
+func setUp() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+
+	engine.Use(func(ctx *gin.Context) {
+		ctx.Set("userId", growerId)
+	})
+
+	return engine
+}
+
+// Test AddEvents handler
+func TestHandler_AddEvents(t *testing.T) {
+	engine := setUp()
+
+	_ = addValidation()
+
+	handler := &Handler{Repo: &repoStruct{events: map[string]*Event{}}}
+	engine.POST("", handler.AddEvents)
+
+	start := time.Now().Add(-time.Hour).UTC()
+	event := mapping{"type": "water", "level": 50, "start": start, "duration": 58, "outcome": OutcomeCompleted}
+
+	testCases := []struct {
+		token     string
+		in        mapping
+		message   string
+		code      int
+		added     float64
+		duplicate float64
+	}{
+		{token: benchToken, in: mapping{"events": []mapping{event}}, message: resAdd, code: http.StatusCreated, added: 1},
+		{token: benchToken, in: mapping{"events": []mapping{event}}, message: resAdd, code: http.StatusCreated, duplicate: 1},
+		{token: benchToken, in: mapping{"events": []mapping{{"type": "light", "start": start, "outcome": OutcomeSkippedManual}}}, message: resAdd, code: http.StatusCreated, added: 1},
+		{token: benchToken, in: mapping{"events": []mapping{{"type": "water", "start": start, "outcome": "skipped-tank-empty"}}}, message: resInvalid, code: http.StatusBadRequest},
+		{token: benchToken, in: mapping{"events": []mapping{{"type": "fan", "start": start, "outcome": OutcomeCompleted}}}, message: resInvalid, code: http.StatusBadRequest},
+		{token: benchToken, in: mapping{"events": []mapping{{"type": "water", "start": time.Now().Add(time.Hour), "outcome": OutcomeCompleted}}}, message: resInvalid, code: http.StatusBadRequest},
+		{token: benchToken, in: mapping{"events": []mapping{}}, message: resInvalid, code: http.StatusBadRequest},
+		{token: "", in: mapping{"events": []mapping{event}}, message: resInvalid, code: http.StatusBadRequest},
+		{token: "bad-token", in: mapping{"events": []mapping{event}}, message: resTokenNotFound, code: http.StatusNotFound},
+	}
+
+	for i, c := range testCases {
+		resp := httptest.NewRecorder()
+
+		body, _ := json.Marshal(c.in)
+		req, _ := http.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		req.Header.Set("token", c.token)
+		engine.ServeHTTP(resp, req)
+
+		respBody := mapping{}
+		_ = json.Unmarshal(resp.Body.Bytes(), &respBody)
+
+		if c.code != resp.Code {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.code, resp.Code)
+		}
+
+		if c.message != respBody["message"] {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.message, respBody["message"])
+		}
+
+		if c.code == http.StatusCreated && (respBody["added"] != c.added || respBody["duplicate"] != c.duplicate) {
+			t.Fatalf("Case %d: expected [%v %v], got = [%v %v]", i, c.added, c.duplicate, respBody["added"], respBody["duplicate"])
+		}
+	}
+}
+
+// Test occurrences are matched with the nearest event of their type within the window
+func TestHandler_Reconcile(t *testing.T) {
+	engine := setUp()
+
+	location, _ := time.LoadLocation("Asia/Bangkok")
+	at := func(day int, hour int, minute int) time.Time {
+		return time.Date(2020, time.April, day, hour, minute, 0, 0, location).UTC()
+	}
+
+	// Monday 13 April to Thursday 16 April in Bangkok
+	repo := &repoStruct{events: map[string]*Event{
+		"1": {Type: "water", Start: at(13, 6, 2), Outcome: OutcomeCompleted},
+		"2": {Type: "water", Start: at(14, 5, 55), Outcome: OutcomeSkippedTankEmpty},
+		"3": {Type: "water", Start: at(15, 6, 30), Outcome: OutcomeCompleted},
+		"4": {Type: "light", Start: at(13, 18, 0), Outcome: OutcomeInterrupted},
+	}}
+
+	handler := &Handler{Repo: repo}
+	engine.GET(":controllerId", handler.Reconcile)
+
+	query := "?from=" + at(13, 0, 0).Format(time.RFC3339) + "&to=" + at(16, 0, 0).Format(time.RFC3339)
+
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/"+benchId+query, nil)
+	engine.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected [%v], got = [%v]", http.StatusOK, resp.Code)
+	}
+
+	respBody := struct {
+		Result *Reconciliation `json:"result"`
+	}{}
+	_ = json.Unmarshal(resp.Body.Bytes(), &respBody)
+
+	expected := []string{StatusExecuted, StatusExecuted, StatusNotExecuted, StatusMissed}
+	result := respBody.Result
+
+	if len(result.Occurrences) != len(expected) {
+		t.Fatalf("expected [%v] occurrences, got = [%v]", len(expected), len(result.Occurrences))
+	}
+
+	for i, entry := range result.Occurrences {
+		if entry.Status != expected[i] {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, expected[i], entry.Status)
+		}
+	}
+
+	// Half an hour late is too late to count for the occurrence of the 15th
+	if len(result.Unscheduled) != 1 || !result.Unscheduled[0].Start.Equal(at(15, 6, 30)) {
+		t.Fatalf("expected one unscheduled event, got = [%v]", result.Unscheduled)
+	}
+
+	if result.Executed != 2 || result.NotExecuted != 1 || result.Missed != 1 {
+		t.Fatalf("expected [2 1 1], got = [%v %v %v]", result.Executed, result.NotExecuted, result.Missed)
+	}
+
+	// Unknown controllers and bad ranges
+	testCases := []struct {
+		path    string
+		message string
+		code    int
+	}{
+		{path: "/" + unknownId + query, message: resNotFound, code: http.StatusNotFound},
+		{path: "/not-a-uuid" + query, message: resInvalid, code: http.StatusBadRequest},
+		{path: "/" + benchId + "?from=" + at(16, 0, 0).Format(time.RFC3339), message: resInvalid, code: http.StatusBadRequest},
+	}
+
+	for i, c := range testCases {
+		resp := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, c.path, nil)
+		engine.ServeHTTP(resp, req)
+
+		respBody := mapping{}
+		_ = json.Unmarshal(resp.Body.Bytes(), &respBody)
+
+		if c.code != resp.Code {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.code, resp.Code)
+		}
+
+		if c.message != respBody["message"] {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.message, respBody["message"])
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package action
+
+import (
+	"context"
+	"github.com/tPhume/ags-backend/lookup"
+	"github.com/tPhume/ags-backend/plan"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+type MongoRepo struct {
+	Col           *mongo.Collection
+	ControllerCol *mongo.Collection
+	Lookup        *lookup.MongoRepo
+}
+
+func (m *MongoRepo) GetController(ctx context.Context, token string) (*Controller, error) {
+	result := m.ControllerCol.FindOne(ctx, bson.M{"token": token})
+	if result.Err() != nil {
+		if result.Err() == mongo.ErrNoDocuments {
+			return nil, errTokenNotFound
+		}
+
+		return nil, result.Err()
+	}
+
+	controller := &Controller{}
+	if err := result.Decode(controller); err != nil {
+		return nil, err
+	}
+
+	return controller, nil
+}
+
+func (m *MongoRepo) GetUserController(ctx context.Context, userId string, controllerId string) (*Controller, error) {
+	controller := &Controller{}
+	if err := m.Lookup.FindController(ctx, userId, controllerId, controller); err != nil {
+		return nil, err
+	}
+
+	return controller, nil
+}
+
+func (m *MongoRepo) GetPlan(ctx context.Context, userId string, planId string) (*plan.Entity, error) {
+	return m.Lookup.GetPlan(ctx, userId, planId)
+}
+
+func (m *MongoRepo) GetTimezone(ctx context.Context, userId string) (string, error) {
+	return m.Lookup.GetTimezone(ctx, userId)
+}
+
+// AddEvents inserts events by _id, an event that is already stored collides and is counted as a duplicate
+func (m *MongoRepo) AddEvents(ctx context.Context, events []*Event) (int, error) {
+	documents := make([]interface{}, len(events))
+	for i, event := range events {
+		documents[i] = event
+	}
+
+	result, err := m.Col.InsertMany(ctx, documents, options.InsertMany().SetOrdered(false))
+	if err == nil {
+		return len(result.InsertedIDs), nil
+	}
+
+	bulkException, ok := err.(mongo.BulkWriteException)
+	if !ok || bulkException.WriteConcernError != nil {
+		return 0, err
+	}
+
+	for _, writeError := range bulkException.WriteErrors {
+		if writeError.Code != 11000 {
+			return 0, err
+		}
+	}
+
+	return len(events) - len(bulkException.WriteErrors), nil
+}
+
+func (m *MongoRepo) ListEvents(ctx context.Context, userId string, controllerId string, from time.Time, to time.Time) ([]*Event, error) {
+	filter := bson.M{
+		"controller_id": controllerId,
+		"user_id":       userId,
+		"start":         bson.M{"$gte": from, "$lt": to},
+	}
+
+	cursor, err := m.Col.Find(ctx, filter, options.Find().SetSort(bson.M{"start": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]*Event, 0)
+	if err := cursor.All(ctx, &events); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
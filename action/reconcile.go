@@ -0,0 +1,107 @@
+package action
+
+import (
+	"github.com/tPhume/ags-backend/plan"
+	"time"
+)
+
+// An event matches an occurrence of the same type scheduled within matchWindow of its start
+const matchWindow = 10 * time.Minute
+
+// Statuses of an occurrence
+const (
+	StatusExecuted    = "executed"
+	StatusNotExecuted = "not_executed"
+	StatusMissed      = "missed"
+)
+
+// Reconciliation of the occurrences of a plan with the events of a controller
+type Reconciliation struct {
+	Occurrences []*Entry `json:"occurrences"`
+
+	// Unscheduled events didn't match any occurrence, such as manual runs
+	Unscheduled []*Event `json:"unscheduled"`
+
+	Executed    int `json:"executed"`
+	NotExecuted int `json:"not_executed"`
+	Missed      int `json:"missed"`
+}
+
+// Entry is an occurrence and the event that matched it, if any
+// It is flagged unless the action was executed
+type Entry struct {
+	*plan.Occurrence
+	Status  string `json:"status"`
+	Flagged bool   `json:"flagged"`
+	Event   *Event `json:"event"`
+}
+
+// reconcile matches each occurrence with the nearest unmatched event of its type, both in start order
+// Events may start up to matchWindow outside the range, but only those within it can be unscheduled
+func reconcile(occurrences []*plan.Occurrence, events []*Event, from time.Time, to time.Time) *Reconciliation {
+	reconciliation := &Reconciliation{Occurrences: make([]*Entry, 0, len(occurrences)), Unscheduled: make([]*Event, 0)}
+	matched := make([]bool, len(events))
+
+	for _, occurrence := range occurrences {
+		entry := &Entry{Occurrence: occurrence, Status: StatusMissed, Flagged: true}
+
+		best := -1
+		for i, event := range events {
+			if matched[i] || event.Type != occurrence.Action.Type {
+				continue
+			}
+
+			distance := absDuration(event.Start.Sub(occurrence.Start))
+			if distance > matchWindow {
+				continue
+			}
+
+			if best == -1 || distance < absDuration(events[best].Start.Sub(occurrence.Start)) {
+				best = i
+			}
+		}
+
+		if best != -1 {
+			matched[best] = true
+			entry.Event = events[best]
+			entry.Status = StatusNotExecuted
+
+			if executed(entry.Event) {
+				entry.Status = StatusExecuted
+				entry.Flagged = false
+			}
+		}
+
+		switch entry.Status {
+		case StatusExecuted:
+			reconciliation.Executed++
+		case StatusNotExecuted:
+			reconciliation.NotExecuted++
+		case StatusMissed:
+			reconciliation.Missed++
+		}
+
+		reconciliation.Occurrences = append(reconciliation.Occurrences, entry)
+	}
+
+	for i, event := range events {
+		if !matched[i] && !event.Start.Before(from) && event.Start.Before(to) {
+			reconciliation.Unscheduled = append(reconciliation.Unscheduled, event)
+		}
+	}
+
+	return reconciliation
+}
+
+// An interrupted action still ran, only skipped and failed ones didn't
+func executed(event *Event) bool {
+	return event.Outcome == OutcomeCompleted || event.Outcome == OutcomeInterrupted
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+
+	return d
+}
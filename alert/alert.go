@@ -0,0 +1,434 @@
+// Package alert raises threshold alerts on the readings of a controller as they arrive
+// Rules are evaluated by the Evaluator and their notifications go out through channels
+package alert
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/tPhume/ags-backend/lookup"
+	"github.com/tPhume/ags-backend/metric"
+	"github.com/tPhume/ags-backend/outbound"
+	"github.com/tPhume/ags-backend/session"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+func RegisterRoutes(handler *Handler, engine *gin.Engine, sessionHandler *session.Handler) {
+	group := engine.Group("api/v1/controller/:controllerId/alert")
+	group.Use(sessionHandler.GetUser)
+
+	group.POST("", handler.AddRule)
+	group.GET("", handler.ListRules)
+	group.PUT("/:ruleId", handler.UpdateRule)
+	group.DELETE("/:ruleId", handler.RemoveRule)
+
+	engine.GET("api/v1/alert/settings", sessionHandler.GetUser, handler.GetSettings)
+	engine.PUT("api/v1/alert/settings", sessionHandler.GetUser, handler.SetSettings)
+
+	engine.POST("api/v1/alert/email", sessionHandler.GetUser, handler.AddEmail)
+	engine.GET("api/v1/alert/email", sessionHandler.GetUser, handler.ListEmails)
+	engine.POST("api/v1/alert/email/confirm", sessionHandler.GetUser, handler.ConfirmEmail)
+}
+
+// Comparators of a rule, the value of the reading is on the left
+const (
+	ComparatorGt  = "gt"
+	ComparatorGte = "gte"
+	ComparatorLt  = "lt"
+	ComparatorLte = "lte"
+)
+
+// Severities of a rule
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// States of a rule
+// A rule is pending while its condition has held for less than its duration and firing after that
+// It is resolved once the condition stops holding while firing
+const (
+	StateInactive = "inactive"
+	StatePending  = "pending"
+	StateFiring   = "firing"
+	StateResolved = "resolved"
+)
+
+// Types of channel a notification can go out through
+const (
+	ChannelWebhook = "webhook"
+	ChannelEmail   = "email"
+	ChannelInbox   = "inbox"
+)
+
+// Rule raises an alert once the value of a sensor has compared to the threshold for the duration
+type Rule struct {
+	RuleId       string `json:"rule_id" bson:"_id"`
+	UserId       string `json:"-" bson:"user_id"`
+	ControllerId string `json:"controller_id" bson:"controller_id"`
+	Name         string `json:"name" bson:"name" binding:"required,max=100"`
+
+	// Key of the sensor, derived metrics such as vpd can be used too
+	Key        string   `json:"key" bson:"key" binding:"required"`
+	Comparator string   `json:"comparator" bson:"comparator" binding:"required,oneof=gt gte lt lte"`
+	Threshold  *float64 `json:"threshold" bson:"threshold" binding:"required"`
+
+	// Duration in seconds the condition has to hold for before the rule fires, at most a day
+	// It fires on the first reading the condition holds for when 0
+	Duration int `json:"duration" bson:"duration" binding:"gte=0,lte=86400"`
+
+	Severity string           `json:"severity" bson:"severity" binding:"required,oneof=info warning critical"`
+	Channels []*ChannelConfig `json:"channels" bson:"channels" binding:"required,min=1,max=5,dive"`
+
+	// Status is kept by the Evaluator, it is ignored in requests
+	Status *Status `json:"status" bson:"status" binding:"-"`
+
+	// Revision changes whenever the rule is saved, so that a status is only saved over the one it was evaluated from
+	Revision string `json:"-" bson:"revision" binding:"-"`
+}
+
+// ChannelConfig is where the notifications of a rule go, target is the url of a webhook or the address of an email
+// Webhooks have to resolve to public addresses and emails have to be confirmed by the user
+// The inbox of the owner of the rule needs no target
+type ChannelConfig struct {
+	Type   string `json:"type" bson:"type" binding:"required,oneof=webhook email inbox"`
+	Target string `json:"target,omitempty" bson:"target,omitempty"`
+}
+
+// Status of a rule as of the last reading evaluated
+type Status struct {
+	State string `json:"state" bson:"state"`
+
+	// Since is when the rule went into its state
+	Since time.Time `json:"since" bson:"since"`
+
+	// Value and At are of the last reading evaluated
+	Value float64   `json:"value" bson:"value"`
+	At    time.Time `json:"at" bson:"at"`
+}
+
+// Controller is what alerts need to know about a controller
+type Controller struct {
+	Name    string          `bson:"name"`
+	Sensors []metric.Sensor `bson:"sensors"`
+}
+
+// SettingsRepo is what sending notifications needs to know about users
+type SettingsRepo interface {
+	// GetSettings returns the alert settings of the user, empty ones when they were never set
+	GetSettings(ctx context.Context, userId string) (*Settings, error)
+
+	lookup.Timezones
+}
+
+// Repo
+type Repo interface {
+	SettingsRepo
+
+	SetSettings(ctx context.Context, settings *Settings) error
+
+	// GetController returns the controller if it belongs to userId
+	GetController(ctx context.Context, userId string, controllerId string) (*Controller, error)
+
+	AddRule(ctx context.Context, rule *Rule) error
+
+	ListRules(ctx context.Context, userId string, controllerId string) ([]*Rule, error)
+
+	// UpdateRule replaces the definition of the rule and sets its status back to rule.Status
+	UpdateRule(ctx context.Context, rule *Rule) error
+
+	RemoveRule(ctx context.Context, userId string, controllerId string, ruleId string) error
+
+	// ControllerRules returns every rule of the controller, whoever asks
+	ControllerRules(ctx context.Context, controllerId string) ([]*Rule, error)
+
+	// SetStatus saves the status and a new revision if the rule is still at revision, it returns false if it was not
+	SetStatus(ctx context.Context, ruleId string, revision string, status *Status) (bool, error)
+
+	// SaveEmail adds the email or replaces its token
+	SaveEmail(ctx context.Context, email *Email) error
+
+	// GetEmail returns errEmailNotFound when the user has not added the address
+	GetEmail(ctx context.Context, userId string, address string) (*Email, error)
+
+	ListEmails(ctx context.Context, userId string) ([]*Email, error)
+
+	// ConfirmEmail confirms the unconfirmed email of the user with the token if it was added after since
+	// It returns errEmailNotFound when there is none
+	ConfirmEmail(ctx context.Context, userId string, tokenHash string, since time.Time) (*Email, error)
+}
+
+var (
+	errControllerNotFound = lookup.ErrControllerNotFound
+	errRuleNotFound       = errors.New("rule not found")
+	errEmailNotFound      = errors.New("email not found")
+)
+
+// Handler for alert REST API
+type Handler struct {
+	Repo Repo
+
+	// Mailer sends the tokens that confirm emails, emails cannot be added without it
+	Mailer Mailer
+
+	// Resolver looks up the hosts of webhooks, net.DefaultResolver when nil
+	Resolver outbound.Resolver
+}
+
+var (
+	// ok message responses for handler
+	resAdd         = "alert rule added"
+	resList        = "list of alert rules retrieved"
+	resUpdate      = "alert rule updated"
+	resRemove      = "alert rule removed"
+	resGetSettings = "alert settings retrieved"
+	resSetSettings = "alert settings saved"
+
+	// error message responses for handler
+	resInternal    = "not your fault, don't worry"
+	resInvalid     = "invalid values"
+	resNotFound    = "not found"
+	resUnknownKey  = "controller has no sensor with key"
+	resBadTarget   = "channel target is invalid"
+	resPrivateUrl  = "webhook url must resolve to a public address"
+	resUnconfirmed = "email address is not confirmed"
+)
+
+func (h *Handler) AddRule(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	// check controllerId
+	controllerId := ctx.Param("controllerId")
+	if _, err := uuid.Parse(controllerId); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	rule := &Rule{}
+	if err := ctx.ShouldBindJSON(rule); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid, "err": err.Error()})
+		return
+	}
+
+	rule.RuleId = uuid.New().String()
+	rule.UserId = userId
+	rule.ControllerId = controllerId
+
+	if !h.checkRule(ctx, rule) {
+		return
+	}
+
+	rule.Status = &Status{State: StateInactive, Since: time.Now()}
+	rule.Revision = uuid.New().String()
+
+	if err := h.Repo.AddRule(ctx, rule); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, gin.H{"message": resAdd, "rule": rule})
+}
+
+func (h *Handler) ListRules(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	// check controllerId
+	controllerId := ctx.Param("controllerId")
+	if _, err := uuid.Parse(controllerId); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	if _, err := h.Repo.GetController(ctx, userId, controllerId); err != nil {
+		if err == errControllerNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resNotFound})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	rules, err := h.Repo.ListRules(ctx, userId, controllerId)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resList, "rules": rules})
+}
+
+// UpdateRule replaces the rule, it starts again from inactive as the old status may not hold for the new definition
+func (h *Handler) UpdateRule(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	// check controllerId and ruleId
+	controllerId := ctx.Param("controllerId")
+	ruleId := ctx.Param("ruleId")
+	_, errController := uuid.Parse(controllerId)
+	_, errRule := uuid.Parse(ruleId)
+	if errController != nil || errRule != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	rule := &Rule{}
+	if err := ctx.ShouldBindJSON(rule); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid, "err": err.Error()})
+		return
+	}
+
+	rule.RuleId = ruleId
+	rule.UserId = userId
+	rule.ControllerId = controllerId
+
+	if !h.checkRule(ctx, rule) {
+		return
+	}
+
+	rule.Status = &Status{State: StateInactive, Since: time.Now()}
+	rule.Revision = uuid.New().String()
+
+	if err := h.Repo.UpdateRule(ctx, rule); err != nil {
+		if err == errRuleNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resNotFound})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resUpdate, "rule": rule})
+}
+
+func (h *Handler) RemoveRule(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	// check controllerId and ruleId
+	controllerId := ctx.Param("controllerId")
+	ruleId := ctx.Param("ruleId")
+	_, errController := uuid.Parse(controllerId)
+	_, errRule := uuid.Parse(ruleId)
+	if errController != nil || errRule != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	if err := h.Repo.RemoveRule(ctx, userId, controllerId, ruleId); err != nil {
+		if err == errRuleNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resNotFound})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resRemove})
+}
+
+// checkRule responds and returns false when the controller is not found or the rule does not fit it
+func (h *Handler) checkRule(ctx *gin.Context, rule *Rule) bool {
+	rule.Name = strings.TrimSpace(rule.Name)
+	if rule.Name == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return false
+	}
+
+	if !h.checkChannels(ctx, rule.UserId, rule.Channels) {
+		return false
+	}
+
+	controller, err := h.Repo.GetController(ctx, rule.UserId, rule.ControllerId)
+	if err != nil {
+		if err == errControllerNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resNotFound})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return false
+	}
+
+	for _, sensor := range metric.WithDerived(metric.Sensors(controller.Sensors)) {
+		if sensor.Key == rule.Key {
+			return true
+		}
+	}
+
+	ctx.JSON(http.StatusBadRequest, gin.H{"message": resUnknownKey, "key": rule.Key})
+	return false
+}
+
+// checkChannels responds and returns false when the target of a channel is not one notifications can go to
+func (h *Handler) checkChannels(ctx *gin.Context, userId string, channels []*ChannelConfig) bool {
+	for _, channel := range channels {
+		switch channel.Type {
+		case ChannelWebhook:
+			if err := outbound.CheckUrl(ctx, h.Resolver, channel.Target); err != nil {
+				if err == outbound.ErrForbiddenAddress {
+					ctx.JSON(http.StatusBadRequest, gin.H{"message": resPrivateUrl, "type": channel.Type})
+				} else {
+					ctx.JSON(http.StatusBadRequest, gin.H{"message": resBadTarget, "type": channel.Type})
+				}
+
+				return false
+			}
+		case ChannelEmail:
+			if !validAddress(channel.Target) {
+				ctx.JSON(http.StatusBadRequest, gin.H{"message": resBadTarget, "type": channel.Type})
+				return false
+			}
+
+			email, err := h.Repo.GetEmail(ctx, userId, channel.Target)
+			if err != nil && err != errEmailNotFound {
+				ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+				return false
+			}
+
+			if err == errEmailNotFound || !email.Confirmed {
+				ctx.JSON(http.StatusBadRequest, gin.H{"message": resUnconfirmed, "type": channel.Type, "target": channel.Target})
+				return false
+			}
+		default:
+			if channel.Target != "" {
+				ctx.JSON(http.StatusBadRequest, gin.H{"message": resBadTarget, "type": channel.Type})
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// validAddress checks the address is a single bare address
+func validAddress(address string) bool {
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return false
+	}
+
+	return parsed.Address == address
+}
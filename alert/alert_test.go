@@ -0,0 +1,747 @@
+package alert
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/tPhume/ags-backend/data"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// For our tests the grower, in Bangkok seven hours ahead of UTC, has a greenhouse with the legacy sensors
+// Any other controller id indicates a missing controller
+const (
+	growerId     = "69b62401-0410-4fea-8a8f-1a3b71d7e558"
+	greenhouseId = "bf122aec-f69b-4a04-83be-36c045f958fd"
+	unknownId    = "6597060a-e38a-4b65-8d0a-d972a87f38d5"
+)
+
+var greenhouse = Controller{Name: "greenhouse"}
+
+// The grower has confirmed one email and is yet to confirm another
+const (
+	confirmedEmail = "grower@example.com"
+	pendingEmail   = "night-shift@example.com"
+)
+
+// Repo struct for testing, rules are kept in memory
+type repoStruct struct {
+	rules    map[string]*Rule
+	settings *Settings
+	contacts []*Contact
+	offline  map[string]*Offline
+
+	// emails of the grower by address
+	emails map[string]*Email
+
+	// edited makes every rule look changed since it was read
+	edited bool
+}
+
+func newEmails() map[string]*Email {
+	return map[string]*Email{
+		confirmedEmail: {UserId: growerId, Address: confirmedEmail, Confirmed: true},
+		pendingEmail:   {UserId: growerId, Address: pendingEmail, TokenHash: hashToken("0123456789abcdef0123456789abcdef"), AddedAt: time.Now()},
+	}
+}
+
+func (r *repoStruct) GetSettings(ctx context.Context, user string) (*Settings, error) {
+	if r.settings == nil {
+		return &Settings{UserId: user}, nil
+	}
+
+	return r.settings, nil
+}
+
+func (r *repoStruct) SetSettings(ctx context.Context, settings *Settings) error {
+	r.settings = settings
+	return nil
+}
+
+func (r *repoStruct) GetTimezone(ctx context.Context, user string) (string, error) {
+	return "Asia/Bangkok", nil
+}
+
+func (r *repoStruct) GetController(ctx context.Context, userId string, controllerId string) (*Controller, error) {
+	if userId != growerId || controllerId != greenhouseId {
+		return nil, errControllerNotFound
+	}
+
+	return &greenhouse, nil
+}
+
+func (r *repoStruct) AddRule(ctx context.Context, rule *Rule) error {
+	r.rules[rule.RuleId] = rule
+	return nil
+}
+
+func (r *repoStruct) ListRules(ctx context.Context, user string, id string) ([]*Rule, error) {
+	return r.ControllerRules(ctx, id)
+}
+
+func (r *repoStruct) UpdateRule(ctx context.Context, rule *Rule) error {
+	if _, ok := r.rules[rule.RuleId]; !ok {
+		return errRuleNotFound
+	}
+
+	r.rules[rule.RuleId] = rule
+	return nil
+}
+
+func (r *repoStruct) RemoveRule(ctx context.Context, user string, id string, ruleId string) error {
+	if _, ok := r.rules[ruleId]; !ok {
+		return errRuleNotFound
+	}
+
+	delete(r.rules, ruleId)
+	return nil
+}
+
+func (r *repoStruct) ControllerRules(ctx context.Context, id string) ([]*Rule, error) {
+	rules := make([]*Rule, 0)
+	for _, rule := range r.rules {
+		if rule.ControllerId == id {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules, nil
+}
+
+func (r *repoStruct) SetStatus(ctx context.Context, ruleId string, revision string, status *Status) (bool, error) {
+	rule := r.rules[ruleId]
+	if r.edited || rule.Revision != revision {
+		return false, nil
+	}
+
+	rule.Status = status
+	rule.Revision = uuid.New().String()
+	return true, nil
+}
+
+func (r *repoStruct) SaveEmail(ctx context.Context, email *Email) error {
+	r.emails[email.Address] = email
+	return nil
+}
+
+func (r *repoStruct) GetEmail(ctx context.Context, user string, address string) (*Email, error) {
+	email, ok := r.emails[address]
+	if !ok || user != growerId {
+		return nil, errEmailNotFound
+	}
+
+	return email, nil
+}
+
+func (r *repoStruct) ListEmails(ctx context.Context, user string) ([]*Email, error) {
+	emails := make([]*Email, 0)
+	for _, email := range r.emails {
+		emails = append(emails, email)
+	}
+
+	return emails, nil
+}
+
+func (r *repoStruct) ConfirmEmail(ctx context.Context, user string, tokenHash string, since time.Time) (*Email, error) {
+	for _, email := range r.emails {
+		if !email.Confirmed && email.TokenHash == tokenHash && email.AddedAt.After(since) {
+			email.Confirmed = true
+			email.TokenHash = ""
+			return email, nil
+		}
+	}
+
+	return nil, errEmailNotFound
+}
+
+func (r *repoStruct) ListContacts(ctx context.Context) ([]*Contact, error) {
+	return r.contacts, nil
+}
+
+func (r *repoStruct) ListOffline(ctx context.Context) (map[string]*Offline, error) {
+	offline := make(map[string]*Offline, len(r.offline))
+	for id, o := range r.offline {
+		copied := *o
+		offline[id] = &copied
+	}
+
+	return offline, nil
+}
+
+func (r *repoStruct) MarkOffline(ctx context.Context, offline *Offline) (bool, error) {
+	if _, ok := r.offline[offline.ControllerId]; ok {
+		return false, nil
+	}
+
+	copied := *offline
+	r.offline[offline.ControllerId] = &copied
+	return true, nil
+}
+
+func (r *repoStruct) ClaimNotice(ctx context.Context, id string) (bool, error) {
+	offline, ok := r.offline[id]
+	if !ok || offline.Notified {
+		return false, nil
+	}
+
+	offline.Notified = true
+	return true, nil
+}
+
+func (r *repoStruct) ClearOffline(ctx context.Context, id string) (*Offline, error) {
+	offline := r.offline[id]
+	delete(r.offline, id)
+	return offline, nil
+}
+
+// channelStruct remembers what it was asked to send
+type channelStruct struct {
+	sent []string
+}
+
+func (c *channelStruct) Send(ctx context.Context, target string, notification *Notification) error {
+	c.sent = append(c.sent, notification.State)
+	return nil
+}
+
+// mailerStruct remembers the bodies it was asked to mail
+type mailerStruct struct {
+	bodies []string
+}
+
+func (m *mailerStruct) Mail(ctx context.Context, to string, subject string, body string) error {
+	m.bodies = append(m.bodies, body)
+	return nil
+}
+
+// Resolver struct for testing, example.com is public and localhost is not
+type resolverStruct struct{}
+
+func (r resolverStruct) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if host == "localhost" {
+		return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+	}
+
+	return []net.IPAddr{{IP: net.IPv4(93, 184, 216, 34)}}, nil
+}
+
+// Setup func for handler testing
+func setUp() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+
+	engine.Use(func(ctx *gin.Context) {
+		ctx.Set("userId", growerId)
+	})
+
+	return engine
+}
+
+// Test AddRule handler
+func TestHandler_AddRule(t *testing.T) {
+	engine := setUp()
+
+	handler := &Handler{Repo: &repoStruct{rules: map[string]*Rule{}, emails: newEmails()}, Resolver: resolverStruct{}}
+	engine.POST(":controllerId", handler.AddRule)
+
+	testCases := []struct {
+		controllerId string
+		body         string
+		message      string
+		code         int
+	}{
+		{controllerId: greenhouseId, message: resAdd, code: http.StatusCreated,
+			body: `{"name":"tank dry","key":"water_level","comparator":"lt","threshold":5,"duration":300,"severity":"critical","channels":[{"type":"inbox"}]}`},
+		// A threshold of 0 is still a threshold
+		{controllerId: greenhouseId, message: resAdd, code: http.StatusCreated,
+			body: `{"name":"frost","key":"temperature","comparator":"lte","threshold":0,"severity":"warning","channels":[{"type":"email","target":"grower@example.com"}]}`},
+		// Derived metrics can be used
+		{controllerId: greenhouseId, message: resAdd, code: http.StatusCreated,
+			body: `{"name":"dry air","key":"vpd","comparator":"gt","threshold":1.6,"severity":"info","channels":[{"type":"webhook","target":"https://example.com/hook"}]}`},
+		{controllerId: greenhouseId, message: resUnknownKey, code: http.StatusBadRequest,
+			body: `{"name":"tank dry","key":"co2","comparator":"lt","threshold":5,"severity":"critical","channels":[{"type":"inbox"}]}`},
+		{controllerId: greenhouseId, message: resInvalid, code: http.StatusBadRequest,
+			body: `{"name":"tank dry","key":"water_level","comparator":"lt","severity":"critical","channels":[{"type":"inbox"}]}`},
+		{controllerId: greenhouseId, message: resInvalid, code: http.StatusBadRequest,
+			body: `{"name":"tank dry","key":"water_level","comparator":"below","threshold":5,"severity":"critical","channels":[{"type":"inbox"}]}`},
+		{controllerId: greenhouseId, message: resInvalid, code: http.StatusBadRequest,
+			body: `{"name":"tank dry","key":"water_level","comparator":"lt","threshold":5,"duration":86401,"severity":"critical","channels":[{"type":"inbox"}]}`},
+		{controllerId: greenhouseId, message: resInvalid, code: http.StatusBadRequest,
+			body: `{"name":"tank dry","key":"water_level","comparator":"lt","threshold":5,"severity":"critical","channels":[]}`},
+		{controllerId: greenhouseId, message: resBadTarget, code: http.StatusBadRequest,
+			body: `{"name":"tank dry","key":"water_level","comparator":"lt","threshold":5,"severity":"critical","channels":[{"type":"webhook","target":"ftp://example.com"}]}`},
+		{controllerId: greenhouseId, message: resBadTarget, code: http.StatusBadRequest,
+			body: `{"name":"tank dry","key":"water_level","comparator":"lt","threshold":5,"severity":"critical","channels":[{"type":"email","target":"Grower <grower@example.com>"}]}`},
+		{controllerId: greenhouseId, message: resPrivateUrl, code: http.StatusBadRequest,
+			body: `{"name":"tank dry","key":"water_level","comparator":"lt","threshold":5,"severity":"critical","channels":[{"type":"webhook","target":"http://localhost:8080/hook"}]}`},
+		{controllerId: greenhouseId, message: resPrivateUrl, code: http.StatusBadRequest,
+			body: `{"name":"tank dry","key":"water_level","comparator":"lt","threshold":5,"severity":"critical","channels":[{"type":"webhook","target":"http://169.254.169.254/latest"}]}`},
+		{controllerId: greenhouseId, message: resUnconfirmed, code: http.StatusBadRequest,
+			body: `{"name":"tank dry","key":"water_level","comparator":"lt","threshold":5,"severity":"critical","channels":[{"type":"email","target":"night-shift@example.com"}]}`},
+		{controllerId: greenhouseId, message: resUnconfirmed, code: http.StatusBadRequest,
+			body: `{"name":"tank dry","key":"water_level","comparator":"lt","threshold":5,"severity":"critical","channels":[{"type":"email","target":"stranger@example.com"}]}`},
+		{controllerId: unknownId, message: resNotFound, code: http.StatusNotFound,
+			body: `{"name":"tank dry","key":"water_level","comparator":"lt","threshold":5,"severity":"critical","channels":[{"type":"inbox"}]}`},
+		{controllerId: "not-a-uuid", message: resInvalid, code: http.StatusBadRequest,
+			body: `{"name":"tank dry","key":"water_level","comparator":"lt","threshold":5,"severity":"critical","channels":[{"type":"inbox"}]}`},
+	}
+
+	for i, c := range testCases {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/"+c.controllerId, strings.NewReader(c.body))
+		engine.ServeHTTP(w, req)
+
+		res := struct {
+			Message string `json:"message"`
+			Rule    *Rule  `json:"rule"`
+		}{}
+		_ = json.Unmarshal(w.Body.Bytes(), &res)
+
+		if w.Code != c.code {
+			t.Fatalf("Case %d: expected [%v], got = [%v] %s", i, c.code, w.Code, w.Body.String())
+		}
+
+		if c.message != res.Message {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.message, res.Message)
+		}
+
+		if c.code != http.StatusCreated {
+			continue
+		}
+
+		if res.Rule.RuleId == "" || res.Rule.Status == nil || res.Rule.Status.State != StateInactive {
+			t.Fatalf("Case %d: expected [inactive rule], got = [%+v]", i, res.Rule)
+		}
+	}
+}
+
+// Test emails are only confirmed by the token mailed to them
+func TestHandler_ConfirmEmail(t *testing.T) {
+	engine := setUp()
+
+	mailer := &mailerStruct{}
+	repo := &repoStruct{emails: newEmails()}
+	handler := &Handler{Repo: repo, Mailer: mailer}
+	engine.POST("/email", handler.AddEmail)
+	engine.POST("/email/confirm", handler.ConfirmEmail)
+
+	testCases := []struct {
+		path    string
+		body    string
+		message string
+		code    int
+	}{
+		{path: "/email", body: `{"address":"frost-watch@example.com"}`, message: resAddEmail, code: http.StatusCreated},
+		{path: "/email", body: `{"address":"grower@example.com"}`, message: resConfirmedEmail, code: http.StatusConflict},
+		{path: "/email", body: `{"address":"Grower <frost-watch@example.com>"}`, message: resInvalid, code: http.StatusBadRequest},
+		{path: "/email/confirm", body: `{"token":"ffffffffffffffffffffffffffffffff"}`, message: resBadToken, code: http.StatusBadRequest},
+		{path: "/email/confirm", body: `{"token":"not a token"}`, message: resInvalid, code: http.StatusBadRequest},
+		// The token that was mailed
+		{path: "/email/confirm", message: resConfirmEmail, code: http.StatusOK},
+	}
+
+	for i, c := range testCases {
+		body := c.body
+		if body == "" {
+			lines := strings.Split(mailer.bodies[0], "\n")
+			body = `{"token":"` + lines[len(lines)-1] + `"}`
+		}
+
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, c.path, strings.NewReader(body))
+		engine.ServeHTTP(w, req)
+
+		res := struct {
+			Message string `json:"message"`
+		}{}
+		_ = json.Unmarshal(w.Body.Bytes(), &res)
+
+		if w.Code != c.code {
+			t.Fatalf("Case %d: expected [%v], got = [%v] %s", i, c.code, w.Code, w.Body.String())
+		}
+
+		if c.message != res.Message {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.message, res.Message)
+		}
+	}
+
+	if len(mailer.bodies) != 1 || !repo.emails["frost-watch@example.com"].Confirmed {
+		t.Fatalf("expected [1 confirmed], got = [%v %+v]", len(mailer.bodies), repo.emails["frost-watch@example.com"])
+	}
+}
+
+// Test rules go pending, firing and resolved as readings arrive
+func TestEvaluator_Evaluate(t *testing.T) {
+	threshold := 5.0
+	repo := &repoStruct{rules: map[string]*Rule{
+		"tank": {RuleId: "tank", UserId: growerId, ControllerId: greenhouseId, Name: "tank dry", Key: "water_level",
+			Comparator: ComparatorLt, Threshold: &threshold, Duration: 600, Severity: SeverityCritical,
+			Channels: []*ChannelConfig{{Type: ChannelInbox}, {Type: ChannelEmail, Target: "grower@example.com"}}},
+	}}
+
+	channel := &channelStruct{}
+	evaluator := &Evaluator{Repo: repo, Channels: map[string]Channel{ChannelInbox: channel}}
+
+	start := time.Date(2020, time.April, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		minute int
+		level  float64
+		flag   bool
+		state  string
+		sent   string
+	}{
+		{minute: 0, level: 8, state: StateInactive},
+		{minute: 1, level: 4, state: StatePending},
+		{minute: 5, level: 3, state: StatePending},
+		// Flagged values are left out
+		{minute: 9, level: 50, flag: true, state: StatePending},
+		{minute: 11, level: 2, state: StateFiring, sent: StateFiring},
+		{minute: 20, level: 1, state: StateFiring},
+		{minute: 25, level: 6, state: StateResolved, sent: StateResolved},
+		{minute: 30, level: 4, state: StatePending},
+		// Back above before the duration
+		{minute: 35, level: 9, state: StateInactive},
+		// Older than the last reading evaluated
+		{minute: 31, level: 1, state: StateInactive},
+	}
+
+	for i, c := range testCases {
+		reading := &data.Reading{Timestamp: start.Add(time.Duration(c.minute) * time.Minute), Metrics: map[string]float64{"water_level": c.level}}
+		if c.flag {
+			reading.Quality = map[string]string{"water_level": "spike"}
+		}
+
+		channel.sent = nil
+
+		notifications, err := evaluator.Evaluate(context.Background(), greenhouseId, []*data.Reading{reading})
+		if err != nil {
+			t.Fatalf("Case %d: expected no error, got = [%v]", i, err)
+		}
+
+		evaluator.Send(context.Background(), notifications)
+
+		if state := repo.rules["tank"].Status; state == nil || state.State != c.state {
+			t.Fatalf("Case %d: expected [%v], got = [%+v]", i, c.state, state)
+		}
+
+		// Email has no channel so only the inbox is sent to
+		if c.sent == "" && len(channel.sent) != 0 || c.sent != "" && (len(channel.sent) != 1 || channel.sent[0] != c.sent) {
+			t.Fatalf("Case %d: expected [%v] sent, got = [%v]", i, c.sent, channel.sent)
+		}
+	}
+}
+
+// Test readings of one batch are evaluated in time order and derived metrics are worked out
+func TestEvaluator_EvaluateBatch(t *testing.T) {
+	threshold := 1.5
+	repo := &repoStruct{rules: map[string]*Rule{
+		"vpd": {RuleId: "vpd", UserId: growerId, ControllerId: greenhouseId, Name: "dry air", Key: "vpd",
+			Comparator: ComparatorGt, Threshold: &threshold, Severity: SeverityWarning, Channels: []*ChannelConfig{{Type: ChannelInbox}}},
+	}}
+
+	evaluator := &Evaluator{Repo: repo}
+	start := time.Date(2020, time.April, 1, 12, 0, 0, 0, time.UTC)
+
+	readings := []*data.Reading{
+		{Timestamp: start.Add(2 * time.Minute), Metrics: map[string]float64{"temperature": 22, "humidity": 70}},
+		{Timestamp: start, Metrics: map[string]float64{"temperature": 30, "humidity": 30}},
+	}
+
+	notifications, err := evaluator.Evaluate(context.Background(), greenhouseId, readings)
+	if err != nil {
+		t.Fatalf("expected no error, got = [%v]", err)
+	}
+
+	if len(notifications) != 2 || notifications[0].State != StateFiring || notifications[1].State != StateResolved {
+		t.Fatalf("expected [firing resolved], got = [%+v]", notifications)
+	}
+
+	if _, ok := readings[0].Metrics["vpd"]; ok {
+		t.Fatalf("expected readings left as they were, got = [%v]", readings[0].Metrics)
+	}
+}
+
+// Test nothing is notified when the rule changed since it was read, whoever changed it notifies
+func TestEvaluator_EvaluateEdited(t *testing.T) {
+	threshold := 5.0
+	repo := &repoStruct{edited: true, rules: map[string]*Rule{
+		"tank": {RuleId: "tank", UserId: growerId, ControllerId: greenhouseId, Name: "tank dry", Key: "water_level",
+			Comparator: ComparatorLt, Threshold: &threshold, Severity: SeverityCritical, Channels: []*ChannelConfig{{Type: ChannelInbox}}},
+	}}
+
+	evaluator := &Evaluator{Repo: repo}
+	reading := &data.Reading{Timestamp: time.Date(2020, time.April, 1, 12, 0, 0, 0, time.UTC), Metrics: map[string]float64{"water_level": 2}}
+
+	notifications, err := evaluator.Evaluate(context.Background(), greenhouseId, []*data.Reading{reading})
+	if err != nil {
+		t.Fatalf("expected no error, got = [%v]", err)
+	}
+
+	if len(notifications) != 0 {
+		t.Fatalf("expected no notifications, got = [%+v]", notifications)
+	}
+}
+
+// Test offline notices wait for quiet hours and recovery notices only follow a notice
+func TestOfflineChecker_RunOnce(t *testing.T) {
+	// 22:00 to 07:00 in Bangkok is 15:00 to 00:00 UTC
+	repo := &repoStruct{
+		offline:  map[string]*Offline{},
+		settings: &Settings{UserId: growerId, QuietHours: &QuietHours{Start: "22:00", End: "07:00"}},
+	}
+
+	channel := &channelStruct{}
+	checker := &OfflineChecker{Repo: repo, Channels: map[string]Channel{ChannelInbox: channel}, After: 15 * time.Minute}
+
+	day := time.Date(2020, time.April, 1, 0, 0, 0, 0, time.UTC)
+	at := func(hour int, minute int) time.Time {
+		return day.Add(time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute)
+	}
+
+	testCases := []struct {
+		lastContact time.Time
+		now         time.Time
+		offline     bool
+		sent        string
+	}{
+		{lastContact: at(8, 0), now: at(8, 10)},
+		{lastContact: at(8, 0), now: at(8, 20), offline: true, sent: StateFiring},
+		// Sent once only
+		{lastContact: at(8, 0), now: at(9, 0), offline: true},
+		{lastContact: at(9, 5), now: at(9, 10), sent: StateResolved},
+		// Silent during quiet hours, the notice waits until they are over
+		{lastContact: at(14, 0), now: at(16, 0), offline: true},
+		{lastContact: at(14, 0), now: at(23, 0), offline: true},
+		{lastContact: at(14, 0), now: at(24, 5), offline: true, sent: StateFiring},
+		{lastContact: at(24, 30), now: at(24, 35), sent: StateResolved},
+		// Back before quiet hours were over, there was no notice so there is no recovery either
+		{lastContact: at(36, 0), now: at(40, 0), offline: true},
+		{lastContact: at(41, 0), now: at(41, 5)},
+	}
+
+	for i, c := range testCases {
+		repo.contacts = []*Contact{{ControllerId: greenhouseId, UserId: growerId, Name: "greenhouse", LastContact: c.lastContact}}
+		channel.sent = nil
+
+		if err := checker.RunOnce(context.Background(), c.now); err != nil {
+			t.Fatalf("Case %d: expected no error, got = [%v]", i, err)
+		}
+
+		if _, offline := repo.offline[greenhouseId]; offline != c.offline {
+			t.Fatalf("Case %d: expected offline [%v], got = [%v]", i, c.offline, offline)
+		}
+
+		if c.sent == "" && len(channel.sent) != 0 || c.sent != "" && (len(channel.sent) != 1 || channel.sent[0] != c.sent) {
+			t.Fatalf("Case %d: expected [%v] sent, got = [%v]", i, c.sent, channel.sent)
+		}
+	}
+
+	// The user can wait longer than the default
+	repo.settings = &Settings{UserId: growerId, OfflineAfter: 60}
+	repo.contacts = []*Contact{{ControllerId: greenhouseId, UserId: growerId, Name: "greenhouse", LastContact: at(50, 0)}}
+	if err := checker.RunOnce(context.Background(), at(50, 30)); err != nil || len(repo.offline) != 0 {
+		t.Fatalf("expected online for an hour, got = [%v] [%v]", err, repo.offline)
+	}
+}
+
+// Test quiet hours drop webhooks and emails of alerts that are not critical
+func TestDeliver(t *testing.T) {
+	repo := &repoStruct{settings: &Settings{UserId: growerId, QuietHours: &QuietHours{Start: "22:00", End: "07:00"}}}
+
+	inbox := &channelStruct{}
+	webhook := &channelStruct{}
+	channels := map[string]Channel{ChannelInbox: inbox, ChannelWebhook: webhook}
+
+	testCases := []struct {
+		now      time.Time
+		severity string
+		webhook  int
+	}{
+		// 10:00 in Bangkok
+		{now: time.Date(2020, time.April, 1, 3, 0, 0, 0, time.UTC), severity: SeverityWarning, webhook: 1},
+		// 23:00 in Bangkok
+		{now: time.Date(2020, time.April, 1, 16, 0, 0, 0, time.UTC), severity: SeverityWarning},
+		{now: time.Date(2020, time.April, 1, 16, 0, 0, 0, time.UTC), severity: SeverityCritical, webhook: 1},
+	}
+
+	for i, c := range testCases {
+		inbox.sent, webhook.sent = nil, nil
+
+		notification := &Notification{Type: TypeThreshold, UserId: growerId, Severity: c.severity, State: StateFiring,
+			Channels: []*ChannelConfig{{Type: ChannelInbox}, {Type: ChannelWebhook, Target: "http://localhost:8080"}}}
+
+		deliver(context.Background(), repo, channels, []*Notification{notification}, c.now)
+
+		if len(inbox.sent) != 1 || len(webhook.sent) != c.webhook {
+			t.Fatalf("Case %d: expected [1 %v], got = [%v %v]", i, c.webhook, len(inbox.sent), len(webhook.sent))
+		}
+	}
+}
+
+// Test what quiet hours dropped is not sent once they are over, only what fires after
+func TestDeliverAfterQuietHours(t *testing.T) {
+	repo := &repoStruct{settings: &Settings{UserId: growerId, QuietHours: &QuietHours{Start: "22:00", End: "07:00"}}}
+
+	webhook := &channelStruct{}
+	channels := map[string]Channel{ChannelInbox: &channelStruct{}, ChannelWebhook: webhook}
+	config := []*ChannelConfig{{Type: ChannelInbox}, {Type: ChannelWebhook, Target: "http://localhost:8080"}}
+
+	// 23:00 then 08:00 in Bangkok
+	firing := &Notification{Type: TypeThreshold, UserId: growerId, Severity: SeverityWarning, State: StateFiring, Channels: config}
+	deliver(context.Background(), repo, channels, []*Notification{firing}, time.Date(2020, time.April, 1, 16, 0, 0, 0, time.UTC))
+
+	resolved := &Notification{Type: TypeThreshold, UserId: growerId, Severity: SeverityWarning, State: StateResolved, Channels: config}
+	deliver(context.Background(), repo, channels, []*Notification{resolved}, time.Date(2020, time.April, 2, 1, 0, 0, 0, time.UTC))
+
+	if len(webhook.sent) != 1 || webhook.sent[0] != StateResolved {
+		t.Fatalf("expected [[%v]], got = [%v]", StateResolved, webhook.sent)
+	}
+}
+
+// Test quiet hours within a day and across midnight
+func TestQuietHours_Contains(t *testing.T) {
+	testCases := []struct {
+		quiet    *QuietHours
+		clock    string
+		expected bool
+	}{
+		{quiet: nil, clock: "23:00"},
+		{quiet: &QuietHours{Start: "22:00", End: "22:00"}, clock: "22:00"},
+		{quiet: &QuietHours{Start: "12:00", End: "14:00"}, clock: "12:00", expected: true},
+		{quiet: &QuietHours{Start: "12:00", End: "14:00"}, clock: "14:00"},
+		{quiet: &QuietHours{Start: "22:00", End: "07:00"}, clock: "23:30", expected: true},
+		{quiet: &QuietHours{Start: "22:00", End: "07:00"}, clock: "06:59", expected: true},
+		{quiet: &QuietHours{Start: "22:00", End: "07:00"}, clock: "07:00"},
+		{quiet: &QuietHours{Start: "22:00", End: "07:00"}, clock: "21:59"},
+	}
+
+	for i, c := range testCases {
+		clock, _ := time.Parse("15:04", c.clock)
+		if got := c.quiet.Contains(clock); got != c.expected {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.expected, got)
+		}
+	}
+}
+
+// Test webhooks are posted the notification
+func TestWebhookChannel_Send(t *testing.T) {
+	received := &Notification{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+
+		_ = json.NewDecoder(r.Body).Decode(received)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	defer server.Close()
+
+	channel := &WebhookChannel{Client: server.Client()}
+	notification := &Notification{RuleId: "tank", Name: "tank dry", State: StateFiring, Value: 2}
+
+	if err := channel.Send(context.Background(), server.URL+"/hook", notification); err != nil {
+		t.Fatalf("expected no error, got = [%v]", err)
+	}
+
+	if received.RuleId != "tank" || received.State != StateFiring || received.Value != 2 {
+		t.Fatalf("expected [%+v], got = [%+v]", notification, received)
+	}
+
+	if err := channel.Send(context.Background(), server.URL+"/gone", notification); err == nil {
+		t.Fatalf("expected an error, got = [nil]")
+	}
+}
+
+// Test emails are sent through an SMTP server
+func TestEmailChannel_Send(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("expected a listener, got = [%v]", err)
+	}
+
+	defer listener.Close()
+
+	messages := make(chan string, 1)
+	go serveSMTP(listener, messages)
+
+	channel := &EmailChannel{Addr: listener.Addr().String(), From: "alerts@example.com"}
+	notification := &Notification{Name: "tank dry\r\nBcc: someone@example.com", ControllerName: "greenhouse", Key: "water_level",
+		Comparator: ComparatorLt, Threshold: 5, Severity: SeverityCritical, State: StateFiring, Value: 2}
+
+	if err := channel.Send(context.Background(), "grower@example.com", notification); err != nil {
+		t.Fatalf("expected no error, got = [%v]", err)
+	}
+
+	message := <-messages
+	if !strings.Contains(message, "To: grower@example.com\r\n") || !strings.Contains(message, "water_level is 2") {
+		t.Fatalf("expected the notification, got = [%v]", message)
+	}
+
+	if strings.Contains(message, "\r\nBcc:") {
+		t.Fatalf("expected no extra header, got = [%v]", message)
+	}
+}
+
+// serveSMTP accepts one connection and answers just enough of SMTP for net/smtp, the message is sent to messages
+func serveSMTP(listener net.Listener, messages chan<- string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	reply := func(line string) {
+		_, _ = conn.Write([]byte(line + "\r\n"))
+	}
+
+	reply("220 localhost ready")
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		switch command := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(command, "EHLO"):
+			reply("250-localhost")
+			reply("250 8BITMIME")
+		case command == "DATA":
+			reply("354 go ahead")
+
+			message := &bytes.Buffer{}
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+
+				if line == ".\r\n" {
+					break
+				}
+
+				message.WriteString(line)
+			}
+
+			messages <- message.String()
+			reply("250 queued")
+		case command == "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/tPhume/ags-backend/notification"
+	"github.com/tPhume/ags-backend/outbound"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Channel sends a notification to a target, what the target is depends on the channel
+type Channel interface {
+	Send(ctx context.Context, target string, notification *Notification) error
+}
+
+// WebhookChannel posts the notification as JSON to the url of the target
+// Client is optional, the default one does not connect to private addresses
+type WebhookChannel struct {
+	Client *http.Client
+}
+
+var defaultClient = outbound.NewClient(10 * time.Second)
+
+func (w *WebhookChannel) Send(ctx context.Context, target string, notification *Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	client := w.Client
+	if client == nil {
+		client = defaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// Mailer sends a plain text email, EmailChannel is one
+type Mailer interface {
+	Mail(ctx context.Context, to string, subject string, body string) error
+}
+
+// EmailChannel sends the notification as a plain text email to the address of the target
+// Auth is optional, a local server such as MailHog needs none
+type EmailChannel struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+func (e *EmailChannel) Send(ctx context.Context, target string, notification *Notification) error {
+	return e.Mail(ctx, target, notification.Title(), notification.Body())
+}
+
+// Mail does not stop when ctx is done, net/smtp has no way to
+func (e *EmailChannel) Mail(ctx context.Context, to string, subject string, body string) error {
+	var message strings.Builder
+	message.WriteString("From: " + e.From + "\r\n")
+	message.WriteString("To: " + to + "\r\n")
+	message.WriteString("Subject: " + headerValue(subject) + "\r\n")
+	message.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	message.WriteString("\r\n")
+	message.WriteString(body + "\r\n")
+
+	return smtp.SendMail(e.Addr, e.Auth, e.From, []string{to}, []byte(message.String()))
+}
+
+// headerValue keeps names from adding headers of their own
+func headerValue(value string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+}
+
+// InboxChannel keeps the notification in the in-app inbox of the owner of the rule, it has no target
+type InboxChannel struct {
+	Inbox *notification.Inbox
+}
+
+func (i *InboxChannel) Send(ctx context.Context, target string, n *Notification) error {
+	notificationType := notification.TypeAlert
+	if n.Type == TypeOffline {
+		notificationType = notification.TypeOffline
+	}
+
+	return i.Inbox.Add(ctx, &notification.Notification{
+		UserId:       n.UserId,
+		Type:         notificationType,
+		Title:        n.Title(),
+		Body:         n.Body(),
+		Severity:     n.Severity,
+		ControllerId: n.ControllerId,
+	})
+}
@@ -0,0 +1,161 @@
+package alert
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"time"
+)
+
+// How long the token sent to an email can confirm it for
+const confirmWithin = 24 * time.Hour
+
+// Email is an address the user wants alerts to go to, they only go to it once the token sent there confirms it
+type Email struct {
+	// EmailId is the user id and the address, so an address is added once per user
+	EmailId   string    `json:"-" bson:"_id"`
+	UserId    string    `json:"-" bson:"user_id"`
+	Address   string    `json:"address" bson:"address" binding:"required,max=254"`
+	Confirmed bool      `json:"confirmed" bson:"confirmed" binding:"-"`
+	TokenHash string    `json:"-" bson:"token_hash,omitempty" binding:"-"`
+	AddedAt   time.Time `json:"added_at" bson:"added_at" binding:"-"`
+}
+
+var (
+	// ok message responses for handler
+	resAddEmail     = "confirmation sent to email"
+	resListEmails   = "list of emails retrieved"
+	resConfirmEmail = "email confirmed"
+
+	// error message responses for handler
+	resNoMailer       = "emails cannot be sent"
+	resConfirmedEmail = "email is already confirmed"
+	resBadToken       = "token is invalid or has expired"
+)
+
+// AddEmail sends a token to the address, it can be added again to send a new one until it is confirmed
+func (h *Handler) AddEmail(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	if h.Mailer == nil {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"message": resNoMailer})
+		return
+	}
+
+	email := &Email{}
+	if err := ctx.ShouldBindJSON(email); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid, "err": err.Error()})
+		return
+	}
+
+	if !validAddress(email.Address) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	existing, err := h.Repo.GetEmail(ctx, userId, email.Address)
+	if err != nil && err != errEmailNotFound {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	if err == nil && existing.Confirmed {
+		ctx.JSON(http.StatusConflict, gin.H{"message": resConfirmedEmail})
+		return
+	}
+
+	token, err := newToken()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	email.EmailId = userId + ":" + email.Address
+	email.UserId = userId
+	email.TokenHash = hashToken(token)
+	email.AddedAt = time.Now()
+
+	if err := h.Repo.SaveEmail(ctx, email); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	body := "Alerts of your controllers were asked to go to this address.\r\n" +
+		"Confirm it with this token within a day, or ignore this email if it was not you:\r\n\r\n" + token
+	if err := h.Mailer.Mail(ctx, email.Address, "Confirm your alert email", body); err != nil {
+		log.Printf("alert: could not send confirmation to %s: %s", email.Address, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, gin.H{"message": resAddEmail, "email": email})
+}
+
+func (h *Handler) ListEmails(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	emails, err := h.Repo.ListEmails(ctx, userId)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resListEmails, "emails": emails})
+}
+
+func (h *Handler) ConfirmEmail(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	body := &struct {
+		Token string `json:"token" binding:"required,hexadecimal,len=32"`
+	}{}
+
+	if err := ctx.ShouldBindJSON(body); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid, "err": err.Error()})
+		return
+	}
+
+	email, err := h.Repo.ConfirmEmail(ctx, userId, hashToken(body.Token), time.Now().Add(-confirmWithin))
+	if err != nil {
+		if err == errEmailNotFound {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": resBadToken})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resConfirmEmail, "email": email})
+}
+
+// newToken is 16 random bytes in hex, too many to guess
+func newToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(token), nil
+}
+
+// hashToken is what is stored, so that reading the database does not confirm an email
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
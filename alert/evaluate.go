@@ -0,0 +1,304 @@
+package alert
+
+import (
+	"context"
+	"fmt"
+	"github.com/tPhume/ags-backend/data"
+	"github.com/tPhume/ags-backend/metric"
+	"log"
+	"sort"
+	"time"
+)
+
+// How long the notifications of one batch of readings have to go out
+const sendTimeout = 30 * time.Second
+
+// Types of notification
+const (
+	TypeThreshold = "threshold"
+	TypeOffline   = "offline"
+)
+
+// Notification is sent when a rule starts firing and when it resolves
+// Offline notices fire when a controller goes silent and resolve when it is heard from again, they have no rule
+type Notification struct {
+	Type           string    `json:"type"`
+	RuleId         string    `json:"rule_id,omitempty"`
+	UserId         string    `json:"-"`
+	ControllerId   string    `json:"controller_id"`
+	ControllerName string    `json:"controller_name"`
+	Name           string    `json:"name"`
+	Key            string    `json:"key"`
+	Comparator     string    `json:"comparator"`
+	Threshold      float64   `json:"threshold"`
+	Severity       string    `json:"severity"`
+	State          string    `json:"state"`
+	Value          float64   `json:"value"`
+	At             time.Time `json:"at"`
+
+	// Channels of the rule at the time
+	Channels []*ChannelConfig `json:"-"`
+}
+
+// Title is a one line summary, the subject of an email
+func (n *Notification) Title() string {
+	if n.Type == TypeOffline {
+		if n.State == StateResolved {
+			return fmt.Sprintf("[%s] %s is back online", n.Severity, n.ControllerName)
+		}
+
+		return fmt.Sprintf("[%s] %s is offline", n.Severity, n.ControllerName)
+	}
+
+	return fmt.Sprintf("[%s] %s is %s on %s", n.Severity, n.Name, n.State, n.ControllerName)
+}
+
+// Body explains the value that changed the state of the rule
+func (n *Notification) Body() string {
+	if n.Type == TypeOffline {
+		if n.State == StateResolved {
+			return fmt.Sprintf("%s was heard from again at %s.", n.ControllerName, n.At.UTC().Format(time.RFC3339))
+		}
+
+		return fmt.Sprintf("%s has not been heard from since %s.", n.ControllerName, n.At.UTC().Format(time.RFC3339))
+	}
+
+	if n.State == StateResolved {
+		return fmt.Sprintf("%s is back to %g at %s, the alert needed it %s %g.",
+			n.Key, n.Value, n.At.UTC().Format(time.RFC3339), comparatorWords[n.Comparator], n.Threshold)
+	}
+
+	return fmt.Sprintf("%s is %g at %s, %s %g.",
+		n.Key, n.Value, n.At.UTC().Format(time.RFC3339), comparatorWords[n.Comparator], n.Threshold)
+}
+
+var comparatorWords = map[string]string{
+	ComparatorGt:  "above",
+	ComparatorGte: "at or above",
+	ComparatorLt:  "below",
+	ComparatorLte: "at or below",
+}
+
+// Events published about alerts, offline notices included, the data is the notification
+const (
+	EventFiring   = "alert.firing"
+	EventResolved = "alert.resolved"
+)
+
+// Publisher is told about alerts as events, whatever the quiet hours of the user
+type Publisher interface {
+	Publish(ctx context.Context, userId string, event string, data interface{})
+}
+
+// Evaluator moves rules through their states as readings are stored, it is a data.Notifier
+type Evaluator struct {
+	Repo Repo
+
+	// Channels by type, notifications to a type without a channel are dropped
+	Channels map[string]Channel
+
+	// Publisher is optional
+	Publisher Publisher
+}
+
+// ReadingsAdded evaluates the rules of the controller, notifications go out in the background
+func (e *Evaluator) ReadingsAdded(ctx context.Context, controllerId string, userId string, readings []*data.Reading) {
+	notifications, err := e.Evaluate(ctx, controllerId, readings)
+	if err != nil {
+		log.Printf("alert: could not evaluate rules of %s: %s", controllerId, err)
+	}
+
+	if len(notifications) == 0 {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+		defer cancel()
+
+		publish(ctx, e.Publisher, notifications)
+		e.Send(ctx, notifications)
+	}()
+}
+
+// Evaluate steps every rule of the controller through the readings in time order and saves their status
+// Readings no later than the last one a rule evaluated are skipped, so readings that arrive late cannot flip it back
+func (e *Evaluator) Evaluate(ctx context.Context, controllerId string, readings []*data.Reading) ([]*Notification, error) {
+	rules, err := e.Repo.ControllerRules(ctx, controllerId)
+	if err != nil || len(rules) == 0 {
+		return nil, err
+	}
+
+	controller, err := e.Repo.GetController(ctx, rules[0].UserId, controllerId)
+	if err != nil {
+		return nil, err
+	}
+
+	readings = derived(readings, metric.Sensors(controller.Sensors))
+
+	notifications := make([]*Notification, 0)
+	for _, rule := range rules {
+		status := rule.Status
+		if status == nil {
+			status = &Status{State: StateInactive}
+		}
+
+		evaluated := false
+		changes := make([]*Notification, 0)
+
+		for _, reading := range readings {
+			if !reading.Timestamp.After(status.At) {
+				continue
+			}
+
+			value, ok := reading.GoodValue(rule.Key)
+			if !ok {
+				continue
+			}
+
+			evaluated = true
+			if step(rule, status, reading.Timestamp, value) {
+				changes = append(changes, newNotification(rule, controller, status))
+			}
+		}
+
+		if !evaluated {
+			continue
+		}
+
+		// Notifying of a change that was not saved would notify it again with the next readings
+		// The rule may have been evaluated or edited since it was read, the changes are then someone else's to notify
+		saved, err := e.Repo.SetStatus(ctx, rule.RuleId, rule.Revision, status)
+		if err != nil {
+			log.Printf("alert: could not save status of rule %s: %s", rule.RuleId, err)
+			continue
+		}
+
+		if !saved {
+			continue
+		}
+
+		notifications = append(notifications, changes...)
+	}
+
+	return notifications, nil
+}
+
+// Send sends every notification through each channel of its rule as of now, failures are logged
+func (e *Evaluator) Send(ctx context.Context, notifications []*Notification) {
+	deliver(ctx, e.Repo, e.Channels, notifications, time.Now())
+}
+
+func publish(ctx context.Context, publisher Publisher, notifications []*Notification) {
+	if publisher == nil {
+		return
+	}
+
+	for _, notification := range notifications {
+		event := EventFiring
+		if notification.State == StateResolved {
+			event = EventResolved
+		}
+
+		publisher.Publish(ctx, notification.UserId, event, notification)
+	}
+}
+
+// step moves status on by the value at a time and reports whether it started firing or resolved
+func step(rule *Rule, status *Status, at time.Time, value float64) bool {
+	holds := compare(rule.Comparator, value, *rule.Threshold)
+	duration := time.Duration(rule.Duration) * time.Second
+
+	status.Value = value
+	status.At = at
+
+	switch status.State {
+	case StatePending:
+		if !holds {
+			status.State = StateInactive
+			status.Since = at
+			return false
+		}
+
+		if at.Sub(status.Since) >= duration {
+			status.State = StateFiring
+			status.Since = at
+			return true
+		}
+	case StateFiring:
+		if !holds {
+			status.State = StateResolved
+			status.Since = at
+			return true
+		}
+	default:
+		if !holds {
+			return false
+		}
+
+		status.Since = at
+		if duration == 0 {
+			status.State = StateFiring
+			return true
+		}
+
+		status.State = StatePending
+	}
+
+	return false
+}
+
+func compare(comparator string, value float64, threshold float64) bool {
+	switch comparator {
+	case ComparatorGt:
+		return value > threshold
+	case ComparatorGte:
+		return value >= threshold
+	case ComparatorLt:
+		return value < threshold
+	case ComparatorLte:
+		return value <= threshold
+	default:
+		return false
+	}
+}
+
+// derived returns copies of the readings with derived values added, in time order
+// The readings are shared with other notifiers so they are left as they are
+func derived(readings []*data.Reading, sensors []metric.Sensor) []*data.Reading {
+	copies := make([]*data.Reading, len(readings))
+	for i, reading := range readings {
+		metrics := make(map[string]float64, len(reading.Metrics)+1)
+		for key, value := range reading.Metrics {
+			metrics[key] = value
+		}
+
+		copies[i] = &data.Reading{Timestamp: reading.Timestamp, Metrics: metrics, Quality: reading.Quality}
+		data.Derive(copies[i], sensors)
+	}
+
+	sort.SliceStable(copies, func(i, j int) bool {
+		return copies[i].Timestamp.Before(copies[j].Timestamp)
+	})
+
+	return copies
+}
+
+func newNotification(rule *Rule, controller *Controller, status *Status) *Notification {
+	return &Notification{
+		Type:           TypeThreshold,
+		RuleId:         rule.RuleId,
+		UserId:         rule.UserId,
+		ControllerId:   rule.ControllerId,
+		ControllerName: controller.Name,
+		Name:           rule.Name,
+		Key:            rule.Key,
+		Comparator:     rule.Comparator,
+		Threshold:      *rule.Threshold,
+		Severity:       rule.Severity,
+		State:          status.State,
+		Value:          status.Value,
+		At:             status.At,
+		Channels:       rule.Channels,
+	}
+}
@@ -0,0 +1,264 @@
+package alert
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/tPhume/ags-backend/lookup"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+type MongoRepo struct {
+	Col           *mongo.Collection
+	SettingsCol   *mongo.Collection
+	OfflineCol    *mongo.Collection
+	EmailCol      *mongo.Collection
+	ControllerCol *mongo.Collection
+	Lookup        *lookup.MongoRepo
+}
+
+func (m *MongoRepo) GetSettings(ctx context.Context, userId string) (*Settings, error) {
+	result := m.SettingsCol.FindOne(ctx, bson.M{"_id": userId})
+	if result.Err() != nil {
+		if result.Err() == mongo.ErrNoDocuments {
+			return &Settings{UserId: userId, Channels: make([]*ChannelConfig, 0)}, nil
+		}
+
+		return nil, result.Err()
+	}
+
+	settings := &Settings{}
+	if err := result.Decode(settings); err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+func (m *MongoRepo) SetSettings(ctx context.Context, settings *Settings) error {
+	_, err := m.SettingsCol.ReplaceOne(ctx, bson.M{"_id": settings.UserId}, settings, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (m *MongoRepo) GetTimezone(ctx context.Context, userId string) (string, error) {
+	return m.Lookup.GetTimezone(ctx, userId)
+}
+
+func (m *MongoRepo) GetController(ctx context.Context, userId string, controllerId string) (*Controller, error) {
+	controller := &Controller{}
+	if err := m.Lookup.FindController(ctx, userId, controllerId, controller); err != nil {
+		return nil, err
+	}
+
+	return controller, nil
+}
+
+func (m *MongoRepo) AddRule(ctx context.Context, rule *Rule) error {
+	_, err := m.Col.InsertOne(ctx, rule)
+	return err
+}
+
+func (m *MongoRepo) ListRules(ctx context.Context, userId string, controllerId string) ([]*Rule, error) {
+	cursor, err := m.Col.Find(ctx, bson.M{"user_id": userId, "controller_id": controllerId}, options.Find().SetSort(bson.M{"name": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]*Rule, 0)
+	if err := cursor.All(ctx, &rules); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func (m *MongoRepo) UpdateRule(ctx context.Context, rule *Rule) error {
+	result := m.Col.FindOneAndReplace(ctx, bson.M{"_id": rule.RuleId, "user_id": rule.UserId, "controller_id": rule.ControllerId}, rule)
+	if result.Err() != nil {
+		if result.Err() == mongo.ErrNoDocuments {
+			return errRuleNotFound
+		}
+
+		return result.Err()
+	}
+
+	return nil
+}
+
+func (m *MongoRepo) RemoveRule(ctx context.Context, userId string, controllerId string, ruleId string) error {
+	result := m.Col.FindOneAndDelete(ctx, bson.M{"_id": ruleId, "user_id": userId, "controller_id": controllerId})
+	if result.Err() != nil {
+		if result.Err() == mongo.ErrNoDocuments {
+			return errRuleNotFound
+		}
+
+		return result.Err()
+	}
+
+	return nil
+}
+
+func (m *MongoRepo) ControllerRules(ctx context.Context, controllerId string) ([]*Rule, error) {
+	cursor, err := m.Col.Find(ctx, bson.M{"controller_id": controllerId})
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]*Rule, 0)
+	if err := cursor.All(ctx, &rules); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func (m *MongoRepo) SetStatus(ctx context.Context, ruleId string, revision string, status *Status) (bool, error) {
+	// Rules saved before revisions were kept have none
+	filter := bson.M{"_id": ruleId, "revision": revision}
+	if revision == "" {
+		filter["revision"] = bson.M{"$in": bson.A{"", nil}}
+	}
+
+	update := bson.M{"$set": bson.M{"status": status, "revision": uuid.New().String()}}
+	result, err := m.Col.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return false, err
+	}
+
+	return result.ModifiedCount == 1, nil
+}
+
+func (m *MongoRepo) SaveEmail(ctx context.Context, email *Email) error {
+	_, err := m.EmailCol.ReplaceOne(ctx, bson.M{"_id": email.EmailId}, email, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (m *MongoRepo) GetEmail(ctx context.Context, userId string, address string) (*Email, error) {
+	result := m.EmailCol.FindOne(ctx, bson.M{"user_id": userId, "address": address})
+	if result.Err() != nil {
+		if result.Err() == mongo.ErrNoDocuments {
+			return nil, errEmailNotFound
+		}
+
+		return nil, result.Err()
+	}
+
+	email := &Email{}
+	if err := result.Decode(email); err != nil {
+		return nil, err
+	}
+
+	return email, nil
+}
+
+func (m *MongoRepo) ListEmails(ctx context.Context, userId string) ([]*Email, error) {
+	cursor, err := m.EmailCol.Find(ctx, bson.M{"user_id": userId}, options.Find().SetSort(bson.M{"address": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	emails := make([]*Email, 0)
+	if err := cursor.All(ctx, &emails); err != nil {
+		return nil, err
+	}
+
+	return emails, nil
+}
+
+func (m *MongoRepo) ConfirmEmail(ctx context.Context, userId string, tokenHash string, since time.Time) (*Email, error) {
+	filter := bson.M{"user_id": userId, "token_hash": tokenHash, "confirmed": false, "added_at": bson.M{"$gt": since}}
+	update := bson.M{"$set": bson.M{"confirmed": true}, "$unset": bson.M{"token_hash": ""}}
+
+	result := m.EmailCol.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After))
+	if result.Err() != nil {
+		if result.Err() == mongo.ErrNoDocuments {
+			return nil, errEmailNotFound
+		}
+
+		return nil, result.Err()
+	}
+
+	email := &Email{}
+	if err := result.Decode(email); err != nil {
+		return nil, err
+	}
+
+	return email, nil
+}
+
+func (m *MongoRepo) ListContacts(ctx context.Context) ([]*Contact, error) {
+	projection := bson.M{"user_id": 1, "name": 1, "last_contact": 1}
+	cursor, err := m.ControllerCol.Find(ctx, bson.M{"last_contact": bson.M{"$exists": true}}, options.Find().SetProjection(projection))
+	if err != nil {
+		return nil, err
+	}
+
+	contacts := make([]*Contact, 0)
+	if err := cursor.All(ctx, &contacts); err != nil {
+		return nil, err
+	}
+
+	return contacts, nil
+}
+
+func (m *MongoRepo) ListOffline(ctx context.Context) (map[string]*Offline, error) {
+	cursor, err := m.OfflineCol.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+
+	marked := make([]*Offline, 0)
+	if err := cursor.All(ctx, &marked); err != nil {
+		return nil, err
+	}
+
+	offline := make(map[string]*Offline, len(marked))
+	for _, o := range marked {
+		offline[o.ControllerId] = o
+	}
+
+	return offline, nil
+}
+
+func (m *MongoRepo) MarkOffline(ctx context.Context, offline *Offline) (bool, error) {
+	if _, err := m.OfflineCol.InsertOne(ctx, offline); err != nil {
+		if writeException, ok := err.(mongo.WriteException); ok {
+			if len(writeException.WriteErrors) != 0 && writeException.WriteErrors[0].Code == 11000 {
+				return false, nil
+			}
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (m *MongoRepo) ClaimNotice(ctx context.Context, controllerId string) (bool, error) {
+	result, err := m.OfflineCol.UpdateOne(ctx, bson.M{"_id": controllerId, "notified": false}, bson.M{"$set": bson.M{"notified": true}})
+	if err != nil {
+		return false, err
+	}
+
+	return result.ModifiedCount == 1, nil
+}
+
+func (m *MongoRepo) ClearOffline(ctx context.Context, controllerId string) (*Offline, error) {
+	result := m.OfflineCol.FindOneAndDelete(ctx, bson.M{"_id": controllerId})
+	if result.Err() != nil {
+		if result.Err() == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+
+		return nil, result.Err()
+	}
+
+	offline := &Offline{}
+	if err := result.Decode(offline); err != nil {
+		return nil, err
+	}
+
+	return offline, nil
+}
@@ -0,0 +1,191 @@
+package alert
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Contact is the last time a controller asked for its plan or sent readings
+type Contact struct {
+	ControllerId string    `bson:"_id"`
+	UserId       string    `bson:"user_id"`
+	Name         string    `bson:"name"`
+	LastContact  time.Time `bson:"last_contact"`
+}
+
+// Offline is a controller that went silent, Notified is set once its offline notice was sent
+type Offline struct {
+	ControllerId string    `bson:"_id"`
+	UserId       string    `bson:"user_id"`
+	Since        time.Time `bson:"since"`
+	Notified     bool      `bson:"notified"`
+}
+
+// OfflineRepo
+// Every replica can run the checker, marking and clearing only succeed for one of them
+type OfflineRepo interface {
+	SettingsRepo
+
+	// ListContacts returns the controllers that made contact at least once
+	ListContacts(ctx context.Context) ([]*Contact, error)
+
+	// ListOffline returns the controllers that are offline by id
+	ListOffline(ctx context.Context) (map[string]*Offline, error)
+
+	// MarkOffline returns false when the controller was already marked
+	MarkOffline(ctx context.Context, offline *Offline) (bool, error)
+
+	// ClaimNotice sets Notified and returns false when it was already set
+	ClaimNotice(ctx context.Context, controllerId string) (bool, error)
+
+	// ClearOffline removes the mark of the controller and returns it, nil when it was already removed
+	ClearOffline(ctx context.Context, controllerId string) (*Offline, error)
+}
+
+// OfflineChecker notifies users of controllers that stopped making contact and of those that came back
+type OfflineChecker struct {
+	Repo OfflineRepo
+
+	// Channels by type, notices to a type without a channel are dropped
+	Channels map[string]Channel
+
+	// After is how long a controller has to be silent for, unless its user set their own
+	After time.Duration
+
+	Interval time.Duration
+
+	// Publisher is optional
+	Publisher Publisher
+}
+
+// Run checks until ctx is done, a failed run is logged and tried again at the next interval
+func (c *OfflineChecker) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.RunOnce(ctx, time.Now()); err != nil {
+			log.Printf("alert: offline check failed: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce marks controllers silent for longer than they may be as of now and clears those heard from since
+// The offline notice waits for the quiet hours of the user to be over, a controller that returns before then is never notified
+func (c *OfflineChecker) RunOnce(ctx context.Context, now time.Time) error {
+	contacts, err := c.Repo.ListContacts(ctx)
+	if err != nil {
+		return err
+	}
+
+	marked, err := c.Repo.ListOffline(ctx)
+	if err != nil {
+		return err
+	}
+
+	quietness := newQuietness(c.Repo, now)
+	settings := make(map[string]*Settings)
+	notifications := make([]*Notification, 0)
+
+	for _, contact := range contacts {
+		offline := marked[contact.ControllerId]
+		delete(marked, contact.ControllerId)
+
+		userSettings, ok := settings[contact.UserId]
+		if !ok {
+			if userSettings, err = c.Repo.GetSettings(ctx, contact.UserId); err != nil {
+				return err
+			}
+
+			settings[contact.UserId] = userSettings
+		}
+
+		if now.Sub(contact.LastContact) < c.after(userSettings) {
+			if offline == nil {
+				continue
+			}
+
+			cleared, err := c.Repo.ClearOffline(ctx, contact.ControllerId)
+			if err != nil {
+				return err
+			}
+
+			if cleared != nil && cleared.Notified {
+				notifications = append(notifications, newOfflineNotification(contact, userSettings, StateResolved, contact.LastContact))
+			}
+
+			continue
+		}
+
+		if offline == nil {
+			offline = &Offline{ControllerId: contact.ControllerId, UserId: contact.UserId, Since: contact.LastContact}
+			first, err := c.Repo.MarkOffline(ctx, offline)
+			if err != nil {
+				return err
+			}
+
+			// Another replica marked it first and sends the notice
+			if !first {
+				continue
+			}
+		}
+
+		if offline.Notified || quietness.quiet(ctx, contact.UserId) {
+			continue
+		}
+
+		claimed, err := c.Repo.ClaimNotice(ctx, contact.ControllerId)
+		if err != nil {
+			return err
+		}
+
+		if claimed {
+			notifications = append(notifications, newOfflineNotification(contact, userSettings, StateFiring, offline.Since))
+		}
+	}
+
+	// What is left is of controllers that were removed
+	for controllerId := range marked {
+		if _, err := c.Repo.ClearOffline(ctx, controllerId); err != nil {
+			return err
+		}
+	}
+
+	publish(ctx, c.Publisher, notifications)
+	deliver(ctx, c.Repo, c.Channels, notifications, now)
+	return nil
+}
+
+func (c *OfflineChecker) after(settings *Settings) time.Duration {
+	if settings.OfflineAfter > 0 {
+		return time.Duration(settings.OfflineAfter) * time.Minute
+	}
+
+	return c.After
+}
+
+func newOfflineNotification(contact *Contact, settings *Settings, state string, at time.Time) *Notification {
+	channels := settings.Channels
+	if len(channels) == 0 {
+		channels = []*ChannelConfig{{Type: ChannelInbox}}
+	}
+
+	return &Notification{
+		Type:           TypeOffline,
+		UserId:         contact.UserId,
+		ControllerId:   contact.ControllerId,
+		ControllerName: contact.Name,
+		Name:           "offline",
+		Severity:       SeverityWarning,
+		State:          state,
+		At:             at,
+		Channels:       channels,
+	}
+}
@@ -0,0 +1,157 @@
+package alert
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Settings of a user that apply to all of their controllers
+type Settings struct {
+	UserId string `json:"-" bson:"_id"`
+
+	// OfflineAfter is how many minutes a controller has to be silent for to be offline, the server default when 0
+	OfflineAfter int `json:"offline_after" bson:"offline_after" binding:"omitempty,min=5,max=10080"`
+
+	// Channels offline notices go to, the inbox when there are none
+	Channels []*ChannelConfig `json:"channels" bson:"channels" binding:"max=5,dive"`
+
+	QuietHours *QuietHours `json:"quiet_hours,omitempty" bson:"quiet_hours,omitempty" binding:"omitempty"`
+}
+
+// QuietHours in the timezone of the user, they span midnight when end is before start
+// Webhooks and emails of anything but critical alerts are dropped, they are not sent once quiet hours are over either,
+// the inbox still gets everything. Offline notices are the exception, they wait until quiet hours are over
+type QuietHours struct {
+	Start string `json:"start" bson:"start" binding:"required,datetime=15:04"`
+	End   string `json:"end" bson:"end" binding:"required,datetime=15:04"`
+}
+
+// Contains reports whether t is within the quiet hours, q can be nil
+func (q *QuietHours) Contains(t time.Time) bool {
+	if q == nil || q.Start == q.End {
+		return false
+	}
+
+	clock := t.Format("15:04")
+	if q.Start < q.End {
+		return clock >= q.Start && clock < q.End
+	}
+
+	return clock >= q.Start || clock < q.End
+}
+
+func (h *Handler) GetSettings(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	settings, err := h.Repo.GetSettings(ctx, userId)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resGetSettings, "settings": settings})
+}
+
+func (h *Handler) SetSettings(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	settings := &Settings{}
+	if err := ctx.ShouldBindJSON(settings); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid, "err": err.Error()})
+		return
+	}
+
+	settings.UserId = userId
+	if settings.Channels == nil {
+		settings.Channels = make([]*ChannelConfig, 0)
+	}
+
+	if !h.checkChannels(ctx, userId, settings.Channels) {
+		return
+	}
+
+	if err := h.Repo.SetSettings(ctx, settings); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resSetSettings, "settings": settings})
+}
+
+// quietness tells whether users are in their quiet hours, settings are looked up once per user
+type quietness struct {
+	repo  SettingsRepo
+	now   time.Time
+	users map[string]bool
+}
+
+func newQuietness(repo SettingsRepo, now time.Time) *quietness {
+	return &quietness{repo: repo, now: now, users: make(map[string]bool)}
+}
+
+// quiet is false when the settings of the user cannot be read, better to send than to lose an alert
+func (q *quietness) quiet(ctx context.Context, userId string) bool {
+	if quiet, ok := q.users[userId]; ok {
+		return quiet
+	}
+
+	settings, err := q.repo.GetSettings(ctx, userId)
+	if err != nil {
+		log.Printf("alert: could not get settings of %s: %s", userId, err)
+		return false
+	}
+
+	quiet := false
+	if settings.QuietHours != nil {
+		timezone, err := q.repo.GetTimezone(ctx, userId)
+		if err != nil {
+			log.Printf("alert: could not get timezone of %s: %s", userId, err)
+			return false
+		}
+
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			location = time.UTC
+		}
+
+		quiet = settings.QuietHours.Contains(q.now.In(location))
+	}
+
+	q.users[userId] = quiet
+	return quiet
+}
+
+// deliver sends every notification through each of its channels, failures are logged
+// Users in their quiet hours only get critical notifications outside of their inbox, the others are dropped there
+func deliver(ctx context.Context, repo SettingsRepo, channels map[string]Channel, notifications []*Notification, now time.Time) {
+	quietness := newQuietness(repo, now)
+
+	for _, notification := range notifications {
+		for _, config := range notification.Channels {
+			if config.Type != ChannelInbox && notification.Severity != SeverityCritical && quietness.quiet(ctx, notification.UserId) {
+				continue
+			}
+
+			channel, ok := channels[config.Type]
+			if !ok {
+				log.Printf("alert: no %s channel for %s of %s", config.Type, notification.Type, notification.ControllerId)
+				continue
+			}
+
+			if err := channel.Send(ctx, config.Target, notification); err != nil {
+				log.Printf("alert: could not send %s %s of %s by %s: %s", notification.Type, notification.State, notification.ControllerId, config.Type, err)
+			}
+		}
+	}
+}
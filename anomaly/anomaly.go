@@ -0,0 +1,140 @@
+// Package anomaly flags days whose summaries are far from the recent norm of the controller
+package anomaly
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/tPhume/ags-backend/lookup"
+	"github.com/tPhume/ags-backend/metric"
+	"github.com/tPhume/ags-backend/session"
+	"net/http"
+	"time"
+)
+
+func RegisterRoutes(handler *Handler, engine *gin.Engine, sessionHandler *session.Handler) {
+	engine.GET("api/v1/controller/:controllerId/anomalies", sessionHandler.GetUser, handler.ListAnomalies)
+}
+
+// Severities from the least to the most severe
+const (
+	SeverityLow    = "low"
+	SeverityMedium = "medium"
+	SeverityHigh   = "high"
+)
+
+// Anomaly is a sensor of a controller whose daily median was far from the baseline of the days before
+type Anomaly struct {
+	AnomalyId    string    `json:"anomaly_id" bson:"_id"`
+	UserId       string    `json:"-" bson:"user_id"`
+	ControllerId string    `json:"controller_id" bson:"controller_id"`
+	Date         string    `json:"date" bson:"date"`
+	Key          string    `json:"key" bson:"key"`
+	Value        float64   `json:"value" bson:"value"`
+	Baseline     float64   `json:"baseline" bson:"baseline"`
+	Spread       float64   `json:"spread" bson:"spread"`
+	Score        float64   `json:"score" bson:"score"`
+	Severity     string    `json:"severity" bson:"severity"`
+	Explanation  string    `json:"explanation" bson:"explanation"`
+	DetectedAt   time.Time `json:"detected_at" bson:"detected_at"`
+}
+
+// Controller is what anomalies need to know about a controller
+type Controller struct {
+	UserId  string          `bson:"user_id"`
+	Sensors []metric.Sensor `bson:"sensors"`
+}
+
+// Repo
+type Repo interface {
+	// GetController returns the controller if it belongs to userId
+	GetController(ctx context.Context, userId string, controllerId string) (*Controller, error)
+
+	// ListAnomalies returns the anomalies of the controller dated from one date to another inclusive, in date order
+	// Only anomalies at least as severe as severities are returned
+	ListAnomalies(ctx context.Context, userId string, controllerId string, from string, to string, severities []string) ([]*Anomaly, error)
+}
+
+var errControllerNotFound = lookup.ErrControllerNotFound
+
+// Handler for anomaly REST API
+type Handler struct {
+	Repo Repo
+}
+
+var (
+	// ok message responses for handler
+	resList = "list of anomalies retrieved"
+
+	// error message responses for handler
+	resInternal = "not your fault, don't worry"
+	resInvalid  = "invalid values"
+	resNotFound = "not found"
+)
+
+// Longest range of one listing
+const maxListDays = 366
+
+// Query for ListAnomalies, dates are inclusive and severity is the least severe to list
+type listQuery struct {
+	From     string `form:"from" binding:"required"`
+	To       string `form:"to" binding:"required"`
+	Severity string `form:"severity" binding:"omitempty,oneof=low medium high"`
+}
+
+func (h *Handler) ListAnomalies(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	controllerId := ctx.Param("controllerId")
+	if _, err := uuid.Parse(controllerId); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	query := &listQuery{}
+	if err := ctx.ShouldBindQuery(query); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid, "err": err.Error()})
+		return
+	}
+
+	from, errFrom := time.Parse(dateLayout, query.From)
+	to, errTo := time.Parse(dateLayout, query.To)
+	if errFrom != nil || errTo != nil || to.Before(from) || to.Sub(from) >= maxListDays*24*time.Hour {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	if _, err := h.Repo.GetController(ctx, userId, controllerId); err != nil {
+		if err == errControllerNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resNotFound})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	anomalies, err := h.Repo.ListAnomalies(ctx, userId, controllerId, query.From, query.To, atLeast(query.Severity))
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resList, "result": anomalies})
+}
+
+// atLeast returns severity and the ones more severe, every severity when it is empty
+func atLeast(severity string) []string {
+	switch severity {
+	case SeverityMedium:
+		return []string{SeverityMedium, SeverityHigh}
+	case SeverityHigh:
+		return []string{SeverityHigh}
+	}
+
+	return []string{SeverityLow, SeverityMedium, SeverityHigh}
+}
@@ -0,0 +1,185 @@
+package anomaly
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/tPhume/ags-backend/summary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// For our tests the grower has one propagation room, any other controller id indicates a missing controller
+var room = Controller{UserId: "939ea1c4-61e4-4971-8563-1e2b78925bd5"}
+
+const (
+	roomId    = "29173d94-5dcb-441f-b7b5-e314297645d9"
+	unknownId = "0d5235f5-5f25-4152-ac9b-45f11ae5a0f9"
+)
+
+// Repo struct for testing, it has dailies of the room for the first half of April 2020
+// Humidity wobbles around 60 and co2 is always 400
+type repoStruct struct {
+	stored map[string][]*Anomaly
+}
+
+func (r *repoStruct) GetController(ctx context.Context, userId string, controllerId string) (*Controller, error) {
+	if userId != room.UserId || controllerId != roomId {
+		return nil, errControllerNotFound
+	}
+
+	return &room, nil
+}
+
+// ListAnomalies returns one humidity anomaly of every severity asked for
+func (r *repoStruct) ListAnomalies(ctx context.Context, userId string, id string, from string, to string, severities []string) ([]*Anomaly, error) {
+	anomalies := make([]*Anomaly, 0)
+	for _, severity := range severities {
+		anomalies = append(anomalies, &Anomaly{ControllerId: id, Date: from, Key: "humidity", Severity: severity})
+	}
+
+	return anomalies, nil
+}
+
+func (r *repoStruct) EachSummary(ctx context.Context, userId string, id string, from string, to string, fn func(*summary.Summary) error) error {
+	wobble := []float64{-2, 1, 0, 2, -1, 1, -1}
+	for day := 1; day <= 15; day++ {
+		date := time.Date(2020, time.April, day, 0, 0, 0, 0, time.UTC).Format(dateLayout)
+		if date < from || date > to {
+			continue
+		}
+
+		humidity := 60 + wobble[day%len(wobble)]
+		daily := &summary.Summary{Date: date, Metrics: map[string]*summary.Stats{
+			"humidity": {Median: humidity},
+			"co2":      {Median: 400},
+		}}
+
+		if err := fn(daily); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *repoStruct) ReplaceAnomalies(ctx context.Context, id string, date string, anomalies []*Anomaly) error {
+	r.stored[id+":"+date] = anomalies
+	return nil
+}
+
+// Test days are judged against the days before
+func TestDetector_Detect(t *testing.T) {
+	repo := &repoStruct{stored: map[string][]*Anomaly{}}
+	detector := &Detector{Repo: repo}
+
+	testCases := []struct {
+		date     string
+		humidity float64
+		co2      float64
+		severity string
+	}{
+		// Within the wobble
+		{date: "2020-04-16", humidity: 61, co2: 400},
+		// The baseline is 60 and the MAD of the wobble is under half the tolerance of 10, so the spread is 5
+		{date: "2020-04-16", humidity: 75, co2: 400},
+		{date: "2020-04-16", humidity: 78, co2: 400, severity: SeverityLow},
+		{date: "2020-04-16", humidity: 87.5, co2: 400, severity: SeverityMedium},
+		{date: "2020-04-16", humidity: 100, co2: 400, severity: SeverityHigh},
+		{date: "2020-04-16", humidity: 20, co2: 400, severity: SeverityHigh},
+		// Only five days before, not enough to judge by
+		{date: "2020-04-06", humidity: 90, co2: 400},
+	}
+
+	for i, c := range testCases {
+		daily := &summary.Summary{UserId: room.UserId, ControllerId: roomId, Date: c.date, Metrics: map[string]*summary.Stats{
+			"humidity": {Median: c.humidity},
+			"co2":      {Median: c.co2},
+		}}
+
+		anomalies, err := detector.Detect(context.Background(), daily)
+		if err != nil {
+			t.Fatalf("Case %d: expected no error, got = [%v]", i, err)
+		}
+
+		if c.severity == "" {
+			if len(anomalies) != 0 {
+				t.Fatalf("Case %d: expected no anomalies, got = [%v]", i, anomalies[0].Explanation)
+			}
+
+			continue
+		}
+
+		if len(anomalies) != 1 || anomalies[0].Key != "humidity" || anomalies[0].Severity != c.severity {
+			t.Fatalf("Case %d: expected [humidity %v], got = [%+v]", i, c.severity, anomalies)
+		}
+
+		if stored := repo.stored[roomId+":"+c.date]; len(stored) != 1 || !strings.Contains(stored[0].Explanation, "median humidity") {
+			t.Fatalf("Case %d: expected the anomaly stored, got = [%+v]", i, stored)
+		}
+	}
+}
+
+// Setup func for handler testing
+func setUp() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+
+	engine.Use(func(ctx *gin.Context) {
+		ctx.Set("userId", room.UserId)
+	})
+
+	return engine
+}
+
+// Test ListAnomalies handler
+func TestHandler_ListAnomalies(t *testing.T) {
+	engine := setUp()
+	handler := &Handler{Repo: &repoStruct{}}
+	engine.GET(":controllerId", handler.ListAnomalies)
+
+	testCases := []struct {
+		controllerId string
+		query        string
+		message      string
+		code         int
+		count        int
+	}{
+		{controllerId: roomId, query: "from=2020-04-01&to=2020-04-30", message: resList, code: http.StatusOK, count: 3},
+		{controllerId: roomId, query: "from=2020-04-01&to=2020-04-30&severity=medium", message: resList, code: http.StatusOK, count: 2},
+		{controllerId: roomId, query: "from=2020-04-01&to=2020-04-30&severity=urgent", message: resInvalid, code: http.StatusBadRequest},
+		{controllerId: roomId, query: "from=2020-04-30&to=2020-04-01", message: resInvalid, code: http.StatusBadRequest},
+		{controllerId: roomId, query: "from=2020-01-01&to=2021-04-01", message: resInvalid, code: http.StatusBadRequest},
+		{controllerId: roomId, query: "from=2020-04-01", message: resInvalid, code: http.StatusBadRequest},
+		{controllerId: "not-a-uuid", query: "from=2020-04-01&to=2020-04-30", message: resInvalid, code: http.StatusBadRequest},
+		{controllerId: unknownId, query: "from=2020-04-01&to=2020-04-30", message: resNotFound, code: http.StatusNotFound},
+	}
+
+	for i, c := range testCases {
+		resp := httptest.NewRecorder()
+
+		req, _ := http.NewRequest(http.MethodGet, "/"+c.controllerId+"?"+c.query, nil)
+		engine.ServeHTTP(resp, req)
+
+		respBody := struct {
+			Message string     `json:"message"`
+			Result  []*Anomaly `json:"result"`
+		}{}
+		_ = json.Unmarshal(resp.Body.Bytes(), &respBody)
+
+		if c.code != resp.Code {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.code, resp.Code)
+		}
+
+		if c.message != respBody.Message {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.message, respBody.Message)
+		}
+
+		if len(respBody.Result) != c.count {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.count, len(respBody.Result))
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package anomaly
+
+import (
+	"context"
+	"fmt"
+	"github.com/tPhume/ags-backend/metric"
+	"github.com/tPhume/ags-backend/summary"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// Dates of summaries are kept as text in this layout
+const dateLayout = "2006-01-02"
+
+// The baseline is the days before, a day is only judged when enough of them have the sensor
+const (
+	baselineDays    = 14
+	minBaselineDays = 7
+)
+
+// Scores from which a day is an anomaly of each severity
+// A score is how many spreads the median of the day is from the baseline, 3.5 is the usual cut for robust z-scores
+const (
+	lowScore    = 3.5
+	mediumScore = 5
+	highScore   = 8
+)
+
+// MAD is scaled by this to be comparable with a standard deviation
+const madScale = 1.4826
+
+// DetectorRepo is where the Detector reads summaries from and writes anomalies to
+type DetectorRepo interface {
+	// GetController returns the controller if it belongs to userId
+	GetController(ctx context.Context, userId string, controllerId string) (*Controller, error)
+
+	EachSummary(ctx context.Context, userId string, controllerId string, from string, to string, fn func(*summary.Summary) error) error
+
+	// ReplaceAnomalies replaces the anomalies of the controller for date, so detecting a day again leaves no stale ones
+	ReplaceAnomalies(ctx context.Context, controllerId string, date string, anomalies []*Anomaly) error
+}
+
+// Detector judges every daily summary against the median and MAD of the days before it
+// It is a summary.Notifier, so it runs once the Builder has written a summary
+type Detector struct {
+	Repo DetectorRepo
+}
+
+// SummaryBuilt detects anomalies of daily, failures are logged since the summary itself is written
+func (d *Detector) SummaryBuilt(ctx context.Context, daily *summary.Summary) {
+	if _, err := d.Detect(ctx, daily); err != nil {
+		log.Printf("anomaly: could not detect %s on %s: %s", daily.ControllerId, daily.Date, err)
+	}
+}
+
+// Detect stores and returns the anomalies of daily
+func (d *Detector) Detect(ctx context.Context, daily *summary.Summary) ([]*Anomaly, error) {
+	day, err := time.Parse(dateLayout, daily.Date)
+	if err != nil {
+		return nil, err
+	}
+
+	controller, err := d.Repo.GetController(ctx, daily.UserId, daily.ControllerId)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := summaryKeys(daily)
+	history := make(map[string][]float64, len(keys))
+
+	from := day.AddDate(0, 0, -baselineDays).Format(dateLayout)
+	to := day.AddDate(0, 0, -1).Format(dateLayout)
+	err = d.Repo.EachSummary(ctx, daily.UserId, daily.ControllerId, from, to, func(before *summary.Summary) error {
+		for _, key := range keys {
+			if stats, ok := before.Stat(key); ok {
+				history[key] = append(history[key], stats.Median)
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	anomalies := make([]*Anomaly, 0)
+	for _, key := range keys {
+		stats, _ := daily.Stat(key)
+		m := sensorMetric(controller.Sensors, key)
+
+		anomaly := judge(key, stats.Median, history[key], m)
+		if anomaly == nil {
+			continue
+		}
+
+		anomaly.AnomalyId = daily.ControllerId + ":" + daily.Date + ":" + key
+		anomaly.UserId = daily.UserId
+		anomaly.ControllerId = daily.ControllerId
+		anomaly.Date = daily.Date
+		anomaly.DetectedAt = now
+
+		anomalies = append(anomalies, anomaly)
+	}
+
+	if err := d.Repo.ReplaceAnomalies(ctx, daily.ControllerId, daily.Date, anomalies); err != nil {
+		return nil, err
+	}
+
+	return anomalies, nil
+}
+
+// judge returns an anomaly without its ids when value is far from the baseline of history, nil otherwise
+// The spread is at least half the tolerance of the metric, so that very steady days don't make every wobble an anomaly
+func judge(key string, value float64, history []float64, m *metric.Metric) *Anomaly {
+	if len(history) < minBaselineDays {
+		return nil
+	}
+
+	baseline := median(history)
+
+	deviations := make([]float64, len(history))
+	for i, past := range history {
+		deviations[i] = math.Abs(past - baseline)
+	}
+
+	spread := madScale * median(deviations)
+	unit := ""
+	if m != nil {
+		spread = math.Max(spread, m.Tolerance/2)
+		unit = m.Unit
+	}
+
+	if spread == 0 {
+		return nil
+	}
+
+	score := (value - baseline) / spread
+	severity := ""
+	switch magnitude := math.Abs(score); {
+	case magnitude >= highScore:
+		severity = SeverityHigh
+	case magnitude >= mediumScore:
+		severity = SeverityMedium
+	case magnitude >= lowScore:
+		severity = SeverityLow
+	default:
+		return nil
+	}
+
+	direction := "above"
+	if score < 0 {
+		direction = "below"
+	}
+
+	return &Anomaly{
+		Key:      key,
+		Value:    value,
+		Baseline: baseline,
+		Spread:   spread,
+		Score:    score,
+		Severity: severity,
+		Explanation: fmt.Sprintf("median %s was %.4g%s, %.1f times the usual spread %s the median of %.4g%s over the %d days before",
+			key, value, withSpace(unit), math.Abs(score), direction, baseline, withSpace(unit), len(history)),
+	}
+}
+
+// summaryKeys returns the sensors of daily, summaries written before metrics have the legacy ones
+func summaryKeys(daily *summary.Summary) []string {
+	keys := make([]string, 0, len(daily.Metrics))
+	for key := range daily.Metrics {
+		keys = append(keys, key)
+	}
+
+	if daily.Metrics == nil {
+		for _, sensor := range metric.LegacySensors {
+			keys = append(keys, sensor.Key)
+		}
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// sensorMetric returns the metric of the sensor with key, derived metrics are keyed by name
+func sensorMetric(sensors []metric.Sensor, key string) *metric.Metric {
+	if m, err := metric.Default.SensorMetric(metric.Sensors(sensors), key); err == nil {
+		return m
+	}
+
+	if m, ok := metric.Default.Lookup(key); ok && m.Derived {
+		return m
+	}
+
+	return nil
+}
+
+func median(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+
+	return sorted[middle]
+}
+
+func withSpace(unit string) string {
+	if unit == "" {
+		return ""
+	}
+
+	return " " + unit
+}
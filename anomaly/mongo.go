@@ -0,0 +1,68 @@
+package anomaly
+
+import (
+	"context"
+	"github.com/tPhume/ags-backend/lookup"
+	"github.com/tPhume/ags-backend/summary"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type MongoRepo struct {
+	Col     *mongo.Collection
+	Lookup  *lookup.MongoRepo
+	Summary *summary.Mongo
+}
+
+func (m *MongoRepo) GetController(ctx context.Context, userId string, controllerId string) (*Controller, error) {
+	controller := &Controller{}
+	if err := m.Lookup.FindController(ctx, userId, controllerId, controller); err != nil {
+		return nil, err
+	}
+
+	return controller, nil
+}
+
+func (m *MongoRepo) ListAnomalies(ctx context.Context, userId string, controllerId string, from string, to string, severities []string) ([]*Anomaly, error) {
+	filter := bson.M{
+		"user_id":       userId,
+		"controller_id": controllerId,
+		"date":          bson.M{"$gte": from, "$lte": to},
+		"severity":      bson.M{"$in": severities},
+	}
+
+	cursor, err := m.Col.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "date", Value: 1}, {Key: "key", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	anomalies := make([]*Anomaly, 0)
+	if err := cursor.All(ctx, &anomalies); err != nil {
+		return nil, err
+	}
+
+	return anomalies, nil
+}
+
+func (m *MongoRepo) EachSummary(ctx context.Context, userId string, controllerId string, from string, to string, fn func(*summary.Summary) error) error {
+	return m.Summary.EachSummary(ctx, userId, controllerId, from, to, fn)
+}
+
+func (m *MongoRepo) ReplaceAnomalies(ctx context.Context, controllerId string, date string, anomalies []*Anomaly) error {
+	if _, err := m.Col.DeleteMany(ctx, bson.M{"controller_id": controllerId, "date": date}); err != nil {
+		return err
+	}
+
+	if len(anomalies) == 0 {
+		return nil
+	}
+
+	documents := make([]interface{}, len(anomalies))
+	for i, anomaly := range anomalies {
+		documents[i] = anomaly
+	}
+
+	_, err := m.Col.InsertMany(ctx, documents)
+	return err
+}
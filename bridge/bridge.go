@@ -0,0 +1,331 @@
+// Package bridge connects controllers that speak MQTT to the backend
+// Telemetry is read from ags/<controllerId>/telemetry, plans and commands are published to ags/<controllerId>/plan and ags/<controllerId>/cmd
+package bridge
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/tPhume/ags-backend/data"
+	"github.com/tPhume/ags-backend/plan"
+	"github.com/tPhume/ags-backend/session"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func RegisterRoutes(handler *Handler, engine *gin.Engine, sessionHandler *session.Handler) {
+	engine.POST("api/v1/controller/:controllerId/cmd", sessionHandler.GetUser, handler.SendCommand)
+}
+
+// Topics, %s is the controllerId
+const (
+	topicPrefix    = "ags/"
+	telemetryTopic = "ags/+/telemetry"
+	ackTopic       = "ags/+/ack"
+	planTopic      = "ags/%s/plan"
+	cmdTopic       = "ags/%s/cmd"
+)
+
+// How long storing the telemetry of a single message may take
+const telemetryTimeout = 10 * time.Second
+
+// MessageHandler receives the topic and payload of a message
+type MessageHandler func(topic string, payload []byte)
+
+// Client is the part of an MQTT client the bridge uses
+type Client interface {
+	// Subscribe registers handler for topic, which may contain + and # wildcards
+	Subscribe(topic string, handler MessageHandler) error
+
+	Publish(topic string, retained bool, payload []byte) error
+}
+
+// Telemetry is sent by a controller, token is the same controller token used over HTTP
+type Telemetry struct {
+	Token    string          `json:"token"`
+	Readings []*data.Reading `json:"readings"`
+}
+
+// Command tells a controller to run an action once, right away
+type Command struct {
+	CommandId string      `json:"command_id"`
+	Action    plan.Action `json:"action" binding:"required"`
+}
+
+// Ack is sent by a controller once it has run or refused a command
+type Ack struct {
+	Token     string `json:"token,omitempty"`
+	CommandId string `json:"command_id"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Notifier is told about acknowledgements of commands
+type Notifier interface {
+	CommandAcknowledged(ctx context.Context, controllerId string, ack *Ack)
+}
+
+// Plan message uses the same body as GetPlanWithToken
+type planMessage struct {
+	Message string       `json:"message"`
+	Result  *plan.Entity `json:"result,omitempty"`
+}
+
+// Repo interface for data source
+// Errors that should be used with Repo interface
+var (
+	errControllerNotFound = errors.New("controller not found")
+	errNoPlan             = errors.New("no plan set")
+)
+
+type Repo interface {
+	// GetToken returns the token of the controller
+	GetToken(ctx context.Context, controllerId string) (string, error)
+
+	// ControllerExist checks that the controller belongs to userId
+	ControllerExist(ctx context.Context, userId string, controllerId string) error
+
+	// GetControllerPlan returns the plan assigned to the controller
+	GetControllerPlan(ctx context.Context, controllerId string) (*plan.Entity, error)
+
+	// ListPlanControllers returns the controllers that are assigned the plan
+	ListPlanControllers(ctx context.Context, userId string, planId string) ([]string, error)
+
+	// ListControllers returns every controller with a plan set
+	ListControllers(ctx context.Context) ([]string, error)
+}
+
+// Bridge moves messages between the broker and the backend
+// It is also the Notifier of plan and controller handlers so that devices always hold their current plan
+type Bridge struct {
+	Client Client
+	Repo   Repo
+
+	// Data stores telemetry the same way as the HTTP endpoint
+	Data *data.Handler
+
+	// Notifier is optional
+	Notifier Notifier
+}
+
+// Start subscribes to telemetry and publishes the current plan of every controller
+func (b *Bridge) Start(ctx context.Context) error {
+	if err := b.Client.Subscribe(telemetryTopic, b.handleTelemetry); err != nil {
+		return err
+	}
+
+	if err := b.Client.Subscribe(ackTopic, b.handleAck); err != nil {
+		return err
+	}
+
+	controllerIds, err := b.Repo.ListControllers(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, controllerId := range controllerIds {
+		if err := b.PublishPlan(ctx, controllerId); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PlanChanged republishes the plan to every controller it is assigned to
+// Failures are logged, the change itself has already been stored
+func (b *Bridge) PlanChanged(ctx context.Context, userId string, planId string) {
+	controllerIds, err := b.Repo.ListPlanControllers(ctx, userId, planId)
+	if err != nil {
+		log.Printf("bridge: could not list controllers of plan %s: %s", planId, err)
+		return
+	}
+
+	for _, controllerId := range controllerIds {
+		if err := b.PublishPlan(ctx, controllerId); err != nil {
+			log.Printf("bridge: could not publish plan to %s: %s", controllerId, err)
+		}
+	}
+}
+
+// ControllerChanged republishes the plan of a controller that was added, updated or removed
+func (b *Bridge) ControllerChanged(ctx context.Context, userId string, controllerId string) {
+	if err := b.PublishPlan(ctx, controllerId); err != nil {
+		log.Printf("bridge: could not publish plan to %s: %s", controllerId, err)
+	}
+}
+
+// PublishPlan publishes the controller's plan as a retained message so devices get it as soon as they subscribe
+func (b *Bridge) PublishPlan(ctx context.Context, controllerId string) error {
+	topic := fmt.Sprintf(planTopic, controllerId)
+
+	entity, err := b.Repo.GetControllerPlan(ctx, controllerId)
+	if err != nil {
+		if err == errControllerNotFound {
+			// An empty retained message clears the plan of a removed controller
+			return b.Client.Publish(topic, true, nil)
+		} else if err == errNoPlan {
+			return b.publishJson(topic, true, &planMessage{Message: "no plan set"})
+		}
+
+		return err
+	}
+
+	return b.publishJson(topic, true, &planMessage{Message: "plan retrieved", Result: entity})
+}
+
+// PublishCommand sends a command to the controller, commands are not retained
+func (b *Bridge) PublishCommand(controllerId string, command *Command) error {
+	return b.publishJson(fmt.Sprintf(cmdTopic, controllerId), false, command)
+}
+
+func (b *Bridge) publishJson(topic string, retained bool, value interface{}) error {
+	payload, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return b.Client.Publish(topic, retained, payload)
+}
+
+// handleTelemetry stores readings published by a controller
+// The token must belong to the controller named in the topic
+func (b *Bridge) handleTelemetry(topic string, payload []byte) {
+	controllerId := controllerFromTopic(topic)
+	if controllerId == "" {
+		return
+	}
+
+	telemetry := &Telemetry{}
+	if err := json.Unmarshal(payload, telemetry); err != nil {
+		log.Printf("bridge: bad telemetry from %s: %s", controllerId, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), telemetryTimeout)
+	defer cancel()
+
+	if !b.authenticate(ctx, controllerId, telemetry.Token) {
+		return
+	}
+
+	if _, err := b.Data.Ingest(ctx, telemetry.Token, telemetry.Readings); err != nil {
+		log.Printf("bridge: could not store telemetry from %s: %s", controllerId, err)
+	}
+}
+
+// handleAck passes on the acknowledgement of a command
+// Acks carry the controller token like telemetry does
+func (b *Bridge) handleAck(topic string, payload []byte) {
+	controllerId := controllerFromTopic(topic)
+	if controllerId == "" || b.Notifier == nil {
+		return
+	}
+
+	ack := &Ack{}
+	if err := json.Unmarshal(payload, ack); err != nil || ack.CommandId == "" {
+		log.Printf("bridge: bad ack from %s", controllerId)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), telemetryTimeout)
+	defer cancel()
+
+	if !b.authenticate(ctx, controllerId, ack.Token) {
+		return
+	}
+
+	// The token must not travel any further
+	ack.Token = ""
+	b.Notifier.CommandAcknowledged(ctx, controllerId, ack)
+}
+
+// authenticate checks that token belongs to the controller
+func (b *Bridge) authenticate(ctx context.Context, controllerId string, token string) bool {
+	expected, err := b.Repo.GetToken(ctx, controllerId)
+	if err != nil {
+		log.Printf("bridge: could not authenticate %s: %s", controllerId, err)
+		return false
+	}
+
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(token)) != 1 {
+		log.Printf("bridge: token does not match controller %s", controllerId)
+		return false
+	}
+
+	return true
+}
+
+// controllerFromTopic returns the controllerId of ags/<controllerId>/<kind>, empty if it isn't one
+func controllerFromTopic(topic string) string {
+	levels := strings.Split(topic, "/")
+	if len(levels) != 3 || levels[0]+"/" != topicPrefix {
+		return ""
+	}
+
+	if _, err := uuid.Parse(levels[1]); err != nil {
+		return ""
+	}
+
+	return levels[1]
+}
+
+// Handler for command REST API
+// Response messages to use
+const (
+	// Success responses
+	resSendCommand = "command sent"
+
+	// Error responses
+	resInvalid            = "invalid format"
+	resInternal           = "internal error"
+	resControllerNotFound = "controller not found"
+)
+
+type Handler struct {
+	Bridge *Bridge
+}
+
+func (h *Handler) SendCommand(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	controllerId := ctx.Param("controllerId")
+	if _, err := uuid.Parse(controllerId); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	command := &Command{}
+	if err := ctx.ShouldBindJSON(command); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid, "err": err.Error()})
+		return
+	}
+
+	if err := h.Bridge.Repo.ControllerExist(ctx, userId, controllerId); err != nil {
+		if err == errControllerNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resControllerNotFound})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	command.CommandId = uuid.New().String()
+	if err := h.Bridge.PublishCommand(controllerId, command); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	ctx.JSON(http.StatusAccepted, gin.H{"message": resSendCommand, "result": command})
+}
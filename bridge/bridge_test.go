@@ -0,0 +1,319 @@
+package bridge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/tPhume/ags-backend/data"
+	"github.com/tPhume/ags-backend/plan"
+	"github.com/tPhume/ags-backend/session"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type mapping map[string]interface{}
+
+const (
+	controllerId = "f1d67e51-4ca4-4b25-a4b7-6c8f06822075"
+	userId       = "76de6d55-e457-4070-8aef-5633726d498f"
+	planId       = "ebd03d33-6659-4241-9e59-d8dad087cc34"
+	token        = "f911ec3e-7c28-4257-a9dd-99f1ff27704e"
+)
+
+// Repo struct for testing, has one controller with a plan that can be swapped
+type repoStruct struct {
+	plan *plan.Entity
+}
+
+func (r *repoStruct) GetToken(ctx context.Context, id string) (string, error) {
+	if id == controllerId {
+		return token, nil
+	}
+
+	return "", errControllerNotFound
+}
+
+func (r *repoStruct) ControllerExist(ctx context.Context, user string, id string) error {
+	if user == userId && id == controllerId {
+		return nil
+	}
+
+	return errControllerNotFound
+}
+
+func (r *repoStruct) GetControllerPlan(ctx context.Context, id string) (*plan.Entity, error) {
+	if id != controllerId {
+		return nil, errControllerNotFound
+	} else if r.plan == nil {
+		return nil, errNoPlan
+	}
+
+	return r.plan, nil
+}
+
+func (r *repoStruct) ListPlanControllers(ctx context.Context, user string, id string) ([]string, error) {
+	if r.plan != nil && id == r.plan.PlanId {
+		return []string{controllerId}, nil
+	}
+
+	return []string{}, nil
+}
+
+func (r *repoStruct) ListControllers(ctx context.Context) ([]string, error) {
+	return []string{controllerId}, nil
+}
+
+// Data repo struct for testing, records stored readings
+type dataRepoStruct struct {
+	readings []*data.Reading
+}
+
+func (d *dataRepoStruct) GetData(ctx context.Context, entity *data.Entity) error {
+	return nil
+}
+
+func (d *dataRepoStruct) GetUserController(ctx context.Context, user string, id string) (*data.Controller, error) {
+	return &data.Controller{ControllerId: controllerId, UserId: userId}, nil
+}
+
+func (d *dataRepoStruct) GetController(ctx context.Context, t string) (*data.Controller, error) {
+	return &data.Controller{ControllerId: controllerId, UserId: userId}, nil
+}
+
+func (d *dataRepoStruct) AddReadings(ctx context.Context, id string, user string, readings []*data.Reading) ([]*data.Reading, error) {
+	d.readings = append(d.readings, readings...)
+	return readings, nil
+}
+
+func (d *dataRepoStruct) GetSensorStates(ctx context.Context, id string) (map[string]*data.SensorState, int, error) {
+	return map[string]*data.SensorState{}, 0, nil
+}
+
+func (d *dataRepoStruct) SetSensorStates(ctx context.Context, id string, states map[string]*data.SensorState, version int) error {
+	return nil
+}
+
+func (d *dataRepoStruct) EachReading(ctx context.Context, userId string, controllerId string, from time.Time, to time.Time, fn func(*data.Reading) error) error {
+	return nil
+}
+
+func setUp() (*Bridge, *MemoryBroker, *repoStruct, *dataRepoStruct) {
+	broker := NewMemoryBroker()
+	repo := &repoStruct{plan: &plan.Entity{PlanId: planId, Name: "first"}}
+	dataRepo := &dataRepoStruct{}
+
+	b := &Bridge{Client: broker, Repo: repo, Data: &data.Handler{Repo: dataRepo}}
+	return b, broker, repo, dataRepo
+}
+
+// Test that a device always ends up with the current plan
+func TestBridge_PublishPlan(t *testing.T) {
+	b, broker, repo, _ := setUp()
+	if err := b.Start(context.Background()); err != nil {
+		t.Fatalf("could not start bridge: %v", err)
+	}
+
+	received := make([]planMessage, 0)
+	_ = broker.Subscribe(fmt.Sprintf(planTopic, controllerId), func(topic string, payload []byte) {
+		message := planMessage{}
+		if len(payload) != 0 {
+			_ = json.Unmarshal(payload, &message)
+		}
+
+		received = append(received, message)
+	})
+
+	repo.plan = &plan.Entity{PlanId: planId, Name: "second"}
+	b.PlanChanged(context.Background(), userId, planId)
+
+	repo.plan = nil
+	b.ControllerChanged(context.Background(), userId, controllerId)
+
+	expected := []string{"first", "second", ""}
+	if len(received) != len(expected) {
+		t.Fatalf("expected [%v] messages, got = [%v]", len(expected), len(received))
+	}
+
+	for i, name := range expected {
+		got := ""
+		if received[i].Result != nil {
+			got = received[i].Result.Name
+		}
+
+		if got != name {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, name, got)
+		}
+	}
+}
+
+// Test telemetry is only stored with the controller's own token
+func TestBridge_Telemetry(t *testing.T) {
+	b, broker, _, dataRepo := setUp()
+	if err := b.Start(context.Background()); err != nil {
+		t.Fatalf("could not start bridge: %v", err)
+	}
+
+	reading := mapping{"timestamp": time.Now().Add(-time.Minute), "temperature": 25, "humidity": 60}
+
+	testCases := []struct {
+		topic  string
+		in     mapping
+		stored int
+	}{
+		{
+			topic:  fmt.Sprintf("ags/%s/telemetry", controllerId),
+			in:     mapping{"token": token, "readings": []mapping{reading, reading}},
+			stored: 2,
+		}, {
+			topic:  fmt.Sprintf("ags/%s/telemetry", controllerId),
+			in:     mapping{"token": userId, "readings": []mapping{reading}},
+			stored: 2,
+		}, {
+			topic:  fmt.Sprintf("ags/%s/telemetry", userId),
+			in:     mapping{"token": token, "readings": []mapping{reading}},
+			stored: 2,
+		}, {
+			topic:  fmt.Sprintf("ags/%s/telemetry", controllerId),
+			in:     mapping{"token": token, "readings": []mapping{{"temperature": 500}}},
+			stored: 2,
+		},
+	}
+
+	for i, c := range testCases {
+		payload, _ := json.Marshal(c.in)
+		_ = broker.Publish(c.topic, false, payload)
+
+		if len(dataRepo.readings) != c.stored {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.stored, len(dataRepo.readings))
+		}
+	}
+}
+
+// Notifier struct for testing, records acknowledgements
+type notifierStruct struct {
+	acks []*Ack
+}
+
+func (n *notifierStruct) CommandAcknowledged(ctx context.Context, id string, ack *Ack) {
+	n.acks = append(n.acks, ack)
+}
+
+// Test acks are passed on without the token and only with the controller's own token
+func TestBridge_Ack(t *testing.T) {
+	b, broker, _, _ := setUp()
+	notifier := &notifierStruct{}
+	b.Notifier = notifier
+
+	if err := b.Start(context.Background()); err != nil {
+		t.Fatalf("could not start bridge: %v", err)
+	}
+
+	testCases := []struct {
+		in    mapping
+		acked int
+	}{
+		{in: mapping{"token": token, "command_id": planId, "status": "done"}, acked: 1},
+		{in: mapping{"token": userId, "command_id": planId, "status": "done"}, acked: 1},
+		{in: mapping{"token": token, "status": "done"}, acked: 1},
+	}
+
+	for i, c := range testCases {
+		payload, _ := json.Marshal(c.in)
+		_ = broker.Publish(fmt.Sprintf("ags/%s/ack", controllerId), false, payload)
+
+		if len(notifier.acks) != c.acked {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.acked, len(notifier.acks))
+		}
+	}
+
+	if notifier.acks[0].Token != "" || notifier.acks[0].Status != "done" {
+		t.Fatalf("unexpected ack [%v]", notifier.acks[0])
+	}
+}
+
+// Test SendCommand handler
+func TestHandler_SendCommand(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	// Action validation is registered by the plan package
+	plan.RegisterRoutes(&plan.Handler{}, gin.New(), &session.Handler{})
+
+	b, broker, _, _ := setUp()
+	commands := make([]Command, 0)
+	_ = broker.Subscribe("ags/+/cmd", func(topic string, payload []byte) {
+		command := Command{}
+		_ = json.Unmarshal(payload, &command)
+		commands = append(commands, command)
+	})
+
+	engine := gin.New()
+	engine.Use(func(ctx *gin.Context) {
+		ctx.Set("userId", userId)
+	})
+	engine.POST(":controllerId", (&Handler{Bridge: b}).SendCommand)
+
+	testCases := []struct {
+		controllerId string
+		in           mapping
+		message      string
+		code         int
+		sent         int
+	}{
+		{
+			controllerId: controllerId,
+			in:           mapping{"action": mapping{"type": "water", "level": 50, "duration": 30}},
+			message:      resSendCommand,
+			code:         http.StatusAccepted,
+			sent:         1,
+		}, {
+			controllerId: controllerId,
+			in:           mapping{"action": mapping{"type": "fertilise", "level": 50, "duration": 30}},
+			message:      resInvalid,
+			code:         http.StatusBadRequest,
+			sent:         1,
+		}, {
+			controllerId: "fewfe",
+			in:           mapping{"action": mapping{"type": "water", "level": 50, "duration": 30}},
+			message:      resInvalid,
+			code:         http.StatusBadRequest,
+			sent:         1,
+		}, {
+			controllerId: planId,
+			in:           mapping{"action": mapping{"type": "water", "level": 50, "duration": 30}},
+			message:      resControllerNotFound,
+			code:         http.StatusNotFound,
+			sent:         1,
+		},
+	}
+
+	for i, c := range testCases {
+		resp := httptest.NewRecorder()
+
+		body, _ := json.Marshal(c.in)
+		req, _ := http.NewRequest(http.MethodPost, "/"+c.controllerId, bytes.NewReader(body))
+		engine.ServeHTTP(resp, req)
+
+		respBody := mapping{}
+		_ = json.Unmarshal(resp.Body.Bytes(), &respBody)
+
+		if c.code != resp.Code {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.code, resp.Code)
+		}
+
+		if c.message != respBody["message"] {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.message, respBody["message"])
+		}
+
+		if len(commands) != c.sent {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.sent, len(commands))
+		}
+	}
+
+	if commands[0].CommandId == "" || commands[0].Action.Type != "water" {
+		t.Fatalf("expected water command with id, got = [%+v]", commands[0])
+	}
+}
@@ -0,0 +1,91 @@
+package bridge
+
+import (
+	"strings"
+	"sync"
+)
+
+// MemoryBroker is an in-process broker implementing Client
+// Messages are delivered synchronously to every matching subscription, retained messages are kept per topic
+// It exists so the bridge and the devices talking to it can be tested without a real broker
+type MemoryBroker struct {
+	mu            sync.Mutex
+	subscriptions []memorySubscription
+	retained      map[string][]byte
+}
+
+type memorySubscription struct {
+	filter  string
+	handler MessageHandler
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{retained: make(map[string][]byte)}
+}
+
+func (m *MemoryBroker) Subscribe(topic string, handler MessageHandler) error {
+	m.mu.Lock()
+	m.subscriptions = append(m.subscriptions, memorySubscription{filter: topic, handler: handler})
+
+	retained := make(map[string][]byte)
+	for t, payload := range m.retained {
+		if topicMatch(topic, t) {
+			retained[t] = payload
+		}
+	}
+	m.mu.Unlock()
+
+	for t, payload := range retained {
+		handler(t, payload)
+	}
+
+	return nil
+}
+
+func (m *MemoryBroker) Publish(topic string, retained bool, payload []byte) error {
+	m.mu.Lock()
+	if retained {
+		// Like MQTT, an empty retained payload removes the retained message
+		if len(payload) == 0 {
+			delete(m.retained, topic)
+		} else {
+			m.retained[topic] = payload
+		}
+	}
+
+	handlers := make([]MessageHandler, 0)
+	for _, subscription := range m.subscriptions {
+		if topicMatch(subscription.filter, topic) {
+			handlers = append(handlers, subscription.handler)
+		}
+	}
+	m.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(topic, payload)
+	}
+
+	return nil
+}
+
+// topicMatch reports whether topic matches filter, with + matching one level and # the remaining levels
+func topicMatch(filter string, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+
+		if i >= len(topicLevels) {
+			return false
+		}
+
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(filterLevels) == len(topicLevels)
+}
@@ -0,0 +1,108 @@
+package bridge
+
+import (
+	"context"
+	"github.com/tPhume/ags-backend/plan"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type MongoRepo struct {
+	ControllerCol *mongo.Collection
+	PlanCol       *mongo.Collection
+}
+
+func (m *MongoRepo) GetToken(ctx context.Context, controllerId string) (string, error) {
+	temp, err := m.getController(ctx, bson.M{"_id": controllerId})
+	if err != nil {
+		return "", err
+	}
+
+	return temp.Token, nil
+}
+
+func (m *MongoRepo) ControllerExist(ctx context.Context, userId string, controllerId string) error {
+	_, err := m.getController(ctx, bson.M{"_id": controllerId, "user_id": userId})
+	return err
+}
+
+func (m *MongoRepo) GetControllerPlan(ctx context.Context, controllerId string) (*plan.Entity, error) {
+	temp, err := m.getController(ctx, bson.M{"_id": controllerId})
+	if err != nil {
+		return nil, err
+	}
+
+	if temp.Plan == "" {
+		return nil, errNoPlan
+	}
+
+	result := m.PlanCol.FindOne(ctx, bson.M{"_id": temp.Plan, "user_id": temp.UserId})
+	if result.Err() != nil {
+		// A deleted plan leaves the controller without one
+		if result.Err() == mongo.ErrNoDocuments {
+			return nil, errNoPlan
+		}
+
+		return nil, result.Err()
+	}
+
+	entity := &plan.Entity{}
+	if err := result.Decode(entity); err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+func (m *MongoRepo) ListPlanControllers(ctx context.Context, userId string, planId string) ([]string, error) {
+	return m.listControllerIds(ctx, bson.M{"user_id": userId, "plan": planId})
+}
+
+func (m *MongoRepo) ListControllers(ctx context.Context) ([]string, error) {
+	return m.listControllerIds(ctx, bson.M{"plan": bson.M{"$ne": ""}})
+}
+
+func (m *MongoRepo) getController(ctx context.Context, filter bson.M) (*controllerResult, error) {
+	result := m.ControllerCol.FindOne(ctx, filter)
+	if result.Err() != nil {
+		if result.Err() == mongo.ErrNoDocuments {
+			return nil, errControllerNotFound
+		}
+
+		return nil, result.Err()
+	}
+
+	temp := &controllerResult{}
+	if err := result.Decode(temp); err != nil {
+		return nil, err
+	}
+
+	return temp, nil
+}
+
+func (m *MongoRepo) listControllerIds(ctx context.Context, filter bson.M) ([]string, error) {
+	cursor, err := m.ControllerCol.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	controllerIds := make([]string, 0)
+	for cursor.Next(ctx) {
+		temp := &controllerResult{}
+		if err := cursor.Decode(temp); err != nil {
+			return nil, err
+		}
+
+		controllerIds = append(controllerIds, temp.ControllerId)
+	}
+
+	return controllerIds, cursor.Err()
+}
+
+type controllerResult struct {
+	ControllerId string `bson:"_id"`
+	UserId       string `bson:"user_id"`
+	Plan         string `bson:"plan"`
+	Token        string `bson:"token"`
+}
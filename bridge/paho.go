@@ -0,0 +1,93 @@
+package bridge
+
+import (
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"log"
+	"sync"
+	"time"
+)
+
+// Quality of service used for every subscription and publish
+const qos = 1
+
+// How long to wait for the broker to acknowledge a subscribe or publish
+const pahoTimeout = 10 * time.Second
+
+// PahoClient implements Client for a real broker
+// Subscriptions are remembered and renewed whenever the connection comes back
+type PahoClient struct {
+	client mqtt.Client
+
+	mu            sync.Mutex
+	subscriptions map[string]MessageHandler
+}
+
+// NewPahoClient connects to the broker at uri, e.g. tcp://localhost:1883
+func NewPahoClient(uri string, clientId string, username string, password string) (*PahoClient, error) {
+	p := &PahoClient{subscriptions: make(map[string]MessageHandler)}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(uri).
+		SetClientID(clientId).
+		SetUsername(username).
+		SetPassword(password).
+		SetAutoReconnect(true).
+		SetOnConnectHandler(p.resubscribe).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			log.Printf("bridge: lost connection to broker: %s", err)
+		})
+
+	p.client = mqtt.NewClient(opts)
+
+	token := p.client.Connect()
+	if !token.WaitTimeout(pahoTimeout) {
+		return nil, mqtt.ErrNotConnected
+	}
+
+	if err := token.Error(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *PahoClient) Subscribe(topic string, handler MessageHandler) error {
+	p.mu.Lock()
+	p.subscriptions[topic] = handler
+	p.mu.Unlock()
+
+	return wait(p.client.Subscribe(topic, qos, wrap(handler)))
+}
+
+func (p *PahoClient) Publish(topic string, retained bool, payload []byte) error {
+	return wait(p.client.Publish(topic, qos, retained, payload))
+}
+
+func (p *PahoClient) Disconnect() {
+	p.client.Disconnect(uint(pahoTimeout / time.Millisecond))
+}
+
+func (p *PahoClient) resubscribe(client mqtt.Client) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for topic, handler := range p.subscriptions {
+		if err := wait(client.Subscribe(topic, qos, wrap(handler))); err != nil {
+			log.Printf("bridge: could not resubscribe to %s: %s", topic, err)
+		}
+	}
+}
+
+func wrap(handler MessageHandler) mqtt.MessageHandler {
+	return func(client mqtt.Client, message mqtt.Message) {
+		handler(message.Topic(), message.Payload())
+	}
+}
+
+func wait(token mqtt.Token) error {
+	if !token.WaitTimeout(pahoTimeout) {
+		return mqtt.ErrNotConnected
+	}
+
+	return token.Error()
+}
@@ -0,0 +1,286 @@
+// Package calendar renders plan schedules as iCalendar (RFC 5545) feeds
+// Feeds are either fetched with a session or through a revocable subscription token
+package calendar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/tPhume/ags-backend/lookup"
+	"github.com/tPhume/ags-backend/plan"
+	"github.com/tPhume/ags-backend/session"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func RegisterRoutes(handler *Handler, engine *gin.Engine, sessionHandler *session.Handler) {
+	// Calendar applications can't send a session header so the token is part of the path
+	engine.GET("api-calendar/v1/:token/calendar.ics", handler.GetFeed)
+
+	engine.GET("api/v1/plan/:planId/calendar.ics", sessionHandler.GetUser, handler.GetPlanCalendar)
+	engine.GET("api/v1/controller/:controllerId/calendar.ics", sessionHandler.GetUser, handler.GetControllerCalendar)
+
+	group := engine.Group("api/v1/calendar")
+	group.Use(sessionHandler.GetUser)
+
+	group.POST("", handler.CreateSubscription)
+	group.GET("", handler.ListSubscriptions)
+	group.DELETE(":subscriptionId", handler.DeleteSubscription)
+}
+
+// Subscription gives access to the calendar of a plan, or of whichever plan a controller is assigned, without a session
+type Subscription struct {
+	SubscriptionId string `json:"subscription_id" bson:"_id"`
+	UserId         string `json:"-" bson:"user_id"`
+	PlanId         string `json:"plan_id,omitempty" bson:"plan_id,omitempty" binding:"omitempty,uuid4"`
+	ControllerId   string `json:"controller_id,omitempty" bson:"controller_id,omitempty" binding:"omitempty,uuid4"`
+	Token          string `json:"token" bson:"token"`
+	Url            string `json:"url" bson:"-"`
+}
+
+// Repo interface for data source
+// Errors that should be used with Repo interface
+var (
+	errPlanNotFound         = lookup.ErrPlanNotFound
+	errControllerNotFound   = lookup.ErrControllerNotFound
+	errNoPlan               = errors.New("no plan set")
+	errSubscriptionNotFound = errors.New("subscription not found")
+)
+
+type Repo interface {
+	lookup.Plans
+
+	// GetControllerPlan fetches the plan currently assigned to the controller owned by userId
+	GetControllerPlan(ctx context.Context, userId string, controllerId string) (*plan.Entity, error)
+
+	lookup.Timezones
+
+	CreateSubscription(ctx context.Context, subscription *Subscription) error
+
+	ListSubscriptions(ctx context.Context, userId string) ([]*Subscription, error)
+
+	DeleteSubscription(ctx context.Context, userId string, subscriptionId string) error
+
+	// GetSubscription finds the subscription that owns the token
+	GetSubscription(ctx context.Context, token string) (*Subscription, error)
+}
+
+// Handler for Calendar endpoint
+// Response messages to use
+const (
+	// Success responses
+	resCreateSubscription = "calendar subscription created"
+	resListSubscriptions  = "list of calendar subscriptions retrieved"
+	resDeleteSubscription = "calendar subscription revoked"
+
+	// Error responses
+	resInvalid               = "invalid format"
+	resInternal              = "internal error"
+	resPlanNotFound          = "plan not found"
+	resControllerNotFound    = "controller not found"
+	resNoPlan                = "no plan set"
+	resSubscriptionNotFound  = "calendar subscription not found"
+	resSubscriptionAmbiguous = "exactly one of plan_id or controller_id is required"
+)
+
+const (
+	calendarContentType        = "text/calendar; charset=utf-8"
+	calendarContentDisposition = `inline; filename="calendar.ics"`
+)
+
+type Handler struct {
+	Repo Repo
+
+	// BaseUrl is prepended to subscription paths, e.g. https://ags.example.com
+	BaseUrl string
+}
+
+func (h *Handler) GetPlanCalendar(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	planId := ctx.Param("planId")
+	if _, err := uuid.Parse(planId); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	h.writeCalendar(ctx, &Subscription{UserId: userId, PlanId: planId})
+}
+
+func (h *Handler) GetControllerCalendar(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	controllerId := ctx.Param("controllerId")
+	if _, err := uuid.Parse(controllerId); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	h.writeCalendar(ctx, &Subscription{UserId: userId, ControllerId: controllerId})
+}
+
+// GetFeed serves the calendar of a subscription to calendar applications
+func (h *Handler) GetFeed(ctx *gin.Context) {
+	token := ctx.Param("token")
+	if _, err := uuid.Parse(token); err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"message": resSubscriptionNotFound})
+		return
+	}
+
+	subscription, err := h.Repo.GetSubscription(ctx, token)
+	if err != nil {
+		if err == errSubscriptionNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resSubscriptionNotFound})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	h.writeCalendar(ctx, subscription)
+}
+
+func (h *Handler) CreateSubscription(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	subscription := &Subscription{}
+	if err := ctx.ShouldBindJSON(subscription); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	if (subscription.PlanId == "") == (subscription.ControllerId == "") {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resSubscriptionAmbiguous})
+		return
+	}
+
+	subscription.SubscriptionId = uuid.New().String()
+	subscription.UserId = userId
+	subscription.Token = uuid.New().String()
+
+	// Make sure the target exists and belongs to the user before handing out a token
+	if _, err := h.getPlan(ctx, subscription); err != nil && err != errNoPlan {
+		h.writeError(ctx, err)
+		return
+	}
+
+	if err := h.Repo.CreateSubscription(ctx, subscription); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	subscription.Url = h.feedUrl(subscription.Token)
+	ctx.JSON(http.StatusCreated, gin.H{"message": resCreateSubscription, "result": subscription})
+}
+
+func (h *Handler) ListSubscriptions(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	subscriptions, err := h.Repo.ListSubscriptions(ctx, userId)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	for _, subscription := range subscriptions {
+		subscription.Url = h.feedUrl(subscription.Token)
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resListSubscriptions, "result": subscriptions})
+}
+
+// DeleteSubscription revokes the token, the feed stops working immediately
+func (h *Handler) DeleteSubscription(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	subscriptionId := ctx.Param("subscriptionId")
+	if _, err := uuid.Parse(subscriptionId); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	if err := h.Repo.DeleteSubscription(ctx, userId, subscriptionId); err != nil {
+		if err == errSubscriptionNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resSubscriptionNotFound})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resDeleteSubscription})
+}
+
+// writeCalendar renders the plan targeted by subscription in the owner's timezone
+func (h *Handler) writeCalendar(ctx *gin.Context, subscription *Subscription) {
+	entity, err := h.getPlan(ctx, subscription)
+	if err != nil {
+		h.writeError(ctx, err)
+		return
+	}
+
+	timezone, err := h.Repo.GetTimezone(ctx, subscription.UserId)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	ctx.Header("Content-Disposition", calendarContentDisposition)
+	ctx.Data(http.StatusOK, calendarContentType, renderPlan(entity, loc, time.Now()))
+}
+
+func (h *Handler) getPlan(ctx context.Context, subscription *Subscription) (*plan.Entity, error) {
+	if subscription.ControllerId != "" {
+		return h.Repo.GetControllerPlan(ctx, subscription.UserId, subscription.ControllerId)
+	}
+
+	return h.Repo.GetPlan(ctx, subscription.UserId, subscription.PlanId)
+}
+
+func (h *Handler) writeError(ctx *gin.Context, err error) {
+	switch err {
+	case errPlanNotFound:
+		ctx.JSON(http.StatusNotFound, gin.H{"message": resPlanNotFound})
+	case errControllerNotFound:
+		ctx.JSON(http.StatusNotFound, gin.H{"message": resControllerNotFound})
+	case errNoPlan:
+		ctx.JSON(http.StatusNotFound, gin.H{"message": resNoPlan})
+	default:
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+	}
+}
+
+func (h *Handler) feedUrl(token string) string {
+	return fmt.Sprintf("%s/api-calendar/v1/%s/calendar.ics", strings.TrimSuffix(h.BaseUrl, "/"), token)
+}
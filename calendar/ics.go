@@ -0,0 +1,265 @@
+package calendar
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/tPhume/ags-backend/plan"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	prodId        = "-//AGS//Plan Calendar//EN"
+	maxLineOctets = 75
+
+	localFormat = "20060102T150405"
+	utcFormat   = "20060102T150405Z"
+)
+
+// Weekday used by RRULE BYDAY, indexed the same as time.Weekday and weekly_time
+var byDay = [...]string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+
+// icsWriter writes content lines with RFC 5545 folding and CRLF endings
+type icsWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *icsWriter) line(name string, value string) {
+	content := name + ":" + value
+
+	// Continuation lines start with a space which counts towards the limit
+	limit := maxLineOctets
+	for len(content) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(content[cut]) {
+			cut--
+		}
+
+		w.buf.WriteString(content[:cut])
+		w.buf.WriteString("\r\n ")
+		content = content[cut:]
+		limit = maxLineOctets - 1
+	}
+
+	w.buf.WriteString(content)
+	w.buf.WriteString("\r\n")
+}
+
+// escapeText escapes a TEXT value as described in RFC 5545 section 3.3.11
+func escapeText(value string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		";", `\;`,
+		",", `\,`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+	).Replace(value)
+}
+
+// renderPlan returns an iCalendar document with one recurring event per routine in the plan
+// Routine times are interpreted in loc and each recurrence is anchored at the current day or month
+func renderPlan(entity *plan.Entity, loc *time.Location, now time.Time) []byte {
+	w := &icsWriter{}
+	local := now.In(loc)
+	stamp := now.UTC().Format(utcFormat)
+
+	w.line("BEGIN", "VCALENDAR")
+	w.line("VERSION", "2.0")
+	w.line("PRODID", prodId)
+	w.line("CALSCALE", "GREGORIAN")
+	w.line("METHOD", "PUBLISH")
+	w.line("X-WR-CALNAME", escapeText(entity.Name))
+	w.line("X-WR-TIMEZONE", loc.String())
+
+	writeTimezone(w, loc, local.Year())
+
+	for i, daily := range entity.Daily {
+		hour, minute := splitTime(daily.DailyTime)
+		start := nextDaily(local, hour, minute)
+
+		writeEvent(w, entity, "daily", i, daily.Action, start, "FREQ=DAILY", stamp)
+	}
+
+	for i, weekly := range entity.Weekly {
+		values := splitTimeValues(weekly.WeeklyTime)
+		start := nextWeekly(local, time.Weekday(values[0]), values[1], values[2])
+
+		writeEvent(w, entity, "weekly", i, weekly.Action, start, "FREQ=WEEKLY;BYDAY="+byDay[values[0]], stamp)
+	}
+
+	for i, monthly := range entity.Monthly {
+		values := splitTimeValues(monthly.MonthlyTime)
+		start := nextMonthly(local, values[0], values[1], values[2])
+
+		// A date of 0 behaves like time.Date and lands on the last day of the month
+		monthDay := strconv.Itoa(values[0])
+		if values[0] == 0 {
+			monthDay = "-1"
+		}
+
+		writeEvent(w, entity, "monthly", i, monthly.Action, start, "FREQ=MONTHLY;BYMONTHDAY="+monthDay, stamp)
+	}
+
+	w.line("END", "VCALENDAR")
+
+	return w.buf.Bytes()
+}
+
+func writeEvent(w *icsWriter, entity *plan.Entity, kind string, index int, action plan.Action, start time.Time, rule string, stamp string) {
+	summary := fmt.Sprintf("%s (level %d%%)", strings.Title(action.Type), action.Level)
+	desc := fmt.Sprintf("%s %s at level %d%% for %d seconds", entity.Name, action.Type, action.Level, action.Duration)
+
+	w.line("BEGIN", "VEVENT")
+	w.line("UID", fmt.Sprintf("%s-%s-%d@ags", entity.PlanId, kind, index))
+	w.line("DTSTAMP", stamp)
+	w.line("DTSTART;TZID="+start.Location().String(), start.Format(localFormat))
+
+	if action.Duration > 0 {
+		w.line("DURATION", fmt.Sprintf("PT%dS", action.Duration))
+	}
+
+	w.line("RRULE", rule)
+	w.line("SUMMARY", escapeText(summary))
+	w.line("DESCRIPTION", escapeText(desc))
+	w.line("CATEGORIES", strings.ToUpper(action.Type))
+	w.line("END", "VEVENT")
+}
+
+// writeTimezone writes a VTIMEZONE for loc using the transitions observed in year
+func writeTimezone(w *icsWriter, loc *time.Location, year int) {
+	w.line("BEGIN", "VTIMEZONE")
+	w.line("TZID", loc.String())
+
+	transitions := findTransitions(loc, year)
+	if len(transitions) == 0 {
+		name, offset := time.Date(year, time.January, 1, 0, 0, 0, 0, loc).Zone()
+
+		w.line("BEGIN", "STANDARD")
+		w.line("DTSTART", "19700101T000000")
+		w.line("TZOFFSETFROM", formatOffset(offset))
+		w.line("TZOFFSETTO", formatOffset(offset))
+		w.line("TZNAME", escapeText(name))
+		w.line("END", "STANDARD")
+	}
+
+	for _, t := range transitions {
+		_, before := t.Add(-time.Second).In(loc).Zone()
+		name, after := t.In(loc).Zone()
+
+		component := "STANDARD"
+		if after > before {
+			component = "DAYLIGHT"
+		}
+
+		// DTSTART of an observance is the wall clock time before the change
+		wall := t.UTC().Add(time.Duration(before) * time.Second)
+
+		w.line("BEGIN", component)
+		w.line("DTSTART", wall.Format(localFormat))
+		w.line("RRULE", yearlyRule(t.In(loc)))
+		w.line("TZOFFSETFROM", formatOffset(before))
+		w.line("TZOFFSETTO", formatOffset(after))
+		w.line("TZNAME", escapeText(name))
+		w.line("END", component)
+	}
+
+	w.line("END", "VTIMEZONE")
+}
+
+// findTransitions returns the instants in year at which loc changes its UTC offset
+func findTransitions(loc *time.Location, year int) []time.Time {
+	transitions := make([]time.Time, 0, 2)
+
+	day := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+	_, offset := day.In(loc).Zone()
+
+	for day.Year() == year {
+		next := day.Add(24 * time.Hour)
+		if _, nextOffset := next.In(loc).Zone(); nextOffset != offset {
+			// Narrow down to the second within the day
+			low, high := day, next
+			for high.Sub(low) > time.Second {
+				mid := low.Add(high.Sub(low) / 2)
+				if _, midOffset := mid.In(loc).Zone(); midOffset == offset {
+					low = mid
+				} else {
+					high = mid
+				}
+			}
+
+			transitions = append(transitions, high)
+			offset = nextOffset
+		}
+
+		day = next
+	}
+
+	return transitions
+}
+
+// yearlyRule describes a transition such as "second Sunday of March" or "last Sunday of October"
+func yearlyRule(t time.Time) string {
+	nth := strconv.Itoa((t.Day()-1)/7 + 1)
+	if t.AddDate(0, 0, 7).Month() != t.Month() {
+		nth = "-1"
+	}
+
+	return fmt.Sprintf("FREQ=YEARLY;BYMONTH=%d;BYDAY=%s%s", t.Month(), nth, byDay[t.Weekday()])
+}
+
+func formatOffset(seconds int) string {
+	sign := "+"
+	if seconds < 0 {
+		sign = "-"
+		seconds = -seconds
+	}
+
+	return fmt.Sprintf("%s%02d%02d", sign, seconds/3600, seconds%3600/60)
+}
+
+// Routine times are validated by the plan package before being stored
+func splitTime(value string) (int, int) {
+	values := splitTimeValues(value)
+	return values[0], values[1]
+}
+
+func splitTimeValues(value string) []int {
+	parts := strings.Split(value, ":")
+	values := make([]int, len(parts))
+
+	for i, part := range parts {
+		values[i], _ = strconv.Atoi(part)
+	}
+
+	return values
+}
+
+func nextDaily(now time.Time, hour int, minute int) time.Time {
+	return time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+}
+
+func nextWeekly(now time.Time, weekday time.Weekday, hour int, minute int) time.Time {
+	days := (int(weekday) - int(now.Weekday()) + 7) % 7
+	return time.Date(now.Year(), now.Month(), now.Day()+days, hour, minute, 0, 0, now.Location())
+}
+
+func nextMonthly(now time.Time, date int, hour int, minute int) time.Time {
+	year, month := now.Year(), now.Month()
+
+	for {
+		first := time.Date(year, month, 1, 0, 0, 0, 0, now.Location())
+		last := first.AddDate(0, 1, -1).Day()
+
+		if date == 0 {
+			return time.Date(year, month, last, hour, minute, 0, 0, now.Location())
+		} else if date <= last {
+			return time.Date(year, month, date, hour, minute, 0, 0, now.Location())
+		}
+
+		// Months without that date are skipped, the same as BYMONTHDAY does
+		next := first.AddDate(0, 1, 0)
+		year, month = next.Year(), next.Month()
+	}
+}
@@ -0,0 +1,123 @@
+package calendar
+
+import (
+	"github.com/tPhume/ags-backend/plan"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testPlan = &plan.Entity{
+	PlanId: "f1d67e51-4ca4-4b25-a4b7-6c8f06822075",
+	Name:   "Tomatoes, greenhouse; north",
+	Daily: []plan.Daily{
+		{DailyTime: "06:30", Action: plan.Action{Type: "water", Level: 50, Duration: 30}},
+	},
+	Weekly: []plan.Weekly{
+		{WeeklyTime: "1:08:00", Action: plan.Action{Type: "light", Level: 100, Duration: 3600}},
+	},
+	Monthly: []plan.Monthly{
+		{MonthlyTime: "0:12:00", Action: plan.Action{Type: "water", Level: 80, Duration: 0}},
+	},
+}
+
+// Test renderPlan output against expected content lines
+func TestRenderPlan(t *testing.T) {
+	now := time.Date(2020, time.April, 15, 10, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		timezone string
+		lines    []string
+	}{
+		{
+			timezone: "America/New_York",
+			lines: []string{
+				"X-WR-CALNAME:Tomatoes\\, greenhouse\\; north",
+				"TZID:America/New_York",
+				"BEGIN:DAYLIGHT",
+				"DTSTART:20200308T020000",
+				"RRULE:FREQ=YEARLY;BYMONTH=3;BYDAY=2SU",
+				"TZOFFSETFROM:-0500",
+				"TZOFFSETTO:-0400",
+				"BEGIN:STANDARD",
+				"DTSTART:20201101T020000",
+				"RRULE:FREQ=YEARLY;BYMONTH=11;BYDAY=1SU",
+				"DTSTART;TZID=America/New_York:20200415T063000",
+				"RRULE:FREQ=DAILY",
+				"DURATION:PT30S",
+				"DTSTART;TZID=America/New_York:20200420T080000",
+				"RRULE:FREQ=WEEKLY;BYDAY=MO",
+				"DTSTART;TZID=America/New_York:20200430T120000",
+				"RRULE:FREQ=MONTHLY;BYMONTHDAY=-1",
+				"UID:f1d67e51-4ca4-4b25-a4b7-6c8f06822075-daily-0@ags",
+				"DTSTAMP:20200415T100000Z",
+			},
+		}, {
+			timezone: "Europe/London",
+			lines: []string{
+				"RRULE:FREQ=YEARLY;BYMONTH=3;BYDAY=-1SU",
+				"RRULE:FREQ=YEARLY;BYMONTH=10;BYDAY=-1SU",
+				"DTSTART:20200329T010000",
+				"DTSTART:20201025T020000",
+			},
+		}, {
+			timezone: "Asia/Bangkok",
+			lines: []string{
+				"DTSTART:19700101T000000",
+				"TZOFFSETFROM:+0700",
+				"TZOFFSETTO:+0700",
+				"DTSTART;TZID=Asia/Bangkok:20200415T063000",
+			},
+		},
+	}
+
+	for i, c := range testCases {
+		loc, err := time.LoadLocation(c.timezone)
+		if err != nil {
+			t.Fatalf("Case %d: could not load location: %v", i, err)
+		}
+
+		out := string(renderPlan(testPlan, loc, now))
+		if !strings.HasSuffix(out, "END:VCALENDAR\r\n") {
+			t.Fatalf("Case %d: expected CRLF terminated calendar", i)
+		}
+
+		lines := strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n")
+		for _, line := range lines {
+			if len(line) > maxLineOctets {
+				t.Fatalf("Case %d: line is not folded [%v]", i, line)
+			}
+		}
+
+		for _, expected := range c.lines {
+			found := false
+			for _, line := range lines {
+				if line == expected {
+					found = true
+					break
+				}
+			}
+
+			if !found {
+				t.Fatalf("Case %d: expected line [%v], got = [%v]", i, expected, out)
+			}
+		}
+	}
+}
+
+// Test long lines are folded without splitting a UTF-8 sequence
+func TestLineFolding(t *testing.T) {
+	w := &icsWriter{}
+	w.line("SUMMARY", strings.Repeat("ผัก", 40))
+
+	unfolded := strings.Replace(strings.TrimSuffix(w.buf.String(), "\r\n"), "\r\n ", "", -1)
+	if unfolded != "SUMMARY:"+strings.Repeat("ผัก", 40) {
+		t.Fatalf("expected [%v], got = [%v]", "SUMMARY:"+strings.Repeat("ผัก", 40), unfolded)
+	}
+
+	for _, line := range strings.Split(w.buf.String(), "\r\n") {
+		if len(line) > maxLineOctets {
+			t.Fatalf("expected at most %d octets, got = [%v]", maxLineOctets, len(line))
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package calendar
+
+import (
+	"context"
+	"github.com/tPhume/ags-backend/lookup"
+	"github.com/tPhume/ags-backend/plan"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type MongoRepo struct {
+	Col    *mongo.Collection
+	Lookup *lookup.MongoRepo
+}
+
+func (m *MongoRepo) GetPlan(ctx context.Context, userId string, planId string) (*plan.Entity, error) {
+	return m.Lookup.GetPlan(ctx, userId, planId)
+}
+
+func (m *MongoRepo) GetControllerPlan(ctx context.Context, userId string, controllerId string) (*plan.Entity, error) {
+	temp := &controllerResult{}
+	if err := m.Lookup.FindController(ctx, userId, controllerId, temp); err != nil {
+		return nil, err
+	}
+
+	if temp.Plan == "" {
+		return nil, errNoPlan
+	}
+
+	return m.GetPlan(ctx, userId, temp.Plan)
+}
+
+func (m *MongoRepo) GetTimezone(ctx context.Context, userId string) (string, error) {
+	return m.Lookup.GetTimezone(ctx, userId)
+}
+
+func (m *MongoRepo) CreateSubscription(ctx context.Context, subscription *Subscription) error {
+	if _, err := m.Col.InsertOne(ctx, subscription); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (m *MongoRepo) ListSubscriptions(ctx context.Context, userId string) ([]*Subscription, error) {
+	cursor, err := m.Col.Find(ctx, bson.M{"user_id": userId})
+	if err != nil {
+		return nil, err
+	}
+
+	subscriptions := make([]*Subscription, 0)
+	if err := cursor.All(ctx, &subscriptions); err != nil {
+		return nil, err
+	}
+
+	return subscriptions, nil
+}
+
+func (m *MongoRepo) DeleteSubscription(ctx context.Context, userId string, subscriptionId string) error {
+	result, err := m.Col.DeleteOne(ctx, bson.M{"_id": subscriptionId, "user_id": userId})
+	if err != nil {
+		return err
+	} else if result.DeletedCount == 0 {
+		return errSubscriptionNotFound
+	}
+
+	return nil
+}
+
+func (m *MongoRepo) GetSubscription(ctx context.Context, token string) (*Subscription, error) {
+	result := m.Col.FindOne(ctx, bson.M{"token": token})
+	if result.Err() != nil {
+		if result.Err() == mongo.ErrNoDocuments {
+			return nil, errSubscriptionNotFound
+		}
+
+		return nil, result.Err()
+	}
+
+	subscription := &Subscription{}
+	if err := result.Decode(subscription); err != nil {
+		return nil, err
+	}
+
+	return subscription, nil
+}
+
+type controllerResult struct {
+	Plan string `bson:"plan"`
+}
@@ -0,0 +1,151 @@
+// Package wiring puts together what more than one command needs, so that every command builds it the same way
+package wiring
+
+import (
+	"errors"
+	"github.com/go-redis/redis/v7"
+	"github.com/spf13/viper"
+	"github.com/tPhume/ags-backend/alert"
+	"github.com/tPhume/ags-backend/data"
+	"github.com/tPhume/ags-backend/lookup"
+	"github.com/tPhume/ags-backend/notification"
+	"github.com/tPhume/ags-backend/outbound"
+	"github.com/tPhume/ags-backend/stream"
+	"github.com/tPhume/ags-backend/webhook"
+	"go.mongodb.org/mongo-driver/mongo"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// Readings is what stored readings go through, the HTTP endpoint, the MQTT bridge and the AMQP consumer share it
+type Readings struct {
+	// Handler stores readings and tells the live stream, alerts and webhooks about them
+	Handler *data.Handler
+	Repo    *data.MongoRepo
+
+	Stream *stream.Stream
+
+	WebhookRepo *webhook.MongoRepo
+	Webhooks    *webhook.Dispatcher
+
+	AlertRepo     *alert.MongoRepo
+	AlertChannels map[string]alert.Channel
+	Alerts        *alert.Evaluator
+
+	// AlertMailer is nil when SMTP_ADDR is not set
+	AlertMailer alert.Mailer
+
+	NotificationRepo   *notification.MongoRepo
+	NotificationPolicy notification.Policy
+}
+
+// NotificationPolicy reads how long notifications are kept from Viper
+// They are kept NOTIFICATION_UNREAD_DAYS, or NOTIFICATION_READ_DAYS once read if that is sooner
+func NotificationPolicy() notification.Policy {
+	viper.SetDefault("NOTIFICATION_UNREAD_DAYS", 90)
+	viper.SetDefault("NOTIFICATION_READ_DAYS", 30)
+
+	return notification.Policy{
+		UnreadDays: viper.GetInt("NOTIFICATION_UNREAD_DAYS"),
+		ReadDays:   viper.GetInt("NOTIFICATION_READ_DAYS"),
+	}
+}
+
+// NewReadings reads the config of webhooks, notifications and SMTP from Viper
+// Only the parts are built, the commands that run their loops start them
+func NewReadings(db *mongo.Database, redisClient *redis.Client) (*Readings, error) {
+	// Due webhook deliveries are looked for every WEBHOOK_INTERVAL, up to WEBHOOK_WORKERS at once
+	// and kept WEBHOOK_DELIVERY_DAYS once they succeed or fail
+	viper.SetDefault("WEBHOOK_INTERVAL", 5*time.Second)
+	viper.SetDefault("WEBHOOK_WORKERS", 8)
+	viper.SetDefault("WEBHOOK_DELIVERY_DAYS", 30)
+
+	r := &Readings{}
+	controllerCol := db.Collection("controller")
+
+	r.Repo = &data.MongoRepo{
+		Col:           db.Collection("data"),
+		BucketCol:     db.Collection("reading_bucket"),
+		RollupCol:     db.Collection("reading_hourly"),
+		ControllerCol: controllerCol,
+	}
+
+	// Events go through Redis so that every replica can serve every stream
+	r.Stream = &stream.Stream{Broker: &stream.RedisBroker{Client: redisClient}}
+
+	r.WebhookRepo = &webhook.MongoRepo{
+		Col:         db.Collection("webhook"),
+		DeliveryCol: db.Collection("webhook_delivery"),
+	}
+
+	r.Webhooks = &webhook.Dispatcher{
+		Repo:      r.WebhookRepo,
+		Client:    outbound.NewClient(10 * time.Second),
+		Interval:  viper.GetDuration("WEBHOOK_INTERVAL"),
+		Workers:   viper.GetInt("WEBHOOK_WORKERS"),
+		Retention: time.Duration(viper.GetInt("WEBHOOK_DELIVERY_DAYS")) * 24 * time.Hour,
+	}
+
+	r.NotificationRepo = &notification.MongoRepo{
+		Col:            db.Collection("notification"),
+		PreferencesCol: db.Collection("notification_preference"),
+	}
+
+	r.NotificationPolicy = NotificationPolicy()
+
+	r.AlertRepo = &alert.MongoRepo{
+		Col:           db.Collection("alert"),
+		SettingsCol:   db.Collection("alert_setting"),
+		OfflineCol:    db.Collection("offline"),
+		EmailCol:      db.Collection("alert_email"),
+		ControllerCol: controllerCol,
+		Lookup:        &lookup.MongoRepo{ControllerCol: controllerCol, PlanCol: db.Collection("plan"), UserCol: db.Collection("user")},
+	}
+
+	channels, err := alertChannels(&notification.Inbox{Repo: r.NotificationRepo, Policy: r.NotificationPolicy})
+	if err != nil {
+		return nil, err
+	}
+
+	r.AlertChannels = channels
+	if mailer, ok := channels[alert.ChannelEmail].(alert.Mailer); ok {
+		r.AlertMailer = mailer
+	}
+	r.Alerts = &alert.Evaluator{Repo: r.AlertRepo, Channels: channels, Publisher: r.Webhooks}
+
+	r.Handler = &data.Handler{Repo: r.Repo, Notifier: data.Notifiers{r.Stream, r.Alerts, r.Webhooks}}
+
+	return r, nil
+}
+
+// alertChannels has email only when SMTP_ADDR is set
+func alertChannels(inbox *notification.Inbox) (map[string]alert.Channel, error) {
+	channels := map[string]alert.Channel{
+		alert.ChannelWebhook: &alert.WebhookChannel{Client: outbound.NewClient(10 * time.Second)},
+		alert.ChannelInbox:   &alert.InboxChannel{Inbox: inbox},
+	}
+
+	smtpAddr := viper.GetString("SMTP_ADDR")
+	if smtpAddr == "" {
+		return channels, nil
+	}
+
+	smtpFrom := viper.GetString("SMTP_FROM")
+	if smtpFrom == "" {
+		return nil, errors.New("SMTP_FROM is needed with SMTP_ADDR")
+	}
+
+	var smtpAuth smtp.Auth
+	if smtpUsername := viper.GetString("SMTP_USERNAME"); smtpUsername != "" {
+		smtpHost, _, err := net.SplitHostPort(smtpAddr)
+		if err != nil {
+			return nil, err
+		}
+
+		smtpAuth = smtp.PlainAuth("", smtpUsername, viper.GetString("SMTP_PASSWORD"), smtpHost)
+	}
+
+	channels[alert.ChannelEmail] = &alert.EmailChannel{Addr: smtpAddr, From: smtpFrom, Auth: smtpAuth}
+	return channels, nil
+}
@@ -7,11 +7,27 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v7"
 	"github.com/spf13/viper"
+	"github.com/tPhume/ags-backend/action"
+	"github.com/tPhume/ags-backend/alert"
+	"github.com/tPhume/ags-backend/anomaly"
+	"github.com/tPhume/ags-backend/bridge"
+	"github.com/tPhume/ags-backend/calendar"
+	"github.com/tPhume/ags-backend/cmd/internal/wiring"
+	"github.com/tPhume/ags-backend/compliance"
+	"github.com/tPhume/ags-backend/consumption"
 	"github.com/tPhume/ags-backend/controller"
 	"github.com/tPhume/ags-backend/data"
+	"github.com/tPhume/ags-backend/lookup"
+	"github.com/tPhume/ags-backend/metric"
+	"github.com/tPhume/ags-backend/notification"
+	"github.com/tPhume/ags-backend/outbox"
 	"github.com/tPhume/ags-backend/plan"
+	"github.com/tPhume/ags-backend/report"
+	"github.com/tPhume/ags-backend/retention"
 	"github.com/tPhume/ags-backend/session"
+	"github.com/tPhume/ags-backend/stream"
 	"github.com/tPhume/ags-backend/summary"
+	"github.com/tPhume/ags-backend/webhook"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"log"
@@ -35,6 +51,44 @@ func main() {
 	clientSecret := viper.GetString("CLIENT_SECRET")
 	redirectUri := viper.GetString("REDIRECT_URI")
 
+	publicUrl := viper.GetString("PUBLIC_URL")
+
+	viper.SetDefault("STREAM_MAX_CONNECTIONS", 5)
+	streamMaxConnections := viper.GetInt("STREAM_MAX_CONNECTIONS")
+
+	// Raw readings and hourly rollups are kept for 90 days and 2 years unless a user has an override
+	viper.SetDefault("RETENTION_RAW_DAYS", 90)
+	viper.SetDefault("RETENTION_HOURLY_MONTHS", 24)
+	viper.SetDefault("RETENTION_INTERVAL", time.Hour)
+	retentionPolicy := retention.Policy{
+		RawDays:      viper.GetInt("RETENTION_RAW_DAYS"),
+		HourlyMonths: viper.GetInt("RETENTION_HOURLY_MONTHS"),
+	}
+	retentionInterval := viper.GetDuration("RETENTION_INTERVAL")
+
+	// MQTT is optional, the bridge only runs when a broker is configured
+	viper.SetDefault("MQTT_CLIENT_ID", "ags-backend")
+	mqttUri := viper.GetString("MQTT_URI")
+	mqttClientId := viper.GetString("MQTT_CLIENT_ID")
+	mqttUsername := viper.GetString("MQTT_USERNAME")
+	mqttPassword := viper.GetString("MQTT_PASSWORD")
+
+	// Controllers silent for longer than OFFLINE_AFTER are offline unless their user set their own
+	viper.SetDefault("OFFLINE_AFTER", 15*time.Minute)
+	viper.SetDefault("OFFLINE_INTERVAL", time.Minute)
+	offlineAfter := viper.GetDuration("OFFLINE_AFTER")
+	offlineInterval := viper.GetDuration("OFFLINE_INTERVAL")
+
+	// RabbitMQ is optional, controller and plan events only go through the outbox when a broker is configured
+	// The outbox needs Mongo to run as a replica set
+	viper.SetDefault("OUTBOX_EXCHANGE", "ags.events")
+	viper.SetDefault("OUTBOX_INTERVAL", time.Second)
+	viper.SetDefault("OUTBOX_RETENTION", 7*24*time.Hour)
+	amqpUri := viper.GetString("AMQP_URI")
+	outboxExchange := viper.GetString("OUTBOX_EXCHANGE")
+	outboxInterval := viper.GetDuration("OUTBOX_INTERVAL")
+	outboxRetention := viper.GetDuration("OUTBOX_RETENTION")
+
 	failOnEmpty(mongoUri, mongoDb, redisAddr, clientId, clientSecret, redirectUri)
 
 	// Setup Redis
@@ -85,17 +139,181 @@ func main() {
 
 	planHandler := &plan.Handler{Repo: planRepo}
 
+	// Setup lookups, for the packages below that read controllers, plans and timezones
+	lookups := &lookup.MongoRepo{ControllerCol: controllerCol, PlanCol: planCol, UserCol: userCol}
+
+	// Setup outbox
+	if amqpUri != "" {
+		failOnError("could not start outbox", outbox.CheckReplicaSet(context.Background(), mongoDatabase))
+
+		outboxCol := mongoDatabase.Collection("outbox")
+		controllerRepo.OutboxCol = outboxCol
+		planRepo.OutboxCol = outboxCol
+
+		outboxRepo := &outbox.MongoRepo{Col: outboxCol}
+		failOnError("could not create outbox indexes", outboxRepo.EnsureIndexes(context.Background()))
+
+		relay := &outbox.Relay{
+			Repo:      outboxRepo,
+			Broker:    &outbox.AmqpBroker{Uri: amqpUri, Exchange: outboxExchange},
+			Interval:  outboxInterval,
+			Retention: outboxRetention,
+		}
+
+		go func() {
+			failOnError("outbox relay stopped", relay.Run(context.Background()))
+		}()
+	}
+
 	// Setup summary
 	summaryCol := mongoDatabase.Collection("summary")
-	summaryRepo := &summary.Mongo{Col: summaryCol}
+	summaryRepo := &summary.Mongo{Col: summaryCol, ControllerCol: controllerCol, Lookup: lookups}
 
 	summaryHandler := &summary.Handler{Repo: summaryRepo}
 
-	// Setup data
-	dataCol := mongoDatabase.Collection("data")
-	dataRepo := &data.MongoRepo{Col: dataCol}
+	// Setup data, readings are told to the live stream, alerts and webhooks
+	readings, err := wiring.NewReadings(mongoDatabase, redisClient)
+	failOnError("improper config file", err)
 
-	dataHandler := &data.Handler{Repo: dataRepo}
+	dataRepo := readings.Repo
+	dataHandler := readings.Handler
+
+	failOnError("could not create reading indexes", dataRepo.EnsureIndexes(context.Background()))
+
+	// Setup live stream
+	liveStream := readings.Stream
+	go func() {
+		failOnError("live stream stopped", liveStream.Run(context.Background()))
+	}()
+
+	streamHandler := &stream.Handler{
+		Repo:      &stream.MongoRepo{Lookup: lookups},
+		Stream:    liveStream,
+		Limiter:   &stream.RedisLimiter{Client: redisClient, Max: streamMaxConnections, TTL: time.Minute},
+		Heartbeat: 15 * time.Second,
+	}
+
+	controllerHandler.Notifier = liveStream
+
+	// Setup webhook, events are published by the handlers below
+	webhookHandler := &webhook.Handler{Repo: readings.WebhookRepo}
+	failOnError("could not create webhook indexes", readings.WebhookRepo.EnsureIndexes(context.Background()))
+	webhookDispatcher := readings.Webhooks
+
+	go func() {
+		failOnError("webhook delivery stopped", webhookDispatcher.Run(context.Background()))
+	}()
+
+	controllerHandler.Publisher = webhookDispatcher
+	planHandler.Publisher = webhookDispatcher
+
+	// Setup notification
+	notificationRepo := readings.NotificationRepo
+	notificationHandler := &notification.Handler{Repo: notificationRepo, Policy: readings.NotificationPolicy}
+
+	// Expired notifications are removed by a TTL index
+	failOnError("could not create notification indexes", notificationRepo.EnsureIndexes(context.Background()))
+
+	// Setup alert
+	alertRepo := readings.AlertRepo
+	alertChannels := readings.AlertChannels
+
+	alertHandler := &alert.Handler{Repo: alertRepo, Mailer: readings.AlertMailer}
+
+	offlineChecker := &alert.OfflineChecker{
+		Repo:      alertRepo,
+		Channels:  alertChannels,
+		After:     offlineAfter,
+		Interval:  offlineInterval,
+		Publisher: webhookDispatcher,
+	}
+
+	go func() {
+		failOnError("offline check stopped", offlineChecker.Run(context.Background()))
+	}()
+
+	// Setup retention
+	retentionRepo := &retention.MongoRepo{
+		Data:          dataRepo,
+		SummaryCol:    summaryCol,
+		ControllerCol: controllerCol,
+		UserCol:       userCol,
+	}
+
+	compactor := &retention.Compactor{Repo: retentionRepo, Policy: retentionPolicy, Interval: retentionInterval}
+	go func() {
+		failOnError("compaction stopped", compactor.Run(context.Background()))
+	}()
+
+	retentionHandler := &retention.Handler{Repo: retentionRepo, Policy: retentionPolicy}
+
+	// Setup compliance
+	complianceRepo := &compliance.MongoRepo{
+		Data:    dataRepo,
+		Summary: summaryRepo,
+		Lookup:  lookups,
+	}
+
+	complianceHandler := &compliance.Handler{Repo: complianceRepo}
+
+	// Setup action log
+	actionRepo := &action.MongoRepo{
+		Col:           mongoDatabase.Collection("action"),
+		ControllerCol: controllerCol,
+		Lookup:        lookups,
+	}
+
+	actionHandler := &action.Handler{Repo: actionRepo}
+
+	// Setup consumption
+	consumptionRepo := &consumption.MongoRepo{Lookup: lookups}
+	consumptionHandler := &consumption.Handler{Repo: consumptionRepo}
+
+	// Setup anomalies, they are detected by cmd/summarize
+	anomalyRepo := &anomaly.MongoRepo{Col: mongoDatabase.Collection("anomaly"), Lookup: lookups, Summary: summaryRepo}
+	anomalyHandler := &anomaly.Handler{Repo: anomalyRepo}
+
+	// Setup report
+	reportRepo := &report.MongoRepo{
+		Summary: summaryRepo,
+		Anomaly: anomalyRepo,
+		Lookup:  lookups,
+	}
+
+	reportHandler := &report.Handler{Repo: reportRepo, Compliance: complianceHandler, Consumption: consumptionHandler}
+
+	// Setup calendar
+	calendarCol := mongoDatabase.Collection("calendar")
+	calendarRepo := &calendar.MongoRepo{
+		Col:    calendarCol,
+		Lookup: lookups,
+	}
+
+	calendarHandler := &calendar.Handler{Repo: calendarRepo, BaseUrl: publicUrl}
+
+	// Setup MQTT bridge
+	var bridgeHandler *bridge.Handler
+	if mqttUri != "" {
+		mqttClient, err := bridge.NewPahoClient(mqttUri, mqttClientId, mqttUsername, mqttPassword)
+		failOnError("could not connect to mqtt broker", err)
+
+		mqttBridge := &bridge.Bridge{
+			Client:   mqttClient,
+			Repo:     &bridge.MongoRepo{ControllerCol: controllerCol, PlanCol: planCol},
+			Data:     dataHandler,
+			Notifier: liveStream,
+		}
+
+		timeout, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err = mqttBridge.Start(timeout)
+		cancel()
+
+		failOnError("could not start mqtt bridge", err)
+
+		planHandler.Notifier = mqttBridge
+		controllerHandler.Notifier = controller.Notifiers{liveStream, mqttBridge}
+		bridgeHandler = &bridge.Handler{Bridge: mqttBridge}
+	}
 
 	// Setup gin
 	corsConfig := cors.Config{
@@ -113,7 +331,23 @@ func main() {
 	controller.RegisterRoutes(controllerHandler, engine, sessionHandler)
 	plan.RegisterRoutes(planHandler, engine, sessionHandler)
 	summary.RegisterRoutes(summaryHandler, engine, sessionHandler)
+	anomaly.RegisterRoutes(anomalyHandler, engine, sessionHandler)
+	alert.RegisterRoutes(alertHandler, engine, sessionHandler)
+	webhook.RegisterRoutes(webhookHandler, engine, sessionHandler)
+	notification.RegisterRoutes(notificationHandler, engine, sessionHandler)
+	report.RegisterRoutes(reportHandler, engine, sessionHandler)
 	data.RegisterRoutes(dataHandler, engine, sessionHandler)
+	calendar.RegisterRoutes(calendarHandler, engine, sessionHandler)
+	stream.RegisterRoutes(streamHandler, engine, sessionHandler)
+	metric.RegisterRoutes(&metric.Handler{Registry: metric.Default}, engine, sessionHandler)
+	retention.RegisterRoutes(retentionHandler, engine, sessionHandler)
+	compliance.RegisterRoutes(complianceHandler, engine, sessionHandler)
+	action.RegisterRoutes(actionHandler, engine, sessionHandler)
+	consumption.RegisterRoutes(consumptionHandler, engine, sessionHandler)
+
+	if bridgeHandler != nil {
+		bridge.RegisterRoutes(bridgeHandler, engine, sessionHandler)
+	}
 
 	log.Fatal(engine.Run("0.0.0.0:9700"))
 }
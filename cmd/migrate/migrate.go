@@ -0,0 +1,100 @@
+// Command migrate moves data kept by earlier versions into where the backend keeps it now
+//
+// Usage:
+//
+//	migrate config.yaml
+//
+// Readings stored one per document in "reading" are moved into buckets and alerts of the first inbox in "inbox"
+// into notifications, each collection is dropped once it is moved. Run it once when upgrading, from one place only,
+// not from every replica. A migration that stopped half way can be run again and one that finished does nothing.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"github.com/spf13/viper"
+	"github.com/tPhume/ags-backend/cmd/internal/wiring"
+	"github.com/tPhume/ags-backend/data"
+	"github.com/tPhume/ags-backend/notification"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"strings"
+	"time"
+)
+
+func main() {
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		failOnError("usage", errors.New("migrate config"))
+	}
+
+	// Read the config to Viper first
+	readConfig(flag.Arg(0))
+
+	mongoUri := viper.GetString("MONGO_URI")
+	mongoDb := viper.GetString("MONGO_DB")
+
+	failOnEmpty(mongoUri, mongoDb)
+
+	// Setup Mongo
+	mongoClient, err := mongo.NewClient(options.Client().ApplyURI(mongoUri))
+	failOnError("could not create mongo client", err)
+
+	timeout, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	err = mongoClient.Connect(timeout)
+	cancel()
+
+	failOnError("could not start mongo connection", err)
+
+	mongoDatabase := mongoClient.Database(mongoDb)
+	ctx := context.Background()
+
+	// Readings from before buckets were one per document in "reading"
+	dataRepo := &data.MongoRepo{
+		Col:           mongoDatabase.Collection("data"),
+		BucketCol:     mongoDatabase.Collection("reading_bucket"),
+		RollupCol:     mongoDatabase.Collection("reading_hourly"),
+		ControllerCol: mongoDatabase.Collection("controller"),
+	}
+
+	failOnError("could not create reading indexes", dataRepo.EnsureIndexes(ctx))
+
+	migrated, err := dataRepo.MigrateReadings(ctx, mongoDatabase.Collection("reading"))
+	log.Printf("moved %d readings into buckets", migrated)
+	failOnError("could not migrate readings", err)
+
+	// The first inbox kept alerts in "inbox"
+	notificationRepo := &notification.MongoRepo{Col: mongoDatabase.Collection("notification")}
+
+	failOnError("could not create notification indexes", notificationRepo.EnsureIndexes(ctx))
+
+	moved, err := notificationRepo.MigrateInbox(ctx, mongoDatabase.Collection("inbox"), wiring.NotificationPolicy(), time.Now())
+	log.Printf("moved %d inbox messages into notifications", moved)
+	failOnError("could not migrate inbox", err)
+}
+
+func readConfig(file string) {
+	// Set and read configurations
+	viper.SetConfigFile(file)
+	viper.AddConfigPath(".")
+
+	err := viper.ReadInConfig()
+	failOnError("could not read config", err)
+}
+
+func failOnEmpty(values ...string) {
+	for _, v := range values {
+		if strings.TrimSpace(v) == "" {
+			failOnError("some values are empty", errors.New("improper config file"))
+		}
+	}
+}
+
+func failOnError(msg string, err error) {
+	if err != nil {
+		log.Fatalf("%s:%s", msg, err)
+	}
+}
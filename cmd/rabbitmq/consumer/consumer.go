@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/go-redis/redis/v7"
+	"github.com/spf13/viper"
+	"github.com/streadway/amqp"
+	"github.com/tPhume/ags-backend/cmd/internal/wiring"
+	"github.com/tPhume/ags-backend/data"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	consumerTag = "ags-backend-telemetry"
+
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+
+	// Messages that could not be stored wait in the retry queue this long before coming back
+	retryDelay = 5 * time.Second
+
+	// Messages still failing after this many retries are dead lettered
+	maxRetries = 12
+)
+
+// Topology declared by the consumer, every field comes from config
+type topology struct {
+	exchange     string
+	exchangeType string
+	queue        string
+	retryQueue   string
+	bindingKeys  []string
+	prefetch     int
+
+	deadLetterExchange string
+	deadLetterQueue    string
+}
+
+type consumer struct {
+	uri      string
+	topology topology
+	handler  *data.Handler
+}
+
+func main() {
+	// Read the config to Viper first
+	readConfig()
+
+	viper.SetDefault("CONSUMER_EXCHANGE_TYPE", "topic")
+	viper.SetDefault("CONSUMER_BINDING_KEYS", "#")
+	viper.SetDefault("CONSUMER_PREFETCH", 32)
+
+	// Get the config
+	amqpUri := viper.GetString("AMQP_URI")
+	mongoUri := viper.GetString("MONGO_URI")
+	mongoDb := viper.GetString("MONGO_DB")
+
+	redisAddr := viper.GetString("REDIS_ADDR")
+	redisDb := viper.GetInt("REDIS_DB")
+
+	t := topology{
+		exchange:           viper.GetString("CONSUMER_EXCHANGE"),
+		exchangeType:       viper.GetString("CONSUMER_EXCHANGE_TYPE"),
+		queue:              viper.GetString("CONSUMER_QUEUE"),
+		retryQueue:         viper.GetString("CONSUMER_QUEUE") + ".retry",
+		bindingKeys:        strings.Split(viper.GetString("CONSUMER_BINDING_KEYS"), ","),
+		prefetch:           viper.GetInt("CONSUMER_PREFETCH"),
+		deadLetterExchange: viper.GetString("CONSUMER_DEAD_LETTER_EXCHANGE"),
+		deadLetterQueue:    viper.GetString("CONSUMER_DEAD_LETTER_QUEUE"),
+	}
+
+	failOnEmpty(amqpUri, mongoUri, mongoDb, redisAddr, t.exchange, t.queue, t.deadLetterExchange, t.deadLetterQueue)
+
+	if t.prefetch <= 0 {
+		failOnError("improper config file", errors.New("CONSUMER_PREFETCH must be positive"))
+	}
+
+	// Setup Mongo
+	mongoClient, err := mongo.NewClient(options.Client().ApplyURI(mongoUri))
+	failOnError("could not create mongo client", err)
+
+	timeout, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	err = mongoClient.Connect(timeout)
+	cancel()
+
+	failOnError("could not start mongo connection", err)
+
+	mongoDatabase := mongoClient.Database(mongoDb)
+
+	redisClient := redis.NewClient(&redis.Options{
+		Addr: redisAddr,
+		DB:   redisDb,
+	})
+
+	// Readings are stored and told to the live stream, alerts and webhooks exactly as on the HTTP endpoint
+	// Webhook deliveries are queued here and sent by the backend
+	readings, err := wiring.NewReadings(mongoDatabase, redisClient)
+	failOnError("improper config file", err)
+
+	c := &consumer{
+		uri:      amqpUri,
+		topology: t,
+		handler:  readings.Handler,
+	}
+
+	// Stop consuming on SIGTERM and let in-flight messages finish
+	ctx, stop := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		log.Printf("received %s, draining", sig)
+		stop()
+	}()
+
+	c.run(ctx)
+
+	disconnect, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	if err := mongoClient.Disconnect(disconnect); err != nil {
+		log.Printf("could not disconnect from mongo: %s", err)
+	}
+
+	log.Println("consumer stopped")
+}
+
+// run keeps a consumer connected until ctx is cancelled, reconnecting with exponential backoff
+func (c *consumer) run(ctx context.Context) {
+	backoff := minBackoff
+
+	for {
+		connected, err := c.consume(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		// A session that got as far as consuming starts the backoff over
+		if connected {
+			backoff = minBackoff
+		}
+
+		log.Printf("consumer disconnected: %s, retrying in %s", err, backoff)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// consume runs a single connection until it fails or ctx is cancelled
+// Reports whether deliveries were started, so that run can tell a failed dial from a dropped connection
+func (c *consumer) consume(ctx context.Context) (bool, error) {
+	conn, err := amqp.Dial(c.uri)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return false, err
+	}
+
+	if err := c.declare(ch); err != nil {
+		return false, err
+	}
+
+	if err := ch.Qos(c.topology.prefetch, 0, false); err != nil {
+		return false, err
+	}
+
+	deliveries, err := ch.Consume(c.topology.queue, consumerTag, false, false, false, false, nil)
+	if err != nil {
+		return false, err
+	}
+
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	log.Printf("consuming from %s", c.topology.queue)
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Stop new deliveries, then finish the ones already prefetched so they get acked
+			if err := ch.Cancel(consumerTag, false); err != nil {
+				return true, err
+			}
+
+			for d := range deliveries {
+				c.handle(ch, d)
+			}
+
+			return true, nil
+		case amqpErr := <-closed:
+			if amqpErr == nil {
+				return true, errors.New("connection closed")
+			}
+
+			return true, amqpErr
+		case d, ok := <-deliveries:
+			if !ok {
+				return true, errors.New("deliveries channel closed")
+			}
+
+			c.handle(ch, d)
+		}
+	}
+}
+
+// declare creates the exchange, queue and bindings, as well as the dead letter queue for rejected messages
+// and the retry queue, which hands messages back to the queue once they have waited there for retryDelay
+func (c *consumer) declare(ch *amqp.Channel) error {
+	t := c.topology
+
+	if err := ch.ExchangeDeclare(t.deadLetterExchange, amqp.ExchangeFanout, true, false, false, false, nil); err != nil {
+		return err
+	}
+
+	if _, err := ch.QueueDeclare(t.deadLetterQueue, true, false, false, false, nil); err != nil {
+		return err
+	}
+
+	if err := ch.QueueBind(t.deadLetterQueue, "", t.deadLetterExchange, false, nil); err != nil {
+		return err
+	}
+
+	if err := ch.ExchangeDeclare(t.exchange, t.exchangeType, true, false, false, false, nil); err != nil {
+		return err
+	}
+
+	retryArgs := amqp.Table{
+		"x-message-ttl":             int32(retryDelay / time.Millisecond),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": t.queue,
+	}
+
+	if _, err := ch.QueueDeclare(t.retryQueue, true, false, false, false, retryArgs); err != nil {
+		return err
+	}
+
+	args := amqp.Table{"x-dead-letter-exchange": t.deadLetterExchange}
+	if _, err := ch.QueueDeclare(t.queue, true, false, false, false, args); err != nil {
+		return err
+	}
+
+	for _, key := range t.bindingKeys {
+		if err := ch.QueueBind(t.queue, strings.TrimSpace(key), t.exchange, false, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// handle stores the readings of a delivery
+// Messages that can never be stored are dead lettered, anything else is retried later through the retry queue
+// so that the messages behind it are not held up
+func (c *consumer) handle(ch *amqp.Channel, d amqp.Delivery) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	added, err := c.ingest(ctx, d)
+	if err != nil {
+		if data.Rejected(err) || retries(d, c.topology.retryQueue) >= maxRetries {
+			log.Printf("dead lettering message %s: %s", d.MessageId, err)
+			logOnError("could not reject message", d.Nack(false, false))
+			return
+		}
+
+		log.Printf("retrying message %s in %s: %s", d.MessageId, retryDelay, err)
+		if err := c.retry(ch, d); err != nil {
+			logOnError("could not retry message, requeueing it", err)
+			logOnError("could not requeue message", d.Nack(false, true))
+			return
+		}
+
+		logOnError("could not ack message", d.Ack(false))
+		return
+	}
+
+	if added == 0 {
+		log.Printf("message %s only had duplicate readings", d.MessageId)
+	}
+
+	logOnError("could not ack message", d.Ack(false))
+}
+
+// retry puts a copy of the delivery in the retry queue, the original can be acked once it is there
+func (c *consumer) retry(ch *amqp.Channel, d amqp.Delivery) error {
+	return ch.Publish("", c.topology.retryQueue, false, false, amqp.Publishing{
+		Headers:      d.Headers,
+		ContentType:  d.ContentType,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    d.MessageId,
+		Timestamp:    d.Timestamp,
+		Body:         d.Body,
+	})
+}
+
+// retries counts how many times the message came back from the retry queue
+func retries(d amqp.Delivery, retryQueue string) int64 {
+	deaths, _ := d.Headers["x-death"].([]interface{})
+	for _, death := range deaths {
+		table, _ := death.(amqp.Table)
+		if queue, _ := table["queue"].(string); queue == retryQueue {
+			count, _ := table["count"].(int64)
+			return count
+		}
+	}
+
+	return 0
+}
+
+func (c *consumer) ingest(ctx context.Context, d amqp.Delivery) (int, error) {
+	// Devices put their controller token in the message headers, the same as the HTTP header
+	token, _ := d.Headers["token"].(string)
+
+	readings, err := data.DecodeReadings(d.ContentType, d.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	return c.handler.Ingest(ctx, token, readings)
+}
+
+func readConfig() {
+	// Set and read configurations
+	viper.SetConfigFile(os.Args[1])
+	viper.AddConfigPath(".")
+
+	err := viper.ReadInConfig()
+	failOnError("could not read config", err)
+}
+
+func failOnEmpty(values ...string) {
+	for _, v := range values {
+		if strings.TrimSpace(v) == "" {
+			failOnError("some values are empty", errors.New("improper config file"))
+		}
+	}
+}
+
+func failOnError(msg string, err error) {
+	if err != nil {
+		log.Fatalf("%s:%s", msg, err)
+	}
+}
+
+func logOnError(msg string, err error) {
+	if err != nil {
+		log.Printf("%s: %s", msg, err)
+	}
+}
@@ -0,0 +1,121 @@
+// Command summarize builds daily summaries from stored readings
+//
+// Usage:
+//
+//	summarize config.yaml
+//	summarize --backfill 2020-04-01..2020-04-30 config.yaml
+//
+// Without --backfill it builds yesterday in the timezone of each user, which is meant to run once a day.
+// Building a day again replaces its summary and its anomalies, so runs can be repeated safely.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"github.com/spf13/viper"
+	"github.com/tPhume/ags-backend/anomaly"
+	"github.com/tPhume/ags-backend/data"
+	"github.com/tPhume/ags-backend/lookup"
+	"github.com/tPhume/ags-backend/summary"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"strings"
+	"time"
+)
+
+func main() {
+	backfill := flag.String("backfill", "", "build every date from..to inclusive, e.g. 2020-04-01..2020-04-30")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		failOnError("usage", errors.New("summarize [--backfill from..to] config"))
+	}
+
+	// Read the config to Viper first
+	readConfig(flag.Arg(0))
+
+	mongoUri := viper.GetString("MONGO_URI")
+	mongoDb := viper.GetString("MONGO_DB")
+
+	failOnEmpty(mongoUri, mongoDb)
+
+	// Setup Mongo
+	mongoClient, err := mongo.NewClient(options.Client().ApplyURI(mongoUri))
+	failOnError("could not create mongo client", err)
+
+	timeout, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	err = mongoClient.Connect(timeout)
+	cancel()
+
+	failOnError("could not start mongo connection", err)
+
+	mongoDatabase := mongoClient.Database(mongoDb)
+	controllerCol := mongoDatabase.Collection("controller")
+	lookups := &lookup.MongoRepo{
+		ControllerCol: controllerCol,
+		PlanCol:       mongoDatabase.Collection("plan"),
+		UserCol:       mongoDatabase.Collection("user"),
+	}
+
+	summaryRepo := &summary.Mongo{
+		Col:           mongoDatabase.Collection("summary"),
+		ControllerCol: controllerCol,
+		Lookup:        lookups,
+		Data: &data.MongoRepo{
+			BucketCol:     mongoDatabase.Collection("reading_bucket"),
+			RollupCol:     mongoDatabase.Collection("reading_hourly"),
+			ControllerCol: controllerCol,
+		},
+	}
+
+	// Anomalies are detected as each summary is written, so a backfill detects them in date order
+	detector := &anomaly.Detector{Repo: &anomaly.MongoRepo{
+		Col:     mongoDatabase.Collection("anomaly"),
+		Lookup:  lookups,
+		Summary: summaryRepo,
+	}}
+
+	builder := &summary.Builder{Repo: summaryRepo, Notifier: detector}
+
+	ctx := context.Background()
+
+	var built int
+	if *backfill != "" {
+		dates := strings.Split(*backfill, "..")
+		if len(dates) != 2 {
+			failOnError("bad --backfill", errors.New("expected from..to"))
+		}
+
+		built, err = builder.Backfill(ctx, dates[0], dates[1])
+	} else {
+		built, err = builder.BuildYesterday(ctx, time.Now())
+	}
+
+	log.Printf("built %d summaries", built)
+	failOnError("could not build summaries", err)
+}
+
+func readConfig(file string) {
+	// Set and read configurations
+	viper.SetConfigFile(file)
+	viper.AddConfigPath(".")
+
+	err := viper.ReadInConfig()
+	failOnError("could not read config", err)
+}
+
+func failOnEmpty(values ...string) {
+	for _, v := range values {
+		if strings.TrimSpace(v) == "" {
+			failOnError("some values are empty", errors.New("improper config file"))
+		}
+	}
+}
+
+func failOnError(msg string, err error) {
+	if err != nil {
+		log.Fatalf("%s:%s", msg, err)
+	}
+}
@@ -0,0 +1,172 @@
+// Package compliance compares what a controller measured with the setpoints of its plan
+package compliance
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/tPhume/ags-backend/data"
+	"github.com/tPhume/ags-backend/lookup"
+	"github.com/tPhume/ags-backend/metric"
+	"github.com/tPhume/ags-backend/session"
+	"github.com/tPhume/ags-backend/summary"
+	"net/http"
+	"time"
+)
+
+func RegisterRoutes(handler *Handler, engine *gin.Engine, sessionHandler *session.Handler) {
+	engine.GET("api/v1/controller/:controllerId/compliance", sessionHandler.GetUser, handler.GetCompliance)
+}
+
+// Longest range of one report, about a growing season
+const maxComplianceRange = 92 * 24 * time.Hour
+
+// Controller is what compliance needs to know about a controller
+type Controller struct {
+	Plan    string          `bson:"plan"`
+	Sensors []metric.Sensor `bson:"sensors"`
+}
+
+// Repo
+type Repo interface {
+	// GetController returns the controller if it belongs to userId
+	GetController(ctx context.Context, userId string, controllerId string) (*Controller, error)
+
+	lookup.Plans
+	lookup.Timezones
+
+	EachReading(ctx context.Context, userId string, controllerId string, from time.Time, to time.Time, fn func(*data.Reading) error) error
+
+	EachSummary(ctx context.Context, userId string, controllerId string, from string, to string, fn func(*summary.Summary) error) error
+}
+
+var (
+	errControllerNotFound = lookup.ErrControllerNotFound
+	errPlanNotFound       = lookup.ErrPlanNotFound
+)
+
+// Handler for compliance REST API
+type Handler struct {
+	Repo Repo
+}
+
+var (
+	// ok message responses for handler
+	resCompliance = "compliance retrieved"
+
+	// error message responses for handler
+	resInternal     = "not your fault, don't worry"
+	resInvalid      = "invalid values"
+	resNotFound     = "not found"
+	resPlanNotFound = "controller has no plan"
+)
+
+type complianceQuery struct {
+	From time.Time `form:"from" binding:"required" time_format:"2006-01-02T15:04:05Z07:00"`
+	To   time.Time `form:"to" binding:"required" time_format:"2006-01-02T15:04:05Z07:00"`
+}
+
+// GetCompliance reports how well readings kept to the setpoints of the plan of the controller
+// Days are those of the timezone of the user, like the dates of summaries
+func (h *Handler) GetCompliance(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	// check controllerId
+	controllerId := ctx.Param("controllerId")
+	if _, err := uuid.Parse(controllerId); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	query := &complianceQuery{}
+	if err := ctx.ShouldBindQuery(query); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	span := query.To.Sub(query.From)
+	if span <= 0 || span > maxComplianceRange {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	report, err := h.Build(ctx, userId, controllerId, query.From, query.To)
+	if err != nil {
+		switch err {
+		case errControllerNotFound:
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resNotFound})
+		case errPlanNotFound:
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resPlanNotFound})
+		default:
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resCompliance, "result": report})
+}
+
+// Build works out the report of the controller for the range, it is what GetCompliance responds with
+func (h *Handler) Build(ctx context.Context, userId string, controllerId string, from time.Time, to time.Time) (*Report, error) {
+	controller, err := h.Repo.GetController(ctx, userId, controllerId)
+	if err != nil {
+		return nil, err
+	}
+
+	if controller.Plan == "" {
+		return nil, errPlanNotFound
+	}
+
+	entity, err := h.Repo.GetPlan(ctx, userId, controller.Plan)
+	if err != nil {
+		return nil, err
+	}
+
+	timezone, err := h.Repo.GetTimezone(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		location = time.UTC
+	}
+
+	// VPD is derived from each reading, DLI and GDD come from the daily summaries
+	sensors := metric.Sensors(controller.Sensors)
+	report := newReport(controllerId, entity, metric.WithDaily(metric.WithDerived(sensors)), from, to, location)
+
+	err = h.Repo.EachReading(ctx, userId, controllerId, from, to, func(reading *data.Reading) error {
+		data.Derive(reading, sensors)
+		report.addReading(reading)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	first, last := report.dates()
+	err = h.Repo.EachSummary(ctx, userId, controllerId, first, last, func(s *summary.Summary) error {
+		report.addSummary(s)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	report.finish()
+
+	return report, nil
+}
+
+// NoPlan reports whether err from Build is because the controller has no plan
+func NoPlan(err error) bool {
+	return err == errPlanNotFound
+}
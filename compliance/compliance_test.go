@@ -0,0 +1,235 @@
+package compliance
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/tPhume/ags-backend/data"
+	"github.com/tPhume/ags-backend/metric"
+	"github.com/tPhume/ags-backend/plan"
+	"github.com/tPhume/ags-backend/summary"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// For our tests the grower has a tomato house on a plan that keeps it at 24°C and a seedling tray with no plan
+// Any other controller id indicates a missing controller
+const (
+	growerId    = "57db4232-0f58-46d0-8014-4d5ec13fd8f4"
+	tomatoesId  = "6ef5386b-c17f-4675-a799-53a85780d51f"
+	seedlingsId = "f50f4996-2661-490a-b613-3930f8134b33"
+	unknownId   = "ed2c452b-b8f2-4369-8103-9b53e6145384"
+)
+
+var tomatoPlan = plan.Entity{
+	PlanId:    "46da5efc-17b9-4d22-988a-4dcfb726a078",
+	UserId:    growerId,
+	Name:      "Tomatoes",
+	Setpoints: map[string]float64{"temperature": 24},
+}
+
+var controllers = map[string]*Controller{
+	tomatoesId:  {Plan: tomatoPlan.PlanId},
+	seedlingsId: {},
+}
+
+// Repo struct for testing
+type repoStruct struct{}
+
+func (r *repoStruct) GetController(ctx context.Context, userId string, controllerId string) (*Controller, error) {
+	if controller, ok := controllers[controllerId]; ok && userId == growerId {
+		return controller, nil
+	}
+
+	return nil, errControllerNotFound
+}
+
+func (r *repoStruct) GetPlan(ctx context.Context, userId string, planId string) (*plan.Entity, error) {
+	if planId != tomatoPlan.PlanId {
+		return nil, errPlanNotFound
+	}
+
+	return &tomatoPlan, nil
+}
+
+func (r *repoStruct) GetTimezone(ctx context.Context, userId string) (string, error) {
+	return "Asia/Bangkok", nil
+}
+
+// Readings every minute at 24°C, with 15 minutes at 30°C from 10:30 and a flagged spike at 10:50
+func (r *repoStruct) EachReading(ctx context.Context, userId string, controllerId string, from time.Time, to time.Time, fn func(*data.Reading) error) error {
+	for minute := 0; minute < 120; minute++ {
+		reading := &data.Reading{
+			Timestamp: time.Date(2020, time.April, 15, 10, minute, 0, 0, time.UTC),
+			Metrics:   map[string]float64{"temperature": 24, "humidity": 60},
+		}
+
+		if minute >= 30 && minute < 45 {
+			reading.Metrics["temperature"] = 30
+		}
+
+		if minute == 50 {
+			reading.Metrics["temperature"] = 80
+			reading.Quality = map[string]string{"temperature": data.FlagRate}
+		}
+
+		if err := fn(reading); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *repoStruct) EachSummary(ctx context.Context, userId string, controllerId string, from string, to string, fn func(*summary.Summary) error) error {
+	return fn(&summary.Summary{Date: "2020-04-15", Metrics: map[string]*summary.Stats{"temperature": {Mean: 24.5}}})
+}
+
+// Setup func for handler testing
+func setUp() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+
+	engine.Use(func(ctx *gin.Context) {
+		ctx.Set("userId", growerId)
+	})
+
+	return engine
+}
+
+// Test GetCompliance handler
+func TestHandler_GetCompliance(t *testing.T) {
+	engine := setUp()
+	handler := &Handler{Repo: &repoStruct{}}
+	engine.GET(":controllerId", handler.GetCompliance)
+
+	const until = "2020-04-15T12:00:00Z"
+
+	testCases := []struct {
+		controllerId string
+		to           string
+		message      string
+		code         int
+	}{
+		{controllerId: tomatoesId, to: until, message: resCompliance, code: http.StatusOK},
+		{controllerId: seedlingsId, to: until, message: resPlanNotFound, code: http.StatusNotFound},
+		{controllerId: unknownId, to: until, message: resNotFound, code: http.StatusNotFound},
+		{controllerId: "not-a-uuid", to: until, message: resInvalid, code: http.StatusBadRequest},
+		{controllerId: tomatoesId, to: "2020-08-15T12:00:00Z", message: resInvalid, code: http.StatusBadRequest},
+		{controllerId: tomatoesId, to: "2020-04-15T09:00:00Z", message: resInvalid, code: http.StatusBadRequest},
+	}
+
+	for i, c := range testCases {
+		resp := httptest.NewRecorder()
+
+		req, _ := http.NewRequest(http.MethodGet, "/"+c.controllerId+"?from=2020-04-15T10:00:00Z&to="+c.to, nil)
+		engine.ServeHTTP(resp, req)
+
+		respBody := struct {
+			Message string  `json:"message"`
+			Result  *Report `json:"result"`
+		}{}
+		_ = json.Unmarshal(resp.Body.Bytes(), &respBody)
+
+		if c.code != resp.Code {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.code, resp.Code)
+		}
+
+		if c.message != respBody.Message {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.message, respBody.Message)
+		}
+
+		if c.code != http.StatusOK {
+			continue
+		}
+
+		if respBody.Result.Sensors["temperature"] == nil || respBody.Result.Timezone != "Asia/Bangkok" {
+			t.Fatalf("Case %d: expected a temperature report in Asia/Bangkok, got = [%v]", i, resp.Body.String())
+		}
+	}
+}
+
+// Test time in range, deviation and excursions are weighted by the time each reading stands for
+func TestReport(t *testing.T) {
+	from := time.Date(2020, time.April, 15, 10, 0, 0, 0, time.UTC)
+	to := from.Add(2 * time.Hour)
+	location, _ := time.LoadLocation("Asia/Bangkok")
+
+	repo := &repoStruct{}
+	report := newReport(tomatoesId, &tomatoPlan, []metric.Sensor{{Key: "temperature", Metric: "temperature"}, {Key: "humidity", Metric: "humidity"}}, from, to, location)
+	_ = repo.EachReading(context.Background(), growerId, tomatoesId, from, to, func(reading *data.Reading) error {
+		report.addReading(reading)
+		return nil
+	})
+	_ = repo.EachSummary(context.Background(), growerId, tomatoesId, "", "", func(s *summary.Summary) error {
+		report.addSummary(s)
+		return nil
+	})
+	report.finish()
+
+	if _, ok := report.Sensors["humidity"]; ok {
+		t.Fatalf("expected no report for humidity, it has no setpoint")
+	}
+
+	temperature := report.Sensors["temperature"]
+	if *temperature.TimeInRange != 87.5 || *temperature.MeanAbsoluteDeviation != 0.75 {
+		t.Fatalf("expected [87.5 0.75], got = [%v %v]", *temperature.TimeInRange, *temperature.MeanAbsoluteDeviation)
+	}
+
+	excursion := temperature.LongestExcursion
+	if !excursion.Start.Equal(from.Add(30*time.Minute)) || excursion.Duration != 900 || excursion.Peak != 30 {
+		t.Fatalf("expected [10:30 900 30], got = [%v %v %v]", excursion.Start, excursion.Duration, excursion.Peak)
+	}
+
+	// 10:00 to 12:00 UTC is the evening of the 15th in Bangkok
+	if len(temperature.Days) != 1 || temperature.Days[0].Date != "2020-04-15" || *temperature.Days[0].Mean != 24.5 {
+		t.Fatalf("expected one day with the summary mean, got = [%v]", temperature.Days)
+	}
+}
+
+// Test VPD is derived from each reading and DLI counts for the whole of its day
+func TestReport_Derived(t *testing.T) {
+	from := time.Date(2020, time.April, 14, 17, 0, 0, 0, time.UTC)
+	to := from.Add(48 * time.Hour)
+	location, _ := time.LoadLocation("Asia/Bangkok")
+
+	entity := &plan.Entity{PlanId: tomatoPlan.PlanId, Setpoints: map[string]float64{metric.VPD: 1.2, metric.DLI: 20}}
+	sensors := []metric.Sensor{{Key: "temperature", Metric: "temperature"}, {Key: "humidity", Metric: "humidity"}, {Key: "light", Metric: "light"}}
+
+	repo := &repoStruct{}
+	report := newReport(tomatoesId, entity, metric.WithDaily(metric.WithDerived(sensors)), from, to, location)
+	_ = repo.EachReading(context.Background(), growerId, tomatoesId, from, to, func(reading *data.Reading) error {
+		data.Derive(reading, sensors)
+		report.addReading(reading)
+		return nil
+	})
+
+	// The 15th in Bangkok had enough light and the 16th too little
+	for _, s := range []*summary.Summary{
+		{Date: "2020-04-15", Metrics: map[string]*summary.Stats{metric.DLI: {Mean: 21}}},
+		{Date: "2020-04-16", Metrics: map[string]*summary.Stats{metric.DLI: {Mean: 12}}},
+	} {
+		report.addSummary(s)
+	}
+
+	report.finish()
+
+	// 24°C at 60% is about 1.19 kPa and 30°C well above, the spike at 10:50 is left out
+	// The last reading stands for 15 minutes, so 15 of 134 minutes are out of range
+	vpd := report.Sensors[metric.VPD]
+	if vpd == nil || math.Abs(*vpd.TimeInRange-100*119.0/134) > 1e-9 || vpd.LongestExcursion.Duration != 900 {
+		t.Fatalf("expected [%v 900], got = [%+v]", 100*119.0/134, vpd)
+	}
+
+	dli := report.Sensors[metric.DLI]
+	if dli == nil || *dli.TimeInRange != 50 || *dli.MeanAbsoluteDeviation != 4.5 || dli.LongestExcursion.Duration != 86400 {
+		t.Fatalf("expected [50 4.5 86400], got = [%+v]", dli)
+	}
+
+	if _, ok := report.Sensors[metric.GDD]; ok {
+		t.Fatalf("expected no report for gdd, it has no setpoint")
+	}
+}
@@ -0,0 +1,42 @@
+package compliance
+
+import (
+	"context"
+	"github.com/tPhume/ags-backend/data"
+	"github.com/tPhume/ags-backend/lookup"
+	"github.com/tPhume/ags-backend/plan"
+	"github.com/tPhume/ags-backend/summary"
+	"time"
+)
+
+type MongoRepo struct {
+	Data    *data.MongoRepo
+	Summary *summary.Mongo
+
+	Lookup *lookup.MongoRepo
+}
+
+func (m *MongoRepo) GetController(ctx context.Context, userId string, controllerId string) (*Controller, error) {
+	controller := &Controller{}
+	if err := m.Lookup.FindController(ctx, userId, controllerId, controller); err != nil {
+		return nil, err
+	}
+
+	return controller, nil
+}
+
+func (m *MongoRepo) GetPlan(ctx context.Context, userId string, planId string) (*plan.Entity, error) {
+	return m.Lookup.GetPlan(ctx, userId, planId)
+}
+
+func (m *MongoRepo) GetTimezone(ctx context.Context, userId string) (string, error) {
+	return m.Lookup.GetTimezone(ctx, userId)
+}
+
+func (m *MongoRepo) EachReading(ctx context.Context, userId string, controllerId string, from time.Time, to time.Time, fn func(*data.Reading) error) error {
+	return m.Data.EachReading(ctx, userId, controllerId, from, to, fn)
+}
+
+func (m *MongoRepo) EachSummary(ctx context.Context, userId string, controllerId string, from string, to string, fn func(*summary.Summary) error) error {
+	return m.Summary.EachSummary(ctx, userId, controllerId, from, to, fn)
+}
@@ -0,0 +1,291 @@
+package compliance
+
+import (
+	"github.com/tPhume/ags-backend/data"
+	"github.com/tPhume/ags-backend/metric"
+	"github.com/tPhume/ags-backend/plan"
+	"github.com/tPhume/ags-backend/summary"
+	"math"
+	"time"
+)
+
+// A reading stands for the time until the next one, but no longer than maxGap, beyond that the controller counts as silent
+const maxGap = 15 * time.Minute
+
+const dateLayout = "2006-01-02"
+
+// Report of every sensor whose metric has a setpoint in the plan
+type Report struct {
+	ControllerId string                   `json:"controller_id"`
+	PlanId       string                   `json:"plan_id"`
+	From         time.Time                `json:"from"`
+	To           time.Time                `json:"to"`
+	Timezone     string                   `json:"timezone"`
+	Sensors      map[string]*SensorReport `json:"sensors"`
+
+	location *time.Location
+}
+
+// SensorReport says how well one sensor kept within Low and High
+// Percentages and deviations are weighted by the time each reading stands for, and are null without readings
+// The value of a daily metric, DLI or GDD, stands for the whole of its day
+type SensorReport struct {
+	Metric    string  `json:"metric"`
+	Setpoint  float64 `json:"setpoint"`
+	Tolerance float64 `json:"tolerance"`
+	Low       float64 `json:"low"`
+	High      float64 `json:"high"`
+
+	TimeInRange           *float64   `json:"time_in_range"`
+	MeanAbsoluteDeviation *float64   `json:"mean_absolute_deviation"`
+	LongestExcursion      *Excursion `json:"longest_excursion"`
+
+	// Days has every day of the range in order, so it can be charted as it is
+	Days []*Day `json:"days"`
+
+	tally
+	days    map[string]*Day
+	pending *point
+	current *Excursion
+}
+
+// Excursion is a stretch of time out of range
+type Excursion struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+
+	// Duration in seconds
+	Duration float64 `json:"duration"`
+
+	// Peak is the value farthest from the setpoint
+	Peak float64 `json:"peak"`
+}
+
+// Day of a sensor, Mean comes from the daily summary and is null when there is none
+type Day struct {
+	Date                  string   `json:"date"`
+	TimeInRange           *float64 `json:"time_in_range"`
+	MeanAbsoluteDeviation *float64 `json:"mean_absolute_deviation"`
+	Mean                  *float64 `json:"mean"`
+
+	tally
+}
+
+// tally sums seconds covered by readings, seconds in range and deviation times seconds
+type tally struct {
+	covered   float64
+	inRange   float64
+	deviation float64
+}
+
+func (t *tally) add(seconds float64, inRange bool, deviation float64) {
+	t.covered += seconds
+	t.deviation += deviation * seconds
+	if inRange {
+		t.inRange += seconds
+	}
+}
+
+// results returns the percentage of time in range and the mean absolute deviation
+func (t *tally) results() (*float64, *float64) {
+	if t.covered == 0 {
+		return nil, nil
+	}
+
+	percentage := 100 * t.inRange / t.covered
+	deviation := t.deviation / t.covered
+
+	return &percentage, &deviation
+}
+
+type point struct {
+	timestamp time.Time
+	value     float64
+}
+
+func newReport(controllerId string, entity *plan.Entity, sensors []metric.Sensor, from time.Time, to time.Time, location *time.Location) *Report {
+	report := &Report{
+		ControllerId: controllerId,
+		PlanId:       entity.PlanId,
+		From:         from,
+		To:           to,
+		Timezone:     location.String(),
+		Sensors:      make(map[string]*SensorReport),
+		location:     location,
+	}
+
+	for _, sensor := range sensors {
+		m, ok := metric.Default.Lookup(sensor.Metric)
+		if !ok {
+			continue
+		}
+
+		setpoint, ok := entity.Setpoint(m.Name)
+		if !ok {
+			continue
+		}
+
+		sensorReport := &SensorReport{
+			Metric:    m.Name,
+			Setpoint:  setpoint,
+			Tolerance: m.Tolerance,
+			Low:       setpoint - m.Tolerance,
+			High:      setpoint + m.Tolerance,
+			Days:      make([]*Day, 0),
+			days:      make(map[string]*Day),
+		}
+
+		// Every day of the range, from the day of from to the day of the last instant before to
+		last := to.Add(-time.Nanosecond).In(location).Format(dateLayout)
+		for day := from.In(location); ; day = day.AddDate(0, 0, 1) {
+			date := day.Format(dateLayout)
+			sensorReport.days[date] = &Day{Date: date}
+			sensorReport.Days = append(sensorReport.Days, sensorReport.days[date])
+
+			if date >= last {
+				break
+			}
+		}
+
+		report.Sensors[sensor.Key] = sensorReport
+	}
+
+	return report
+}
+
+// dates returns the first and last date of the range in the timezone of the report
+func (r *Report) dates() (string, string) {
+	return r.From.In(r.location).Format(dateLayout), r.To.Add(-time.Nanosecond).In(r.location).Format(dateLayout)
+}
+
+// addReading must be called in timestamp order, flagged values are left out
+func (r *Report) addReading(reading *data.Reading) {
+	for key, sensorReport := range r.Sensors {
+		value, ok := reading.GoodValue(key)
+		if !ok {
+			continue
+		}
+
+		if sensorReport.pending != nil {
+			r.settle(sensorReport, reading.Timestamp)
+		}
+
+		sensorReport.pending = &point{timestamp: reading.Timestamp, value: value}
+	}
+}
+
+// addSummary must be called in date order
+func (r *Report) addSummary(s *summary.Summary) {
+	for key, sensorReport := range r.Sensors {
+		stats, ok := s.Stat(key)
+		if !ok {
+			continue
+		}
+
+		day, ok := sensorReport.days[s.Date]
+		if !ok {
+			continue
+		}
+
+		mean := stats.Mean
+		day.Mean = &mean
+
+		if daily[sensorReport.Metric] {
+			r.addDaily(sensorReport, s.Date, mean)
+		}
+	}
+}
+
+// Metrics there is one value of per day, they are only in the daily summaries
+var daily = map[string]bool{metric.DLI: true, metric.GDD: true}
+
+// addDaily counts the value of a daily metric for the part of its day within the range
+func (r *Report) addDaily(s *SensorReport, date string, value float64) {
+	start, err := time.ParseInLocation(dateLayout, date, r.location)
+	if err != nil {
+		return
+	}
+
+	end := start.AddDate(0, 0, 1)
+	if start.Before(r.From) {
+		start = r.From
+	}
+
+	if end.After(r.To) {
+		end = r.To
+	}
+
+	if end.After(start) {
+		r.count(s, &point{timestamp: start, value: value}, end.Sub(start))
+	}
+}
+
+// settle counts the pending point of a sensor for the time until next
+func (r *Report) settle(s *SensorReport, next time.Time) {
+	p := s.pending
+	s.pending = nil
+
+	elapsed := next.Sub(p.timestamp)
+	if elapsed > maxGap {
+		elapsed = maxGap
+	}
+
+	r.count(s, p, elapsed)
+}
+
+// count adds a point that stands for elapsed to the sensor, its day and its excursions
+func (r *Report) count(s *SensorReport, p *point, elapsed time.Duration) {
+	seconds := elapsed.Seconds()
+	deviation := math.Abs(p.value - s.Setpoint)
+	inRange := p.value >= s.Low && p.value <= s.High
+
+	s.add(seconds, inRange, deviation)
+	if day, ok := s.days[p.timestamp.In(r.location).Format(dateLayout)]; ok {
+		day.add(seconds, inRange, deviation)
+	}
+
+	// An excursion ends once the sensor is back in range or has gone silent
+	if s.current != nil && (inRange || p.timestamp.After(s.current.End)) {
+		s.endExcursion()
+	}
+
+	if inRange {
+		return
+	}
+
+	if s.current == nil {
+		s.current = &Excursion{Start: p.timestamp, Peak: p.value}
+	}
+
+	s.current.End = p.timestamp.Add(elapsed)
+	if deviation > math.Abs(s.current.Peak-s.Setpoint) {
+		s.current.Peak = p.value
+	}
+}
+
+func (s *SensorReport) endExcursion() {
+	s.current.Duration = s.current.End.Sub(s.current.Start).Seconds()
+	if s.LongestExcursion == nil || s.current.Duration > s.LongestExcursion.Duration {
+		s.LongestExcursion = s.current
+	}
+
+	s.current = nil
+}
+
+// finish settles the last reading of each sensor and works out the results
+func (r *Report) finish() {
+	for _, s := range r.Sensors {
+		if s.pending != nil {
+			r.settle(s, r.To)
+		}
+
+		if s.current != nil {
+			s.endExcursion()
+		}
+
+		s.TimeInRange, s.MeanAbsoluteDeviation = s.results()
+		for _, day := range s.Days {
+			day.TimeInRange, day.MeanAbsoluteDeviation = day.results()
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Package consumption works out the water and energy used by the actions in the plan of a controller
+// Figures are estimates from the schedule and the specs of the actuators, not metered values
+package consumption
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/tPhume/ags-backend/controller"
+	"github.com/tPhume/ags-backend/lookup"
+	"github.com/tPhume/ags-backend/session"
+	"net/http"
+	"time"
+)
+
+func RegisterRoutes(handler *Handler, engine *gin.Engine, sessionHandler *session.Handler) {
+	engine.GET("api/v1/controller/:controllerId/consumption", sessionHandler.GetUser, handler.GetConsumption)
+}
+
+// Granularities of the periods of a report
+const (
+	GranularityDay   = "day"
+	GranularityMonth = "month"
+)
+
+// Longest range of a report, a year of months
+const maxConsumptionRange = 366 * 24 * time.Hour
+
+// Controller is what consumption needs to know about a controller
+type Controller struct {
+	Plan  string            `bson:"plan"`
+	Specs *controller.Specs `bson:"specs"`
+}
+
+// Repo
+type Repo interface {
+	// GetController returns the controller if it belongs to userId
+	GetController(ctx context.Context, userId string, controllerId string) (*Controller, error)
+
+	lookup.Plans
+	lookup.Timezones
+}
+
+var (
+	errControllerNotFound = lookup.ErrControllerNotFound
+	errPlanNotFound       = lookup.ErrPlanNotFound
+)
+
+// Handler for consumption REST API
+type Handler struct {
+	Repo Repo
+}
+
+var (
+	// ok message responses for handler
+	resConsumption = "consumption retrieved"
+
+	// error message responses for handler
+	resInternal     = "not your fault, don't worry"
+	resInvalid      = "invalid values"
+	resNotFound     = "not found"
+	resPlanNotFound = "controller has no plan"
+)
+
+type consumptionQuery struct {
+	From        time.Time `form:"from" binding:"required" time_format:"2006-01-02T15:04:05Z07:00"`
+	To          time.Time `form:"to" binding:"required" time_format:"2006-01-02T15:04:05Z07:00"`
+	Granularity string    `form:"granularity" binding:"omitempty,oneof=day month"`
+}
+
+// GetConsumption reports the consumption of the controller by day or month of the timezone of the user
+// The plan currently assigned is used for the whole range
+func (h *Handler) GetConsumption(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	// check controllerId
+	controllerId := ctx.Param("controllerId")
+	if _, err := uuid.Parse(controllerId); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	query := &consumptionQuery{}
+	if err := ctx.ShouldBindQuery(query); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	if query.Granularity == "" {
+		query.Granularity = GranularityDay
+	}
+
+	span := query.To.Sub(query.From)
+	if span <= 0 || span > maxConsumptionRange {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	report, err := h.Build(ctx, userId, controllerId, query.From, query.To, query.Granularity)
+	if err != nil {
+		switch err {
+		case errControllerNotFound:
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resNotFound})
+		case errPlanNotFound:
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resPlanNotFound})
+		default:
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resConsumption, "result": report})
+}
+
+// Build works out the report of the controller for the range by granularity, it is what GetConsumption responds with
+func (h *Handler) Build(ctx context.Context, userId string, controllerId string, from time.Time, to time.Time, granularity string) (*Report, error) {
+	c, err := h.Repo.GetController(ctx, userId, controllerId)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Plan == "" {
+		return nil, errPlanNotFound
+	}
+
+	entity, err := h.Repo.GetPlan(ctx, userId, c.Plan)
+	if err != nil {
+		return nil, err
+	}
+
+	timezone, err := h.Repo.GetTimezone(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		location = time.UTC
+	}
+
+	return newReport(controllerId, entity, c.Specs, from, to, location, granularity), nil
+}
+
+// NoPlan reports whether err from Build is because the controller has no plan
+func NoPlan(err error) bool {
+	return err == errPlanNotFound
+}
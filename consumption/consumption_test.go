@@ -0,0 +1,184 @@
+package consumption
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/tPhume/ags-backend/controller"
+	"github.com/tPhume/ags-backend/plan"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// For our tests the grower has a greenhouse with a pump, a lamp and a tariff, and a rack nobody described
+// Both follow the same plan, any other controller id indicates a missing controller
+const (
+	growerId     = "4688e591-b649-4eec-8fcd-d10e1c8af4e5"
+	greenhouseId = "b89588a0-77c2-4bf6-931f-9fe088c8700a"
+	rackId       = "f6ccf9ea-c331-47a9-91af-785ef529aca7"
+	unknownId    = "1d8d78ad-52b3-4e29-abce-80f8ebcc8553"
+)
+
+// Water at half flow for two minutes every morning, light at full power for twelve hours every evening
+var dailyPlan = plan.Entity{
+	PlanId: "7c8ca149-837f-42bb-afbe-97f79493de2e",
+	UserId: growerId,
+	Name:   "Daily",
+	Daily: []plan.Daily{
+		{DailyTime: "06:00", Action: plan.Action{Type: "water", Level: 50, Duration: 120}},
+		{DailyTime: "18:00", Action: plan.Action{Type: "light", Level: 100, Duration: 43200}},
+	},
+}
+
+var controllers = map[string]*Controller{
+	greenhouseId: {Plan: dailyPlan.PlanId, Specs: &controller.Specs{
+		PumpFlowRate: 10,
+		PumpWattage:  60,
+		LampWattage:  200,
+		Tariff:       &controller.Tariff{PricePerKwh: 4, Currency: "THB"},
+	}},
+	rackId: {Plan: dailyPlan.PlanId},
+}
+
+// Repo struct for testing
+type repoStruct struct{}
+
+func (r *repoStruct) GetController(ctx context.Context, userId string, controllerId string) (*Controller, error) {
+	if c, ok := controllers[controllerId]; ok && userId == growerId {
+		return c, nil
+	}
+
+	return nil, errControllerNotFound
+}
+
+func (r *repoStruct) GetPlan(ctx context.Context, userId string, planId string) (*plan.Entity, error) {
+	if planId != dailyPlan.PlanId {
+		return nil, errPlanNotFound
+	}
+
+	return &dailyPlan, nil
+}
+
+func (r *repoStruct) GetTimezone(ctx context.Context, userId string) (string, error) {
+	return "Asia/Bangkok", nil
+}
+
+// Setup func for handler testing
+func setUp() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+
+	engine.Use(func(ctx *gin.Context) {
+		ctx.Set("userId", growerId)
+	})
+
+	return engine
+}
+
+// Test GetConsumption handler
+func TestHandler_GetConsumption(t *testing.T) {
+	engine := setUp()
+	handler := &Handler{Repo: &repoStruct{}}
+	engine.GET(":controllerId", handler.GetConsumption)
+
+	april := "from=2020-04-01T00:00:00%2B07:00&to=2020-05-01T00:00:00%2B07:00"
+
+	testCases := []struct {
+		controllerId string
+		query        string
+		message      string
+		code         int
+		periods      int
+		total        *Usage
+	}{
+		{
+			controllerId: greenhouseId,
+			query:        april + "&granularity=month",
+			message:      resConsumption,
+			code:         http.StatusOK,
+			periods:      1,
+			total:        &Usage{WaterLitres: float(300), PumpKwh: float(0.03), LampKwh: float(72), EnergyKwh: float(72.03), Cost: float(288.12)},
+		}, {
+			controllerId: greenhouseId,
+			query:        april,
+			message:      resConsumption,
+			code:         http.StatusOK,
+			periods:      30,
+			total:        &Usage{WaterLitres: float(300), PumpKwh: float(0.03), LampKwh: float(72), EnergyKwh: float(72.03), Cost: float(288.12)},
+		}, {
+			controllerId: rackId,
+			query:        april,
+			message:      resConsumption,
+			code:         http.StatusOK,
+			periods:      30,
+			total:        &Usage{},
+		}, {
+			controllerId: greenhouseId,
+			query:        april + "&granularity=week",
+			message:      resInvalid,
+			code:         http.StatusBadRequest,
+		}, {
+			controllerId: greenhouseId,
+			query:        "from=2020-04-01T00:00:00Z&to=2021-05-01T00:00:00Z",
+			message:      resInvalid,
+			code:         http.StatusBadRequest,
+		}, {
+			controllerId: unknownId,
+			query:        april,
+			message:      resNotFound,
+			code:         http.StatusNotFound,
+		},
+	}
+
+	for i, c := range testCases {
+		resp := httptest.NewRecorder()
+
+		req, _ := http.NewRequest(http.MethodGet, "/"+c.controllerId+"?"+c.query, nil)
+		engine.ServeHTTP(resp, req)
+
+		respBody := struct {
+			Message string  `json:"message"`
+			Result  *Report `json:"result"`
+		}{}
+		_ = json.Unmarshal(resp.Body.Bytes(), &respBody)
+
+		if c.code != resp.Code {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.code, resp.Code)
+		}
+
+		if c.message != respBody.Message {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.message, respBody.Message)
+		}
+
+		if c.code != http.StatusOK {
+			continue
+		}
+
+		if len(respBody.Result.Periods) != c.periods {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.periods, len(respBody.Result.Periods))
+		}
+
+		total := respBody.Result.Total
+		expected := []*float64{c.total.WaterLitres, c.total.PumpKwh, c.total.LampKwh, c.total.EnergyKwh, c.total.Cost}
+		got := []*float64{total.WaterLitres, total.PumpKwh, total.LampKwh, total.EnergyKwh, total.Cost}
+
+		for j := range expected {
+			if (expected[j] == nil) != (got[j] == nil) || (expected[j] != nil && *expected[j] != *got[j]) {
+				t.Fatalf("Case %d: figure %d expected [%v], got = [%v]", i, j, value(expected[j]), value(got[j]))
+			}
+		}
+	}
+}
+
+func float(value float64) *float64 {
+	return &value
+}
+
+func value(pointer *float64) interface{} {
+	if pointer == nil {
+		return nil
+	}
+
+	return *pointer
+}
@@ -0,0 +1,28 @@
+package consumption
+
+import (
+	"context"
+	"github.com/tPhume/ags-backend/lookup"
+	"github.com/tPhume/ags-backend/plan"
+)
+
+type MongoRepo struct {
+	Lookup *lookup.MongoRepo
+}
+
+func (m *MongoRepo) GetController(ctx context.Context, userId string, controllerId string) (*Controller, error) {
+	controller := &Controller{}
+	if err := m.Lookup.FindController(ctx, userId, controllerId, controller); err != nil {
+		return nil, err
+	}
+
+	return controller, nil
+}
+
+func (m *MongoRepo) GetPlan(ctx context.Context, userId string, planId string) (*plan.Entity, error) {
+	return m.Lookup.GetPlan(ctx, userId, planId)
+}
+
+func (m *MongoRepo) GetTimezone(ctx context.Context, userId string) (string, error) {
+	return m.Lookup.GetTimezone(ctx, userId)
+}
@@ -0,0 +1,145 @@
+package consumption
+
+import (
+	"github.com/tPhume/ags-backend/controller"
+	"github.com/tPhume/ags-backend/plan"
+	"math"
+	"time"
+)
+
+// Report of the consumption of a controller
+type Report struct {
+	ControllerId string            `json:"controller_id"`
+	PlanId       string            `json:"plan_id"`
+	From         time.Time         `json:"from"`
+	To           time.Time         `json:"to"`
+	Timezone     string            `json:"timezone"`
+	Granularity  string            `json:"granularity"`
+	Specs        *controller.Specs `json:"specs"`
+	Currency     string            `json:"currency,omitempty"`
+
+	Total   *Usage   `json:"total"`
+	Periods []*Usage `json:"periods"`
+}
+
+// Usage over a period, or over the whole range for the total
+// A figure is null when the specs it needs are not set, cost also needs a tariff
+type Usage struct {
+	Period      string   `json:"period,omitempty"`
+	WaterLitres *float64 `json:"water_litres"`
+	PumpKwh     *float64 `json:"pump_kwh"`
+	LampKwh     *float64 `json:"lamp_kwh"`
+	EnergyKwh   *float64 `json:"energy_kwh"`
+	Cost        *float64 `json:"cost"`
+
+	water, pump, lamp float64
+}
+
+var periodLayouts = map[string]string{
+	GranularityDay:   "2006-01-02",
+	GranularityMonth: "2006-01",
+}
+
+// newReport adds up every occurrence of the plan within the range
+// An action counts in the period it starts in, even when it runs on into the next one
+func newReport(controllerId string, entity *plan.Entity, specs *controller.Specs, from time.Time, to time.Time, location *time.Location, granularity string) *Report {
+	if specs == nil {
+		specs = &controller.Specs{}
+	}
+
+	report := &Report{
+		ControllerId: controllerId,
+		PlanId:       entity.PlanId,
+		From:         from,
+		To:           to,
+		Timezone:     location.String(),
+		Granularity:  granularity,
+		Specs:        specs,
+		Total:        &Usage{},
+		Periods:      make([]*Usage, 0),
+	}
+
+	if specs.Tariff != nil {
+		report.Currency = specs.Tariff.Currency
+	}
+
+	layout := periodLayouts[granularity]
+	periods := make(map[string]*Usage)
+
+	// Every period of the range, from the one of from to the one of the last instant before to
+	last := to.Add(-time.Nanosecond).In(location).Format(layout)
+	for day := from.In(location); ; day = day.AddDate(0, 0, 1) {
+		period := day.Format(layout)
+		if _, ok := periods[period]; !ok {
+			periods[period] = &Usage{Period: period}
+			report.Periods = append(report.Periods, periods[period])
+		}
+
+		if period >= last {
+			break
+		}
+	}
+
+	for _, occurrence := range entity.Occurrences(from, to, location) {
+		usage := periods[occurrence.Start.In(location).Format(layout)]
+		usage.add(occurrence.Action, specs)
+		report.Total.add(occurrence.Action, specs)
+	}
+
+	for _, usage := range report.Periods {
+		usage.finish(specs)
+	}
+
+	report.Total.finish(specs)
+
+	return report
+}
+
+func (u *Usage) add(action plan.Action, specs *controller.Specs) {
+	fraction := float64(action.Level) / 100
+	seconds := float64(action.Duration)
+
+	switch action.Type {
+	case "water":
+		u.water += specs.PumpFlowRate * seconds / 60 * fraction
+		u.pump += kwh(specs.PumpWattage*fraction, seconds)
+	case "light":
+		u.lamp += kwh(specs.LampWattage*fraction, seconds)
+	}
+}
+
+func kwh(watts float64, seconds float64) float64 {
+	return watts * seconds / 3600 / 1000
+}
+
+// finish rounds the sums into the figures the specs allow for
+func (u *Usage) finish(specs *controller.Specs) {
+	if specs.PumpFlowRate > 0 {
+		u.WaterLitres = round(u.water, 2)
+	}
+
+	if specs.PumpWattage > 0 {
+		u.PumpKwh = round(u.pump, 3)
+	}
+
+	if specs.LampWattage > 0 {
+		u.LampKwh = round(u.lamp, 3)
+	}
+
+	if u.PumpKwh == nil && u.LampKwh == nil {
+		return
+	}
+
+	u.EnergyKwh = round(u.pump+u.lamp, 3)
+
+	if specs.Tariff != nil {
+		u.Cost = round((u.pump+u.lamp)*specs.Tariff.PricePerKwh, 2)
+	}
+}
+
+func round(value float64, places int) *float64 {
+	scale := math.Pow(10, float64(places))
+	rounded := math.Round(value*scale) / scale
+
+	return &rounded
+}
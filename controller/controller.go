@@ -9,9 +9,11 @@ import (
 	"github.com/gin-gonic/gin/binding"
 	"github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
+	"github.com/tPhume/ags-backend/metric"
 	"github.com/tPhume/ags-backend/session"
 	"net/http"
 	"strings"
+	"time"
 )
 
 type mapping map[string]interface{}
@@ -38,12 +40,107 @@ type Entity struct {
 	Desc         string `json:"desc"`
 	Plan         string `json:"plan" binding:"omitempty,uuid4"`
 	Token        string `json:"token,omitempty"`
+
+	// Sensors the controller reports, controllers that declare none report the legacy five
+	Sensors []metric.Sensor `json:"sensors" binding:"omitempty,sensors"`
+
+	// Specs of the actuators, consumption can only be worked out for the ones that are set
+	Specs *Specs `json:"specs,omitempty" binding:"omitempty"`
+
+	// Growing has what DLI and GDD are worked out with, defaults are used when it is not set
+	Growing *Growing `json:"growing,omitempty" binding:"omitempty"`
+
+	// LastContact is when the device last asked for its plan or sent readings, it is ignored in requests
+	LastContact *time.Time `json:"last_contact,omitempty" binding:"-"`
+}
+
+// Specs of the pump and lamp of a controller, the level of an action scales flow and power
+type Specs struct {
+	// PumpFlowRate in litres per minute
+	PumpFlowRate float64 `json:"pump_flow_rate" bson:"pump_flow_rate" binding:"gte=0"`
+
+	// PumpWattage and LampWattage in watts
+	PumpWattage float64 `json:"pump_wattage" bson:"pump_wattage" binding:"gte=0"`
+	LampWattage float64 `json:"lamp_wattage" bson:"lamp_wattage" binding:"gte=0"`
+
+	// Tariff is optional, costs are estimated when it is set
+	Tariff *Tariff `json:"tariff,omitempty" bson:"tariff,omitempty" binding:"omitempty"`
+}
+
+// Tariff of electricity
+type Tariff struct {
+	PricePerKwh float64 `json:"price_per_kwh" bson:"price_per_kwh" binding:"gte=0"`
+	Currency    string  `json:"currency" bson:"currency" binding:"required,len=3,uppercase"`
+}
+
+// Growing conditions of what a controller looks after
+type Growing struct {
+	// LightSource picks the lux to PPFD conversion, sunlight when empty
+	LightSource string `json:"light_source,omitempty" bson:"light_source,omitempty" binding:"omitempty,light_source"`
+
+	// LuxToPpfd in µmol/m²/s per lux overrides the conversion of the light source
+	LuxToPpfd float64 `json:"lux_to_ppfd,omitempty" bson:"lux_to_ppfd,omitempty" binding:"gte=0,lte=1"`
+
+	// Crop picks the base temperature of growing degree days
+	Crop string `json:"crop,omitempty" bson:"crop,omitempty" binding:"omitempty,crop"`
+
+	// BaseTemperature in °C overrides the base temperature of the crop
+	BaseTemperature *float64 `json:"base_temperature,omitempty" bson:"base_temperature,omitempty" binding:"omitempty,gte=-10,lte=40"`
+
+	// SeasonStart is the date growing degree days add up from, from the first summary when empty
+	SeasonStart string `json:"season_start,omitempty" bson:"season_start,omitempty" binding:"omitempty,datetime=2006-01-02"`
+}
+
+// PpfdPerLux returns the lux to PPFD conversion, g can be nil
+func (g *Growing) PpfdPerLux() float64 {
+	if g == nil {
+		return metric.LightSources[metric.DefaultLightSource]
+	}
+
+	if g.LuxToPpfd > 0 {
+		return g.LuxToPpfd
+	}
+
+	if factor, ok := metric.LightSources[g.LightSource]; ok {
+		return factor
+	}
+
+	return metric.LightSources[metric.DefaultLightSource]
+}
+
+// Base returns the base temperature of growing degree days, g can be nil
+func (g *Growing) Base() float64 {
+	if g == nil {
+		return metric.DefaultBaseTemperature
+	}
+
+	if g.BaseTemperature != nil {
+		return *g.BaseTemperature
+	}
+
+	if base, ok := metric.Crops[g.Crop]; ok {
+		return base
+	}
+
+	return metric.DefaultBaseTemperature
+}
+
+// Season returns the date growing degree days add up from, g can be nil
+func (g *Growing) Season() string {
+	if g == nil {
+		return ""
+	}
+
+	return g.SeasonStart
 }
 
 // addStructValidation register StructValidation function to Gin's default validator Engine
 func addValidation() {
 	v := binding.Validator.Engine().(*validator.Validate)
 	_ = v.RegisterValidation("name", NameValidation)
+	_ = v.RegisterValidation("sensors", SensorsValidation)
+	_ = v.RegisterValidation("light_source", LightSourceValidation)
+	_ = v.RegisterValidation("crop", CropValidation)
 }
 
 // Field level validation
@@ -58,6 +155,28 @@ func NameValidation(fl validator.FieldLevel) bool {
 	return true
 }
 
+// SensorsValidation checks the sensor list against the metric registry
+func SensorsValidation(fl validator.FieldLevel) bool {
+	sensors, ok := fl.Field().Interface().([]metric.Sensor)
+	if !ok {
+		return false
+	}
+
+	return metric.Default.ValidateSensors(sensors) == nil
+}
+
+// LightSourceValidation checks the light source has a known conversion
+func LightSourceValidation(fl validator.FieldLevel) bool {
+	_, ok := metric.LightSources[fl.Field().String()]
+	return ok
+}
+
+// CropValidation checks the crop has a known base temperature
+func CropValidation(fl validator.FieldLevel) bool {
+	_, ok := metric.Crops[fl.Field().String()]
+	return ok
+}
+
 // Controller Repo - interface to communicate with data source
 type Repo interface {
 	// AddController creates new controller at data source given *Entity type
@@ -99,10 +218,42 @@ type PlanRepo interface {
 
 var planNotFound = errors.New("plan not found")
 
+// Notifier is told about controllers that were added, updated or removed
+type Notifier interface {
+	ControllerChanged(ctx context.Context, userId string, controllerId string)
+}
+
+// Notifiers tells every Notifier in order
+type Notifiers []Notifier
+
+func (n Notifiers) ControllerChanged(ctx context.Context, userId string, controllerId string) {
+	for _, notifier := range n {
+		notifier.ControllerChanged(ctx, userId, controllerId)
+	}
+}
+
+// Events published about controllers
+const (
+	EventCreated = "controller.created"
+	EventUpdated = "controller.updated"
+	EventRemoved = "controller.removed"
+)
+
+// Publisher is told about changes to controllers as events, data is what the event is about
+type Publisher interface {
+	Publish(ctx context.Context, userId string, event string, data interface{})
+}
+
 // Handler for controller REST API
 type Handler struct {
 	Repo     Repo
 	PlanRepo PlanRepo
+
+	// Notifier is optional
+	Notifier Notifier
+
+	// Publisher is optional
+	Publisher Publisher
 }
 
 var (
@@ -148,6 +299,7 @@ func (h *Handler) AddController(ctx *gin.Context) {
 	}
 
 	entity.Name = strings.TrimSpace(entity.Name)
+	entity.LastContact = nil
 
 	if entity.Plan != "" {
 		if err := h.PlanRepo.PlanExist(ctx, entity.UserId, entity.Plan); err != nil {
@@ -171,6 +323,8 @@ func (h *Handler) AddController(ctx *gin.Context) {
 		return
 	}
 
+	h.notify(ctx, userId, entity.ControllerId)
+	h.publish(ctx, userId, EventCreated, entity)
 	ctx.JSON(http.StatusCreated, gin.H{"message": resAdded, "controller": entity})
 }
 
@@ -244,6 +398,7 @@ func (h *Handler) UpdateController(ctx *gin.Context) {
 	}
 
 	entity.Name = strings.TrimSpace(entity.Name)
+	entity.LastContact = nil
 
 	if entity.Plan != "" {
 		if err := h.PlanRepo.PlanExist(ctx, entity.UserId, entity.Plan); err != nil {
@@ -268,6 +423,8 @@ func (h *Handler) UpdateController(ctx *gin.Context) {
 		return
 	}
 
+	h.notify(ctx, userId, controllerId)
+	h.publish(ctx, userId, EventUpdated, entity)
 	ctx.JSON(http.StatusOK, gin.H{"message": resUpdate, "controller": entity})
 }
 
@@ -295,6 +452,8 @@ func (h *Handler) RemoveController(ctx *gin.Context) {
 		return
 	}
 
+	h.notify(ctx, userId, controllerId)
+	h.publish(ctx, userId, EventRemoved, gin.H{"controller_id": controllerId})
 	ctx.JSON(http.StatusOK, gin.H{"message": resRemove})
 }
 
@@ -326,3 +485,30 @@ func (h *Handler) GenerateToken(ctx *gin.Context) {
 
 	ctx.JSON(http.StatusOK, gin.H{"message": resGenerate, "token": token})
 }
+
+func (h *Handler) notify(ctx context.Context, userId string, controllerId string) {
+	if h.Notifier != nil {
+		h.Notifier.ControllerChanged(ctx, userId, controllerId)
+	}
+}
+
+// publish leaves the token out, it is the secret of the device
+func (h *Handler) publish(ctx context.Context, userId string, event string, data interface{}) {
+	if h.Publisher == nil {
+		return
+	}
+
+	if entity, ok := data.(*Entity); ok {
+		data = public(entity)
+	}
+
+	h.Publisher.Publish(ctx, userId, event, data)
+}
+
+// public is a copy of the entity without its token, for events
+func public(entity *Entity) *Entity {
+	copied := *entity
+	copied.Token = ""
+
+	return &copied
+}
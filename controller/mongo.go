@@ -2,22 +2,35 @@ package controller
 
 import (
 	"context"
+	"github.com/tPhume/ags-backend/metric"
+	"github.com/tPhume/ags-backend/outbox"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"time"
 )
 
 type MongoRepo struct {
 	Col *mongo.Collection
+
+	// OutboxCol is optional, changes to controllers are written together with their event when it is set
+	OutboxCol *mongo.Collection
 }
 
 func (m *MongoRepo) AddController(ctx context.Context, entity *Entity) (error, error) {
-	if _, err := m.Col.InsertOne(ctx, bson.M{
-		"_id":     entity.ControllerId,
-		"user_id": entity.UserId,
-		"name":    entity.Name,
-		"desc":    entity.Desc,
-		"plan":    entity.Plan,
-		"token":   entity.Token,
+	if err := outbox.WithEvent(ctx, m.OutboxCol, entity.UserId, EventCreated, public(entity), func(ctx context.Context) error {
+		_, err := m.Col.InsertOne(ctx, bson.M{
+			"_id":     entity.ControllerId,
+			"user_id": entity.UserId,
+			"name":    entity.Name,
+			"desc":    entity.Desc,
+			"plan":    entity.Plan,
+			"token":   entity.Token,
+			"sensors": entity.Sensors,
+			"specs":   entity.Specs,
+			"growing": entity.Growing,
+		})
+
+		return err
 	}); err != nil {
 		writeException, ok := err.(mongo.WriteException)
 		if !ok {
@@ -56,6 +69,10 @@ func (m *MongoRepo) ListControllers(ctx context.Context, userId string) ([]*Enti
 			Desc:         result.Desc,
 			Plan:         result.Plan,
 			Token:        result.Token,
+			Sensors:      result.Sensors,
+			Specs:        result.Specs,
+			Growing:      result.Growing,
+			LastContact:  result.LastContact,
 		})
 	}
 
@@ -85,43 +102,56 @@ func (m *MongoRepo) GetController(ctx context.Context, entity *Entity) error {
 	entity.Desc = resultBody.Desc
 	entity.Plan = resultBody.Plan
 	entity.Token = resultBody.Token
+	entity.Sensors = resultBody.Sensors
+	entity.Specs = resultBody.Specs
+	entity.Growing = resultBody.Growing
+	entity.LastContact = resultBody.LastContact
 
 	return nil
 }
 
 func (m *MongoRepo) UpdateController(ctx context.Context, entity *Entity) error {
-	result := m.Col.FindOneAndUpdate(ctx, bson.M{"_id": entity.ControllerId, "user_id": entity.UserId}, bson.M{
-		"$set": bson.M{
-			"name": entity.Name,
-			"desc": entity.Desc,
-			"plan": entity.Plan,
-		},
+	err := outbox.WithEvent(ctx, m.OutboxCol, entity.UserId, EventUpdated, public(entity), func(ctx context.Context) error {
+		return m.Col.FindOneAndUpdate(ctx, bson.M{"_id": entity.ControllerId, "user_id": entity.UserId}, bson.M{
+			"$set": bson.M{
+				"name":    entity.Name,
+				"desc":    entity.Desc,
+				"plan":    entity.Plan,
+				"sensors": entity.Sensors,
+				"specs":   entity.Specs,
+				"growing": entity.Growing,
+			},
+		}).Err()
 	})
 
-	if result.Err() != nil {
-		if result.Err() == mongo.ErrNoDocuments {
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
 			return controllerNotFound
 		}
 
-		if err, ok := result.Err().(mongo.CommandError); ok {
+		if err, ok := err.(mongo.CommandError); ok {
 			if err.Code == 11000 {
 				return duplicateName
 			}
 		}
 
-		return result.Err()
+		return err
 	}
 
 	return nil
 }
 
 func (m *MongoRepo) RemoveController(ctx context.Context, userId string, controllerId string) error {
-	if result := m.Col.FindOneAndDelete(ctx, bson.M{"_id": controllerId, "userId": userId}); result.Err() != nil {
-		if result.Err() == mongo.ErrNoDocuments {
+	err := outbox.WithEvent(ctx, m.OutboxCol, userId, EventRemoved, bson.M{"controller_id": controllerId}, func(ctx context.Context) error {
+		return m.Col.FindOneAndDelete(ctx, bson.M{"_id": controllerId, "user_id": userId}).Err()
+	})
+
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
 			return controllerNotFound
 		}
 
-		return result.Err()
+		return err
 	}
 
 	return nil
@@ -142,11 +172,15 @@ func (m *MongoRepo) GenerateToken(ctx context.Context, userId string, controller
 }
 
 type Result struct {
-	ControllerId string `bson:"_id"`
-	Name         string `json:"name"`
-	Desc         string `json:"desc"`
-	Plan         string `json:"plan"`
-	Token        string `json:"token"`
+	ControllerId string          `bson:"_id"`
+	Name         string          `json:"name"`
+	Desc         string          `json:"desc"`
+	Plan         string          `json:"plan"`
+	Token        string          `json:"token"`
+	Sensors      []metric.Sensor `json:"sensors"`
+	Specs        *Specs          `json:"specs"`
+	Growing      *Growing        `json:"growing"`
+	LastContact  *time.Time      `json:"last_contact" bson:"last_contact"`
 }
 
 // For PlanRepo type
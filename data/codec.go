@@ -0,0 +1,203 @@
+package data
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Content types accepted by DecodeReadings
+const (
+	ContentTypeJson   = "application/json"
+	ContentTypeBinary = "application/vnd.ags.reading"
+)
+
+// Compact binary forms for constrained devices, all integers are big endian
+//
+//	offset 0  uint8   version, binaryVersionLegacy or binaryVersion
+//	offset 1  uint8   number of records that follow
+//
+// Each record of version 1 is binaryRecordSize bytes and only holds the legacy sensors
+//
+//	offset 0  int64   unix timestamp in milliseconds
+//	offset 8  int16   temperature in hundredths of a degree Celsius
+//	offset 10 uint16  humidity in hundredths of a percent
+//	offset 12 uint16  light
+//	offset 14 uint16  soil moisture
+//	offset 16 uint16  water level
+//
+// Each record of version 2 has any sensors
+//
+//	offset 0  int64   unix timestamp in milliseconds
+//	offset 8  uint8   number of values that follow
+//
+// followed by each value
+//
+//	offset 0  uint8   length of the sensor key
+//	offset 1  bytes   sensor key
+//	offset n  float64 value
+const (
+	binaryVersionLegacy = 1
+	binaryVersion       = 2
+	binaryHeaderSize    = 2
+	binaryRecordSize    = 18
+)
+
+// DecodeReadings decodes a message body into readings
+// JSON bodies use the same shape as the AddReadings request body, a single reading object is also accepted
+// Readings are not validated, use ValidateReadings or Ingest
+func DecodeReadings(contentType string, body []byte) ([]*Reading, error) {
+	// Ignore parameters such as charset
+	contentType = strings.TrimSpace(strings.Split(contentType, ";")[0])
+
+	switch contentType {
+	case ContentTypeJson, "":
+		return decodeJson(body)
+	case ContentTypeBinary:
+		return decodeBinary(body)
+	}
+
+	return nil, errBadPayload
+}
+
+func decodeJson(body []byte) ([]*Reading, error) {
+	batch := &readingsBody{}
+	if err := json.Unmarshal(body, batch); err == nil && len(batch.Readings) != 0 {
+		return batch.Readings, nil
+	}
+
+	reading := &Reading{}
+	if err := json.Unmarshal(body, reading); err != nil || reading.Timestamp.IsZero() {
+		return nil, errBadPayload
+	}
+
+	return []*Reading{reading}, nil
+}
+
+func decodeBinary(body []byte) ([]*Reading, error) {
+	if len(body) < binaryHeaderSize {
+		return nil, errBadPayload
+	}
+
+	switch body[0] {
+	case binaryVersionLegacy:
+		return decodeBinaryLegacy(body)
+	case binaryVersion:
+		return decodeBinaryMetrics(body)
+	}
+
+	return nil, errBadPayload
+}
+
+func decodeBinaryLegacy(body []byte) ([]*Reading, error) {
+	count := int(body[1])
+	if len(body) != binaryHeaderSize+count*binaryRecordSize {
+		return nil, errBadPayload
+	}
+
+	readings := make([]*Reading, count)
+	for i := range readings {
+		record := body[binaryHeaderSize+i*binaryRecordSize:]
+
+		readings[i] = &Reading{
+			Timestamp: fromMillis(int64(binary.BigEndian.Uint64(record[0:8]))),
+			Metrics: map[string]float64{
+				"temperature":   float64(int16(binary.BigEndian.Uint16(record[8:10]))) / 100,
+				"humidity":      float64(binary.BigEndian.Uint16(record[10:12])) / 100,
+				"light":         float64(binary.BigEndian.Uint16(record[12:14])),
+				"soil_moisture": float64(binary.BigEndian.Uint16(record[14:16])),
+				"water_level":   float64(binary.BigEndian.Uint16(record[16:18])),
+			},
+		}
+	}
+
+	return readings, nil
+}
+
+func decodeBinaryMetrics(body []byte) ([]*Reading, error) {
+	count := int(body[1])
+	rest := body[binaryHeaderSize:]
+
+	readings := make([]*Reading, count)
+	for i := range readings {
+		if len(rest) < 9 {
+			return nil, errBadPayload
+		}
+
+		reading := &Reading{
+			Timestamp: fromMillis(int64(binary.BigEndian.Uint64(rest[0:8]))),
+			Metrics:   make(map[string]float64, rest[8]),
+		}
+
+		values := int(rest[8])
+		rest = rest[9:]
+
+		for j := 0; j < values; j++ {
+			if len(rest) < 1 || len(rest) < 1+int(rest[0])+8 {
+				return nil, errBadPayload
+			}
+
+			keyEnd := 1 + int(rest[0])
+			reading.Metrics[string(rest[1:keyEnd])] = math.Float64frombits(binary.BigEndian.Uint64(rest[keyEnd : keyEnd+8]))
+			rest = rest[keyEnd+8:]
+		}
+
+		readings[i] = reading
+	}
+
+	if len(rest) != 0 {
+		return nil, errBadPayload
+	}
+
+	return readings, nil
+}
+
+// EncodeReadings writes readings in the current binary form
+// At most 255 readings fit in one message, with at most 255 values of keys no longer than 255 bytes
+func EncodeReadings(readings []*Reading) ([]byte, error) {
+	if len(readings) > math.MaxUint8 {
+		return nil, errBadPayload
+	}
+
+	body := []byte{binaryVersion, uint8(len(readings))}
+	for _, reading := range readings {
+		if len(reading.Metrics) > math.MaxUint8 {
+			return nil, errBadPayload
+		}
+
+		body = appendUint64(body, uint64(reading.Timestamp.UnixNano()/int64(time.Millisecond)))
+		body = append(body, uint8(len(reading.Metrics)))
+
+		// Keys are sorted so that the same reading always encodes the same way
+		keys := make([]string, 0, len(reading.Metrics))
+		for key := range reading.Metrics {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if len(key) > math.MaxUint8 {
+				return nil, errBadPayload
+			}
+
+			body = append(body, uint8(len(key)))
+			body = append(body, key...)
+			body = appendUint64(body, math.Float64bits(reading.Metrics[key]))
+		}
+	}
+
+	return body, nil
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func fromMillis(millis int64) time.Time {
+	return time.Unix(millis/1000, millis%1000*int64(time.Millisecond)).UTC()
+}
@@ -0,0 +1,118 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Test DecodeReadings for every accepted content type
+func TestDecodeReadings(t *testing.T) {
+	timestamp := time.Date(2020, time.April, 15, 10, 0, 0, 250*int(time.Millisecond), time.UTC)
+	expected := &Reading{
+		Timestamp: timestamp,
+		Metrics: map[string]float64{
+			"temperature":   -3.25,
+			"humidity":      61.5,
+			"light":         1200,
+			"soil_moisture": 400,
+			"water_level":   80,
+		},
+	}
+
+	binary, err := EncodeReadings([]*Reading{expected, expected})
+	if err != nil {
+		t.Fatalf("could not encode readings: %v", err)
+	}
+
+	// Version 1 record of the same reading
+	legacyRecord := []byte{0, 0, 1, 113, 125, 71, 245, 250, 254, 187, 24, 6, 4, 176, 1, 144, 0, 80}
+	legacy := append([]byte{1, 2}, append(legacyRecord, legacyRecord...)...)
+
+	jsonReading := `{"timestamp":"2020-04-15T10:00:00.25Z","temperature":-3.25,"humidity":61.5,"light":1200,"soil_moisture":400,"water_level":80}`
+	jsonMetrics := `{"timestamp":"2020-04-15T10:00:00.25Z","temperature":0,"metrics":{"temperature":-3.25,"humidity":61.5,"light":1200,"soil_moisture":400,"water_level":80}}`
+
+	testCases := []struct {
+		contentType string
+		body        []byte
+		count       int
+		err         error
+	}{
+		{
+			contentType: ContentTypeJson,
+			body:        []byte(`{"readings":[` + jsonReading + `,` + jsonMetrics + `]}`),
+			count:       2,
+		}, {
+			contentType: "application/json; charset=utf-8",
+			body:        []byte(jsonReading),
+			count:       1,
+		}, {
+			contentType: ContentTypeBinary,
+			body:        binary,
+			count:       2,
+		}, {
+			contentType: ContentTypeBinary,
+			body:        legacy,
+			count:       2,
+		}, {
+			contentType: ContentTypeBinary,
+			body:        binary[:len(binary)-1],
+			err:         errBadPayload,
+		}, {
+			contentType: ContentTypeBinary,
+			body:        legacy[:len(legacy)-1],
+			err:         errBadPayload,
+		}, {
+			contentType: ContentTypeBinary,
+			body:        append([]byte{3}, binary[1:]...),
+			err:         errBadPayload,
+		}, {
+			contentType: ContentTypeJson,
+			body:        []byte(`{"temperature":25}`),
+			err:         errBadPayload,
+		}, {
+			contentType: "text/plain",
+			body:        []byte(jsonReading),
+			err:         errBadPayload,
+		},
+	}
+
+	for i, c := range testCases {
+		readings, err := DecodeReadings(c.contentType, c.body)
+		if err != c.err {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.err, err)
+		}
+
+		if len(readings) != c.count {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.count, len(readings))
+		}
+
+		for _, reading := range readings {
+			if !reading.Timestamp.Equal(expected.Timestamp) || !reflect.DeepEqual(reading.Metrics, expected.Metrics) {
+				t.Fatalf("Case %d: expected [%+v], got = [%+v]", i, expected, reading)
+			}
+		}
+	}
+}
+
+// Test readings keep sensors other than the legacy ones through the binary form
+func TestEncodeReadings(t *testing.T) {
+	reading := &Reading{
+		Timestamp: time.Date(2020, time.April, 15, 10, 0, 0, 0, time.UTC),
+		Metrics:   map[string]float64{"co2": 812.5, "soil_moisture_1": 300, "soil_moisture_2": 410},
+	}
+
+	body, err := EncodeReadings([]*Reading{reading})
+	if err != nil {
+		t.Fatalf("could not encode readings: %v", err)
+	}
+
+	readings, err := DecodeReadings(ContentTypeBinary, body)
+	if err != nil || len(readings) != 1 {
+		t.Fatalf("could not decode readings: %v", err)
+	}
+
+	if !reflect.DeepEqual(readings[0].Metrics, reading.Metrics) {
+		t.Fatalf("expected [%v], got = [%v]", reading.Metrics, readings[0].Metrics)
+	}
+}
@@ -4,48 +4,183 @@ import (
 	"context"
 	"errors"
 	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
+	"github.com/tPhume/ags-backend/metric"
 	"github.com/tPhume/ags-backend/session"
 	"net/http"
+	"strings"
+	"time"
 )
 
 func RegisterRoutes(handler *Handler, engine *gin.Engine, sessionHandler *session.Handler) {
+	engine.POST("api-controller/v1/data", handler.AddReadings)
+
 	group := engine.Group("api/v1/data")
 	group.Use(sessionHandler.GetUser)
 
 	group.GET("/:controllerId", handler.GetData)
+	group.GET("/:controllerId/history", handler.GetHistory)
+	group.GET("/:controllerId/export", handler.ExportReadings)
+	group.GET("/:controllerId/quality", handler.GetQuality)
 }
 
 // Controller Entity type represent edge device
+// The five fixed fields are kept for older apps, Metrics has the latest value of every sensor
 type Entity struct {
-	ControllerId string  `bson:"_id" json:"controller_id"`
-	UserId       string  `bson:"user_id" json:"user_id"`
-	Temperature  float64 `bson:"temperature" json:"temperature"`
-	Humidity     float64 `bson:"humidity" json:"humidity"`
-	Light        float64 `bson:"light" json:"light"`
-	SoilMoisture int     `bson:"soil_moisture" json:"soil_moisture"`
-	WaterLevel   int     `bson:"water_level" json:"water_level"`
+	ControllerId string             `bson:"_id" json:"controller_id"`
+	UserId       string             `bson:"user_id" json:"user_id"`
+	Temperature  float64            `bson:"temperature" json:"temperature"`
+	Humidity     float64            `bson:"humidity" json:"humidity"`
+	Light        float64            `bson:"light" json:"light"`
+	SoilMoisture int                `bson:"soil_moisture" json:"soil_moisture"`
+	WaterLevel   int                `bson:"water_level" json:"water_level"`
+	Metrics      map[string]float64 `bson:"metrics" json:"metrics"`
+	// Timestamp of the reading the values above came from
+	Timestamp time.Time `bson:"timestamp" json:"timestamp"`
+}
+
+// Controller is what handling data needs to know about a controller
+type Controller struct {
+	ControllerId string          `bson:"_id"`
+	UserId       string          `bson:"user_id"`
+	Name         string          `bson:"name"`
+	Sensors      []metric.Sensor `bson:"sensors"`
+}
+
+// Body for AddReadings
+type readingsBody struct {
+	Readings []*Reading `json:"readings" binding:"required,min=1,max=500,dive,required"`
+}
+
+// Device clocks drift, readings slightly in the future are still accepted
+const maxClockSkew = 5 * time.Minute
+
+// ValidateReadings checks readings have values of the sensors of the controller
+// Readings must have a timestamp that isn't ahead of now and at least one value
+// Values are not rejected for being implausible, Ingest flags them instead
+func ValidateReadings(readings []*Reading, sensors []metric.Sensor, now time.Time) error {
+	if len(readings) == 0 {
+		return errNoReadings
+	}
+
+	for _, reading := range readings {
+		if reading.Timestamp.IsZero() || reading.Timestamp.After(now.Add(maxClockSkew)) {
+			return errBadTimestamp
+		}
+
+		if len(reading.Metrics) == 0 {
+			return errEmptyReading
+		}
+
+		if err := metric.Default.CheckSensors(sensors, reading.Metrics); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // Repo
 type Repo interface {
 	GetData(ctx context.Context, entity *Entity) error
+
+	// GetUserController returns the controller if it belongs to userId
+	GetUserController(ctx context.Context, userId string, controllerId string) (*Controller, error)
+
+	// GetController returns the controller that owns the token and records that it made contact
+	GetController(ctx context.Context, token string) (*Controller, error)
+
+	// AddReadings appends readings to the history and moves the latest values forward
+	// Readings already stored for the controller at the same timestamp are ignored
+	// Returns the readings that were not already stored
+	AddReadings(ctx context.Context, controllerId string, userId string, readings []*Reading) ([]*Reading, error)
+
+	// GetSensorStates returns the state of every sensor of the controller that has sent a value and the version of the states
+	GetSensorStates(ctx context.Context, controllerId string) (map[string]*SensorState, int, error)
+
+	// SetSensorStates replaces the states of the sensors of the controller if they are still at version
+	// Returns errStatesChanged when another submission replaced them first
+	SetSensorStates(ctx context.Context, controllerId string, states map[string]*SensorState, version int) error
+
+	// EachReading calls fn with every reading of the controller in [from, to) in time order
+	// Iteration stops at the first error returned by fn
+	EachReading(ctx context.Context, userId string, controllerId string, from time.Time, to time.Time, fn func(*Reading) error) error
 }
 
 var (
-	notFound = errors.New("not found")
+	notFound         = errors.New("not found")
+	errTokenNotFound = errors.New("token not found")
+	errNoReadings    = errors.New("no readings")
+	errBadTimestamp  = errors.New("timestamp missing or in the future")
+	errBadPayload    = errors.New("payload could not be decoded")
+	errEmptyReading  = errors.New("reading has no values")
+	errStatesChanged = errors.New("sensor states changed")
 
 	// ok message responses for handler
-	resGet = "data retrieved"
+	resGet     = "data retrieved"
+	resAdd     = "readings added"
+	resHistory = "history retrieved"
+	resQuality = "quality retrieved"
 
 	// error message responses for handler
-	resInternal = "not your fault, don't worry"
-	resInvalid  = "invalid values"
-	resNotFound = "not found"
+	resInternal      = "not your fault, don't worry"
+	resInvalid       = "invalid values"
+	resNotFound      = "not found"
+	resTokenNotFound = "token not found"
+	resRangeTooLarge = "requested range has too many points"
 )
 
+// Bounds on history queries so a single request can't scan months of raw readings
+const (
+	maxHistoryRange  = 31 * 24 * time.Hour
+	maxHistoryPoints = 1000
+	minHistoryStep   = time.Minute
+
+	// Used when step is left out
+	defaultHistoryPoints = 200
+)
+
+// Query for GetHistory, from and to are RFC 3339 and step is a Go duration such as 15m
+type historyQuery struct {
+	From        time.Time `form:"from" binding:"required" time_format:"2006-01-02T15:04:05Z07:00"`
+	To          time.Time `form:"to" binding:"required" time_format:"2006-01-02T15:04:05Z07:00"`
+	Metrics     string    `form:"metrics"`
+	Step        string    `form:"step"`
+	Aggregation string    `form:"agg"`
+}
+
+// History is a downsampled series per requested sensor
+// Aggregation is only set when one was asked for, otherwise every metric uses its own
+type History struct {
+	ControllerId string             `json:"controller_id"`
+	From         time.Time          `json:"from"`
+	To           time.Time          `json:"to"`
+	Step         string             `json:"step"`
+	Aggregation  string             `json:"aggregation,omitempty"`
+	Aggregations map[string]string  `json:"aggregations"`
+	Series       map[string][]Point `json:"series"`
+}
+
+// Notifier is told about readings once they are stored
+type Notifier interface {
+	ReadingsAdded(ctx context.Context, controllerId string, userId string, readings []*Reading)
+}
+
+// Notifiers tells every Notifier in order
+type Notifiers []Notifier
+
+func (n Notifiers) ReadingsAdded(ctx context.Context, controllerId string, userId string, readings []*Reading) {
+	for _, notifier := range n {
+		notifier.ReadingsAdded(ctx, controllerId, userId, readings)
+	}
+}
+
 type Handler struct {
 	Repo Repo
+
+	// Notifier is optional
+	Notifier Notifier
 }
 
 func (h *Handler) GetData(ctx *gin.Context) {
@@ -73,5 +208,309 @@ func (h *Handler) GetData(ctx *gin.Context) {
 		return
 	}
 
+	controller, err := h.Repo.GetUserController(ctx, userId, controllerId)
+	if err != nil {
+		if err == notFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resNotFound})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	// The latest values are only stored when they are good
+	if entity.Metrics != nil {
+		newDeriver(metric.Sensors(controller.Sensors)).derive(entity.Metrics, nil)
+	}
+
 	ctx.JSON(http.StatusOK, gin.H{"message": resGet, "data": entity})
 }
+
+// AddReadings is for the Controller using Token
+// Submitting the same readings again is safe, duplicates are counted but not stored twice
+func (h *Handler) AddReadings(ctx *gin.Context) {
+	token := ctx.GetHeader("token")
+	if strings.TrimSpace(token) == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	body := &readingsBody{}
+	if err := ctx.ShouldBindJSON(body); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid, "err": err.Error()})
+		return
+	}
+
+	added, err := h.Ingest(ctx, token, body.Readings)
+	if err != nil {
+		if err == errTokenNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resTokenNotFound})
+		} else if Rejected(err) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid, "err": err.Error()})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, gin.H{"message": resAdd, "added": added, "duplicate": len(body.Readings) - added})
+}
+
+// Ingest validates and stores readings for the controller that owns token
+// It is the single storage path for readings, whichever transport they arrived on
+func (h *Handler) Ingest(ctx context.Context, token string, readings []*Reading) (int, error) {
+	if strings.TrimSpace(token) == "" {
+		return 0, errTokenNotFound
+	}
+
+	controller, err := h.Repo.GetController(ctx, token)
+	if err != nil {
+		return 0, err
+	}
+
+	sensors := metric.Sensors(controller.Sensors)
+	if err := ValidateReadings(readings, sensors, time.Now()); err != nil {
+		return 0, err
+	}
+
+	if err := h.flag(ctx, controller.ControllerId, readings, sensors); err != nil {
+		return 0, err
+	}
+
+	added, err := h.Repo.AddReadings(ctx, controller.ControllerId, controller.UserId, readings)
+	if err != nil {
+		return 0, err
+	}
+
+	// Duplicates were already told about when they were first stored
+	if len(added) != 0 && h.Notifier != nil {
+		h.Notifier.ReadingsAdded(ctx, controller.ControllerId, controller.UserId, added)
+	}
+
+	return len(added), nil
+}
+
+// Submissions of one controller racing to flag are tried this many times
+const maxFlagAttempts = 5
+
+// flag sets the quality flags of readings against the sensor states and saves the states they moved to
+// States are saved before the readings, so that two submissions never flag from the same states
+// Should storing the readings then fail, a resubmission is older than the states and only checked against ranges
+func (h *Handler) flag(ctx context.Context, controllerId string, readings []*Reading, sensors []metric.Sensor) error {
+	for attempt := 1; ; attempt++ {
+		states, version, err := h.Repo.GetSensorStates(ctx, controllerId)
+		if err != nil {
+			return err
+		}
+
+		for _, reading := range readings {
+			reading.Quality = nil
+		}
+
+		flagReadings(readings, sensors, states)
+
+		err = h.Repo.SetSensorStates(ctx, controllerId, states, version)
+		if err != errStatesChanged || attempt == maxFlagAttempts {
+			return err
+		}
+	}
+}
+
+// Rejected reports whether err from Ingest was caused by the submission itself
+// Retrying a rejected submission will never succeed
+func Rejected(err error) bool {
+	for _, rejected := range []error{
+		errTokenNotFound, errNoReadings, errBadTimestamp, errBadPayload, errEmptyReading,
+		metric.ErrUnknownSensor, metric.ErrUnknownMetric, metric.ErrOutOfRange,
+	} {
+		if errors.Is(err, rejected) {
+			return true
+		}
+	}
+
+	_, ok := err.(validator.ValidationErrors)
+	return ok
+}
+
+// GetHistory returns downsampled series of the controller's readings
+func (h *Handler) GetHistory(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	// check controllerId
+	controllerId := ctx.Param("controllerId")
+	if _, err := uuid.Parse(controllerId); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	query := &historyQuery{}
+	if err := ctx.ShouldBindQuery(query); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid, "err": err.Error()})
+		return
+	}
+
+	span := query.To.Sub(query.From)
+	if span <= 0 || span > maxHistoryRange {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	controller, err := h.Repo.GetUserController(ctx, userId, controllerId)
+	if err != nil {
+		if err == notFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resNotFound})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	sensors := metric.Sensors(controller.Sensors)
+	keys, aggregations, ok := parseMetrics(query.Metrics, query.Aggregation, metric.WithDerived(sensors))
+	if !ok {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	step := (span / defaultHistoryPoints).Truncate(time.Minute)
+	if query.Step != "" {
+		var err error
+		if step, err = time.ParseDuration(query.Step); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+			return
+		}
+	}
+
+	if step < minHistoryStep {
+		step = minHistoryStep
+	}
+
+	if span/step > maxHistoryPoints {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resRangeTooLarge})
+		return
+	}
+
+	sampler := newDownsampler(query.From, step, keys, aggregations)
+	deriver := newDeriver(sensors)
+	err = h.Repo.EachReading(ctx, userId, controllerId, query.From, query.To, func(reading *Reading) error {
+		deriver.derive(reading.Metrics, reading.Quality)
+		sampler.add(reading)
+		return nil
+	})
+
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	history := &History{
+		ControllerId: controllerId,
+		From:         query.From,
+		To:           query.To,
+		Step:         step.String(),
+		Aggregation:  query.Aggregation,
+		Aggregations: aggregations,
+		Series:       sampler.series(),
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resHistory, "result": history})
+}
+
+// Query for GetQuality, from and to are RFC 3339
+type qualityQuery struct {
+	From time.Time `form:"from" binding:"required" time_format:"2006-01-02T15:04:05Z07:00"`
+	To   time.Time `form:"to" binding:"required" time_format:"2006-01-02T15:04:05Z07:00"`
+}
+
+// GetQuality returns the share of good values of every sensor of the controller
+func (h *Handler) GetQuality(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	// check controllerId
+	controllerId := ctx.Param("controllerId")
+	if _, err := uuid.Parse(controllerId); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	query := &qualityQuery{}
+	if err := ctx.ShouldBindQuery(query); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid, "err": err.Error()})
+		return
+	}
+
+	span := query.To.Sub(query.From)
+	if span <= 0 || span > maxHistoryRange {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	controller, err := h.Repo.GetUserController(ctx, userId, controllerId)
+	if err != nil {
+		if err == notFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resNotFound})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	quality := newQuality(controllerId, query.From, query.To, metric.Sensors(controller.Sensors))
+	err = h.Repo.EachReading(ctx, userId, controllerId, query.From, query.To, func(reading *Reading) error {
+		quality.add(reading)
+		return nil
+	})
+
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	quality.finish()
+	ctx.JSON(http.StatusOK, gin.H{"message": resQuality, "result": quality})
+}
+
+// parseMetrics splits a comma separated list of sensor keys, an empty list means every sensor
+// Each sensor is aggregated with aggregation, or the default of its metric when it is empty
+func parseMetrics(value string, aggregation string, sensors []metric.Sensor) ([]string, map[string]string, bool) {
+	keys := make([]string, 0, len(sensors))
+	if strings.TrimSpace(value) == "" {
+		for _, sensor := range sensors {
+			keys = append(keys, sensor.Key)
+		}
+	} else {
+		for _, key := range strings.Split(value, ",") {
+			keys = append(keys, strings.TrimSpace(key))
+		}
+	}
+
+	aggregations := make(map[string]string, len(keys))
+	for _, key := range keys {
+		m, err := metric.Default.SensorMetric(sensors, key)
+		if err != nil {
+			return nil, nil, false
+		}
+
+		if aggregation == "" {
+			aggregations[key] = m.Aggregation
+		} else if m.Allows(aggregation) {
+			aggregations[key] = aggregation
+		} else {
+			return nil, nil, false
+		}
+	}
+
+	return keys, aggregations, true
+}
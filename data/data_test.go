@@ -0,0 +1,544 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/tPhume/ags-backend/metric"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type mapping map[string]interface{}
+
+const (
+	goodToken     = "f911ec3e-7c28-4257-a9dd-99f1ff27704e"
+	rigToken      = "0b6a3e0c-2a8d-4f4e-9d8e-2f0b3b8b6d11"
+	internalToken = "ebd03d33-6659-4241-9e59-d8dad087cc34"
+	controllerId  = "f1d67e51-4ca4-4b25-a4b7-6c8f06822075"
+	userId        = "76de6d55-e457-4070-8aef-5633726d498f"
+)
+
+// Repo struct for testing, remembers stored timestamps to act like the unique index
+// races is how many more times saving sensor states loses to another submission
+type repoStruct struct {
+	stored  map[int64]bool
+	version int
+	races   int
+}
+
+func (t *repoStruct) GetData(ctx context.Context, entity *Entity) error {
+	return notFound
+}
+
+// A rig declares its sensors, other controllers have the legacy ones
+var rigSensors = []metric.Sensor{
+	{Key: "co2", Metric: "co2"},
+	{Key: "soil_moisture_1", Metric: "soil_moisture"},
+	{Key: "soil_moisture_2", Metric: "soil_moisture"},
+}
+
+func (t *repoStruct) GetUserController(ctx context.Context, userId string, id string) (*Controller, error) {
+	if id != controllerId {
+		return nil, notFound
+	}
+
+	return &Controller{ControllerId: controllerId, UserId: userId, Name: "North greenhouse"}, nil
+}
+
+func (t *repoStruct) GetController(ctx context.Context, token string) (*Controller, error) {
+	if token == goodToken {
+		return &Controller{ControllerId: controllerId, UserId: userId}, nil
+	} else if token == rigToken {
+		return &Controller{ControllerId: controllerId, UserId: userId, Sensors: rigSensors}, nil
+	} else if token == internalToken {
+		return nil, errors.New("some error")
+	}
+
+	return nil, errTokenNotFound
+}
+
+func (t *repoStruct) AddReadings(ctx context.Context, controllerId string, userId string, readings []*Reading) ([]*Reading, error) {
+	added := make([]*Reading, 0)
+	for _, reading := range readings {
+		if !t.stored[reading.Timestamp.UnixNano()] {
+			t.stored[reading.Timestamp.UnixNano()] = true
+			added = append(added, reading)
+		}
+	}
+
+	return added, nil
+}
+
+// notifierStruct counts the readings it is told about
+type notifierStruct struct {
+	notified int
+}
+
+func (n *notifierStruct) ReadingsAdded(ctx context.Context, controllerId string, userId string, readings []*Reading) {
+	n.notified += len(readings)
+}
+
+func reading(timestamp time.Time, temperature float64) mapping {
+	return mapping{
+		"timestamp":     timestamp,
+		"temperature":   temperature,
+		"humidity":      60,
+		"light":         1200,
+		"soil_moisture": 400,
+		"water_level":   80,
+	}
+}
+
+func (t *repoStruct) GetSensorStates(ctx context.Context, controllerId string) (map[string]*SensorState, int, error) {
+	return map[string]*SensorState{}, t.version, nil
+}
+
+func (t *repoStruct) SetSensorStates(ctx context.Context, controllerId string, states map[string]*SensorState, version int) error {
+	if t.races > 0 {
+		t.races--
+		t.version++
+	}
+
+	if version != t.version {
+		return errStatesChanged
+	}
+
+	t.version++
+	return nil
+}
+
+func (t *repoStruct) EachReading(ctx context.Context, userId string, controllerId string, from time.Time, to time.Time, fn func(*Reading) error) error {
+	for minute := 0; minute < 120; minute++ {
+		reading := &Reading{
+			Timestamp: from.Add(time.Duration(minute) * time.Minute),
+			Metrics:   map[string]float64{"temperature": float64(minute), "humidity": 60},
+		}
+
+		// Every fourth reading is flagged
+		if minute%4 == 3 {
+			reading.Quality = map[string]string{"temperature": FlagRate}
+		}
+		if !reading.Timestamp.Before(to) {
+			break
+		}
+
+		if err := fn(reading); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Test AddReadings handler
+func TestHandler_AddReadings(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+
+	notifier := &notifierStruct{}
+	handler := &Handler{Repo: &repoStruct{stored: map[int64]bool{}}, Notifier: notifier}
+	engine.POST("", handler.AddReadings)
+
+	first := time.Now().Add(-time.Hour).UTC()
+	second := first.Add(time.Minute)
+	third := second.Add(time.Minute)
+	fourth := third.Add(time.Minute)
+	fifth := fourth.Add(time.Minute)
+	sixth := fifth.Add(time.Minute)
+
+	testCases := []struct {
+		token     string
+		in        mapping
+		message   string
+		code      int
+		added     float64
+		duplicate float64
+	}{
+		{
+			token:   goodToken,
+			in:      mapping{"readings": []mapping{reading(first, 25), reading(second, 26)}},
+			message: resAdd,
+			code:    http.StatusCreated,
+			added:   2,
+		}, {
+			token:     goodToken,
+			in:        mapping{"readings": []mapping{reading(first, 25), reading(second, 26)}},
+			message:   resAdd,
+			code:      http.StatusCreated,
+			duplicate: 2,
+		}, {
+			token:     goodToken,
+			in:        mapping{"readings": []mapping{reading(second, 26), reading(sixth, 27)}},
+			message:   resAdd,
+			code:      http.StatusCreated,
+			added:     1,
+			duplicate: 1,
+		}, {
+			token:   "",
+			in:      mapping{"readings": []mapping{reading(first, 25)}},
+			message: resInvalid,
+			code:    http.StatusBadRequest,
+		}, {
+			token:   goodToken,
+			in:      mapping{"readings": []mapping{}},
+			message: resInvalid,
+			code:    http.StatusBadRequest,
+		}, {
+			token:   goodToken,
+			in:      mapping{"readings": []mapping{reading(fourth, 200)}},
+			message: resAdd,
+			code:    http.StatusCreated,
+			added:   1,
+		}, {
+			token:   goodToken,
+			in:      mapping{"readings": []mapping{reading(time.Now().Add(time.Hour), 25)}},
+			message: resInvalid,
+			code:    http.StatusBadRequest,
+		}, {
+			token:   goodToken,
+			in:      mapping{"readings": []mapping{{"temperature": 25}}},
+			message: resInvalid,
+			code:    http.StatusBadRequest,
+		}, {
+			token:   goodToken,
+			in:      mapping{"readings": []mapping{{"timestamp": third, "metrics": mapping{"co2": 400}}}},
+			message: resInvalid,
+			code:    http.StatusBadRequest,
+		}, {
+			token:   rigToken,
+			in:      mapping{"readings": []mapping{{"timestamp": third, "metrics": mapping{"co2": 400, "soil_moisture_2": 310}}}},
+			message: resAdd,
+			code:    http.StatusCreated,
+			added:   1,
+		}, {
+			token:   rigToken,
+			in:      mapping{"readings": []mapping{{"timestamp": fifth, "metrics": mapping{"co2": 40000}}}},
+			message: resAdd,
+			code:    http.StatusCreated,
+			added:   1,
+		}, {
+			token:   rigToken,
+			in:      mapping{"readings": []mapping{{"timestamp": third, "metrics": mapping{}}}},
+			message: resInvalid,
+			code:    http.StatusBadRequest,
+		}, {
+			token:   controllerId,
+			in:      mapping{"readings": []mapping{reading(first, 25)}},
+			message: resTokenNotFound,
+			code:    http.StatusNotFound,
+		}, {
+			token:   internalToken,
+			in:      mapping{"readings": []mapping{reading(first, 25)}},
+			message: resInternal,
+			code:    http.StatusInternalServerError,
+		},
+	}
+
+	for i, c := range testCases {
+		resp := httptest.NewRecorder()
+		notifier.notified = 0
+
+		body, _ := json.Marshal(c.in)
+		req, _ := http.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		req.Header.Set("token", c.token)
+		engine.ServeHTTP(resp, req)
+
+		respBody := mapping{}
+		_ = json.Unmarshal(resp.Body.Bytes(), &respBody)
+
+		if c.code != resp.Code {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.code, resp.Code)
+		}
+
+		if c.message != respBody["message"] {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.message, respBody["message"])
+		}
+
+		if c.code == http.StatusCreated && (c.added != respBody["added"] || c.duplicate != respBody["duplicate"]) {
+			t.Fatalf("Case %d: expected [%v %v], got = [%v %v]", i, c.added, c.duplicate, respBody["added"], respBody["duplicate"])
+		}
+
+		// Only readings that were stored are told about
+		if float64(notifier.notified) != c.added {
+			t.Fatalf("Case %d: expected [%v] notified, got = [%v]", i, c.added, notifier.notified)
+		}
+	}
+}
+
+// Test Ingest flags again when another submission saved sensor states first, and gives up after maxFlagAttempts
+func TestHandler_Ingest(t *testing.T) {
+	start := time.Now().Add(-time.Hour).UTC()
+
+	testCases := []struct {
+		races int
+		added int
+		err   error
+	}{
+		{races: 0, added: 1},
+		{races: 1, added: 1},
+		{races: maxFlagAttempts - 1, added: 1},
+		{races: maxFlagAttempts, err: errStatesChanged},
+	}
+
+	for i, c := range testCases {
+		repo := &repoStruct{stored: map[int64]bool{}, races: c.races}
+		handler := &Handler{Repo: repo}
+
+		readings := []*Reading{{Timestamp: start, Metrics: map[string]float64{"temperature": 25}}}
+		added, err := handler.Ingest(context.Background(), goodToken, readings)
+
+		if c.added != added || c.err != err {
+			t.Fatalf("Case %d: expected [%v %v], got = [%v %v]", i, c.added, c.err, added, err)
+		}
+	}
+}
+
+// Test GetHistory handler
+func TestHandler_GetHistory(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(func(ctx *gin.Context) {
+		ctx.Set("userId", userId)
+	})
+
+	handler := &Handler{Repo: &repoStruct{stored: map[int64]bool{}}}
+	engine.GET(":controllerId", handler.GetHistory)
+
+	testCases := []struct {
+		controllerId string
+		query        string
+		message      string
+		code         int
+		points       int
+		key          string
+	}{
+		{
+			controllerId: controllerId,
+			query:        "from=2020-04-15T10:00:00Z&to=2020-04-15T11:00:00Z&metrics=vpd",
+			message:      resHistory,
+			code:         http.StatusOK,
+			// VPD can't be worked out when temperature is flagged
+			points: 45,
+			key:    "vpd",
+		}, {
+			controllerId: controllerId,
+			query:        "from=2020-04-15T10:00:00Z&to=2020-04-15T12:00:00Z&step=30m&metrics=temperature",
+			message:      resHistory,
+			code:         http.StatusOK,
+			points:       4,
+		}, {
+			controllerId: controllerId,
+			query:        "from=2020-04-15T10:00:00Z&to=2020-04-15T11:00:00Z&agg=max",
+			message:      resHistory,
+			code:         http.StatusOK,
+			// Flagged readings are left out
+			points: 45,
+		}, {
+			controllerId: controllerId,
+			query:        "from=2020-04-15T10:00:00Z&to=2020-04-25T10:00:00Z&step=1m",
+			message:      resRangeTooLarge,
+			code:         http.StatusBadRequest,
+		}, {
+			controllerId: controllerId,
+			query:        "from=2020-01-01T00:00:00Z&to=2020-04-01T00:00:00Z&step=1h",
+			message:      resInvalid,
+			code:         http.StatusBadRequest,
+		}, {
+			controllerId: controllerId,
+			query:        "from=2020-04-15T10:00:00Z&to=2020-04-15T12:00:00Z&metrics=co2",
+			message:      resInvalid,
+			code:         http.StatusBadRequest,
+		}, {
+			controllerId: controllerId,
+			query:        "from=2020-04-15T10:00:00Z&to=2020-04-15T12:00:00Z&agg=median",
+			message:      resInvalid,
+			code:         http.StatusBadRequest,
+		}, {
+			controllerId: controllerId,
+			query:        "to=2020-04-15T12:00:00Z",
+			message:      resInvalid,
+			code:         http.StatusBadRequest,
+		}, {
+			controllerId: "fewfe",
+			query:        "from=2020-04-15T10:00:00Z&to=2020-04-15T12:00:00Z",
+			message:      resInvalid,
+			code:         http.StatusBadRequest,
+		},
+	}
+
+	for i, c := range testCases {
+		resp := httptest.NewRecorder()
+
+		req, _ := http.NewRequest(http.MethodGet, "/"+c.controllerId+"?"+c.query, nil)
+		engine.ServeHTTP(resp, req)
+
+		respBody := struct {
+			Message string   `json:"message"`
+			Result  *History `json:"result"`
+		}{}
+		_ = json.Unmarshal(resp.Body.Bytes(), &respBody)
+
+		if c.code != resp.Code {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.code, resp.Code)
+		}
+
+		if c.message != respBody.Message {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.message, respBody.Message)
+		}
+
+		if c.key == "" {
+			c.key = "temperature"
+		}
+
+		if c.code == http.StatusOK && len(respBody.Result.Series[c.key]) != c.points {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.points, len(respBody.Result.Series[c.key]))
+		}
+	}
+}
+
+// Test ExportReadings handler
+func TestHandler_ExportReadings(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(func(ctx *gin.Context) {
+		ctx.Set("userId", userId)
+	})
+
+	handler := &Handler{Repo: &repoStruct{stored: map[int64]bool{}}}
+	engine.GET(":controllerId", handler.ExportReadings)
+
+	testCases := []struct {
+		controllerId string
+		query        string
+		code         int
+		contentType  string
+		lines        int
+	}{
+		{
+			controllerId: controllerId,
+			query:        "from=2020-04-15T10:00:00Z&to=2020-04-15T11:00:00Z&format=csv",
+			code:         http.StatusOK,
+			contentType:  "text/csv; charset=utf-8",
+			lines:        9 + 60,
+		}, {
+			controllerId: controllerId,
+			query:        "from=2020-04-15T10:00:00Z&to=2020-04-15T10:30:00Z&format=ndjson",
+			code:         http.StatusOK,
+			contentType:  "application/x-ndjson",
+			lines:        1 + 30,
+		}, {
+			controllerId: controllerId,
+			query:        "from=2020-04-15T10:00:00Z&to=2020-04-15T11:00:00Z&format=xlsx",
+			code:         http.StatusBadRequest,
+		}, {
+			controllerId: controllerId,
+			query:        "from=2019-01-01T00:00:00Z&to=2020-04-15T11:00:00Z&format=csv",
+			code:         http.StatusBadRequest,
+		}, {
+			controllerId: "4c6ab327-4b6c-4412-a4c3-d99c8db6d238",
+			query:        "from=2020-04-15T10:00:00Z&to=2020-04-15T11:00:00Z&format=csv",
+			code:         http.StatusNotFound,
+		}, {
+			controllerId: "fewfe",
+			query:        "from=2020-04-15T10:00:00Z&to=2020-04-15T11:00:00Z&format=csv",
+			code:         http.StatusBadRequest,
+		},
+	}
+
+	for i, c := range testCases {
+		resp := httptest.NewRecorder()
+
+		req, _ := http.NewRequest(http.MethodGet, "/"+c.controllerId+"?"+c.query, nil)
+		engine.ServeHTTP(resp, req)
+
+		if c.code != resp.Code {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.code, resp.Code)
+		}
+
+		if c.code != http.StatusOK {
+			continue
+		}
+
+		if contentType := resp.Header().Get("Content-Type"); c.contentType != contentType {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.contentType, contentType)
+		}
+
+		if lines := bytes.Count(resp.Body.Bytes(), []byte("\n")); c.lines != lines {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.lines, lines)
+		}
+
+		if !bytes.Contains(resp.Body.Bytes(), []byte("North greenhouse")) {
+			t.Fatalf("Case %d: expected controller name in export", i)
+		}
+	}
+}
+
+// Test GetQuality handler
+func TestHandler_GetQuality(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+	engine.Use(func(ctx *gin.Context) {
+		ctx.Set("userId", userId)
+	})
+
+	handler := &Handler{Repo: &repoStruct{stored: map[int64]bool{}}}
+	engine.GET(":controllerId", handler.GetQuality)
+
+	testCases := []struct {
+		controllerId string
+		query        string
+		code         int
+		score        float64
+		flagged      int
+	}{
+		{
+			controllerId: controllerId,
+			query:        "from=2020-04-15T10:00:00Z&to=2020-04-15T12:00:00Z",
+			code:         http.StatusOK,
+			// A quarter of temperature is flagged and all of humidity is good
+			score:   0.875,
+			flagged: 30,
+		}, {
+			controllerId: controllerId,
+			query:        "from=2020-04-15T10:00:00Z&to=2020-06-15T12:00:00Z",
+			code:         http.StatusBadRequest,
+		}, {
+			controllerId: "4c6ab327-4b6c-4412-a4c3-d99c8db6d238",
+			query:        "from=2020-04-15T10:00:00Z&to=2020-04-15T12:00:00Z",
+			code:         http.StatusNotFound,
+		},
+	}
+
+	for i, c := range testCases {
+		resp := httptest.NewRecorder()
+
+		req, _ := http.NewRequest(http.MethodGet, "/"+c.controllerId+"?"+c.query, nil)
+		engine.ServeHTTP(resp, req)
+
+		if c.code != resp.Code {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.code, resp.Code)
+		}
+
+		if c.code != http.StatusOK {
+			continue
+		}
+
+		respBody := struct {
+			Result *Quality `json:"result"`
+		}{}
+		_ = json.Unmarshal(resp.Body.Bytes(), &respBody)
+
+		if respBody.Result.Score != c.score {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.score, respBody.Result.Score)
+		}
+
+		if flagged := respBody.Result.Sensors["temperature"].Flagged[FlagRate]; flagged != c.flagged {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.flagged, flagged)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package data
+
+import (
+	"github.com/tPhume/ags-backend/metric"
+	"math"
+)
+
+// deriver adds the derived values of a controller to its readings
+type deriver struct {
+	temperature, humidity string
+	vpd                   bool
+}
+
+// newDeriver returns nil when nothing can be derived from sensors or the controller declares a sensor keyed like a derived metric
+func newDeriver(sensors []metric.Sensor) *deriver {
+	derived := metric.WithDerived(sensors)
+	if len(derived) == len(sensors) {
+		return nil
+	}
+
+	temperature, humidity, _ := metric.VPDSensors(sensors)
+	return &deriver{temperature: temperature, humidity: humidity, vpd: true}
+}
+
+// derive adds VPD to the values when both temperature and humidity are good, metrics is changed in place
+func (d *deriver) derive(metrics map[string]float64, quality map[string]string) {
+	if d == nil || !d.vpd {
+		return
+	}
+
+	if _, flagged := quality[d.temperature]; flagged {
+		return
+	}
+
+	if _, flagged := quality[d.humidity]; flagged {
+		return
+	}
+
+	temperature, okTemperature := metrics[d.temperature]
+	humidity, okHumidity := metrics[d.humidity]
+	if !okTemperature || !okHumidity {
+		return
+	}
+
+	vpd := metric.VapourPressureDeficit(temperature, humidity)
+	if math.IsNaN(vpd) || math.IsInf(vpd, 0) {
+		return
+	}
+
+	metrics[metric.VPD] = vpd
+}
+
+// Derive adds the derived values a reading of a controller with sensors can have
+func Derive(reading *Reading, sensors []metric.Sensor) {
+	newDeriver(sensors).derive(reading.Metrics, reading.Quality)
+}
@@ -0,0 +1,118 @@
+package data
+
+import (
+	"github.com/tPhume/ags-backend/metric"
+	"math"
+	"time"
+)
+
+// Point is the aggregated value of one step, Timestamp is the start of the step
+type Point struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+	Count     int       `json:"count"`
+}
+
+// downsampler aggregates readings into fixed steps as they are read, so memory only grows with the number of steps
+type downsampler struct {
+	from         time.Time
+	step         time.Duration
+	keys         []string
+	aggregations map[string]string
+
+	// steps of each sensor keyed by step index
+	steps map[string]map[int64]*stepState
+}
+
+type stepState struct {
+	value     float64
+	count     int
+	timestamp time.Time
+}
+
+// newDownsampler aggregates the sensors with keys, each with its own aggregation
+func newDownsampler(from time.Time, step time.Duration, keys []string, aggregations map[string]string) *downsampler {
+	steps := make(map[string]map[int64]*stepState, len(keys))
+	for _, key := range keys {
+		steps[key] = make(map[int64]*stepState)
+	}
+
+	return &downsampler{from: from, step: step, keys: keys, aggregations: aggregations, steps: steps}
+}
+
+func (d *downsampler) add(reading *Reading) {
+	if reading.Timestamp.Before(d.from) {
+		return
+	}
+
+	index := int64(reading.Timestamp.Sub(d.from) / d.step)
+
+	// Flagged values are left out, the history is what summaries are computed from
+	for _, key := range d.keys {
+		value, ok := reading.GoodValue(key)
+		if !ok || math.IsNaN(value) {
+			continue
+		}
+
+		state, ok := d.steps[key][index]
+		if !ok {
+			d.steps[key][index] = &stepState{value: value, count: 1, timestamp: reading.Timestamp}
+			continue
+		}
+
+		switch d.aggregations[key] {
+		case metric.AggAvg:
+			state.value += value
+		case metric.AggMin:
+			state.value = math.Min(state.value, value)
+		case metric.AggMax:
+			state.value = math.Max(state.value, value)
+		case metric.AggLast:
+			if !reading.Timestamp.Before(state.timestamp) {
+				state.value = value
+				state.timestamp = reading.Timestamp
+			}
+		}
+
+		state.count++
+	}
+}
+
+// series returns the points of every sensor in time order, steps without readings are left out
+func (d *downsampler) series() map[string][]Point {
+	result := make(map[string][]Point, len(d.keys))
+
+	for _, key := range d.keys {
+		steps := d.steps[key]
+		points := make([]Point, 0, len(steps))
+
+		last := int64(-1)
+		for index := range steps {
+			if index > last {
+				last = index
+			}
+		}
+
+		for index := int64(0); index <= last; index++ {
+			state, ok := steps[index]
+			if !ok {
+				continue
+			}
+
+			value := state.value
+			if d.aggregations[key] == metric.AggAvg {
+				value /= float64(state.count)
+			}
+
+			points = append(points, Point{
+				Timestamp: d.from.Add(time.Duration(index) * d.step),
+				Value:     value,
+				Count:     state.count,
+			})
+		}
+
+		result[key] = points
+	}
+
+	return result
+}
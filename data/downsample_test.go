@@ -0,0 +1,58 @@
+package data
+
+import (
+	"github.com/tPhume/ags-backend/metric"
+	"testing"
+	"time"
+)
+
+// Test downsampler for every aggregation
+func TestDownsampler(t *testing.T) {
+	from := time.Date(2020, time.April, 15, 10, 0, 0, 0, time.UTC)
+
+	// Two steps of 10 minutes with an empty step in between
+	readings := []*Reading{
+		{Timestamp: from.Add(1 * time.Minute), Metrics: map[string]float64{"temperature": 20, "humidity": 50}},
+		{Timestamp: from.Add(5 * time.Minute), Metrics: map[string]float64{"temperature": 24, "humidity": 70}},
+		{Timestamp: from.Add(3 * time.Minute), Metrics: map[string]float64{"temperature": 22, "humidity": 60}},
+		{Timestamp: from.Add(25 * time.Minute), Metrics: map[string]float64{"temperature": 30, "humidity": 40}},
+		{Timestamp: from.Add(-time.Minute), Metrics: map[string]float64{"temperature": 99, "humidity": 99}},
+	}
+
+	testCases := []struct {
+		aggregation string
+		expected    []float64
+	}{
+		{aggregation: metric.AggAvg, expected: []float64{22, 30}},
+		{aggregation: metric.AggMin, expected: []float64{20, 30}},
+		{aggregation: metric.AggMax, expected: []float64{24, 30}},
+		{aggregation: metric.AggLast, expected: []float64{24, 30}},
+	}
+
+	for i, c := range testCases {
+		aggregations := map[string]string{"temperature": c.aggregation, "humidity": c.aggregation}
+		sampler := newDownsampler(from, 10*time.Minute, []string{"temperature", "humidity"}, aggregations)
+		for _, reading := range readings {
+			sampler.add(reading)
+		}
+
+		points := sampler.series()["temperature"]
+		if len(points) != len(c.expected) {
+			t.Fatalf("Case %d: expected [%v] points, got = [%v]", i, len(c.expected), len(points))
+		}
+
+		for j, value := range c.expected {
+			if points[j].Value != value {
+				t.Fatalf("Case %d: expected [%v], got = [%v]", i, value, points[j].Value)
+			}
+		}
+
+		if !points[1].Timestamp.Equal(from.Add(20*time.Minute)) || points[0].Count != 3 {
+			t.Fatalf("Case %d: unexpected step [%+v]", i, points)
+		}
+
+		if len(sampler.series()["humidity"]) != 2 {
+			t.Fatalf("Case %d: expected humidity series", i)
+		}
+	}
+}
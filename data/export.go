@@ -0,0 +1,131 @@
+package data
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/tPhume/ags-backend/export"
+	"github.com/tPhume/ags-backend/metric"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Exports read raw readings, so the range is bounded even though rows are streamed
+const maxExportRange = 366 * 24 * time.Hour
+
+// Query for ExportReadings, from and to are RFC 3339
+type exportQuery struct {
+	From   time.Time `form:"from" binding:"required" time_format:"2006-01-02T15:04:05Z07:00"`
+	To     time.Time `form:"to" binding:"required" time_format:"2006-01-02T15:04:05Z07:00"`
+	Format string    `form:"format" binding:"required,oneof=csv ndjson parquet"`
+}
+
+// readingColumns has the timestamp, a column per sensor of the controller and the quality flags
+func readingColumns(sensors []metric.Sensor) []export.Column {
+	columns := []export.Column{{Name: "timestamp", Type: export.TypeTime}}
+	for _, sensor := range sensors {
+		column := export.Column{Name: sensor.Key, Type: export.TypeFloat}
+		if m, ok := metric.Default.Lookup(sensor.Metric); ok {
+			column.Unit = m.Unit
+		}
+
+		columns = append(columns, column)
+	}
+
+	// Flags of the row as sensor=flag pairs, empty when every value is good
+	return append(columns, export.Column{Name: "quality", Type: export.TypeString})
+}
+
+// ExportReadings streams every reading of the controller in [from, to) as a file download
+func (h *Handler) ExportReadings(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	// check controllerId
+	controllerId := ctx.Param("controllerId")
+	if _, err := uuid.Parse(controllerId); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	query := &exportQuery{}
+	if err := ctx.ShouldBindQuery(query); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid, "err": err.Error()})
+		return
+	}
+
+	span := query.To.Sub(query.From)
+	if span <= 0 || span > maxExportRange {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	controller, err := h.Repo.GetUserController(ctx, userId, controllerId)
+	if err != nil {
+		if err == notFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resNotFound})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	sensors := metric.Sensors(controller.Sensors)
+	header := &export.Header{
+		Title:          fmt.Sprintf("readings from %s to %s", query.From.Format(time.RFC3339), query.To.Format(time.RFC3339)),
+		ControllerId:   controllerId,
+		ControllerName: controller.Name,
+		Columns:        readingColumns(sensors),
+	}
+
+	filename := export.Filename(fmt.Sprintf("readings-%s-%s", controllerId, query.From.UTC().Format("20060102")), query.Format)
+	ctx.Header("Content-Type", export.ContentType(query.Format))
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	ctx.Status(http.StatusOK)
+
+	// The status is sent with the first bytes, after that a failure can only cut the download short
+	buffered := bufio.NewWriter(ctx.Writer)
+	w, err := export.NewWriter(query.Format, buffered, header)
+	if err != nil {
+		log.Printf("data: could not start export of %s: %s", controllerId, err)
+		return
+	}
+
+	// Sensors missing from a reading are written as empty values
+	row := make([]interface{}, len(sensors)+2)
+	err = h.Repo.EachReading(ctx, userId, controllerId, query.From, query.To, func(reading *Reading) error {
+		row[0] = reading.Timestamp
+		for i, sensor := range sensors {
+			value, ok := reading.Value(sensor.Key)
+			if !ok {
+				value = math.NaN()
+			}
+
+			row[i+1] = value
+		}
+
+		row[len(row)-1] = flagList(reading)
+
+		return w.Write(row...)
+	})
+
+	if err == nil {
+		err = w.Close()
+	}
+
+	if err == nil {
+		err = buffered.Flush()
+	}
+
+	if err != nil {
+		log.Printf("data: export of %s stopped: %s", controllerId, err)
+		_ = ctx.Error(err)
+	}
+}
@@ -0,0 +1,105 @@
+package data
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// EnsureIndexes creates the indexes that history and compaction look buckets and rollups up by, it is safe to run on every start
+func (m *MongoRepo) EnsureIndexes(ctx context.Context) error {
+	byStart := mongo.IndexModel{Keys: bson.D{{Key: "controller_id", Value: 1}, {Key: "start", Value: 1}}}
+
+	if _, err := m.BucketCol.Indexes().CreateOne(ctx, byStart); err != nil {
+		return err
+	}
+
+	if m.RollupCol == nil {
+		return nil
+	}
+
+	_, err := m.RollupCol.Indexes().CreateOne(ctx, byStart)
+	return err
+}
+
+// Readings are moved from the legacy collection this many at a time
+const migrateBatch = 500
+
+// legacyReading is a reading as it was stored one per document before buckets, it only had the fixed sensors
+type legacyReading struct {
+	ControllerId string    `bson:"controller_id"`
+	UserId       string    `bson:"user_id"`
+	Timestamp    time.Time `bson:"timestamp"`
+	Temperature  float64   `bson:"temperature"`
+	Humidity     float64   `bson:"humidity"`
+	Light        float64   `bson:"light"`
+	SoilMoisture float64   `bson:"soil_moisture"`
+	WaterLevel   float64   `bson:"water_level"`
+}
+
+func (l *legacyReading) reading() *Reading {
+	return &Reading{Timestamp: l.Timestamp, Metrics: map[string]float64{
+		"temperature":   l.Temperature,
+		"humidity":      l.Humidity,
+		"light":         l.Light,
+		"soil_moisture": l.SoilMoisture,
+		"water_level":   l.WaterLevel,
+	}}
+}
+
+// MigrateReadings moves readings stored one per document in legacyCol into buckets, then drops legacyCol
+// Readings already in a bucket are skipped, so a migration that stopped half way can be run again
+// It returns how many readings were added
+func (m *MongoRepo) MigrateReadings(ctx context.Context, legacyCol *mongo.Collection) (int, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "controller_id", Value: 1}, {Key: "timestamp", Value: 1}})
+	cursor, err := legacyCol.Find(ctx, bson.M{}, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	added := 0
+	batch := make([]*Reading, 0, migrateBatch)
+	var controllerId, userId string
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		readings, err := m.AddReadings(ctx, controllerId, userId, batch)
+		added += len(readings)
+		batch = batch[:0]
+
+		return err
+	}
+
+	for cursor.Next(ctx) {
+		legacy := &legacyReading{}
+		if err := cursor.Decode(legacy); err != nil {
+			return added, err
+		}
+
+		if legacy.ControllerId != controllerId || len(batch) == migrateBatch {
+			if err := flush(); err != nil {
+				return added, err
+			}
+
+			controllerId, userId = legacy.ControllerId, legacy.UserId
+		}
+
+		batch = append(batch, legacy.reading())
+	}
+
+	if err := cursor.Err(); err != nil {
+		return added, err
+	}
+
+	if err := flush(); err != nil {
+		return added, err
+	}
+
+	return added, legacyCol.Drop(ctx)
+}
@@ -2,12 +2,29 @@ package data
 
 import (
 	"context"
+	"fmt"
+	"github.com/google/uuid"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"sort"
+	"time"
 )
 
+// Readings are grouped into one bucket document per controller per bucketSize
+const bucketSize = time.Hour
+
 type MongoRepo struct {
+	// Col keeps the latest values of each controller, keyed by controller _id
 	Col *mongo.Collection
+
+	// BucketCol keeps every reading ever received, grouped in time buckets
+	BucketCol *mongo.Collection
+
+	// RollupCol keeps hourly rollups of buckets that were compacted, it is optional
+	RollupCol *mongo.Collection
+
+	ControllerCol *mongo.Collection
 }
 
 func (m *MongoRepo) GetData(ctx context.Context, entity *Entity) error {
@@ -30,3 +47,484 @@ func (m *MongoRepo) GetData(ctx context.Context, entity *Entity) error {
 
 	return nil
 }
+
+func (m *MongoRepo) GetUserController(ctx context.Context, userId string, controllerId string) (*Controller, error) {
+	return m.findController(ctx, bson.M{"_id": controllerId, "user_id": userId}, notFound)
+}
+
+func (m *MongoRepo) GetController(ctx context.Context, token string) (*Controller, error) {
+	result := m.ControllerCol.FindOneAndUpdate(ctx, bson.M{"token": token}, bson.M{"$set": bson.M{"last_contact": time.Now()}})
+	if result.Err() != nil {
+		if result.Err() == mongo.ErrNoDocuments {
+			return nil, errTokenNotFound
+		}
+
+		return nil, result.Err()
+	}
+
+	controller := &Controller{}
+	if err := result.Decode(controller); err != nil {
+		return nil, err
+	}
+
+	return controller, nil
+}
+
+func (m *MongoRepo) findController(ctx context.Context, filter bson.M, missing error) (*Controller, error) {
+	result := m.ControllerCol.FindOne(ctx, filter)
+	if result.Err() != nil {
+		if result.Err() == mongo.ErrNoDocuments {
+			return nil, missing
+		}
+
+		return nil, result.Err()
+	}
+
+	controller := &Controller{}
+	if err := result.Decode(controller); err != nil {
+		return nil, err
+	}
+
+	return controller, nil
+}
+
+func (m *MongoRepo) AddReadings(ctx context.Context, controllerId string, userId string, readings []*Reading) ([]*Reading, error) {
+	models := make([]mongo.WriteModel, len(readings))
+	latest := readings[0]
+
+	for i, reading := range readings {
+		start := reading.Timestamp.UTC().Truncate(bucketSize)
+
+		// The push only happens when the bucket has no reading at that instant, which makes resubmission idempotent
+		// A bucket that already has one doesn't match, the upsert then collides on _id and is counted as a duplicate
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.M{
+				"_id":                bucketId(controllerId, start),
+				"readings.timestamp": bson.M{"$ne": reading.Timestamp},
+			}).
+			SetUpdate(bson.M{
+				"$setOnInsert": bson.M{"controller_id": controllerId, "user_id": userId, "start": start},
+				"$push":        bson.M{"readings": reading},
+				"$inc":         bson.M{"count": 1},
+			}).
+			SetUpsert(true)
+
+		if reading.Timestamp.After(latest.Timestamp) {
+			latest = reading
+		}
+	}
+
+	collided, err := m.writeBuckets(ctx, models)
+	if err != nil {
+		return nil, err
+	}
+
+	// Two upserts racing to create the same bucket also collide, so collisions are tried once more against the created bucket
+	duplicate := make(map[int]bool, len(collided))
+	if len(collided) != 0 {
+		retry := make([]mongo.WriteModel, len(collided))
+		for i, index := range collided {
+			retry[i] = models[index]
+		}
+
+		collidedAgain, err := m.writeBuckets(ctx, retry)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, index := range collidedAgain {
+			duplicate[collided[index]] = true
+		}
+	}
+
+	if err := m.updateLatest(ctx, controllerId, userId, latest); err != nil {
+		return nil, err
+	}
+
+	added := make([]*Reading, 0, len(readings)-len(duplicate))
+	for i, reading := range readings {
+		if !duplicate[i] {
+			added = append(added, reading)
+		}
+	}
+
+	return added, nil
+}
+
+// writeBuckets returns the index of every model that collided on _id, every other model pushed its reading
+func (m *MongoRepo) writeBuckets(ctx context.Context, models []mongo.WriteModel) ([]int, error) {
+	_, err := m.BucketCol.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err == nil {
+		return nil, nil
+	}
+
+	bulkException, ok := err.(mongo.BulkWriteException)
+	if !ok || bulkException.WriteConcernError != nil {
+		return nil, err
+	}
+
+	collided := make([]int, 0, len(bulkException.WriteErrors))
+	for _, writeError := range bulkException.WriteErrors {
+		if writeError.Code != 11000 {
+			return nil, err
+		}
+
+		collided = append(collided, writeError.Index)
+	}
+
+	return collided, nil
+}
+
+// updateLatest replaces the latest values unless a newer reading has already been stored
+func (m *MongoRepo) updateLatest(ctx context.Context, controllerId string, userId string, reading *Reading) error {
+	filter := bson.M{
+		"_id": controllerId,
+		"$or": bson.A{
+			bson.M{"timestamp": bson.M{"$lt": reading.Timestamp}},
+			bson.M{"timestamp": bson.M{"$exists": false}},
+		},
+	}
+
+	// Flagged values would show up on gauges, the last good value is kept instead
+	set := bson.M{"user_id": userId, "timestamp": reading.Timestamp}
+	for key := range reading.Metrics {
+		if value, ok := reading.GoodValue(key); ok {
+			set["metrics."+key] = value
+		}
+	}
+
+	// The fixed fields of Entity are kept up to date for older apps
+	for _, key := range legacyKeys {
+		if value, ok := reading.GoodValue(key); ok {
+			if key == "soil_moisture" || key == "water_level" {
+				set[key] = legacyInt(value)
+			} else {
+				set[key] = value
+			}
+		}
+	}
+
+	update := bson.M{"$set": set}
+
+	if _, err := m.Col.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true)); err != nil {
+		// The upsert collides with the existing document when it already holds a newer reading
+		if writeException, ok := err.(mongo.WriteException); ok {
+			if len(writeException.WriteErrors) != 0 && writeException.WriteErrors[0].Code == 11000 {
+				return nil
+			}
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// Sensor states are kept with the latest values of the controller
+func (m *MongoRepo) GetSensorStates(ctx context.Context, controllerId string) (map[string]*SensorState, int, error) {
+	projection := bson.M{"sensor_states": 1, "sensor_states_version": 1}
+	result := m.Col.FindOne(ctx, bson.M{"_id": controllerId}, options.FindOne().SetProjection(projection))
+	if result.Err() != nil {
+		if result.Err() == mongo.ErrNoDocuments {
+			return make(map[string]*SensorState), 0, nil
+		}
+
+		return nil, 0, result.Err()
+	}
+
+	temp := &struct {
+		SensorStates map[string]*SensorState `bson:"sensor_states"`
+		Version      int                     `bson:"sensor_states_version"`
+	}{}
+
+	if err := result.Decode(temp); err != nil {
+		return nil, 0, err
+	}
+
+	if temp.SensorStates == nil {
+		return make(map[string]*SensorState), temp.Version, nil
+	}
+
+	return temp.SensorStates, temp.Version, nil
+}
+
+func (m *MongoRepo) SetSensorStates(ctx context.Context, controllerId string, states map[string]*SensorState, version int) error {
+	// Documents written before states were versioned have no version, they count as version 0
+	filter := bson.M{"_id": controllerId, "sensor_states_version": version}
+	if version == 0 {
+		filter["sensor_states_version"] = bson.M{"$in": bson.A{0, nil}}
+	}
+
+	update := bson.M{"$set": bson.M{"sensor_states": states, "sensor_states_version": version + 1}}
+
+	// A newer version doesn't match, the upsert then collides on _id
+	if _, err := m.Col.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true)); err != nil {
+		if writeException, ok := err.(mongo.WriteException); ok {
+			if len(writeException.WriteErrors) != 0 && writeException.WriteErrors[0].Code == 11000 {
+				return errStatesChanged
+			}
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+func (m *MongoRepo) EachReading(ctx context.Context, userId string, controllerId string, from time.Time, to time.Time, fn func(*Reading) error) error {
+	filter := bson.M{
+		"controller_id": controllerId,
+		"user_id":       userId,
+		"start":         bson.M{"$gte": from.UTC().Truncate(bucketSize), "$lt": to},
+	}
+
+	// Hours whose raw readings were compacted are served from their rollups
+	rollups, err := m.findRollups(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	cursor, err := m.BucketCol.Find(ctx, filter, options.Find().SetSort(bson.M{"start": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	each := func(reading *Reading) error {
+		if reading.Timestamp.Before(from) || !reading.Timestamp.Before(to) {
+			return nil
+		}
+
+		return fn(reading)
+	}
+
+	for cursor.Next(ctx) {
+		bucket := &bucketResult{}
+		if err := cursor.Decode(bucket); err != nil {
+			return err
+		}
+
+		for len(rollups) != 0 && !rollups[0].Start.After(bucket.Start) {
+			if err := each(rollups[0].Reading()); err != nil {
+				return err
+			}
+
+			rollups = rollups[1:]
+		}
+
+		// Pushes arrive in any order, so readings are sorted within their bucket
+		sortReadings(bucket.Readings)
+
+		for _, reading := range bucket.Readings {
+			if err := each(reading); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+
+	for _, rollup := range rollups {
+		if err := each(rollup.Reading()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *MongoRepo) findRollups(ctx context.Context, filter bson.M) ([]*Rollup, error) {
+	rollups := make([]*Rollup, 0)
+	if m.RollupCol == nil {
+		return rollups, nil
+	}
+
+	cursor, err := m.RollupCol.Find(ctx, filter, options.Find().SetSort(bson.M{"start": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cursor.All(ctx, &rollups); err != nil {
+		return nil, err
+	}
+
+	return rollups, nil
+}
+
+// Compact rolls up the buckets of a controller that ended before the given time, then deletes them
+// It returns how many buckets were deleted
+func (m *MongoRepo) Compact(ctx context.Context, controllerId string, before time.Time) (int, error) {
+	filter := bson.M{"controller_id": controllerId, "start": bson.M{"$lte": before.Add(-bucketSize)}}
+
+	cursor, err := m.BucketCol.Find(ctx, filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return 0, err
+	}
+
+	ids := make([]struct {
+		Id string `bson:"_id"`
+	}, 0)
+
+	if err := cursor.All(ctx, &ids); err != nil {
+		return 0, err
+	}
+
+	compacted := 0
+	for _, id := range ids {
+		deleted, err := m.compactBucket(ctx, id.Id)
+		if err != nil {
+			return compacted, err
+		}
+
+		if deleted {
+			compacted++
+		}
+	}
+
+	return compacted, nil
+}
+
+// compactBucket merges a bucket into its rollup
+// The bucket is marked first with the timestamps it will merge, so that a run that failed half way merges and removes exactly those
+// Readings that arrive after the mark are left in the bucket for the next run
+func (m *MongoRepo) compactBucket(ctx context.Context, id string) (bool, error) {
+	bucket, err := m.findBucket(ctx, id)
+	if bucket == nil {
+		return false, err
+	}
+
+	if bucket.CompactionId == "" {
+		timestamps := make(bson.A, len(bucket.Readings))
+		for i, reading := range bucket.Readings {
+			timestamps[i] = reading.Timestamp
+		}
+
+		if _, err := m.BucketCol.UpdateOne(ctx, bson.M{"_id": id, "compaction_id": bson.M{"$exists": false}}, bson.M{
+			"$set": bson.M{"compaction_id": uuid.New().String(), "compacting": timestamps},
+		}); err != nil {
+			return false, err
+		}
+
+		// Another run may have marked it first, its mark is the one that counts
+		if bucket, err = m.findBucket(ctx, id); bucket == nil {
+			return false, err
+		}
+	}
+
+	if err := m.mergeRollup(ctx, bucket); err != nil {
+		return false, err
+	}
+
+	if _, err := m.BucketCol.UpdateOne(ctx, bson.M{"_id": id, "compaction_id": bucket.CompactionId}, bson.M{
+		"$pull":  bson.M{"readings": bson.M{"timestamp": bson.M{"$in": bucket.Compacting}}},
+		"$inc":   bson.M{"count": -len(bucket.compacting())},
+		"$unset": bson.M{"compaction_id": "", "compacting": ""},
+	}); err != nil {
+		return false, err
+	}
+
+	result, err := m.BucketCol.DeleteOne(ctx, bson.M{"_id": id, "count": bson.M{"$lte": 0}})
+	if err != nil {
+		return false, err
+	}
+
+	return result.DeletedCount != 0, nil
+}
+
+// findBucket returns nil when the bucket is gone
+func (m *MongoRepo) findBucket(ctx context.Context, id string) (*bucketResult, error) {
+	bucket := &bucketResult{}
+	if err := m.BucketCol.FindOne(ctx, bson.M{"_id": id}).Decode(bucket); err != nil {
+		if err == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return bucket, nil
+}
+
+// A bucket is compacted once at a time, so a rollup only has to remember its latest compactions to merge each once
+const keptCompactions = 10
+
+func (m *MongoRepo) mergeRollup(ctx context.Context, bucket *bucketResult) error {
+	rollup := newRollup(bucket.ControllerId, bucket.UserId, bucket.Start, bucket.compacting())
+
+	inc, min, max := bson.M{}, bson.M{}, bson.M{}
+	for key, stats := range rollup.Metrics {
+		inc["metrics."+key+".sum"] = stats.Sum
+		inc["metrics."+key+".count"] = stats.Count
+		min["metrics."+key+".min"] = stats.Min
+		max["metrics."+key+".max"] = stats.Max
+	}
+
+	update := bson.M{
+		"$setOnInsert": bson.M{"controller_id": rollup.ControllerId, "user_id": rollup.UserId, "start": rollup.Start},
+		"$push":        bson.M{"compactions": bson.M{"$each": bson.A{bucket.CompactionId}, "$slice": -keptCompactions}},
+	}
+
+	if len(rollup.Metrics) != 0 {
+		update["$inc"], update["$min"], update["$max"] = inc, min, max
+	}
+
+	// Like AddReadings, a rollup that already has the compaction collides on _id instead of being merged again
+	_, err := m.RollupCol.UpdateOne(ctx, bson.M{"_id": rollup.Id, "compactions": bson.M{"$ne": bucket.CompactionId}}, update, options.Update().SetUpsert(true))
+	if writeException, ok := err.(mongo.WriteException); ok {
+		if len(writeException.WriteErrors) != 0 && writeException.WriteErrors[0].Code == 11000 {
+			return nil
+		}
+	}
+
+	return err
+}
+
+// PruneRollups deletes the rollups of a controller that started before the given time
+func (m *MongoRepo) PruneRollups(ctx context.Context, controllerId string, before time.Time) (int, error) {
+	result, err := m.RollupCol.DeleteMany(ctx, bson.M{"controller_id": controllerId, "start": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+
+	return int(result.DeletedCount), nil
+}
+
+func bucketId(controllerId string, start time.Time) string {
+	return fmt.Sprintf("%s:%d", controllerId, start.Unix())
+}
+
+type bucketResult struct {
+	ControllerId string     `bson:"controller_id"`
+	UserId       string     `bson:"user_id"`
+	Start        time.Time  `bson:"start"`
+	CompactionId string     `bson:"compaction_id"`
+	Readings     []*Reading `bson:"readings"`
+
+	// Compacting has the timestamps of the readings the current compaction merges
+	Compacting []time.Time `bson:"compacting"`
+}
+
+// compacting returns the readings the current compaction merges
+func (b *bucketResult) compacting() []*Reading {
+	marked := make(map[int64]bool, len(b.Compacting))
+	for _, timestamp := range b.Compacting {
+		marked[timestamp.UnixNano()] = true
+	}
+
+	readings := make([]*Reading, 0, len(b.Compacting))
+	for _, reading := range b.Readings {
+		if marked[reading.Timestamp.UnixNano()] {
+			readings = append(readings, reading)
+		}
+	}
+
+	return readings
+}
+
+func sortReadings(readings []*Reading) {
+	sort.Slice(readings, func(i, j int) bool {
+		return readings[i].Timestamp.Before(readings[j].Timestamp)
+	})
+}
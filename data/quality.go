@@ -0,0 +1,171 @@
+package data
+
+import (
+	"github.com/tPhume/ags-backend/metric"
+	"math"
+	"sort"
+	"time"
+)
+
+// Quality flags of a value, a value without a flag is good
+const (
+	FlagOutOfRange = "out_of_range"
+	FlagRate       = "rate_of_change"
+	FlagStuck      = "stuck"
+)
+
+// SensorState is what flagging needs to remember about a sensor between submissions
+type SensorState struct {
+	// Last good value, rates of change are measured from it
+	Good   float64   `bson:"good"`
+	GoodAt time.Time `bson:"good_at"`
+
+	// Last value whatever its quality and how many readings in a row had it
+	Last    float64   `bson:"last"`
+	LastAt  time.Time `bson:"last_at"`
+	Repeats int       `bson:"repeats"`
+}
+
+// flagReadings sets the quality flags of readings and moves states forward
+// Readings older than the state of a sensor can only be checked against the range of the metric
+func flagReadings(readings []*Reading, sensors []metric.Sensor, states map[string]*SensorState) {
+	ordered := make([]*Reading, len(readings))
+	copy(ordered, readings)
+	sortReadings(ordered)
+
+	for _, reading := range ordered {
+		for key, value := range reading.Metrics {
+			m, err := metric.Default.SensorMetric(sensors, key)
+			if err != nil {
+				continue
+			}
+
+			if flag := flagValue(m, states, key, reading.Timestamp, value); flag != "" {
+				if reading.Quality == nil {
+					reading.Quality = make(map[string]string)
+				}
+
+				reading.Quality[key] = flag
+			}
+		}
+	}
+}
+
+func flagValue(m *metric.Metric, states map[string]*SensorState, key string, timestamp time.Time, value float64) string {
+	if m.Check(value) != nil {
+		return FlagOutOfRange
+	}
+
+	state, ok := states[key]
+	if !ok {
+		states[key] = &SensorState{Good: value, GoodAt: timestamp, Last: value, LastAt: timestamp, Repeats: 1}
+		return ""
+	}
+
+	if !timestamp.After(state.LastAt) {
+		return ""
+	}
+
+	if value == state.Last {
+		state.Repeats++
+	} else {
+		state.Repeats = 1
+	}
+
+	state.Last, state.LastAt = value, timestamp
+
+	if m.StuckCount != 0 && state.Repeats >= m.StuckCount {
+		return FlagStuck
+	}
+
+	// The allowed change grows with the time since the last good value, so a real step is accepted eventually
+	if m.MaxRate != 0 {
+		minutes := timestamp.Sub(state.GoodAt).Minutes()
+		if math.Abs(value-state.Good) > m.MaxRate*math.Max(minutes, 1) {
+			return FlagRate
+		}
+	}
+
+	state.Good, state.GoodAt = value, timestamp
+	return ""
+}
+
+// SensorQuality counts values of one sensor by quality
+type SensorQuality struct {
+	Total   int            `json:"total"`
+	Good    int            `json:"good"`
+	Flagged map[string]int `json:"flagged"`
+	Score   float64        `json:"score"`
+}
+
+// Quality is the share of good values of every sensor of a controller, a score is 1 when every value was good
+type Quality struct {
+	ControllerId string                    `json:"controller_id"`
+	From         time.Time                 `json:"from"`
+	To           time.Time                 `json:"to"`
+	Score        float64                   `json:"score"`
+	Sensors      map[string]*SensorQuality `json:"sensors"`
+}
+
+func newQuality(controllerId string, from time.Time, to time.Time, sensors []metric.Sensor) *Quality {
+	quality := &Quality{ControllerId: controllerId, From: from, To: to, Sensors: make(map[string]*SensorQuality)}
+	for _, sensor := range sensors {
+		quality.Sensors[sensor.Key] = &SensorQuality{Flagged: make(map[string]int)}
+	}
+
+	return quality
+}
+
+func (q *Quality) add(reading *Reading) {
+	for key := range reading.Metrics {
+		sensor, ok := q.Sensors[key]
+		if !ok {
+			continue
+		}
+
+		sensor.Total++
+		if flag, flagged := reading.Quality[key]; flagged {
+			sensor.Flagged[flag]++
+		} else {
+			sensor.Good++
+		}
+	}
+}
+
+// finish computes the scores, the overall score weighs every value the same
+// Sensors without values in the range have a score of 0 and don't count towards the overall score
+func (q *Quality) finish() {
+	total, good := 0, 0
+	for _, sensor := range q.Sensors {
+		if sensor.Total != 0 {
+			sensor.Score = float64(sensor.Good) / float64(sensor.Total)
+		}
+
+		total += sensor.Total
+		good += sensor.Good
+	}
+
+	if total != 0 {
+		q.Score = float64(good) / float64(total)
+	}
+}
+
+// flagList writes the flags of a reading as key=flag pairs separated by semicolons, sorted by key
+func flagList(reading *Reading) string {
+	keys := make([]string, 0, len(reading.Quality))
+	for key := range reading.Quality {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	list := ""
+	for i, key := range keys {
+		if i != 0 {
+			list += ";"
+		}
+
+		list += key + "=" + reading.Quality[key]
+	}
+
+	return list
+}
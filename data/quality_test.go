@@ -0,0 +1,75 @@
+package data
+
+import (
+	"github.com/tPhume/ags-backend/metric"
+	"math"
+	"testing"
+	"time"
+)
+
+// Test every check of flagReadings, values are flagged rather than dropped
+func TestFlagReadings(t *testing.T) {
+	from := time.Date(2020, time.April, 15, 10, 0, 0, 0, time.UTC)
+	sensors := []metric.Sensor{{Key: "temperature", Metric: "temperature"}, {Key: "light", Metric: "light"}}
+
+	testCases := []struct {
+		values   []float64
+		expected []string
+	}{
+		{
+			values:   []float64{24, 24.5, 200, math.NaN(), 25},
+			expected: []string{"", "", FlagOutOfRange, FlagOutOfRange, ""},
+		}, {
+			// A spike is flagged, the readings after it are measured from the last good value
+			values:   []float64{24, 35, 24.2, 24.4},
+			expected: []string{"", FlagRate, "", ""},
+		},
+	}
+
+	for i, c := range testCases {
+		readings := make([]*Reading, len(c.values))
+		for j, value := range c.values {
+			readings[j] = &Reading{Timestamp: from.Add(time.Duration(j) * time.Minute), Metrics: map[string]float64{"temperature": value}}
+		}
+
+		flagReadings(readings, sensors, map[string]*SensorState{})
+
+		for j, reading := range readings {
+			if reading.Quality["temperature"] != c.expected[j] {
+				t.Fatalf("Case %d: reading %d expected [%v], got = [%v]", i, j, c.expected[j], reading.Quality["temperature"])
+			}
+		}
+	}
+}
+
+// Test a sensor is stuck once StuckCount readings in a row are identical, across submissions
+func TestFlagReadings_Stuck(t *testing.T) {
+	from := time.Date(2020, time.April, 15, 10, 0, 0, 0, time.UTC)
+	sensors := []metric.Sensor{{Key: "temperature", Metric: "temperature"}}
+	temperature, _ := metric.Default.Lookup("temperature")
+
+	states := map[string]*SensorState{}
+	flagged := 0
+
+	// Submitted one reading at a time like a device would
+	for i := 0; i < temperature.StuckCount+5; i++ {
+		reading := &Reading{Timestamp: from.Add(time.Duration(i) * time.Minute), Metrics: map[string]float64{"temperature": 21}}
+		flagReadings([]*Reading{reading}, sensors, states)
+
+		if reading.Quality["temperature"] == FlagStuck {
+			flagged++
+		}
+	}
+
+	if flagged != 6 {
+		t.Fatalf("expected [%v], got = [%v]", 6, flagged)
+	}
+
+	// A change unsticks it
+	reading := &Reading{Timestamp: from.Add(2 * time.Hour), Metrics: map[string]float64{"temperature": 21.5}}
+	flagReadings([]*Reading{reading}, sensors, states)
+
+	if len(reading.Quality) != 0 {
+		t.Fatalf("expected no flags, got = [%v]", reading.Quality)
+	}
+}
@@ -0,0 +1,156 @@
+package data
+
+import (
+	"encoding/json"
+	"go.mongodb.org/mongo-driver/bson"
+	"math"
+	"time"
+)
+
+// Reading is a single measurement sent by a controller, timestamped by the device
+// Values are keyed by the sensor keys of the controller
+type Reading struct {
+	Timestamp time.Time          `bson:"timestamp"`
+	Metrics   map[string]float64 `bson:"metrics"`
+
+	// Quality has a flag for every value that failed a check when it was ingested
+	Quality map[string]string `bson:"quality,omitempty"`
+}
+
+// Sensors of the first controllers, sent at the top level of a reading rather than in metrics
+// They are still accepted and returned there so that older devices and apps keep working
+var legacyKeys = []string{"temperature", "humidity", "light", "soil_moisture", "water_level"}
+
+// Value returns the value of the sensor with key
+func (r *Reading) Value(key string) (float64, bool) {
+	value, ok := r.Metrics[key]
+	return value, ok
+}
+
+// GoodValue returns the value of the sensor with key unless it was flagged
+// Anything computed from readings, such as summaries, should use it
+func (r *Reading) GoodValue(key string) (float64, bool) {
+	if _, flagged := r.Quality[key]; flagged {
+		return 0, false
+	}
+
+	return r.Value(key)
+}
+
+func (r *Reading) UnmarshalJSON(b []byte) error {
+	raw := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+
+	// Quality is decided by the backend, devices can't send it
+	r.Timestamp = time.Time{}
+	r.Metrics = make(map[string]float64)
+	r.Quality = nil
+
+	if timestamp, ok := raw["timestamp"]; ok {
+		if err := json.Unmarshal(timestamp, &r.Timestamp); err != nil {
+			return err
+		}
+	}
+
+	if metrics, ok := raw["metrics"]; ok {
+		if err := json.Unmarshal(metrics, &r.Metrics); err != nil {
+			return err
+		}
+
+		if r.Metrics == nil {
+			r.Metrics = make(map[string]float64)
+		}
+	}
+
+	// Values in metrics win over the same key at the top level
+	for _, key := range legacyKeys {
+		value, ok := raw[key]
+		if _, set := r.Metrics[key]; !ok || set {
+			continue
+		}
+
+		var number float64
+		if err := json.Unmarshal(value, &number); err != nil {
+			return err
+		}
+
+		r.Metrics[key] = number
+	}
+
+	return nil
+}
+
+func (r Reading) MarshalJSON() ([]byte, error) {
+	out := make(map[string]interface{}, len(legacyKeys)+3)
+	out["timestamp"] = r.Timestamp
+
+	// JSON has no NaN or infinity, those are flagged and written as null
+	metrics := make(map[string]interface{}, len(r.Metrics))
+	for key, value := range r.Metrics {
+		metrics[key] = jsonNumber(value)
+	}
+	out["metrics"] = metrics
+
+	for _, key := range legacyKeys {
+		if value, ok := r.Metrics[key]; ok {
+			out[key] = jsonNumber(value)
+		}
+	}
+
+	if len(r.Quality) != 0 {
+		out["quality"] = r.Quality
+	}
+
+	return json.Marshal(out)
+}
+
+func jsonNumber(value float64) interface{} {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return nil
+	}
+
+	return value
+}
+
+// Readings stored before metrics were introduced have the legacy values at the top level
+type storedReading struct {
+	Timestamp time.Time          `bson:"timestamp"`
+	Metrics   map[string]float64 `bson:"metrics"`
+	Quality   map[string]string  `bson:"quality"`
+
+	Temperature  *float64 `bson:"temperature"`
+	Humidity     *float64 `bson:"humidity"`
+	Light        *float64 `bson:"light"`
+	SoilMoisture *float64 `bson:"soil_moisture"`
+	WaterLevel   *float64 `bson:"water_level"`
+}
+
+func (r *Reading) UnmarshalBSON(b []byte) error {
+	stored := &storedReading{}
+	if err := bson.Unmarshal(b, stored); err != nil {
+		return err
+	}
+
+	r.Timestamp = stored.Timestamp
+	r.Quality = stored.Quality
+	r.Metrics = stored.Metrics
+	if r.Metrics == nil {
+		r.Metrics = make(map[string]float64)
+	}
+
+	legacy := []*float64{stored.Temperature, stored.Humidity, stored.Light, stored.SoilMoisture, stored.WaterLevel}
+	for i, value := range legacy {
+		if _, set := r.Metrics[legacyKeys[i]]; value != nil && !set {
+			r.Metrics[legacyKeys[i]] = *value
+		}
+	}
+
+	return nil
+}
+
+// legacyInt rounds a value for the integer fields of Entity
+func legacyInt(value float64) int {
+	return int(math.Round(value))
+}
@@ -0,0 +1,61 @@
+package data
+
+import (
+	"encoding/json"
+	"go.mongodb.org/mongo-driver/bson"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Test readings stored before metrics existed still decode
+func TestReading_UnmarshalBSON(t *testing.T) {
+	timestamp := time.Date(2020, time.April, 15, 10, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		stored   bson.M
+		expected map[string]float64
+	}{
+		{
+			stored:   bson.M{"timestamp": timestamp, "temperature": 25.5, "humidity": 60.0, "light": 1200.0, "soil_moisture": int32(400), "water_level": int64(80)},
+			expected: map[string]float64{"temperature": 25.5, "humidity": 60, "light": 1200, "soil_moisture": 400, "water_level": 80},
+		}, {
+			stored:   bson.M{"timestamp": timestamp, "metrics": bson.M{"co2": 812.0, "temperature": 21.0}},
+			expected: map[string]float64{"co2": 812, "temperature": 21},
+		},
+	}
+
+	for i, c := range testCases {
+		raw, _ := bson.Marshal(c.stored)
+
+		reading := &Reading{}
+		if err := bson.Unmarshal(raw, reading); err != nil {
+			t.Fatalf("Case %d: could not decode: %v", i, err)
+		}
+
+		if !reading.Timestamp.Equal(timestamp) || !reflect.DeepEqual(reading.Metrics, c.expected) {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.expected, reading.Metrics)
+		}
+	}
+}
+
+// Test legacy sensors are also returned at the top level
+func TestReading_MarshalJSON(t *testing.T) {
+	reading := &Reading{
+		Timestamp: time.Date(2020, time.April, 15, 10, 0, 0, 0, time.UTC),
+		Metrics:   map[string]float64{"temperature": 25.5, "co2": 812},
+	}
+
+	body, _ := json.Marshal(reading)
+
+	out := map[string]interface{}{}
+	_ = json.Unmarshal(body, &out)
+
+	if out["temperature"] != 25.5 || out["co2"] != nil {
+		t.Fatalf("unexpected top level [%v]", out)
+	}
+
+	if metrics, _ := out["metrics"].(map[string]interface{}); metrics["co2"] != float64(812) {
+		t.Fatalf("unexpected metrics [%v]", out["metrics"])
+	}
+}
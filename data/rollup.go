@@ -0,0 +1,73 @@
+package data
+
+import (
+	"time"
+)
+
+// Rollup keeps one hour of readings of a controller once its raw readings have been compacted
+type Rollup struct {
+	Id           string                  `bson:"_id"`
+	ControllerId string                  `bson:"controller_id"`
+	UserId       string                  `bson:"user_id"`
+	Start        time.Time               `bson:"start"`
+	Metrics      map[string]*RollupStats `bson:"metrics"`
+}
+
+// RollupStats of the good values of one sensor, sums are kept rather than means so that rollups can be merged
+type RollupStats struct {
+	Sum   float64 `bson:"sum"`
+	Min   float64 `bson:"min"`
+	Max   float64 `bson:"max"`
+	Count int     `bson:"count"`
+}
+
+// newRollup rolls up the good values of readings, flagged values are left out like everywhere else
+func newRollup(controllerId string, userId string, start time.Time, readings []*Reading) *Rollup {
+	rollup := &Rollup{
+		Id:           bucketId(controllerId, start),
+		ControllerId: controllerId,
+		UserId:       userId,
+		Start:        start,
+		Metrics:      make(map[string]*RollupStats),
+	}
+
+	for _, reading := range readings {
+		for key := range reading.Metrics {
+			value, ok := reading.GoodValue(key)
+			if !ok {
+				continue
+			}
+
+			stats, ok := rollup.Metrics[key]
+			if !ok {
+				rollup.Metrics[key] = &RollupStats{Sum: value, Min: value, Max: value, Count: 1}
+				continue
+			}
+
+			stats.Sum += value
+			stats.Count++
+
+			if value < stats.Min {
+				stats.Min = value
+			}
+
+			if value > stats.Max {
+				stats.Max = value
+			}
+		}
+	}
+
+	return rollup
+}
+
+// Reading stands in for the readings of the hour, with the mean of each sensor at the start of the hour
+func (r *Rollup) Reading() *Reading {
+	reading := &Reading{Timestamp: r.Start, Metrics: make(map[string]float64, len(r.Metrics))}
+	for key, stats := range r.Metrics {
+		if stats.Count != 0 {
+			reading.Metrics[key] = stats.Sum / float64(stats.Count)
+		}
+	}
+
+	return reading
+}
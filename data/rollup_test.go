@@ -0,0 +1,33 @@
+package data
+
+import (
+	"testing"
+	"time"
+)
+
+// Test rollups leave out flagged values and stand in for the hour with the mean
+func TestNewRollup(t *testing.T) {
+	start := time.Date(2020, time.April, 15, 10, 0, 0, 0, time.UTC)
+
+	readings := []*Reading{
+		{Timestamp: start, Metrics: map[string]float64{"temperature": 20, "humidity": 60}},
+		{Timestamp: start.Add(time.Minute), Metrics: map[string]float64{"temperature": 24, "humidity": 64}},
+		{Timestamp: start.Add(2 * time.Minute), Metrics: map[string]float64{"temperature": 90}, Quality: map[string]string{"temperature": FlagRate}},
+	}
+
+	rollup := newRollup(controllerId, userId, start, readings)
+
+	temperature := rollup.Metrics["temperature"]
+	if temperature.Count != 2 || temperature.Min != 20 || temperature.Max != 24 {
+		t.Fatalf("expected [2 20 24], got = [%v %v %v]", temperature.Count, temperature.Min, temperature.Max)
+	}
+
+	reading := rollup.Reading()
+	if !reading.Timestamp.Equal(start) {
+		t.Fatalf("expected [%v], got = [%v]", start, reading.Timestamp)
+	}
+
+	if reading.Metrics["temperature"] != 22 || reading.Metrics["humidity"] != 62 {
+		t.Fatalf("expected [22 62], got = [%v]", reading.Metrics)
+	}
+}
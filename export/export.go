@@ -0,0 +1,220 @@
+// Package export writes rows of sensor data as CSV, newline delimited JSON or Parquet
+// Rows are written as they are produced so that exports never have to be held in memory
+package export
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Supported formats
+const (
+	FormatCsv     = "csv"
+	FormatNdjson  = "ndjson"
+	FormatParquet = "parquet"
+)
+
+var ErrUnknownFormat = errors.New("unknown export format")
+
+// Type of the values of a column
+type Type int
+
+const (
+	TypeTime Type = iota
+	TypeFloat
+	TypeInt
+	TypeString
+)
+
+// Column of an export, Unit is empty for unitless columns
+type Column struct {
+	Name string
+	Unit string
+	Type Type
+}
+
+// Header describes an export and is written before any row
+type Header struct {
+	Title          string
+	ControllerId   string
+	ControllerName string
+	Columns        []Column
+}
+
+// Writer writes one row per call to Write, values must match the columns of the header in order and type
+// Close must be called to complete the export
+type Writer interface {
+	Write(values ...interface{}) error
+	Close() error
+}
+
+// NewWriter writes the header in format to w and returns a Writer for the rows
+func NewWriter(format string, w io.Writer, header *Header) (Writer, error) {
+	switch format {
+	case FormatCsv:
+		return newCsvWriter(w, header)
+	case FormatNdjson:
+		return newNdjsonWriter(w, header)
+	case FormatParquet:
+		return newParquetWriter(w, header)
+	}
+
+	return nil, ErrUnknownFormat
+}
+
+// ContentType of format, empty for an unknown format
+func ContentType(format string) string {
+	switch format {
+	case FormatCsv:
+		return "text/csv; charset=utf-8"
+	case FormatNdjson:
+		return "application/x-ndjson"
+	case FormatParquet:
+		return "application/vnd.apache.parquet"
+	}
+
+	return ""
+}
+
+// Filename for an export, name should not contain a path
+func Filename(name string, format string) string {
+	return fmt.Sprintf("%s.%s", name, format)
+}
+
+// CSV starts with comment lines describing the export, pandas can skip them with comment="#"
+type csvWriter struct {
+	w      *csv.Writer
+	header *Header
+	record []string
+}
+
+func newCsvWriter(w io.Writer, header *Header) (*csvWriter, error) {
+	preamble := []string{
+		fmt.Sprintf("# %s", header.Title),
+		fmt.Sprintf("# controller: %s", header.ControllerName),
+		fmt.Sprintf("# controller_id: %s", header.ControllerId),
+	}
+
+	for _, column := range header.Columns {
+		if column.Unit != "" {
+			preamble = append(preamble, fmt.Sprintf("# unit of %s: %s", column.Name, column.Unit))
+		}
+	}
+
+	for _, line := range preamble {
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			return nil, err
+		}
+	}
+
+	c := &csvWriter{w: csv.NewWriter(w), header: header, record: make([]string, len(header.Columns))}
+	for i, column := range header.Columns {
+		c.record[i] = column.Name
+	}
+
+	if err := c.w.Write(c.record); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *csvWriter) Write(values ...interface{}) error {
+	if len(values) != len(c.header.Columns) {
+		return fmt.Errorf("expected %d values, got %d", len(c.header.Columns), len(values))
+	}
+
+	for i, value := range values {
+		switch v := value.(type) {
+		case time.Time:
+			c.record[i] = v.UTC().Format(time.RFC3339Nano)
+		case float64:
+			c.record[i] = ""
+			if !math.IsNaN(v) {
+				c.record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+			}
+		case int:
+			c.record[i] = strconv.Itoa(v)
+		case string:
+			c.record[i] = v
+		default:
+			return fmt.Errorf("unsupported value %T", value)
+		}
+	}
+
+	return c.w.Write(c.record)
+}
+
+func (c *csvWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// Newline delimited JSON starts with an object describing the export, then one object per row
+type ndjsonWriter struct {
+	encoder *json.Encoder
+	header  *Header
+}
+
+type ndjsonHeader struct {
+	Title          string            `json:"title"`
+	ControllerId   string            `json:"controller_id"`
+	ControllerName string            `json:"controller_name"`
+	Units          map[string]string `json:"units"`
+}
+
+func newNdjsonWriter(w io.Writer, header *Header) (*ndjsonWriter, error) {
+	n := &ndjsonWriter{encoder: json.NewEncoder(w), header: header}
+
+	first := &ndjsonHeader{
+		Title:          header.Title,
+		ControllerId:   header.ControllerId,
+		ControllerName: header.ControllerName,
+		Units:          units(header),
+	}
+
+	if err := n.encoder.Encode(map[string]interface{}{"header": first}); err != nil {
+		return nil, err
+	}
+
+	return n, nil
+}
+
+func (n *ndjsonWriter) Write(values ...interface{}) error {
+	if len(values) != len(n.header.Columns) {
+		return fmt.Errorf("expected %d values, got %d", len(n.header.Columns), len(values))
+	}
+
+	row := make(map[string]interface{}, len(values))
+	for i, value := range values {
+		// JSON has no NaN, missing values become null
+		if v, ok := value.(float64); ok && math.IsNaN(v) {
+			value = nil
+		}
+
+		row[n.header.Columns[i].Name] = value
+	}
+
+	return n.encoder.Encode(row)
+}
+
+func (n *ndjsonWriter) Close() error {
+	return nil
+}
+
+func units(header *Header) map[string]string {
+	result := make(map[string]string)
+	for _, column := range header.Columns {
+		if column.Unit != "" {
+			result[column.Name] = column.Unit
+		}
+	}
+
+	return result
+}
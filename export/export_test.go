@@ -0,0 +1,112 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testHeader = &Header{
+	Title:          "readings",
+	ControllerId:   "f1d67e51-4ca4-4b25-a4b7-6c8f06822075",
+	ControllerName: "North greenhouse",
+	Columns: []Column{
+		{Name: "timestamp", Type: TypeTime},
+		{Name: "temperature", Unit: "°C", Type: TypeFloat},
+		{Name: "water_level", Unit: "%", Type: TypeInt},
+		{Name: "date", Type: TypeString},
+	},
+}
+
+var timestamp = time.Date(2020, time.April, 15, 10, 0, 0, 0, time.UTC)
+
+func writeRows(t *testing.T, format string) string {
+	buf := &bytes.Buffer{}
+
+	w, err := NewWriter(format, buf, testHeader)
+	if err != nil {
+		t.Fatalf("%s: could not create writer: %v", format, err)
+	}
+
+	if err := w.Write(timestamp, 25.5, 80, "2020-04-15"); err != nil {
+		t.Fatalf("%s: could not write row: %v", format, err)
+	}
+
+	if err := w.Write(timestamp.Add(time.Minute), math.NaN(), 79, "2020-04-15"); err != nil {
+		t.Fatalf("%s: could not write row: %v", format, err)
+	}
+
+	if err := w.Write(timestamp); err == nil {
+		t.Fatalf("%s: expected error for missing values", format)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("%s: could not close writer: %v", format, err)
+	}
+
+	return buf.String()
+}
+
+// Test CSV export has a preamble, a header row and a row per Write
+func TestCsvWriter(t *testing.T) {
+	expected := strings.Join([]string{
+		"# readings",
+		"# controller: North greenhouse",
+		"# controller_id: f1d67e51-4ca4-4b25-a4b7-6c8f06822075",
+		"# unit of temperature: °C",
+		"# unit of water_level: %",
+		"timestamp,temperature,water_level,date",
+		"2020-04-15T10:00:00Z,25.5,80,2020-04-15",
+		"2020-04-15T10:01:00Z,,79,2020-04-15",
+		"",
+	}, "\n")
+
+	if got := writeRows(t, FormatCsv); got != expected {
+		t.Fatalf("expected [%v], got = [%v]", expected, got)
+	}
+}
+
+// Test newline delimited JSON export has a header object and an object per Write
+func TestNdjsonWriter(t *testing.T) {
+	lines := strings.Split(strings.TrimSpace(writeRows(t, FormatNdjson)), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected [%v], got = [%v]", 3, len(lines))
+	}
+
+	header := map[string]map[string]interface{}{}
+	_ = json.Unmarshal([]byte(lines[0]), &header)
+	if header["header"]["controller_name"] != "North greenhouse" {
+		t.Fatalf("expected [%v], got = [%v]", "North greenhouse", header["header"]["controller_name"])
+	}
+
+	row := map[string]interface{}{}
+	_ = json.Unmarshal([]byte(lines[2]), &row)
+	if row["temperature"] != nil || row["water_level"] != float64(79) {
+		t.Fatalf("unexpected row [%v]", row)
+	}
+}
+
+// Test Parquet export is a complete file with the header in its metadata
+func TestParquetWriter(t *testing.T) {
+	out := writeRows(t, FormatParquet)
+
+	if !strings.HasPrefix(out, "PAR1") || !strings.HasSuffix(out, "PAR1") {
+		t.Fatalf("expected parquet magic at start and end")
+	}
+
+	for _, expected := range []string{"North greenhouse", "unit.temperature", "°C"} {
+		if !strings.Contains(out, expected) {
+			t.Fatalf("expected metadata [%v]", expected)
+		}
+	}
+}
+
+// Test unknown formats are refused
+func TestNewWriter_UnknownFormat(t *testing.T) {
+	if _, err := NewWriter("xlsx", &bytes.Buffer{}, testHeader); err != ErrUnknownFormat {
+		t.Fatalf("expected [%v], got = [%v]", ErrUnknownFormat, err)
+	}
+}
@@ -0,0 +1,94 @@
+package export
+
+import (
+	"fmt"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+	"io"
+	"math"
+	"time"
+)
+
+// Rows are flushed to the response once a row group reaches this size
+const parquetRowGroupSize = 4 * 1024 * 1024
+
+// Parquet keeps the header in the key value metadata of the footer
+type parquetWriter struct {
+	pw     *writer.CSVWriter
+	header *Header
+}
+
+func newParquetWriter(w io.Writer, header *Header) (*parquetWriter, error) {
+	schema := make([]string, len(header.Columns))
+	for i, column := range header.Columns {
+		switch column.Type {
+		case TypeTime:
+			schema[i] = fmt.Sprintf("name=%s, type=TIMESTAMP_MILLIS, repetitiontype=OPTIONAL", column.Name)
+		case TypeFloat:
+			schema[i] = fmt.Sprintf("name=%s, type=DOUBLE, repetitiontype=OPTIONAL", column.Name)
+		case TypeInt:
+			schema[i] = fmt.Sprintf("name=%s, type=INT64, repetitiontype=OPTIONAL", column.Name)
+		case TypeString:
+			schema[i] = fmt.Sprintf("name=%s, type=UTF8, repetitiontype=OPTIONAL", column.Name)
+		}
+	}
+
+	pw, err := writer.NewCSVWriterFromWriter(schema, w, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	pw.RowGroupSize = parquetRowGroupSize
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+
+	metadata := map[string]string{
+		"title":           header.Title,
+		"controller_id":   header.ControllerId,
+		"controller_name": header.ControllerName,
+	}
+
+	for name, unit := range units(header) {
+		metadata["unit."+name] = unit
+	}
+
+	for key, value := range metadata {
+		keyValue := parquet.NewKeyValue()
+		keyValue.Key = key
+		keyValue.Value = new(string)
+		*keyValue.Value = value
+		pw.Footer.KeyValueMetadata = append(pw.Footer.KeyValueMetadata, keyValue)
+	}
+
+	return &parquetWriter{pw: pw, header: header}, nil
+}
+
+func (p *parquetWriter) Write(values ...interface{}) error {
+	if len(values) != len(p.header.Columns) {
+		return fmt.Errorf("expected %d values, got %d", len(p.header.Columns), len(values))
+	}
+
+	// The writer keeps the row until its row group is flushed, so every row needs its own slice
+	row := make([]interface{}, len(values))
+	for i, value := range values {
+		switch v := value.(type) {
+		case time.Time:
+			row[i] = v.UnixNano() / int64(time.Millisecond)
+		case float64:
+			if !math.IsNaN(v) {
+				row[i] = v
+			}
+		case int:
+			row[i] = int64(v)
+		case string:
+			row[i] = v
+		default:
+			return fmt.Errorf("unsupported value %T", value)
+		}
+	}
+
+	return p.pw.Write(row)
+}
+
+func (p *parquetWriter) Close() error {
+	return p.pw.WriteStop()
+}
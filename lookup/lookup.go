@@ -0,0 +1,25 @@
+// Package lookup finds the users, controllers and plans that other packages read but don't own
+package lookup
+
+import (
+	"context"
+	"errors"
+	"github.com/tPhume/ags-backend/plan"
+)
+
+var (
+	ErrControllerNotFound = errors.New("controller not found")
+	ErrPlanNotFound       = errors.New("plan not found")
+)
+
+// Timezones is embedded in the Repo of packages that work in the local time of a user
+type Timezones interface {
+	// GetTimezone returns the timezone of the user, empty when it was never set
+	GetTimezone(ctx context.Context, userId string) (string, error)
+}
+
+// Plans is embedded in the Repo of packages that read plans
+type Plans interface {
+	// GetPlan returns the plan of the user, ErrPlanNotFound when the user has none by that id
+	GetPlan(ctx context.Context, userId string, planId string) (*plan.Entity, error)
+}
@@ -0,0 +1,69 @@
+package lookup
+
+import (
+	"context"
+	"github.com/tPhume/ags-backend/plan"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type MongoRepo struct {
+	ControllerCol *mongo.Collection
+	PlanCol       *mongo.Collection
+	UserCol       *mongo.Collection
+}
+
+func (m *MongoRepo) GetTimezone(ctx context.Context, userId string) (string, error) {
+	result := m.UserCol.FindOne(ctx, bson.M{"_id": userId}, options.FindOne().SetProjection(bson.M{"timezone": 1}))
+	if result.Err() != nil {
+		if result.Err() == mongo.ErrNoDocuments {
+			return "", nil
+		}
+
+		return "", result.Err()
+	}
+
+	user := &struct {
+		Timezone string `bson:"timezone"`
+	}{}
+
+	if err := result.Decode(user); err != nil {
+		return "", err
+	}
+
+	return user.Timezone, nil
+}
+
+func (m *MongoRepo) GetPlan(ctx context.Context, userId string, planId string) (*plan.Entity, error) {
+	result := m.PlanCol.FindOne(ctx, bson.M{"_id": planId, "user_id": userId})
+	if result.Err() != nil {
+		if result.Err() == mongo.ErrNoDocuments {
+			return nil, ErrPlanNotFound
+		}
+
+		return nil, result.Err()
+	}
+
+	entity := &plan.Entity{}
+	if err := result.Decode(entity); err != nil {
+		return nil, err
+	}
+
+	return entity, nil
+}
+
+// FindController decodes the controller of the user into controller, a struct with the fields the caller needs
+// Returns ErrControllerNotFound when the user has none by that id
+func (m *MongoRepo) FindController(ctx context.Context, userId string, controllerId string, controller interface{}) error {
+	result := m.ControllerCol.FindOne(ctx, bson.M{"_id": controllerId, "user_id": userId})
+	if result.Err() != nil {
+		if result.Err() == mongo.ErrNoDocuments {
+			return ErrControllerNotFound
+		}
+
+		return result.Err()
+	}
+
+	return result.Decode(controller)
+}
@@ -0,0 +1,126 @@
+package metric
+
+import "math"
+
+// Derived metrics are worked out from readings rather than measured
+// Controllers can't declare sensors of them, but plans can have setpoints for them
+const (
+	// VPD is the vapour pressure deficit of the air in kPa, from temperature and humidity
+	VPD = "vpd"
+
+	// DLI is the daily light integral in mol/m²/d, from light
+	DLI = "dli"
+
+	// GDD is growing degree days in °C·d, from the daily min and max of temperature
+	GDD = "gdd"
+)
+
+// LightSources convert lux to PPFD in µmol/m²/s per lux, the spectrum decides how much of the light plants can use
+var LightSources = map[string]float64{
+	"sunlight":     0.0185,
+	"led":          0.015,
+	"hps":          0.0122,
+	"metal_halide": 0.0141,
+	"fluorescent":  0.0135,
+}
+
+// DefaultLightSource is assumed when a controller doesn't say
+const DefaultLightSource = "sunlight"
+
+// Crops have the base temperature in °C below which they don't develop
+var Crops = map[string]float64{
+	"basil":      10,
+	"cucumber":   10,
+	"lettuce":    4.4,
+	"pepper":     10,
+	"rice":       10,
+	"spinach":    2.2,
+	"strawberry": 3,
+	"tomato":     10,
+}
+
+// DefaultBaseTemperature is used for crops that aren't known
+const DefaultBaseTemperature = 10
+
+// SaturationVapourPressure of air at temperature in °C, in kPa by the Tetens equation
+func SaturationVapourPressure(temperature float64) float64 {
+	return 0.6108 * math.Exp(17.27*temperature/(temperature+237.3))
+}
+
+// VapourPressureDeficit of air at temperature in °C and relative humidity in %, in kPa
+func VapourPressureDeficit(temperature float64, humidity float64) float64 {
+	return SaturationVapourPressure(temperature) * (1 - humidity/100)
+}
+
+// DegreeDays of a day with the min and max temperature in °C, none when the mean is below base
+func DegreeDays(min float64, max float64, base float64) float64 {
+	return math.Max((min+max)/2-base, 0)
+}
+
+// VPDSensors returns the keys of the first temperature and humidity sensors, which VPD is worked out from
+func VPDSensors(sensors []Sensor) (string, string, bool) {
+	temperature, humidity := "", ""
+	for _, sensor := range sensors {
+		if sensor.Metric == "temperature" && temperature == "" {
+			temperature = sensor.Key
+		}
+
+		if sensor.Metric == "humidity" && humidity == "" {
+			humidity = sensor.Key
+		}
+	}
+
+	return temperature, humidity, temperature != "" && humidity != ""
+}
+
+// FirstSensor returns the key of the first sensor of the metric
+func FirstSensor(sensors []Sensor, name string) (string, bool) {
+	for _, sensor := range sensors {
+		if sensor.Metric == name {
+			return sensor.Key, true
+		}
+	}
+
+	return "", false
+}
+
+// WithDerived returns sensors and a sensor for every derived metric that can be worked out per reading from them
+// A declared sensor with the same key wins
+func WithDerived(sensors []Sensor) []Sensor {
+	if _, _, ok := VPDSensors(sensors); !ok {
+		return sensors
+	}
+
+	for _, sensor := range sensors {
+		if sensor.Key == VPD {
+			return sensors
+		}
+	}
+
+	all := make([]Sensor, len(sensors), len(sensors)+1)
+	copy(all, sensors)
+
+	return append(all, Sensor{Key: VPD, Metric: VPD})
+}
+
+// WithDaily returns sensors and a sensor for every derived metric that is worked out once per day from them
+// DLI needs a light sensor and GDD a temperature sensor, a declared sensor with the same key wins
+func WithDaily(sensors []Sensor) []Sensor {
+	all := make([]Sensor, len(sensors), len(sensors)+2)
+	copy(all, sensors)
+
+	taken := make(map[string]bool, len(sensors))
+	for _, sensor := range sensors {
+		taken[sensor.Key] = true
+	}
+
+	if _, ok := FirstSensor(sensors, "light"); ok && !taken[DLI] {
+		all = append(all, Sensor{Key: DLI, Metric: DLI})
+	}
+
+	if _, ok := FirstSensor(sensors, "temperature"); ok && !taken[GDD] {
+		all = append(all, Sensor{Key: GDD, Metric: GDD})
+	}
+
+	return all
+}
@@ -0,0 +1,66 @@
+package metric
+
+import (
+	"math"
+	"testing"
+)
+
+// Test VPD against values from published tables
+func TestVapourPressureDeficit(t *testing.T) {
+	testCases := []struct {
+		temperature float64
+		humidity    float64
+		expected    float64
+	}{
+		{temperature: 25, humidity: 60, expected: 1.267},
+		{temperature: 20, humidity: 100, expected: 0},
+		{temperature: 30, humidity: 50, expected: 2.121},
+	}
+
+	for i, c := range testCases {
+		if got := VapourPressureDeficit(c.temperature, c.humidity); math.Abs(got-c.expected) > 0.001 {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.expected, got)
+		}
+	}
+}
+
+// Test days colder than the base add nothing
+func TestDegreeDays(t *testing.T) {
+	testCases := []struct {
+		min, max, base float64
+		expected       float64
+	}{
+		{min: 15, max: 25, base: 10, expected: 10},
+		{min: 2, max: 12, base: 10, expected: 0},
+		{min: 0, max: 10, base: 4.4, expected: 0.6},
+	}
+
+	for i, c := range testCases {
+		if got := DegreeDays(c.min, c.max, c.base); math.Abs(got-c.expected) > 1e-9 {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.expected, got)
+		}
+	}
+}
+
+// Test VPD is only added for controllers with temperature and humidity
+func TestWithDerived(t *testing.T) {
+	testCases := []struct {
+		sensors  []Sensor
+		expected int
+	}{
+		{sensors: LegacySensors, expected: len(LegacySensors) + 1},
+		{sensors: []Sensor{{Key: "air", Metric: "temperature"}, {Key: "rh", Metric: "humidity"}}, expected: 3},
+		{sensors: []Sensor{{Key: "leaf", Metric: "leaf_temperature"}, {Key: "rh", Metric: "humidity"}}, expected: 2},
+		{sensors: []Sensor{{Key: "co2", Metric: "co2"}}, expected: 1},
+	}
+
+	for i, c := range testCases {
+		if got := WithDerived(c.sensors); len(got) != c.expected {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.expected, len(got))
+		}
+	}
+
+	if temperature, humidity, _ := VPDSensors(testCases[1].sensors); temperature != "air" || humidity != "rh" {
+		t.Fatalf("expected [air rh], got = [%v %v]", temperature, humidity)
+	}
+}
@@ -0,0 +1,248 @@
+// Package metric is the registry of everything a controller can measure
+// Readings, summaries and plan setpoints are keyed by the names registered here
+package metric
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/tPhume/ags-backend/session"
+	"math"
+	"net/http"
+	"regexp"
+)
+
+func RegisterRoutes(handler *Handler, engine *gin.Engine, sessionHandler *session.Handler) {
+	engine.GET("api/v1/metric", sessionHandler.GetUser, handler.ListMetrics)
+}
+
+// Aggregations of readings over a span of time
+const (
+	AggAvg  = "avg"
+	AggMin  = "min"
+	AggMax  = "max"
+	AggLast = "last"
+)
+
+// Metric is a quantity that can be measured
+type Metric struct {
+	Name string  `json:"name"`
+	Unit string  `json:"unit"`
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+
+	// Aggregation is used when downsampling without one being asked for
+	Aggregation string `json:"aggregation"`
+
+	// Aggregations that make sense for the metric
+	Aggregations []string `json:"aggregations"`
+
+	// MaxRate is the largest believable change per minute, zero when any change is
+	MaxRate float64 `json:"max_rate,omitempty"`
+
+	// StuckCount is how many identical readings in a row mean the sensor is stuck, zero when steady values are normal
+	StuckCount int `json:"stuck_count,omitempty"`
+
+	// Invalid values are sent by faulty sensors even though they are within range
+	Invalid []float64 `json:"invalid,omitempty"`
+
+	// Tolerance is how far from a plan setpoint a value still counts as on target
+	Tolerance float64 `json:"tolerance,omitempty"`
+
+	// Derived metrics are worked out by the backend, no sensor measures them
+	Derived bool `json:"derived,omitempty"`
+}
+
+var (
+	ErrUnknownMetric = errors.New("unknown metric")
+	ErrDerivedMetric = errors.New("metric is derived and can't be measured")
+	ErrOutOfRange    = errors.New("value out of range")
+	errDuplicate     = errors.New("metric already registered")
+)
+
+// Check returns ErrOutOfRange unless value is a number within the valid range of the metric
+func (m *Metric) Check(value float64) error {
+	if math.IsNaN(value) || value < m.Min || value > m.Max {
+		return ErrOutOfRange
+	}
+
+	for _, invalid := range m.Invalid {
+		if value == invalid {
+			return ErrOutOfRange
+		}
+	}
+
+	return nil
+}
+
+// Allows reports whether aggregation is one of the aggregations of the metric
+func (m *Metric) Allows(aggregation string) bool {
+	for _, allowed := range m.Aggregations {
+		if allowed == aggregation {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Registry of metrics by name, it keeps the order metrics were registered in
+type Registry struct {
+	metrics map[string]*Metric
+	order   []*Metric
+}
+
+// NewRegistry panics on duplicate names, it is meant for metrics known at compile time
+func NewRegistry(metrics ...*Metric) *Registry {
+	r := &Registry{metrics: make(map[string]*Metric)}
+	for _, m := range metrics {
+		if err := r.Register(m); err != nil {
+			panic(fmt.Sprintf("metric %s: %s", m.Name, err))
+		}
+	}
+
+	return r
+}
+
+func (r *Registry) Register(m *Metric) error {
+	if _, ok := r.metrics[m.Name]; ok {
+		return errDuplicate
+	}
+
+	r.metrics[m.Name] = m
+	r.order = append(r.order, m)
+
+	return nil
+}
+
+func (r *Registry) Lookup(name string) (*Metric, bool) {
+	m, ok := r.metrics[name]
+	return m, ok
+}
+
+func (r *Registry) List() []*Metric {
+	return r.order
+}
+
+var allAggregations = []string{AggAvg, AggMin, AggMax, AggLast}
+
+// Default registry, the first five metrics are the fields controllers have always sent and the last three are derived
+// Light and water level change in steps, soil moisture, water level, pH and EC hold steady for hours, so they have no limits for those
+var Default = NewRegistry(
+	&Metric{Name: "temperature", Unit: "°C", Min: -40, Max: 85, Aggregation: AggAvg, Aggregations: allAggregations, MaxRate: 5, StuckCount: 60, Tolerance: 2},
+	&Metric{Name: "humidity", Unit: "%", Min: 0, Max: 100, Aggregation: AggAvg, Aggregations: allAggregations, MaxRate: 20, StuckCount: 60, Tolerance: 10},
+	&Metric{Name: "light", Unit: "lux", Min: 0, Max: 65535, Aggregation: AggAvg, Aggregations: allAggregations, Invalid: []float64{65535}, Tolerance: 2000},
+	&Metric{Name: "soil_moisture", Unit: "raw", Min: 0, Max: 1000, Aggregation: AggAvg, Aggregations: allAggregations, MaxRate: 100, Tolerance: 50},
+	&Metric{Name: "water_level", Unit: "%", Min: 0, Max: 100, Aggregation: AggLast, Aggregations: allAggregations, Tolerance: 10},
+	&Metric{Name: "co2", Unit: "ppm", Min: 0, Max: 10000, Aggregation: AggAvg, Aggregations: allAggregations, MaxRate: 500, StuckCount: 60, Tolerance: 200},
+	&Metric{Name: "ph", Unit: "pH", Min: 0, Max: 14, Aggregation: AggAvg, Aggregations: allAggregations, MaxRate: 1, Tolerance: 0.5},
+	&Metric{Name: "ec", Unit: "mS/cm", Min: 0, Max: 20, Aggregation: AggAvg, Aggregations: allAggregations, MaxRate: 2, Tolerance: 0.5},
+	&Metric{Name: "leaf_temperature", Unit: "°C", Min: -40, Max: 85, Aggregation: AggAvg, Aggregations: allAggregations, MaxRate: 5, StuckCount: 60, Tolerance: 2},
+	&Metric{Name: VPD, Unit: "kPa", Min: 0, Max: 10, Aggregation: AggAvg, Aggregations: allAggregations, Tolerance: 0.2, Derived: true},
+	&Metric{Name: DLI, Unit: "mol/m²/d", Min: 0, Max: 100, Aggregation: AggAvg, Aggregations: allAggregations, Tolerance: 2, Derived: true},
+	&Metric{Name: GDD, Unit: "°C·d", Min: 0, Max: 10000, Aggregation: AggAvg, Aggregations: allAggregations, Tolerance: 10, Derived: true},
+)
+
+// Sensor is declared by a controller, Key names its values in readings
+// A controller with several probes of one metric declares a sensor per probe, such as soil_moisture_1 and soil_moisture_2
+type Sensor struct {
+	Key    string `json:"key" bson:"key"`
+	Metric string `json:"metric" bson:"metric"`
+	Label  string `json:"label,omitempty" bson:"label,omitempty"`
+}
+
+// LegacySensors are assumed for controllers that don't declare any
+var LegacySensors = []Sensor{
+	{Key: "temperature", Metric: "temperature"},
+	{Key: "humidity", Metric: "humidity"},
+	{Key: "light", Metric: "light"},
+	{Key: "soil_moisture", Metric: "soil_moisture"},
+	{Key: "water_level", Metric: "water_level"},
+}
+
+// Limit on the sensors of one controller
+const MaxSensors = 32
+
+var (
+	ErrUnknownSensor = errors.New("unknown sensor")
+	errSensorKey     = errors.New("sensor key must be lowercase letters, digits and underscores")
+	errDuplicateKey  = errors.New("duplicate sensor key")
+	errTooMany       = errors.New("too many sensors")
+)
+
+var sensorKey = regexp.MustCompile(`^[a-z][a-z0-9_]{0,31}$`)
+
+// Sensors returns declared, or LegacySensors when nothing is declared
+func Sensors(declared []Sensor) []Sensor {
+	if len(declared) == 0 {
+		return LegacySensors
+	}
+
+	return declared
+}
+
+// ValidateSensors checks keys are well formed and unique, and that every metric is registered
+func (r *Registry) ValidateSensors(sensors []Sensor) error {
+	if len(sensors) > MaxSensors {
+		return errTooMany
+	}
+
+	keys := make(map[string]bool, len(sensors))
+	for _, sensor := range sensors {
+		if !sensorKey.MatchString(sensor.Key) {
+			return errSensorKey
+		}
+
+		if keys[sensor.Key] {
+			return errDuplicateKey
+		}
+
+		m, ok := r.Lookup(sensor.Metric)
+		if !ok {
+			return ErrUnknownMetric
+		}
+
+		if m.Derived {
+			return ErrDerivedMetric
+		}
+
+		keys[sensor.Key] = true
+	}
+
+	return nil
+}
+
+// SensorMetric returns the metric measured by the sensor with key
+func (r *Registry) SensorMetric(sensors []Sensor, key string) (*Metric, error) {
+	for _, sensor := range sensors {
+		if sensor.Key == key {
+			if m, ok := r.Lookup(sensor.Metric); ok {
+				return m, nil
+			}
+
+			return nil, ErrUnknownMetric
+		}
+	}
+
+	return nil, ErrUnknownSensor
+}
+
+// CheckSensors returns an error unless every key of values is one of the sensors
+func (r *Registry) CheckSensors(sensors []Sensor, values map[string]float64) error {
+	for key := range values {
+		if _, err := r.SensorMetric(sensors, key); err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+// Handler for metric REST API
+type Handler struct {
+	Registry *Registry
+}
+
+func (h *Handler) ListMetrics(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"message": "metrics retrieved", "result": h.Registry.List()})
+}
@@ -0,0 +1,82 @@
+package metric
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+// Test sensor lists are checked against the registry
+func TestRegistry_ValidateSensors(t *testing.T) {
+	testCases := []struct {
+		sensors []Sensor
+		ok      bool
+	}{
+		{sensors: LegacySensors, ok: true},
+		{sensors: []Sensor{{Key: "soil_moisture_1", Metric: "soil_moisture"}, {Key: "soil_moisture_2", Metric: "soil_moisture"}}, ok: true},
+		{sensors: []Sensor{{Key: "co2", Metric: "co2"}, {Key: "co2", Metric: "co2"}}},
+		{sensors: []Sensor{{Key: "radiation", Metric: "radiation"}}},
+		{sensors: []Sensor{{Key: "Soil.1", Metric: "soil_moisture"}}},
+		{sensors: []Sensor{{Key: "vpd", Metric: VPD}}},
+		{sensors: make([]Sensor, MaxSensors+1)},
+	}
+
+	for i, c := range testCases {
+		if err := Default.ValidateSensors(c.sensors); (err == nil) != c.ok {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.ok, err)
+		}
+	}
+}
+
+// Test values must belong to a sensor of the controller
+func TestRegistry_CheckSensors(t *testing.T) {
+	sensors := []Sensor{{Key: "ph", Metric: "ph"}, {Key: "leaf", Metric: "leaf_temperature"}}
+
+	testCases := []struct {
+		values map[string]float64
+		err    error
+	}{
+		{values: map[string]float64{"ph": 6.5, "leaf": 24}},
+		{values: map[string]float64{"ph": 15}},
+		{values: map[string]float64{"temperature": 24}, err: ErrUnknownSensor},
+	}
+
+	for i, c := range testCases {
+		if err := Default.CheckSensors(sensors, c.values); !errors.Is(err, c.err) {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.err, err)
+		}
+	}
+}
+
+// Test values outside the range or known to be invalid fail the check
+func TestMetric_Check(t *testing.T) {
+	light, _ := Default.Lookup("light")
+
+	testCases := []struct {
+		value float64
+		err   error
+	}{
+		{value: 1200},
+		{value: -1, err: ErrOutOfRange},
+		{value: 65535, err: ErrOutOfRange},
+		{value: math.NaN(), err: ErrOutOfRange},
+	}
+
+	for i, c := range testCases {
+		if err := light.Check(c.value); err != c.err {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.err, err)
+		}
+	}
+}
+
+// Test controllers without declared sensors get the legacy ones
+func TestSensors(t *testing.T) {
+	if got := Sensors(nil); len(got) != len(LegacySensors) {
+		t.Fatalf("expected [%v], got = [%v]", len(LegacySensors), len(got))
+	}
+
+	declared := []Sensor{{Key: "co2", Metric: "co2"}}
+	if got := Sensors(declared); len(got) != 1 {
+		t.Fatalf("expected [%v], got = [%v]", 1, len(got))
+	}
+}
@@ -0,0 +1,50 @@
+package notification
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"time"
+)
+
+// Policy says how long notifications are kept, both must be more than zero
+// A notification that is read expires ReadDays after it was read, unless it would expire sooner anyway
+type Policy struct {
+	UnreadDays int `json:"unread_days"`
+	ReadDays   int `json:"read_days"`
+}
+
+// Expiry of a notification created at now
+func (p Policy) Expiry(now time.Time) time.Time {
+	return now.AddDate(0, 0, p.UnreadDays)
+}
+
+// ReadExpiry of a notification read at now
+func (p Policy) ReadExpiry(now time.Time) time.Time {
+	return now.AddDate(0, 0, p.ReadDays)
+}
+
+// Inbox puts notifications in the inbox of their user, the other packages send through it
+type Inbox struct {
+	Repo   Repo
+	Policy Policy
+}
+
+// Add keeps the notification unless its user turned its type off
+func (i *Inbox) Add(ctx context.Context, notification *Notification) error {
+	preferences, err := i.Repo.GetPreferences(ctx, notification.UserId)
+	if err != nil {
+		return err
+	}
+
+	if !preferences.Enabled(notification.Type) {
+		return nil
+	}
+
+	now := time.Now()
+	notification.NotificationId = uuid.New().String()
+	notification.CreatedAt = now
+	notification.ReadAt = nil
+	notification.ExpiresAt = i.Policy.Expiry(now)
+
+	return i.Repo.AddNotification(ctx, notification)
+}
@@ -0,0 +1,86 @@
+package notification
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// legacyMessage is an alert as the first inbox kept it, before notifications
+// When it was read was not kept, so read ones are taken as read when they arrived
+type legacyMessage struct {
+	MessageId string    `bson:"_id"`
+	UserId    string    `bson:"user_id"`
+	Title     string    `bson:"title"`
+	Body      string    `bson:"body"`
+	Severity  string    `bson:"severity"`
+	CreatedAt time.Time `bson:"created_at"`
+	Read      bool      `bson:"read"`
+}
+
+func (l *legacyMessage) notification(policy Policy) *Notification {
+	notification := &Notification{
+		NotificationId: l.MessageId,
+		UserId:         l.UserId,
+		Type:           TypeAlert,
+		Title:          l.Title,
+		Body:           l.Body,
+		Severity:       l.Severity,
+		CreatedAt:      l.CreatedAt,
+		ExpiresAt:      policy.Expiry(l.CreatedAt),
+	}
+
+	if l.Read {
+		readAt := l.CreatedAt
+		notification.ReadAt = &readAt
+
+		if expiresAt := policy.ReadExpiry(readAt); expiresAt.Before(notification.ExpiresAt) {
+			notification.ExpiresAt = expiresAt
+		}
+	}
+
+	return notification
+}
+
+// MigrateInbox moves the messages of the first inbox in legacyCol into notifications by the policy, then drops legacyCol
+// Messages that would have expired by now are left behind, ids are kept so a migration that stopped half way can be run again
+// It returns how many notifications were added
+func (m *MongoRepo) MigrateInbox(ctx context.Context, legacyCol *mongo.Collection, policy Policy, now time.Time) (int, error) {
+	cursor, err := legacyCol.Find(ctx, bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	added := 0
+	for cursor.Next(ctx) {
+		legacy := &legacyMessage{}
+		if err := cursor.Decode(legacy); err != nil {
+			return added, err
+		}
+
+		notification := legacy.notification(policy)
+		if !notification.ExpiresAt.After(now) {
+			continue
+		}
+
+		// Ones moved by an earlier run may have been read since
+		update := bson.M{"$setOnInsert": notification}
+		result, err := m.Col.UpdateOne(ctx, bson.M{"_id": notification.NotificationId}, update, options.Update().SetUpsert(true))
+		if err != nil {
+			return added, err
+		}
+
+		if result.UpsertedCount == 1 {
+			added++
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		return added, err
+	}
+
+	return added, legacyCol.Drop(ctx)
+}
@@ -0,0 +1,119 @@
+package notification
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+type MongoRepo struct {
+	Col            *mongo.Collection
+	PreferencesCol *mongo.Collection
+}
+
+// EnsureIndexes creates the indexes the inbox is paged and counted by and the one Mongo removes expired notifications by
+// It is safe to run on every start
+func (m *MongoRepo) EnsureIndexes(ctx context.Context) error {
+	_, err := m.Col.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "read_at", Value: 1}, {Key: "expires_at", Value: 1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+
+	return err
+}
+
+func (m *MongoRepo) AddNotification(ctx context.Context, notification *Notification) error {
+	_, err := m.Col.InsertOne(ctx, notification)
+	return err
+}
+
+func (m *MongoRepo) ListNotifications(ctx context.Context, userId string, unread bool, before *Cursor, now time.Time, limit int) ([]*Notification, error) {
+	filter := bson.M{"user_id": userId, "expires_at": bson.M{"$gt": now}}
+	if before != nil {
+		filter["$or"] = bson.A{
+			bson.M{"created_at": bson.M{"$lt": before.CreatedAt}},
+			bson.M{"created_at": before.CreatedAt, "_id": bson.M{"$lt": before.NotificationId}},
+		}
+	}
+
+	if unread {
+		filter["read_at"] = nil
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}, {Key: "_id", Value: -1}}).SetLimit(int64(limit))
+	cursor, err := m.Col.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	notifications := make([]*Notification, 0)
+	if err := cursor.All(ctx, &notifications); err != nil {
+		return nil, err
+	}
+
+	return notifications, nil
+}
+
+func (m *MongoRepo) CountUnread(ctx context.Context, userId string, now time.Time, limit int) (int, error) {
+	filter := bson.M{"user_id": userId, "read_at": nil, "expires_at": bson.M{"$gt": now}}
+	count, err := m.Col.CountDocuments(ctx, filter, options.Count().SetLimit(int64(limit)))
+
+	return int(count), err
+}
+
+func (m *MongoRepo) MarkRead(ctx context.Context, userId string, notificationId string, readAt *time.Time, expiresAt time.Time) error {
+	update := bson.M{"$unset": bson.M{"read_at": ""}}
+	if readAt != nil {
+		update = bson.M{"$set": bson.M{"read_at": readAt}, "$min": bson.M{"expires_at": expiresAt}}
+	}
+
+	result, err := m.Col.UpdateOne(ctx, bson.M{"_id": notificationId, "user_id": userId}, update)
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return errNotificationNotFound
+	}
+
+	return nil
+}
+
+func (m *MongoRepo) MarkAllRead(ctx context.Context, userId string, readAt time.Time, expiresAt time.Time) (int, error) {
+	result, err := m.Col.UpdateMany(ctx, bson.M{"user_id": userId, "read_at": nil, "expires_at": bson.M{"$gt": readAt}}, bson.M{
+		"$set": bson.M{"read_at": readAt},
+		"$min": bson.M{"expires_at": expiresAt},
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int(result.ModifiedCount), nil
+}
+
+func (m *MongoRepo) GetPreferences(ctx context.Context, userId string) (*Preferences, error) {
+	result := m.PreferencesCol.FindOne(ctx, bson.M{"_id": userId})
+	if result.Err() != nil {
+		if result.Err() == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+
+		return nil, result.Err()
+	}
+
+	preferences := &Preferences{}
+	if err := result.Decode(preferences); err != nil {
+		return nil, err
+	}
+
+	return preferences, nil
+}
+
+func (m *MongoRepo) SetPreferences(ctx context.Context, preferences *Preferences) error {
+	_, err := m.PreferencesCol.ReplaceOne(ctx, bson.M{"_id": preferences.UserId}, preferences, options.Replace().SetUpsert(true))
+	return err
+}
@@ -0,0 +1,344 @@
+// Package notification is the in-app inbox of a user, alerts and system messages land here
+// Notifications expire by the Policy, sooner once they are read, and Mongo removes them once they have
+package notification
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/tPhume/ags-backend/session"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func RegisterRoutes(handler *Handler, engine *gin.Engine, sessionHandler *session.Handler) {
+	group := engine.Group("api/v1/notifications")
+	group.Use(sessionHandler.GetUser)
+
+	group.GET("", handler.ListNotifications)
+	group.GET("/unread-count", handler.UnreadCount)
+	group.POST("/read-all", handler.MarkAllRead)
+	group.PATCH("/:notificationId", handler.MarkRead)
+
+	group.GET("/preferences", handler.GetPreferences)
+	group.PUT("/preferences", handler.SetPreferences)
+}
+
+// Types of notification, users can turn each of them off
+const (
+	TypeAlert   = "alert"
+	TypeOffline = "offline"
+	TypeSystem  = "system"
+)
+
+var Types = []string{TypeAlert, TypeOffline, TypeSystem}
+
+// Notification in the inbox of a user
+type Notification struct {
+	NotificationId string `json:"notification_id" bson:"_id"`
+	UserId         string `json:"-" bson:"user_id"`
+	Type           string `json:"type" bson:"type"`
+	Title          string `json:"title" bson:"title"`
+	Body           string `json:"body" bson:"body"`
+	Severity       string `json:"severity,omitempty" bson:"severity,omitempty"`
+
+	// ControllerId is set when the notification is about a controller
+	ControllerId string `json:"controller_id,omitempty" bson:"controller_id,omitempty"`
+
+	CreatedAt time.Time  `json:"created_at" bson:"created_at"`
+	ReadAt    *time.Time `json:"read_at" bson:"read_at"`
+	ExpiresAt time.Time  `json:"expires_at" bson:"expires_at"`
+}
+
+// Preferences of a user by type, types that are not set are on
+type Preferences struct {
+	UserId string          `json:"-" bson:"_id"`
+	Types  map[string]bool `json:"types" bson:"types" binding:"required"`
+}
+
+// Enabled reports whether notifications of type should land in the inbox, p can be nil
+func (p *Preferences) Enabled(notificationType string) bool {
+	if p == nil {
+		return true
+	}
+
+	enabled, ok := p.Types[notificationType]
+	return !ok || enabled
+}
+
+// Repo
+type Repo interface {
+	AddNotification(ctx context.Context, notification *Notification) error
+
+	// ListNotifications returns up to limit notifications of the user that come after the cursor and are not expired by now
+	// Newest come first, ties are broken by id, before is nil for the first page
+	ListNotifications(ctx context.Context, userId string, unread bool, before *Cursor, now time.Time, limit int) ([]*Notification, error)
+
+	// CountUnread counts the unread notifications of the user that are not expired by now, it stops counting at limit
+	CountUnread(ctx context.Context, userId string, now time.Time, limit int) (int, error)
+
+	// MarkRead sets when the notification was read, or clears it when readAt is nil
+	// It is made to expire by expiresAt unless it would expire before then anyway
+	MarkRead(ctx context.Context, userId string, notificationId string, readAt *time.Time, expiresAt time.Time) error
+
+	// MarkAllRead does MarkRead to every unread notification of the user, it returns how many there were
+	MarkAllRead(ctx context.Context, userId string, readAt time.Time, expiresAt time.Time) (int, error)
+
+	// GetPreferences returns nil when the user never set them
+	GetPreferences(ctx context.Context, userId string) (*Preferences, error)
+
+	SetPreferences(ctx context.Context, preferences *Preferences) error
+}
+
+var (
+	errNotificationNotFound = errors.New("notification not found")
+	errBadCursor            = errors.New("cursor is not a time and an id")
+)
+
+// Handler for notification REST API
+type Handler struct {
+	Repo   Repo
+	Policy Policy
+}
+
+var (
+	// ok message responses for handler
+	resList           = "list of notifications retrieved"
+	resUnreadCount    = "unread count retrieved"
+	resMarkRead       = "notification updated"
+	resMarkAllRead    = "notifications marked read"
+	resGetPreferences = "preferences retrieved"
+	resSetPreferences = "preferences saved"
+
+	// error message responses for handler
+	resInternal    = "not your fault, don't worry"
+	resInvalid     = "invalid values"
+	resNotFound    = "not found"
+	resUnknownType = "unknown notification type"
+)
+
+// Unread counts stop at this, the app shows it as that many or more
+const maxUnreadCount = 100
+
+// How long clients may keep an unread count for
+const unreadCountMaxAge = "10"
+
+// Cursor is the last notification of a page, notifications created at the same time are told apart by id
+type Cursor struct {
+	CreatedAt      time.Time
+	NotificationId string
+}
+
+// String is the next of a page, it is opaque to clients
+func (c *Cursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.CreatedAt.Format(time.RFC3339Nano) + " " + c.NotificationId))
+}
+
+func parseCursor(value string) (*Cursor, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.SplitN(string(decoded), " ", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, errBadCursor
+	}
+
+	createdAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cursor{CreatedAt: createdAt, NotificationId: parts[1]}, nil
+}
+
+// Query for ListNotifications, before is the next of the previous page
+type listQuery struct {
+	Unread bool   `form:"unread"`
+	Limit  int    `form:"limit,default=20" binding:"min=1,max=100"`
+	Before string `form:"before"`
+}
+
+type markBody struct {
+	Read *bool `json:"read" binding:"required"`
+}
+
+func (h *Handler) ListNotifications(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	query := &listQuery{}
+	if err := ctx.ShouldBindQuery(query); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid, "err": err.Error()})
+		return
+	}
+
+	var before *Cursor
+	if query.Before != "" {
+		cursor, err := parseCursor(query.Before)
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+			return
+		}
+
+		before = cursor
+	}
+
+	// One more than asked for tells whether there is a next page
+	notifications, err := h.Repo.ListNotifications(ctx, userId, query.Unread, before, time.Now(), query.Limit+1)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	next := ""
+	if len(notifications) > query.Limit {
+		notifications = notifications[:query.Limit]
+		last := notifications[query.Limit-1]
+		next = (&Cursor{CreatedAt: last.CreatedAt, NotificationId: last.NotificationId}).String()
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resList, "notifications": notifications, "next": next})
+}
+
+// UnreadCount is polled by the app, it only counts up to maxUnreadCount
+func (h *Handler) UnreadCount(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	count, err := h.Repo.CountUnread(ctx, userId, time.Now(), maxUnreadCount)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	ctx.Header("Cache-Control", "private, max-age="+unreadCountMaxAge)
+	ctx.JSON(http.StatusOK, gin.H{"message": resUnreadCount, "unread": count, "more": count >= maxUnreadCount})
+}
+
+// MarkRead marks one notification read or unread, reading it brings its expiry forward
+func (h *Handler) MarkRead(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	notificationId := ctx.Param("notificationId")
+	if _, err := uuid.Parse(notificationId); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	body := &markBody{}
+	if err := ctx.ShouldBindJSON(body); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid, "err": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	var readAt *time.Time
+	if *body.Read {
+		readAt = &now
+	}
+
+	if err := h.Repo.MarkRead(ctx, userId, notificationId, readAt, h.Policy.ReadExpiry(now)); err != nil {
+		if err == errNotificationNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resNotFound})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resMarkRead})
+}
+
+func (h *Handler) MarkAllRead(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	now := time.Now()
+	marked, err := h.Repo.MarkAllRead(ctx, userId, now, h.Policy.ReadExpiry(now))
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resMarkAllRead, "marked": marked})
+}
+
+// GetPreferences responds with every type, on unless the user turned it off
+func (h *Handler) GetPreferences(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	preferences, err := h.Repo.GetPreferences(ctx, userId)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	types := make(map[string]bool, len(Types))
+	for _, notificationType := range Types {
+		types[notificationType] = preferences.Enabled(notificationType)
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resGetPreferences, "preferences": &Preferences{Types: types}})
+}
+
+func (h *Handler) SetPreferences(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	preferences := &Preferences{}
+	if err := ctx.ShouldBindJSON(preferences); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid, "err": err.Error()})
+		return
+	}
+
+	for notificationType := range preferences.Types {
+		if !knownType(notificationType) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": resUnknownType, "type": notificationType})
+			return
+		}
+	}
+
+	preferences.UserId = userId
+	if err := h.Repo.SetPreferences(ctx, preferences); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resSetPreferences, "preferences": preferences})
+}
+
+func knownType(notificationType string) bool {
+	for _, known := range Types {
+		if notificationType == known {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,405 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// For our tests the grower has a frost notification, the neighbour is another user of the same inbox
+// Any other notification id indicates a missing notification
+const (
+	growerId    = "a3237af2-8a64-4a07-82a3-e120cbd23fa1"
+	neighbourId = "6036b226-a6b3-4c77-acd4-4e5cd963caba"
+	frostId     = "57c73057-84e1-4992-b3d1-82bbbb9ce142"
+	unknownId   = "590a0114-0b03-47ef-9ac5-15544f17ac95"
+)
+
+// Repo struct for testing, notifications and preferences are kept in memory
+type repoStruct struct {
+	notifications map[string]*Notification
+	preferences   map[string]*Preferences
+}
+
+func (r *repoStruct) AddNotification(ctx context.Context, notification *Notification) error {
+	r.notifications[notification.NotificationId] = notification
+	return nil
+}
+
+func (r *repoStruct) ListNotifications(ctx context.Context, user string, unread bool, before *Cursor, now time.Time, limit int) ([]*Notification, error) {
+	notifications := make([]*Notification, 0)
+	for _, notification := range r.notifications {
+		if notification.UserId != user || !notification.ExpiresAt.After(now) {
+			continue
+		}
+
+		if before != nil && !newer(before, notification) {
+			continue
+		}
+
+		if unread && notification.ReadAt != nil {
+			continue
+		}
+
+		notifications = append(notifications, notification)
+	}
+
+	sort.Slice(notifications, func(i, j int) bool {
+		return newer(&Cursor{CreatedAt: notifications[i].CreatedAt, NotificationId: notifications[i].NotificationId}, notifications[j])
+	})
+
+	if len(notifications) > limit {
+		notifications = notifications[:limit]
+	}
+
+	return notifications, nil
+}
+
+// newer reports whether the cursor comes before the notification, newest first and then by id
+func newer(cursor *Cursor, notification *Notification) bool {
+	if cursor.CreatedAt.Equal(notification.CreatedAt) {
+		return notification.NotificationId < cursor.NotificationId
+	}
+
+	return notification.CreatedAt.Before(cursor.CreatedAt)
+}
+
+func (r *repoStruct) CountUnread(ctx context.Context, user string, now time.Time, limit int) (int, error) {
+	notifications, _ := r.ListNotifications(ctx, user, true, nil, now, limit)
+	return len(notifications), nil
+}
+
+func (r *repoStruct) MarkRead(ctx context.Context, user string, id string, readAt *time.Time, expiresAt time.Time) error {
+	notification, ok := r.notifications[id]
+	if !ok || notification.UserId != user {
+		return errNotificationNotFound
+	}
+
+	notification.ReadAt = readAt
+	if readAt != nil && expiresAt.Before(notification.ExpiresAt) {
+		notification.ExpiresAt = expiresAt
+	}
+
+	return nil
+}
+
+func (r *repoStruct) MarkAllRead(ctx context.Context, user string, readAt time.Time, expiresAt time.Time) (int, error) {
+	notifications, _ := r.ListNotifications(ctx, user, true, nil, readAt, len(r.notifications))
+	for _, notification := range notifications {
+		_ = r.MarkRead(ctx, user, notification.NotificationId, &readAt, expiresAt)
+	}
+
+	return len(notifications), nil
+}
+
+func (r *repoStruct) GetPreferences(ctx context.Context, user string) (*Preferences, error) {
+	return r.preferences[user], nil
+}
+
+func (r *repoStruct) SetPreferences(ctx context.Context, preferences *Preferences) error {
+	r.preferences[preferences.UserId] = preferences
+	return nil
+}
+
+func newRepo() *repoStruct {
+	return &repoStruct{notifications: map[string]*Notification{}, preferences: map[string]*Preferences{}}
+}
+
+// Setup func for handler testing
+func setUp() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+
+	engine.Use(func(ctx *gin.Context) {
+		ctx.Set("userId", growerId)
+	})
+
+	return engine
+}
+
+// Test notifications of types the user turned off are left out and the rest expire by the policy
+func TestInbox_Add(t *testing.T) {
+	repo := newRepo()
+	repo.preferences[growerId] = &Preferences{UserId: growerId, Types: map[string]bool{TypeOffline: false, TypeAlert: true}}
+	inbox := &Inbox{Repo: repo, Policy: Policy{UnreadDays: 90, ReadDays: 30}}
+
+	testCases := []struct {
+		user             string
+		notificationType string
+		kept             bool
+	}{
+		{user: growerId, notificationType: TypeAlert, kept: true},
+		{user: growerId, notificationType: TypeOffline, kept: false},
+		{user: growerId, notificationType: TypeSystem, kept: true},
+		{user: neighbourId, notificationType: TypeOffline, kept: true},
+	}
+
+	for i, c := range testCases {
+		repo.notifications = map[string]*Notification{}
+		before := time.Now()
+
+		if err := inbox.Add(context.Background(), &Notification{UserId: c.user, Type: c.notificationType, Title: "title"}); err != nil {
+			t.Fatalf("Case %d: expected no error, got = [%v]", i, err)
+		}
+
+		if (len(repo.notifications) == 1) != c.kept {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.kept, len(repo.notifications))
+		}
+
+		for _, notification := range repo.notifications {
+			if notification.ExpiresAt.Before(before.AddDate(0, 0, 90)) || notification.ReadAt != nil {
+				t.Fatalf("Case %d: expected unread and expiring in 90 days, got = [%+v]", i, notification)
+			}
+		}
+	}
+}
+
+// Test ListNotifications pages newest first and leaves out expired notifications
+func TestHandler_ListNotifications(t *testing.T) {
+	repo := newRepo()
+	engine := setUp()
+	handler := &Handler{Repo: repo}
+	engine.GET("", handler.ListNotifications)
+
+	// n1 and n2 arrived at the same time, so they are ordered by id
+	now := time.Now()
+	readAt := now.Add(-time.Hour)
+	for i, id := range []string{"n0", "n1", "n2", "n3", "n4"} {
+		minutes := i
+		if id == "n2" {
+			minutes = 1
+		}
+
+		notification := &Notification{NotificationId: id, UserId: growerId, Type: TypeAlert,
+			CreatedAt: now.Add(-time.Duration(minutes) * time.Minute), ExpiresAt: now.Add(time.Hour)}
+		if i%2 == 1 {
+			notification.ReadAt = &readAt
+		}
+
+		repo.notifications[id] = notification
+	}
+
+	repo.notifications["expired"] = &Notification{NotificationId: "expired", UserId: growerId, CreatedAt: now, ExpiresAt: now.Add(-time.Minute)}
+	repo.notifications["other"] = &Notification{NotificationId: "other", UserId: neighbourId, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+
+	testCases := []struct {
+		query   string
+		message string
+		code    int
+		ids     []string
+		next    []string
+	}{
+		{query: "", message: resList, code: http.StatusOK, ids: []string{"n0", "n2", "n1", "n3", "n4"}},
+		{query: "?limit=2", message: resList, code: http.StatusOK, ids: []string{"n0", "n2"}, next: []string{"n1", "n3"}},
+		{query: "?limit=3&unread=true", message: resList, code: http.StatusOK, ids: []string{"n0", "n2", "n4"}},
+		{query: "?limit=1&unread=true", message: resList, code: http.StatusOK, ids: []string{"n0"}, next: []string{"n2"}},
+		{query: "?limit=0", message: resInvalid, code: http.StatusBadRequest},
+		{query: "?limit=101", message: resInvalid, code: http.StatusBadRequest},
+		{query: "?before=yesterday", message: resInvalid, code: http.StatusBadRequest},
+		{query: "?before=" + (&Cursor{CreatedAt: now}).String(), message: resInvalid, code: http.StatusBadRequest},
+	}
+
+	list := func(query string) ([]string, string, string, int) {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+query, nil))
+
+		res := struct {
+			Message       string          `json:"message"`
+			Notifications []*Notification `json:"notifications"`
+			Next          string          `json:"next"`
+		}{}
+		_ = json.Unmarshal(w.Body.Bytes(), &res)
+
+		ids := make([]string, len(res.Notifications))
+		for j, notification := range res.Notifications {
+			ids[j] = notification.NotificationId
+		}
+
+		return ids, res.Next, res.Message, w.Code
+	}
+
+	for i, c := range testCases {
+		ids, next, message, code := list(c.query)
+
+		if code != c.code {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.code, code)
+		}
+
+		if c.message != message {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.message, message)
+		}
+
+		if c.code != http.StatusOK {
+			continue
+		}
+
+		if strings.Join(ids, ",") != strings.Join(c.ids, ",") || (next != "") != (c.next != nil) {
+			t.Fatalf("Case %d: expected [%v %v], got = [%v %q]", i, c.ids, c.next, ids, next)
+		}
+
+		// The next page carries on where this one stopped, past the notifications that arrived at the same time
+		if c.next != nil {
+			ids, _, _, _ = list(strings.Replace(c.query, "?", "?before="+next+"&", 1))
+			if strings.Join(ids[:len(c.next)], ",") != strings.Join(c.next, ",") {
+				t.Fatalf("Case %d: expected the next page [%v], got = [%v]", i, c.next, ids)
+			}
+		}
+	}
+}
+
+// Test marking read brings expiry forward, marking unread keeps it and the unread count follows
+func TestHandler_MarkRead(t *testing.T) {
+	repo := newRepo()
+	engine := setUp()
+	handler := &Handler{Repo: repo, Policy: Policy{UnreadDays: 90, ReadDays: 30}}
+	engine.GET("/unread-count", handler.UnreadCount)
+	engine.POST("/read-all", handler.MarkAllRead)
+	engine.PATCH("/:notificationId", handler.MarkRead)
+
+	now := time.Now()
+	later := now.AddDate(0, 0, 90)
+	soon := now.AddDate(0, 0, 7)
+	repo.notifications[frostId] = &Notification{NotificationId: frostId, UserId: growerId, CreatedAt: now, ExpiresAt: later}
+	repo.notifications["n1"] = &Notification{NotificationId: "n1", UserId: growerId, CreatedAt: now, ExpiresAt: soon}
+	repo.notifications["n2"] = &Notification{NotificationId: "n2", UserId: growerId, CreatedAt: now, ExpiresAt: later}
+
+	unread := func() int {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/unread-count", nil))
+
+		res := struct {
+			Unread int `json:"unread"`
+		}{}
+
+		_ = json.Unmarshal(w.Body.Bytes(), &res)
+		return res.Unread
+	}
+
+	testCases := []struct {
+		id      string
+		body    string
+		message string
+		code    int
+		unread  int
+	}{
+		{id: frostId, body: `{"read":true}`, message: resMarkRead, code: http.StatusOK, unread: 2},
+		{id: frostId, body: `{"read":false}`, message: resMarkRead, code: http.StatusOK, unread: 3},
+		{id: frostId, body: `{}`, message: resInvalid, code: http.StatusBadRequest, unread: 3},
+		{id: unknownId, body: `{"read":true}`, message: resNotFound, code: http.StatusNotFound, unread: 3},
+		{id: "n1", body: `{"read":true}`, message: resInvalid, code: http.StatusBadRequest, unread: 3},
+	}
+
+	for i, c := range testCases {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest(http.MethodPatch, "/"+c.id, strings.NewReader(c.body)))
+
+		if w.Code != c.code {
+			t.Fatalf("Case %d: expected [%v], got = [%v] %s", i, c.code, w.Code, w.Body.String())
+		}
+
+		res := struct {
+			Message string `json:"message"`
+		}{}
+		_ = json.Unmarshal(w.Body.Bytes(), &res)
+
+		if c.message != res.Message {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.message, res.Message)
+		}
+
+		if got := unread(); got != c.unread {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.unread, got)
+		}
+	}
+
+	// Read and then unread again it still expires 30 days after it was read
+	if expiresAt := repo.notifications[frostId].ExpiresAt; !expiresAt.Before(now.AddDate(0, 0, 31)) {
+		t.Fatalf("expected expiry within 30 days, got = [%v]", expiresAt)
+	}
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/read-all", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"marked":3`) || unread() != 0 {
+		t.Fatalf("expected [200 3 marked], got = [%v] %s", w.Code, w.Body.String())
+	}
+
+	// Expiry only comes forward
+	if !repo.notifications["n1"].ExpiresAt.Equal(soon) || !repo.notifications["n2"].ExpiresAt.Before(later) {
+		t.Fatalf("expected [%v earlier than %v], got = [%v %v]", soon, later, repo.notifications["n1"].ExpiresAt, repo.notifications["n2"].ExpiresAt)
+	}
+}
+
+// Test SetPreferences only takes known types
+func TestHandler_SetPreferences(t *testing.T) {
+	repo := newRepo()
+	engine := setUp()
+	handler := &Handler{Repo: repo}
+	engine.PUT("/preferences", handler.SetPreferences)
+
+	testCases := []struct {
+		body    string
+		message string
+		code    int
+	}{
+		{body: `{"types":{"offline":false}}`, message: resSetPreferences, code: http.StatusOK},
+		{body: `{"types":{"alert":false,"system":true}}`, message: resSetPreferences, code: http.StatusOK},
+		{body: `{"types":{"weather":false}}`, message: resUnknownType, code: http.StatusBadRequest},
+		{body: `{}`, message: resInvalid, code: http.StatusBadRequest},
+	}
+
+	for i, c := range testCases {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/preferences", strings.NewReader(c.body)))
+
+		if w.Code != c.code {
+			t.Fatalf("Case %d: expected [%v], got = [%v] %s", i, c.code, w.Code, w.Body.String())
+		}
+
+		res := struct {
+			Message string `json:"message"`
+		}{}
+		_ = json.Unmarshal(w.Body.Bytes(), &res)
+
+		if c.message != res.Message {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.message, res.Message)
+		}
+	}
+
+	// Preferences are replaced, not merged
+	preferences := repo.preferences[growerId]
+	if !preferences.Enabled(TypeOffline) || preferences.Enabled(TypeAlert) || !preferences.Enabled(TypeSystem) {
+		t.Fatalf("expected [offline system], got = [%v]", preferences.Types)
+	}
+}
+
+// Test messages of the first inbox become alerts that expire by the policy, read ones as if read when they arrived
+func TestLegacyMessage_Notification(t *testing.T) {
+	policy := Policy{UnreadDays: 90, ReadDays: 30}
+	createdAt := time.Date(2020, time.April, 1, 12, 0, 0, 0, time.UTC)
+
+	testCases := []struct {
+		read      bool
+		expiresAt time.Time
+	}{
+		{read: false, expiresAt: createdAt.AddDate(0, 0, 90)},
+		{read: true, expiresAt: createdAt.AddDate(0, 0, 30)},
+	}
+
+	for i, c := range testCases {
+		legacy := &legacyMessage{MessageId: frostId, UserId: growerId, Title: "frost", CreatedAt: createdAt, Read: c.read}
+		notification := legacy.notification(policy)
+
+		if notification.NotificationId != frostId || notification.Type != TypeAlert || (notification.ReadAt != nil) != c.read {
+			t.Fatalf("Case %d: expected [%v alert read %v], got = [%+v]", i, frostId, c.read, notification)
+		}
+
+		if !notification.ExpiresAt.Equal(c.expiresAt) {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.expiresAt, notification.ExpiresAt)
+		}
+	}
+}
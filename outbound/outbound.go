@@ -0,0 +1,140 @@
+// Package outbound keeps requests to the urls users give, webhooks and alert channels, away from private networks
+// Urls are checked when they are saved and every connection is checked again when it is dialed,
+// so a name that resolves somewhere else later or a redirect cannot reach inside either
+package outbound
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrBadUrl           = errors.New("url is not an http or https url with a host")
+	ErrForbiddenAddress = errors.New("url does not resolve to a public address")
+)
+
+// Resolver looks up the addresses of a host, *net.Resolver is one
+type Resolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// forbidden are the networks that are not on the public internet
+var forbidden = cidrs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"64:ff9b::/96",
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+)
+
+func cidrs(blocks ...string) []*net.IPNet {
+	networks := make([]*net.IPNet, len(blocks))
+	for i, block := range blocks {
+		_, network, err := net.ParseCIDR(block)
+		if err != nil {
+			panic(err)
+		}
+
+		networks[i] = network
+	}
+
+	return networks
+}
+
+// Allowed reports whether ip is a public address
+func Allowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+
+	for _, network := range forbidden {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// CheckUrl returns ErrBadUrl unless rawUrl is http or https with a host and ErrForbiddenAddress when the host resolves to
+// an address that is not public, resolver is net.DefaultResolver when nil
+func CheckUrl(ctx context.Context, resolver Resolver, rawUrl string) error {
+	target, err := url.Parse(rawUrl)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Hostname() == "" {
+		return ErrBadUrl
+	}
+
+	if ip := net.ParseIP(target.Hostname()); ip != nil {
+		if !Allowed(ip) {
+			return ErrForbiddenAddress
+		}
+
+		return nil
+	}
+
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	addresses, err := resolver.LookupIPAddr(ctx, target.Hostname())
+	if err != nil || len(addresses) == 0 {
+		return ErrForbiddenAddress
+	}
+
+	for _, address := range addresses {
+		if !Allowed(address.IP) {
+			return ErrForbiddenAddress
+		}
+	}
+
+	return nil
+}
+
+// NewClient returns a client that refuses to connect to addresses that are not public, redirects included
+func NewClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network string, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+
+			if !Allowed(net.ParseIP(host)) {
+				return ErrForbiddenAddress
+			}
+
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConnsPerHost: 2,
+		},
+	}
+}
@@ -0,0 +1,74 @@
+package outbound
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Resolver struct for testing, hosts it does not know are not found
+type resolverStruct map[string]string
+
+func (r resolverStruct) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	address, ok := r[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+
+	return []net.IPAddr{{IP: net.ParseIP(address)}}, nil
+}
+
+func TestCheckUrl(t *testing.T) {
+	resolver := resolverStruct{
+		"example.com":          "93.184.216.34",
+		"localhost":            "127.0.0.1",
+		"metadata.internal":    "169.254.169.254",
+		"router.home":          "192.168.1.1",
+		"ipv6.example.com":     "2606:2800:220:1:248:1893:25c8:1946",
+		"unique-local.example": "fd00::1",
+	}
+
+	testCases := []struct {
+		url string
+		err error
+	}{
+		{url: "https://example.com/hook", err: nil},
+		{url: "http://example.com:8080/hook", err: nil},
+		{url: "https://ipv6.example.com/hook", err: nil},
+		{url: "https://93.184.216.34/hook", err: nil},
+		{url: "ftp://example.com/hook", err: ErrBadUrl},
+		{url: "https:///hook", err: ErrBadUrl},
+		{url: "not a url", err: ErrBadUrl},
+		{url: "http://localhost:8080/hook", err: ErrForbiddenAddress},
+		{url: "http://metadata.internal/latest", err: ErrForbiddenAddress},
+		{url: "http://router.home/", err: ErrForbiddenAddress},
+		{url: "http://unique-local.example/", err: ErrForbiddenAddress},
+		{url: "http://missing.example/", err: ErrForbiddenAddress},
+		{url: "http://10.0.0.1/", err: ErrForbiddenAddress},
+		{url: "http://[::1]:8080/", err: ErrForbiddenAddress},
+		{url: "http://[::ffff:127.0.0.1]/", err: ErrForbiddenAddress},
+		{url: "http://100.64.0.1/", err: ErrForbiddenAddress},
+	}
+
+	for i, c := range testCases {
+		if err := CheckUrl(context.Background(), resolver, c.url); err != c.err {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.err, err)
+		}
+	}
+}
+
+func TestNewClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	_, err := NewClient(time.Second).Get(server.URL)
+	if !errors.Is(err, ErrForbiddenAddress) {
+		t.Fatalf("expected [%v], got = [%v]", ErrForbiddenAddress, err)
+	}
+}
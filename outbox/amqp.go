@@ -0,0 +1,110 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"github.com/streadway/amqp"
+	"time"
+)
+
+// How long the broker has to confirm a message
+const confirmTimeout = 10 * time.Second
+
+var (
+	errNack          = errors.New("broker did not accept the message")
+	errNotConfirmed  = errors.New("broker did not confirm the message in time")
+	errConfirmClosed = errors.New("channel closed before the message was confirmed")
+)
+
+// AmqpBroker publishes persistent messages to a durable topic exchange, the event is the routing key
+// The id of the message is its MessageId and its idempotency_key header
+// It connects on first use and again after any failure, it is not safe for concurrent use
+type AmqpBroker struct {
+	Uri      string
+	Exchange string
+
+	conn     *amqp.Connection
+	ch       *amqp.Channel
+	confirms chan amqp.Confirmation
+}
+
+func (a *AmqpBroker) Publish(ctx context.Context, message *Message) error {
+	if a.ch == nil {
+		if err := a.connect(); err != nil {
+			return err
+		}
+	}
+
+	err := a.ch.Publish(a.Exchange, message.Event, false, false, amqp.Publishing{
+		Headers:      amqp.Table{"idempotency_key": message.MessageId, "user_id": message.UserId},
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    message.MessageId,
+		Timestamp:    message.CreatedAt,
+		Type:         message.Event,
+		Body:         []byte(message.Payload),
+	})
+
+	if err != nil {
+		a.close()
+		return err
+	}
+
+	timer := time.NewTimer(confirmTimeout)
+	defer timer.Stop()
+
+	// Confirms come in publishing order, giving up on one means starting over on a new channel
+	select {
+	case confirm, ok := <-a.confirms:
+		if !ok {
+			a.close()
+			return errConfirmClosed
+		}
+
+		if !confirm.Ack {
+			return errNack
+		}
+
+		return nil
+	case <-timer.C:
+		a.close()
+		return errNotConfirmed
+	case <-ctx.Done():
+		a.close()
+		return ctx.Err()
+	}
+}
+
+func (a *AmqpBroker) connect() error {
+	conn, err := amqp.Dial(a.Uri)
+	if err != nil {
+		return err
+	}
+
+	ch, err := conn.Channel()
+	if err == nil {
+		err = ch.ExchangeDeclare(a.Exchange, amqp.ExchangeTopic, true, false, false, false, nil)
+	}
+
+	if err == nil {
+		err = ch.Confirm(false)
+	}
+
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+
+	a.conn, a.ch = conn, ch
+	a.confirms = ch.NotifyPublish(make(chan amqp.Confirmation, 1))
+
+	return nil
+}
+
+func (a *AmqpBroker) close() {
+	if a.conn != nil {
+		_ = a.conn.Close()
+	}
+
+	a.conn, a.ch, a.confirms = nil, nil, nil
+}
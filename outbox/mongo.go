@@ -0,0 +1,63 @@
+package outbox
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+type MongoRepo struct {
+	Col *mongo.Collection
+}
+
+// EnsureIndexes creates the index messages are claimed by, it is safe to run on every start
+func (m *MongoRepo) EnsureIndexes(ctx context.Context) error {
+	_, err := m.Col.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "sent_at", Value: 1}, {Key: "created_at", Value: 1}, {Key: "next_attempt", Value: 1}},
+	})
+
+	return err
+}
+
+func (m *MongoRepo) ClaimMessage(ctx context.Context, now time.Time, lease time.Time) (*Message, error) {
+	result := m.Col.FindOneAndUpdate(ctx,
+		bson.M{"sent_at": nil, "next_attempt": bson.M{"$lte": now}},
+		bson.M{"$set": bson.M{"next_attempt": lease}},
+		options.FindOneAndUpdate().SetSort(bson.M{"created_at": 1}),
+	)
+
+	if result.Err() != nil {
+		if result.Err() == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+
+		return nil, result.Err()
+	}
+
+	message := &Message{}
+	if err := result.Decode(message); err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+func (m *MongoRepo) MarkSent(ctx context.Context, messageId string, sentAt time.Time) error {
+	_, err := m.Col.UpdateOne(ctx, bson.M{"_id": messageId}, bson.M{
+		"$set":   bson.M{"sent_at": sentAt},
+		"$unset": bson.M{"next_attempt": ""},
+	})
+
+	return err
+}
+
+func (m *MongoRepo) DeleteSent(ctx context.Context, before time.Time) (int, error) {
+	result, err := m.Col.DeleteMany(ctx, bson.M{"sent_at": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+
+	return int(result.DeletedCount), nil
+}
@@ -0,0 +1,80 @@
+package outbox_test
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/tPhume/ags-backend/controller"
+	"github.com/tPhume/ags-backend/outbox"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
+	"testing"
+	"time"
+)
+
+// For our tests the grower removes their greenhouse, the neighbour tries to first
+const (
+	growerId     = "d6b1a3c4-8f0e-4b7a-9c2d-3e5f7a9b1c2d"
+	neighbourId  = "2f4e6a8c-0b1d-4e3f-8a5c-7d9e1f3a5b7c"
+	greenhouseId = "9a7c5e3b-1d2f-4a6b-8c0e-2f4a6c8e0b1d"
+)
+
+// Test removing a controller writes exactly one outbox message and a failed removal writes none
+// It needs a replica set at OUTBOX_TEST_MONGO_URI, a database of its own is made and dropped
+func TestMongoRepo_RemoveController(t *testing.T) {
+	uri := os.Getenv("OUTBOX_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("OUTBOX_TEST_MONGO_URI is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatalf("expected a connection, got = [%v]", err)
+	}
+	defer client.Disconnect(ctx)
+
+	db := client.Database("ags_outbox_test_" + uuid.New().String()[:8])
+	defer db.Drop(ctx)
+
+	if err := outbox.CheckReplicaSet(ctx, db); err != nil {
+		t.Fatalf("expected a replica set, got = [%v]", err)
+	}
+
+	// Mongo 4.2 cannot create collections inside a transaction
+	for _, name := range []string{"controller", "outbox"} {
+		if err := db.RunCommand(ctx, bson.M{"create": name}).Err(); err != nil {
+			t.Fatalf("expected [%v] created, got = [%v]", name, err)
+		}
+	}
+
+	repo := &controller.MongoRepo{Col: db.Collection("controller"), OutboxCol: db.Collection("outbox")}
+	entity := &controller.Entity{ControllerId: greenhouseId, UserId: growerId, Name: "greenhouse", Token: "token"}
+	if err, _ := repo.AddController(ctx, entity); err != nil {
+		t.Fatalf("expected no error, got = [%v]", err)
+	}
+
+	removed := func() int64 {
+		count, err := db.Collection("outbox").CountDocuments(ctx, bson.M{"event": controller.EventRemoved})
+		if err != nil {
+			t.Fatalf("expected a count, got = [%v]", err)
+		}
+
+		return count
+	}
+
+	if err := repo.RemoveController(ctx, neighbourId, greenhouseId); err == nil || removed() != 0 {
+		t.Fatalf("expected [not found, no message], got = [%v %v]", err, removed())
+	}
+
+	if err := repo.RemoveController(ctx, growerId, greenhouseId); err != nil || removed() != 1 {
+		t.Fatalf("expected [removed, 1 message], got = [%v %v]", err, removed())
+	}
+
+	if count, _ := db.Collection("controller").CountDocuments(ctx, bson.M{}); count != 0 {
+		t.Fatalf("expected [0] controllers, got = [%v]", count)
+	}
+}
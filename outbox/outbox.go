@@ -0,0 +1,204 @@
+// Package outbox keeps events in Mongo in the same transaction as the change they are about
+// The Relay publishes them to RabbitMQ afterwards, so an event is never lost when the process dies in between
+// Delivery is at least once, consumers skip messages whose id they have already handled
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"log"
+	"time"
+)
+
+// Message is one event in the outbox
+type Message struct {
+	// MessageId is the idempotency key, it is the same every time the message is published
+	MessageId string `bson:"_id"`
+	Event     string `bson:"event"`
+	UserId    string `bson:"user_id"`
+
+	// Payload is the JSON of the Event as it is published
+	Payload   string    `bson:"payload"`
+	CreatedAt time.Time `bson:"created_at"`
+
+	// NextAttempt is when the message can be claimed again, it is cleared once the message is sent
+	NextAttempt *time.Time `bson:"next_attempt"`
+	SentAt      *time.Time `bson:"sent_at"`
+}
+
+// Event is the body of a message
+type Event struct {
+	EventId   string      `json:"id"`
+	Type      string      `json:"type"`
+	UserId    string      `json:"user_id"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// NewMessage returns a message that is due now
+func NewMessage(userId string, event string, data interface{}, now time.Time) (*Message, error) {
+	messageId := uuid.New().String()
+	payload, err := json.Marshal(&Event{EventId: messageId, Type: event, UserId: userId, CreatedAt: now, Data: data})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		MessageId:   messageId,
+		Event:       event,
+		UserId:      userId,
+		Payload:     string(payload),
+		CreatedAt:   now,
+		NextAttempt: &now,
+	}, nil
+}
+
+// WithEvent runs change and adds the event to the outbox in one transaction, neither happens without the other
+// change must use the ctx it is given and may run more than once when the transaction is retried
+// When col is nil there is no outbox and change runs on its own
+// Transactions need Mongo to run as a replica set
+func WithEvent(ctx context.Context, col *mongo.Collection, userId string, event string, data interface{}, change func(ctx context.Context) error) error {
+	if col == nil {
+		return change(ctx)
+	}
+
+	message, err := NewMessage(userId, event, data, time.Now())
+	if err != nil {
+		return err
+	}
+
+	session, err := col.Database().Client().StartSession()
+	if err != nil {
+		return err
+	}
+
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		if err := change(sessCtx); err != nil {
+			return nil, err
+		}
+
+		_, err := col.InsertOne(sessCtx, message)
+		return nil, err
+	})
+
+	return err
+}
+
+// Repo
+type Repo interface {
+	// ClaimMessage returns the oldest message that is due by now and not sent, it is not due again until lease
+	// It returns nil when there is none
+	ClaimMessage(ctx context.Context, now time.Time, lease time.Time) (*Message, error)
+
+	MarkSent(ctx context.Context, messageId string, sentAt time.Time) error
+
+	// DeleteSent deletes messages sent before a time and returns how many
+	DeleteSent(ctx context.Context, before time.Time) (int, error)
+}
+
+// Broker publishes a message and returns once the broker has confirmed it
+type Broker interface {
+	Publish(ctx context.Context, message *Message) error
+}
+
+// How long a claimed message is left alone for, longer than a publish can take
+const claimLease = time.Minute
+
+// Most messages published by one run
+const maxMessagesPerRun = 100
+
+// Relay publishes messages in the outbox, every replica can run it
+// Messages are published oldest first, but one that failed waits for its claim to run out and relays on several replicas interleave
+// Times are taken as each message is claimed and sent, a run can take a while
+type Relay struct {
+	Repo   Repo
+	Broker Broker
+
+	Interval time.Duration
+
+	// Sent messages are kept this long, zero keeps them forever
+	Retention time.Duration
+}
+
+// Run publishes due messages until ctx is done, a failed run is logged and tried again at the next interval
+func (r *Relay) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.RunOnce(ctx, time.Now()); err != nil {
+			log.Printf("outbox: relay run failed: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce publishes the messages that are due as of now and deletes the ones past retention
+// A message that fails to publish is logged and stays in the outbox, it is due again once its claim runs out
+// and the ones after it are still published
+func (r *Relay) RunOnce(ctx context.Context, now time.Time) error {
+	if r.Retention > 0 {
+		if _, err := r.Repo.DeleteSent(ctx, now.Add(-r.Retention)); err != nil {
+			return err
+		}
+	}
+
+	failed := 0
+	for i := 0; i < maxMessagesPerRun; i++ {
+		message, err := r.Repo.ClaimMessage(ctx, now, time.Now().Add(claimLease))
+		if err != nil {
+			return err
+		}
+
+		if message == nil {
+			break
+		}
+
+		if err := r.Broker.Publish(ctx, message); err != nil {
+			log.Printf("outbox: could not publish %s: %s", message.MessageId, err)
+			failed++
+			continue
+		}
+
+		if err := r.Repo.MarkSent(ctx, message.MessageId, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d messages could not be published", failed)
+	}
+
+	return nil
+}
+
+var ErrNoReplicaSet = errors.New("mongo is not a replica set, the outbox needs transactions")
+
+// CheckReplicaSet returns ErrNoReplicaSet unless db is served by a replica set, so that a relay is not started that can never write
+func CheckReplicaSet(ctx context.Context, db *mongo.Database) error {
+	result := &struct {
+		SetName string `bson:"setName"`
+	}{}
+
+	if err := db.RunCommand(ctx, bson.M{"isMaster": 1}).Decode(result); err != nil {
+		return err
+	}
+
+	if result.SetName == "" {
+		return ErrNoReplicaSet
+	}
+
+	return nil
+}
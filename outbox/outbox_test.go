@@ -0,0 +1,164 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+)
+
+// For our tests the grower changes a plan and a controller of theirs
+const (
+	growerId     = "88b37dfd-330d-4aa4-8cda-dadc47a18faa"
+	tomatoPlanId = "f0a87fb4-9c9b-4b27-8f0c-403b6e31d1f1"
+	greenhouseId = "e8c82574-25e9-4443-a1ee-75f27c75badd"
+)
+
+// Repo struct for testing, messages are kept in memory
+type repoStruct struct {
+	messages map[string]*Message
+}
+
+func (r *repoStruct) ClaimMessage(ctx context.Context, now time.Time, lease time.Time) (*Message, error) {
+	due := make([]*Message, 0)
+	for _, message := range r.messages {
+		if message.SentAt == nil && message.NextAttempt != nil && !message.NextAttempt.After(now) {
+			due = append(due, message)
+		}
+	}
+
+	if len(due) == 0 {
+		return nil, nil
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].CreatedAt.Before(due[j].CreatedAt)
+	})
+
+	due[0].NextAttempt = &lease
+	return due[0], nil
+}
+
+func (r *repoStruct) MarkSent(ctx context.Context, messageId string, sentAt time.Time) error {
+	r.messages[messageId].SentAt = &sentAt
+	r.messages[messageId].NextAttempt = nil
+
+	return nil
+}
+
+func (r *repoStruct) DeleteSent(ctx context.Context, before time.Time) (int, error) {
+	deleted := 0
+	for id, message := range r.messages {
+		if message.SentAt != nil && message.SentAt.Before(before) {
+			delete(r.messages, id)
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+// brokerStruct records the ids it publishes and fails while failures is more than zero
+type brokerStruct struct {
+	published []string
+	failures  int
+}
+
+func (b *brokerStruct) Publish(ctx context.Context, message *Message) error {
+	if b.failures > 0 {
+		b.failures--
+		return errors.New("connection refused")
+	}
+
+	b.published = append(b.published, message.MessageId)
+	return nil
+}
+
+// Test the relay publishes oldest first, carries on past a failed message, retries it under the same id
+// and deletes old sent messages
+func TestRelay_RunOnce(t *testing.T) {
+	repo := &repoStruct{messages: map[string]*Message{}}
+	broker := &brokerStruct{}
+	relay := &Relay{Repo: repo, Broker: broker, Retention: 24 * time.Hour}
+
+	// Claims and sends are timed as they happen, so the messages are from a little while ago
+	start := time.Now().Add(-time.Hour)
+	ids := make([]string, 0)
+	for i, event := range []string{"plan.created", "controller.updated", "plan.deleted"} {
+		message, err := NewMessage(growerId, event, map[string]string{"plan_id": tomatoPlanId}, start.Add(time.Duration(i)*time.Second))
+		if err != nil {
+			t.Fatalf("Case %d: expected no error, got = [%v]", i, err)
+		}
+
+		repo.messages[message.MessageId] = message
+		ids = append(ids, message.MessageId)
+	}
+
+	// The broker fails the first message, the others still go out and it is not due again until its claim runs out
+	broker.failures = 1
+	before := time.Now()
+	if err := relay.RunOnce(context.Background(), time.Now()); err == nil {
+		t.Fatalf("expected an error, got = [nil]")
+	}
+
+	if len(broker.published) != 2 || broker.published[0] != ids[1] || broker.published[1] != ids[2] {
+		t.Fatalf("expected [%v], got = [%v]", ids[1:], broker.published)
+	}
+
+	if sentAt := repo.messages[ids[1]].SentAt; sentAt == nil || sentAt.Before(before) {
+		t.Fatalf("expected sent as it was published, got = [%v]", sentAt)
+	}
+
+	if err := relay.RunOnce(context.Background(), time.Now()); err != nil || len(broker.published) != 2 {
+		t.Fatalf("expected nothing due, got = [%v %v]", err, broker.published)
+	}
+
+	now := time.Now().Add(claimLease)
+	if err := relay.RunOnce(context.Background(), now); err != nil || len(broker.published) != 3 || broker.published[2] != ids[0] {
+		t.Fatalf("expected [%v] last, got = [%v %v]", ids[0], err, broker.published)
+	}
+
+	// Everything is sent so nothing is published again
+	if err := relay.RunOnce(context.Background(), now.Add(time.Hour)); err != nil || len(broker.published) != 3 {
+		t.Fatalf("expected [3] published, got = [%v %v]", err, len(broker.published))
+	}
+
+	if err := relay.RunOnce(context.Background(), now.Add(25*time.Hour)); err != nil || len(repo.messages) != 0 {
+		t.Fatalf("expected sent messages deleted, got = [%v %v]", err, len(repo.messages))
+	}
+}
+
+// Test the body of a message carries its id as the idempotency key
+func TestNewMessage(t *testing.T) {
+	now := time.Date(2020, time.April, 1, 12, 0, 0, 0, time.UTC)
+	message, err := NewMessage(growerId, "controller.removed", map[string]string{"controller_id": greenhouseId}, now)
+	if err != nil {
+		t.Fatalf("expected no error, got = [%v]", err)
+	}
+
+	event := &Event{}
+	if err := json.Unmarshal([]byte(message.Payload), event); err != nil {
+		t.Fatalf("expected no error, got = [%v]", err)
+	}
+
+	if event.EventId != message.MessageId || event.Type != "controller.removed" || event.UserId != growerId || !event.CreatedAt.Equal(now) {
+		t.Fatalf("expected [%v controller.removed %v %v], got = [%+v]", message.MessageId, growerId, now, event)
+	}
+
+	if message.NextAttempt == nil || !message.NextAttempt.Equal(now) || message.SentAt != nil {
+		t.Fatalf("expected due at [%v] and not sent, got = [%+v]", now, message)
+	}
+
+	// Without an outbox the change runs on its own
+	changed := false
+	err = WithEvent(context.Background(), nil, growerId, "plan.created", nil, func(ctx context.Context) error {
+		changed = true
+		return nil
+	})
+
+	if err != nil || !changed {
+		t.Fatalf("expected the change to run, got = [%v %v]", err, changed)
+	}
+}
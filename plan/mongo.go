@@ -3,18 +3,28 @@ package plan
 import (
 	"context"
 	"errors"
+	"github.com/tPhume/ags-backend/outbox"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
 )
 
 type MongoRepo struct {
 	Col           *mongo.Collection
 	ControllerCol *mongo.Collection
+
+	// OutboxCol is optional, changes to plans are written together with their event when it is set
+	OutboxCol *mongo.Collection
 }
 
 func (m MongoRepo) CreatePlan(ctx context.Context, entity *Entity) error {
-	if _, err := m.Col.InsertOne(ctx, entity); err != nil {
+	err := outbox.WithEvent(ctx, m.OutboxCol, entity.UserId, EventCreated, entity, func(ctx context.Context) error {
+		_, err := m.Col.InsertOne(ctx, entity)
+		return err
+	})
+
+	if err != nil {
 		writeException, ok := err.(mongo.WriteException)
 		if !ok {
 			return err
@@ -63,39 +73,46 @@ func (m MongoRepo) GetPlan(ctx context.Context, entity *Entity) error {
 
 func (m MongoRepo) ReplacePlan(ctx context.Context, entity *Entity) error {
 	projection := options.FindOneAndReplace().SetProjection(bson.M{"_id": 1})
-	result := m.Col.FindOneAndReplace(ctx, bson.M{"_id": entity.PlanId, "user_id": entity.UserId}, entity, projection)
-	if result.Err() != nil {
-		if result.Err() == mongo.ErrNoDocuments {
+	err := outbox.WithEvent(ctx, m.OutboxCol, entity.UserId, EventReplaced, entity, func(ctx context.Context) error {
+		return m.Col.FindOneAndReplace(ctx, bson.M{"_id": entity.PlanId, "user_id": entity.UserId}, entity, projection).Err()
+	})
+
+	if err != nil {
+		if err == mongo.ErrNoDocuments {
 			return errPlanNotFound
 		}
 
-		if err, ok := result.Err().(mongo.CommandError); ok {
+		if err, ok := err.(mongo.CommandError); ok {
 			if err.Code == 11000 {
 				return errPlanDuplicate
 			}
 		}
 
-		return result.Err()
+		return err
 	}
 
 	return nil
 }
 
 func (m MongoRepo) DeletePlan(ctx context.Context, userId string, planId string) error {
-	result, err := m.Col.DeleteOne(ctx, bson.M{"_id": planId, "user_id": userId})
-	if err != nil {
-		return err
-	} else if result.DeletedCount == 0 {
-		return errPlanNotFound
-	} else if result.DeletedCount != 1 {
-		return errors.New("should be 1")
-	}
+	// Nothing deleted aborts the transaction so there is no event
+	return outbox.WithEvent(ctx, m.OutboxCol, userId, EventDeleted, bson.M{"plan_id": planId}, func(ctx context.Context) error {
+		result, err := m.Col.DeleteOne(ctx, bson.M{"_id": planId, "user_id": userId})
+		if err != nil {
+			return err
+		} else if result.DeletedCount == 0 {
+			return errPlanNotFound
+		} else if result.DeletedCount != 1 {
+			return errors.New("should be 1")
+		}
 
-	return nil
+		return nil
+	})
 }
 
+// GetPlanId also records that the controller made contact, devices poll for their plan
 func (m *MongoRepo) GetPlanId(ctx context.Context, token string) (*Entity, error) {
-	res := m.ControllerCol.FindOne(ctx, bson.M{"token": token})
+	res := m.ControllerCol.FindOneAndUpdate(ctx, bson.M{"token": token}, bson.M{"$set": bson.M{"last_contact": time.Now()}})
 	if res.Err() != nil {
 		if res.Err() == mongo.ErrNoDocuments {
 			return nil, errTokenNotFound
@@ -7,7 +7,9 @@ import (
 	"github.com/gin-gonic/gin/binding"
 	"github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
+	"github.com/tPhume/ags-backend/metric"
 	"github.com/tPhume/ags-backend/session"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
@@ -53,6 +55,10 @@ func addValidation() error {
 		return err
 	}
 
+	if err := validate.RegisterValidation("setpoints", setpoints); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -68,6 +74,9 @@ type Entity struct {
 	Daily         []Daily   `json:"daily" bson:"daily" binding:"dive"`
 	Weekly        []Weekly  `json:"weekly" bson:"weekly" binding:"dive"`
 	Monthly       []Monthly `json:"monthly" bson:"monthly" binding:"dive"`
+
+	// Setpoints are targets keyed by metric name, the *_state fields are kept in step for older controllers
+	Setpoints map[string]float64 `json:"setpoints,omitempty" bson:"setpoints,omitempty" binding:"omitempty,setpoints"`
 }
 
 // Different type of routine
@@ -98,6 +107,44 @@ const (
 	lightAction = "light"
 )
 
+// Setpoint returns the target of a metric
+// Plans made before setpoints only have the *_state fields, which count when they are not zero
+func (e *Entity) Setpoint(name string) (float64, bool) {
+	if value, ok := e.Setpoints[name]; ok {
+		return value, true
+	}
+
+	var legacy float64
+	switch name {
+	case "temperature":
+		legacy = float64(e.TempState)
+	case "humidity":
+		legacy = float64(e.HumidityState)
+	case "light":
+		legacy = float64(e.LightState)
+	case "soil_moisture":
+		legacy = float64(e.MoistureState)
+	}
+
+	return legacy, legacy != 0
+}
+
+// syncSetpoints copies setpoints of the legacy metrics to the *_state fields
+func (e *Entity) syncSetpoints() {
+	for name, value := range e.Setpoints {
+		switch name {
+		case "temperature":
+			e.TempState = float32(value)
+		case "humidity":
+			e.HumidityState = float32(value)
+		case "light":
+			e.LightState = float32(value)
+		case "soil_moisture":
+			e.MoistureState = int(math.Round(value))
+		}
+	}
+}
+
 // Custom field validation
 func planName(fl validator.FieldLevel) bool {
 	if strings.TrimSpace(fl.Field().String()) == "" {
@@ -188,6 +235,35 @@ func monthlyTime(fl validator.FieldLevel) bool {
 	return true
 }
 
+// setpoints must name registered metrics and be within their range
+// stateBounds are the ranges of the *_state fields, setpoints copied to them by syncSetpoints must fit
+var stateBounds = map[string][2]float64{
+	"temperature":   {0, 50},
+	"humidity":      {0, 100},
+	"light":         {0, 65535},
+	"soil_moisture": {0, 1000},
+}
+
+func setpoints(fl validator.FieldLevel) bool {
+	values, ok := fl.Field().Interface().(map[string]float64)
+	if !ok {
+		return false
+	}
+
+	for name, value := range values {
+		m, ok := metric.Default.Lookup(name)
+		if !ok || m.Check(value) != nil {
+			return false
+		}
+
+		if bounds, ok := stateBounds[name]; ok && (value < bounds[0] || value > bounds[1]) {
+			return false
+		}
+	}
+
+	return true
+}
+
 func actionType(fl validator.FieldLevel) bool {
 	field := fl.Field().String()
 	if field == waterAction || field == lightAction {
@@ -218,6 +294,7 @@ type Repo interface {
 
 	DeletePlan(ctx context.Context, userId string, planId string) error
 
+	// GetPlanId returns the plan id and user of the controller that owns token and records that it made contact
 	GetPlanId(ctx context.Context, token string) (*Entity, error)
 }
 
@@ -238,8 +315,31 @@ const (
 	resPlanNotFound = "plan not found"
 )
 
+// Notifier is told about plans that were replaced or deleted, so they can be pushed to controllers
+type Notifier interface {
+	PlanChanged(ctx context.Context, userId string, planId string)
+}
+
+// Events published about plans
+const (
+	EventCreated  = "plan.created"
+	EventReplaced = "plan.replaced"
+	EventDeleted  = "plan.deleted"
+)
+
+// Publisher is told about changes to plans as events, data is what the event is about
+type Publisher interface {
+	Publish(ctx context.Context, userId string, event string, data interface{})
+}
+
 type Handler struct {
 	Repo Repo
+
+	// Notifier is optional
+	Notifier Notifier
+
+	// Publisher is optional
+	Publisher Publisher
 }
 
 func (h *Handler) CreatePlan(ctx *gin.Context) {
@@ -255,6 +355,8 @@ func (h *Handler) CreatePlan(ctx *gin.Context) {
 		return
 	}
 
+	entity.syncSetpoints()
+
 	if err := h.Repo.CreatePlan(ctx, entity); err != nil {
 		if err == errPlanDuplicate {
 			ctx.JSON(http.StatusConflict, gin.H{"message": resPlanConflict})
@@ -265,6 +367,7 @@ func (h *Handler) CreatePlan(ctx *gin.Context) {
 		return
 	}
 
+	h.publish(ctx, userId, EventCreated, entity)
 	ctx.JSON(http.StatusCreated, gin.H{"message": resCreatePlan, "result": entity})
 }
 
@@ -328,6 +431,8 @@ func (h *Handler) ReplacePlan(ctx *gin.Context) {
 		return
 	}
 
+	entity.syncSetpoints()
+
 	if err := h.Repo.ReplacePlan(ctx, entity); err != nil {
 		if err == errPlanDuplicate {
 			ctx.JSON(http.StatusConflict, gin.H{"message": resPlanConflict})
@@ -340,6 +445,11 @@ func (h *Handler) ReplacePlan(ctx *gin.Context) {
 		return
 	}
 
+	if h.Notifier != nil {
+		h.Notifier.PlanChanged(ctx, userId, entity.PlanId)
+	}
+
+	h.publish(ctx, userId, EventReplaced, entity)
 	ctx.JSON(http.StatusOK, gin.H{"message": resReplacePlan, "result": entity})
 }
 
@@ -366,9 +476,20 @@ func (h *Handler) DeletePlan(ctx *gin.Context) {
 		return
 	}
 
+	if h.Notifier != nil {
+		h.Notifier.PlanChanged(ctx, userId, planId)
+	}
+
+	h.publish(ctx, userId, EventDeleted, gin.H{"plan_id": planId})
 	ctx.JSON(http.StatusOK, gin.H{"message": resDeletePlan})
 }
 
+func (h *Handler) publish(ctx context.Context, userId string, event string, data interface{}) {
+	if h.Publisher != nil {
+		h.Publisher.Publish(ctx, userId, event, data)
+	}
+}
+
 // This is for the Controller using Token
 func (h *Handler) GetPlanWithToken(ctx *gin.Context) {
 	token := ctx.GetHeader("token")
@@ -0,0 +1,84 @@
+package plan
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of routine
+const (
+	RoutineDaily   = "daily"
+	RoutineWeekly  = "weekly"
+	RoutineMonthly = "monthly"
+)
+
+// Occurrence is one run of a routine of the plan
+type Occurrence struct {
+	Routine string    `json:"routine"`
+	Index   int       `json:"index"`
+	Start   time.Time `json:"start"`
+	Action  Action    `json:"action"`
+}
+
+// Occurrences returns the runs of every routine that start from one time to another, in order
+// Routine times are wall clock times in loc, a monthly date of 0 is the last day of the month
+// and months without the date are skipped, the same as the calendar feed
+func (e *Entity) Occurrences(from time.Time, to time.Time, loc *time.Location) []*Occurrence {
+	occurrences := make([]*Occurrence, 0)
+
+	add := func(routine string, index int, action Action, start time.Time) {
+		if !start.Before(from) && start.Before(to) {
+			occurrences = append(occurrences, &Occurrence{Routine: routine, Index: index, Start: start, Action: action})
+		}
+	}
+
+	first := from.In(loc)
+	last := to.In(loc)
+
+	for day := time.Date(first.Year(), first.Month(), first.Day(), 0, 0, 0, 0, loc); !day.After(last); day = day.AddDate(0, 0, 1) {
+		lastOfMonth := day.AddDate(0, 1, -day.Day()).Day()
+
+		for i, daily := range e.Daily {
+			values := routineValues(daily.DailyTime)
+			add(RoutineDaily, i, daily.Action, at(day, values[0], values[1]))
+		}
+
+		for i, weekly := range e.Weekly {
+			values := routineValues(weekly.WeeklyTime)
+			if time.Weekday(values[0]) == day.Weekday() {
+				add(RoutineWeekly, i, weekly.Action, at(day, values[1], values[2]))
+			}
+		}
+
+		for i, monthly := range e.Monthly {
+			values := routineValues(monthly.MonthlyTime)
+			if values[0] == day.Day() || (values[0] == 0 && day.Day() == lastOfMonth) {
+				add(RoutineMonthly, i, monthly.Action, at(day, values[1], values[2]))
+			}
+		}
+	}
+
+	sort.SliceStable(occurrences, func(i, j int) bool {
+		return occurrences[i].Start.Before(occurrences[j].Start)
+	})
+
+	return occurrences
+}
+
+func at(day time.Time, hour int, minute int) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), hour, minute, 0, 0, day.Location())
+}
+
+// Routine times are validated before being stored
+func routineValues(value string) []int {
+	parts := strings.Split(value, ":")
+	values := make([]int, len(parts))
+
+	for i, part := range parts {
+		values[i], _ = strconv.Atoi(part)
+	}
+
+	return values
+}
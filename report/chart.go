@@ -0,0 +1,248 @@
+package report
+
+import (
+	"fmt"
+	"github.com/tPhume/ags-backend/metric"
+	"github.com/tPhume/ags-backend/summary"
+	"math"
+	"strings"
+	"time"
+)
+
+const dateLayout = "2006-01-02"
+
+// Chart of the daily mean of a sensor, with the daily min and max as a band on days whose summaries have them
+type Chart struct {
+	Key   string
+	Title string
+	Unit  string
+	Dates []string
+	Mean  []*float64
+	Min   []*float64
+	Max   []*float64
+}
+
+// charts are filled from dailies in any order
+type charts struct {
+	charts []*Chart
+	index  map[string]int
+}
+
+// newCharts has a chart for each of the first sensors and for VPD and DLI, over every date from first to last
+func newCharts(sensors []metric.Sensor, first string, last string) *charts {
+	c := &charts{index: make(map[string]int)}
+
+	start, _ := time.Parse(dateLayout, first)
+	end, _ := time.Parse(dateLayout, last)
+	dates := make([]string, 0)
+	for day := start; !day.After(end); day = day.AddDate(0, 0, 1) {
+		c.index[day.Format(dateLayout)] = len(dates)
+		dates = append(dates, day.Format(dateLayout))
+	}
+
+	keys := make([]metric.Sensor, 0, maxCharts)
+	for _, sensor := range metric.WithDerived(sensors) {
+		if len(keys) < maxCharts-2 || sensor.Metric == metric.VPD {
+			keys = append(keys, sensor)
+		}
+	}
+
+	keys = append(keys, metric.Sensor{Key: metric.DLI, Metric: metric.DLI})
+
+	for _, sensor := range keys {
+		m, ok := metric.Default.Lookup(sensor.Metric)
+		if !ok {
+			continue
+		}
+
+		title := sensor.Label
+		if title == "" {
+			title = strings.Replace(sensor.Key, "_", " ", -1)
+		}
+
+		c.charts = append(c.charts, &Chart{
+			Key:   sensor.Key,
+			Title: title,
+			Unit:  m.Unit,
+			Dates: dates,
+			Mean:  make([]*float64, len(dates)),
+			Min:   make([]*float64, len(dates)),
+			Max:   make([]*float64, len(dates)),
+		})
+	}
+
+	return c
+}
+
+func (c *charts) add(daily *summary.Summary) {
+	i, ok := c.index[daily.Date]
+	if !ok {
+		return
+	}
+
+	for _, chart := range c.charts {
+		stats, ok := daily.Stat(chart.Key)
+		if !ok {
+			continue
+		}
+
+		mean := stats.Mean
+		chart.Mean[i] = &mean
+
+		// Summaries written before min and max were added have no count
+		if stats.Count > 0 {
+			low, high := stats.Min, stats.Max
+			chart.Min[i], chart.Max[i] = &low, &high
+		}
+	}
+}
+
+// list returns the charts that have something to draw
+func (c *charts) list() []*Chart {
+	list := make([]*Chart, 0, len(c.charts))
+	for _, chart := range c.charts {
+		for _, mean := range chart.Mean {
+			if mean != nil {
+				list = append(list, chart)
+				break
+			}
+		}
+	}
+
+	return list
+}
+
+type point struct {
+	X, Y float64
+}
+
+// plot is a chart scaled into a box, y grows downwards like in SVG and PDF
+type plot struct {
+	// Lines of the mean, broken where days have no summary
+	Lines [][]point
+
+	// Bands between min and max, each goes along max and back along min
+	Bands [][]point
+
+	Low, High float64
+}
+
+// plot scales the chart into a box of width and height
+func (c *Chart) plot(width float64, height float64) *plot {
+	p := &plot{Low: math.Inf(1), High: math.Inf(-1)}
+	for _, series := range [][]*float64{c.Mean, c.Min, c.Max} {
+		for _, value := range series {
+			if value != nil {
+				p.Low, p.High = math.Min(p.Low, *value), math.Max(p.High, *value)
+			}
+		}
+	}
+
+	if p.Low == p.High {
+		p.Low, p.High = p.Low-1, p.High+1
+	}
+
+	x := func(i int) float64 {
+		if len(c.Dates) == 1 {
+			return width / 2
+		}
+
+		return float64(i) / float64(len(c.Dates)-1) * width
+	}
+
+	y := func(value float64) float64 {
+		return height - (value-p.Low)/(p.High-p.Low)*height
+	}
+
+	var line []point
+	var upper, lower []point
+	for i := range c.Dates {
+		if c.Mean[i] != nil {
+			line = append(line, point{X: x(i), Y: y(*c.Mean[i])})
+		} else if len(line) > 0 {
+			p.Lines, line = append(p.Lines, line), nil
+		}
+
+		if c.Min[i] != nil && c.Max[i] != nil {
+			upper = append(upper, point{X: x(i), Y: y(*c.Max[i])})
+			lower = append(lower, point{X: x(i), Y: y(*c.Min[i])})
+		} else if len(upper) > 0 {
+			p.Bands, upper, lower = append(p.Bands, band(upper, lower)), nil, nil
+		}
+	}
+
+	if len(line) > 0 {
+		p.Lines = append(p.Lines, line)
+	}
+
+	if len(upper) > 0 {
+		p.Bands = append(p.Bands, band(upper, lower))
+	}
+
+	return p
+}
+
+func band(upper []point, lower []point) []point {
+	polygon := append([]point(nil), upper...)
+	for i := len(lower) - 1; i >= 0; i-- {
+		polygon = append(polygon, lower[i])
+	}
+
+	return polygon
+}
+
+// Size of a chart in SVG, the plot is inset by the margins for the axis labels
+const (
+	svgWidth  = 640
+	svgHeight = 180
+	svgLeft   = 56
+	svgRight  = 8
+	svgTop    = 8
+	svgBottom = 24
+)
+
+// SVG draws the chart to be inlined in HTML
+func (c *Chart) SVG() string {
+	width, height := float64(svgWidth-svgLeft-svgRight), float64(svgHeight-svgTop-svgBottom)
+	p := c.plot(width, height)
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" role="img">`, svgWidth, svgHeight, svgWidth, svgHeight)
+	fmt.Fprintf(b, `<g transform="translate(%d,%d)">`, svgLeft, svgTop)
+	fmt.Fprintf(b, `<rect width="%.1f" height="%.1f" fill="none" stroke="#ccc"/>`, width, height)
+
+	for _, polygon := range p.Bands {
+		fmt.Fprintf(b, `<polygon points="%s" fill="#cfe3cf" stroke="none"/>`, points(polygon))
+	}
+
+	for _, line := range p.Lines {
+		if len(line) == 1 {
+			fmt.Fprintf(b, `<circle cx="%.1f" cy="%.1f" r="2" fill="#2e7d32"/>`, line[0].X, line[0].Y)
+			continue
+		}
+
+		fmt.Fprintf(b, `<polyline points="%s" fill="none" stroke="#2e7d32" stroke-width="1.5"/>`, points(line))
+	}
+
+	fmt.Fprintf(b, `<text x="-6" y="8" font-size="10" text-anchor="end">%s</text>`, label(p.High))
+	fmt.Fprintf(b, `<text x="-6" y="%.1f" font-size="10" text-anchor="end">%s</text>`, height, label(p.Low))
+	fmt.Fprintf(b, `<text x="0" y="%.1f" font-size="10">%s</text>`, height+16, c.Dates[0])
+	fmt.Fprintf(b, `<text x="%.1f" y="%.1f" font-size="10" text-anchor="end">%s</text>`, width, height+16, c.Dates[len(c.Dates)-1])
+	b.WriteString(`</g></svg>`)
+
+	return b.String()
+}
+
+func points(polyline []point) string {
+	parts := make([]string, len(polyline))
+	for i, p := range polyline {
+		parts[i] = fmt.Sprintf("%.1f,%.1f", p.X, p.Y)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// label formats a value for an axis or a table
+func label(value float64) string {
+	return fmt.Sprintf("%.4g", value)
+}
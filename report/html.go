@@ -0,0 +1,114 @@
+package report
+
+import (
+	"html/template"
+	"io"
+	"time"
+)
+
+var htmlTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"num":   num,
+	"time":  func(t time.Time) string { return t.Format("2006-01-02 15:04 MST") },
+	"svg":   func(c *Chart) template.HTML { return template.HTML(c.SVG()) },
+	"hours": func(seconds float64) string { return label(seconds / 3600) },
+}).Parse(htmlSource))
+
+func writeHTML(w io.Writer, report *Report) error {
+	return htmlTemplate.Execute(w, report)
+}
+
+// num formats a figure, nil pointers are figures that could not be worked out
+func num(value interface{}) string {
+	switch v := value.(type) {
+	case float64:
+		return label(v)
+	case *float64:
+		if v == nil {
+			return "–"
+		}
+
+		return label(*v)
+	}
+
+	return ""
+}
+
+// Charts are drawn by Chart.SVG, only numbers and dates go into them
+const htmlSource = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Grow report – {{.ControllerName}}</title>
+<style>
+body { font-family: sans-serif; color: #222; max-width: 720px; margin: 24px auto; }
+h1 { font-size: 22px; margin-bottom: 4px; }
+h2 { font-size: 16px; border-bottom: 1px solid #ccc; padding-bottom: 2px; margin-top: 28px; }
+table { border-collapse: collapse; width: 100%; font-size: 13px; }
+th, td { text-align: left; padding: 3px 6px; border-bottom: 1px solid #eee; }
+.muted { color: #777; font-size: 13px; }
+@media print { h2 { page-break-after: avoid; } figure { page-break-inside: avoid; } }
+</style>
+</head>
+<body>
+<h1>Grow report – {{.ControllerName}}</h1>
+<p class="muted">{{time .From}} to {{time .To}} ({{.Timezone}}), generated {{time .GeneratedAt}}</p>
+
+<h2>Plan</h2>
+{{with .Plan}}
+<p>{{.Name}}</p>
+{{if $.Setpoints}}
+<table>
+<tr><th>Metric</th><th>Setpoint</th></tr>
+{{range $.Setpoints}}<tr><td>{{.Metric}}</td><td>{{num .Value}} {{.Unit}}</td></tr>
+{{end}}</table>
+{{end}}
+<table>
+<tr><th>When</th><th>Action</th><th>Level</th><th>Duration</th></tr>
+{{range .Daily}}<tr><td>daily at {{.DailyTime}}</td><td>{{.Action.Type}}</td><td>{{.Action.Level}}%</td><td>{{.Action.Duration}} s</td></tr>
+{{end}}{{range .Weekly}}<tr><td>weekly at {{.WeeklyTime}}</td><td>{{.Action.Type}}</td><td>{{.Action.Level}}%</td><td>{{.Action.Duration}} s</td></tr>
+{{end}}{{range .Monthly}}<tr><td>monthly at {{.MonthlyTime}}</td><td>{{.Action.Type}}</td><td>{{.Action.Level}}%</td><td>{{.Action.Duration}} s</td></tr>
+{{end}}</table>
+{{else}}
+<p class="muted">The controller has no plan.</p>
+{{end}}
+
+{{with .Compliance}}
+<h2>Compliance</h2>
+<table>
+<tr><th>Sensor</th><th>Target</th><th>Time in range</th><th>Mean deviation</th><th>Longest excursion</th></tr>
+{{range $key, $sensor := .Sensors}}<tr><td>{{$key}}</td><td>{{num $sensor.Low}} to {{num $sensor.High}}</td><td>{{num $sensor.TimeInRange}}%</td><td>{{num $sensor.MeanAbsoluteDeviation}}</td><td>{{with $sensor.LongestExcursion}}{{hours .Duration}} h from {{time .Start}}{{else}}none{{end}}</td></tr>
+{{end}}</table>
+{{end}}
+
+{{with .Consumption}}
+<h2>Consumption</h2>
+<p class="muted">Estimated from the plan and the specs of the actuators.</p>
+<table>
+<tr><th>Period</th><th>Water (L)</th><th>Energy (kWh)</th><th>Cost{{with .Currency}} ({{.}}){{end}}</th></tr>
+{{range .Periods}}<tr><td>{{.Period}}</td><td>{{num .WaterLitres}}</td><td>{{num .EnergyKwh}}</td><td>{{num .Cost}}</td></tr>
+{{end}}{{with .Total}}<tr><th>Total</th><th>{{num .WaterLitres}}</th><th>{{num .EnergyKwh}}</th><th>{{num .Cost}}</th></tr>{{end}}
+</table>
+{{end}}
+
+<h2>Notable anomalies</h2>
+{{if .Anomalies}}
+<table>
+<tr><th>Date</th><th>Severity</th><th>What happened</th></tr>
+{{range .Anomalies}}<tr><td>{{.Date}}</td><td>{{.Severity}}</td><td>{{.Explanation}}</td></tr>
+{{end}}</table>
+{{else}}
+<p class="muted">None.</p>
+{{end}}
+
+<h2>Daily conditions</h2>
+{{range .Charts}}
+<figure>
+<figcaption>{{.Title}} ({{.Unit}}), daily mean with min and max</figcaption>
+{{svg .}}
+</figure>
+{{else}}
+<p class="muted">No daily summaries in this range.</p>
+{{end}}
+</body>
+</html>
+`
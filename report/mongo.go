@@ -0,0 +1,41 @@
+package report
+
+import (
+	"context"
+	"github.com/tPhume/ags-backend/anomaly"
+	"github.com/tPhume/ags-backend/lookup"
+	"github.com/tPhume/ags-backend/plan"
+	"github.com/tPhume/ags-backend/summary"
+)
+
+type MongoRepo struct {
+	Summary *summary.Mongo
+	Anomaly *anomaly.MongoRepo
+
+	Lookup *lookup.MongoRepo
+}
+
+func (m *MongoRepo) GetController(ctx context.Context, userId string, controllerId string) (*Controller, error) {
+	controller := &Controller{}
+	if err := m.Lookup.FindController(ctx, userId, controllerId, controller); err != nil {
+		return nil, err
+	}
+
+	return controller, nil
+}
+
+func (m *MongoRepo) GetPlan(ctx context.Context, userId string, planId string) (*plan.Entity, error) {
+	return m.Lookup.GetPlan(ctx, userId, planId)
+}
+
+func (m *MongoRepo) GetTimezone(ctx context.Context, userId string) (string, error) {
+	return m.Lookup.GetTimezone(ctx, userId)
+}
+
+func (m *MongoRepo) EachSummary(ctx context.Context, userId string, controllerId string, from string, to string, fn func(*summary.Summary) error) error {
+	return m.Summary.EachSummary(ctx, userId, controllerId, from, to, fn)
+}
+
+func (m *MongoRepo) ListAnomalies(ctx context.Context, userId string, controllerId string, from string, to string, severities []string) ([]*anomaly.Anomaly, error) {
+	return m.Anomaly.ListAnomalies(ctx, userId, controllerId, from, to, severities)
+}
@@ -0,0 +1,195 @@
+package report
+
+import (
+	"fmt"
+	"github.com/jung-kurt/gofpdf"
+	"io"
+	"sort"
+)
+
+// Sizes in mm on A4
+const (
+	pdfMargin      = 15
+	pdfWidth       = 180
+	pdfLine        = 5
+	pdfChartHeight = 45
+	pdfChartLeft   = 14
+)
+
+// pdfWriter keeps the document and the translator from UTF-8 to the encoding of the core fonts
+type pdfWriter struct {
+	pdf *gofpdf.Fpdf
+	tr  func(string) string
+}
+
+// writePDF lays out the same sections as the HTML, with the charts drawn as vectors
+func writePDF(w io.Writer, report *Report) error {
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetMargins(pdfMargin, pdfMargin, pdfMargin)
+	pdf.SetAutoPageBreak(true, pdfMargin)
+	pdf.SetTitle("Grow report - "+report.ControllerName, true)
+	pdf.AddPage()
+
+	p := &pdfWriter{pdf: pdf, tr: pdf.UnicodeTranslatorFromDescriptor("")}
+
+	pdf.SetFont("Helvetica", "B", 16)
+	p.cell(pdfWidth, 8, "Grow report – "+report.ControllerName)
+	pdf.SetFont("Helvetica", "", 9)
+	p.cell(pdfWidth, pdfLine, fmt.Sprintf("%s to %s (%s), generated %s",
+		report.From.Format("2006-01-02 15:04 MST"), report.To.Format("2006-01-02 15:04 MST"), report.Timezone, report.GeneratedAt.Format("2006-01-02 15:04 MST")))
+
+	p.heading("Plan")
+	if report.Plan == nil {
+		p.cell(pdfWidth, pdfLine, "The controller has no plan.")
+	} else {
+		p.cell(pdfWidth, pdfLine, report.Plan.Name)
+		for _, setpoint := range report.Setpoints {
+			p.row([]float64{60, 120}, setpoint.Metric, num(setpoint.Value)+" "+setpoint.Unit)
+		}
+
+		p.row([]float64{50, 40, 40, 50}, "When", "Action", "Level", "Duration")
+		for _, daily := range report.Plan.Daily {
+			p.row([]float64{50, 40, 40, 50}, "daily at "+daily.DailyTime, daily.Action.Type, fmt.Sprintf("%d%%", daily.Action.Level), fmt.Sprintf("%d s", daily.Action.Duration))
+		}
+
+		for _, weekly := range report.Plan.Weekly {
+			p.row([]float64{50, 40, 40, 50}, "weekly at "+weekly.WeeklyTime, weekly.Action.Type, fmt.Sprintf("%d%%", weekly.Action.Level), fmt.Sprintf("%d s", weekly.Action.Duration))
+		}
+
+		for _, monthly := range report.Plan.Monthly {
+			p.row([]float64{50, 40, 40, 50}, "monthly at "+monthly.MonthlyTime, monthly.Action.Type, fmt.Sprintf("%d%%", monthly.Action.Level), fmt.Sprintf("%d s", monthly.Action.Duration))
+		}
+	}
+
+	if report.Compliance != nil {
+		p.heading("Compliance")
+
+		keys := make([]string, 0, len(report.Compliance.Sensors))
+		for key := range report.Compliance.Sensors {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		widths := []float64{40, 40, 30, 30, 40}
+		p.row(widths, "Sensor", "Target", "Time in range", "Mean deviation", "Longest excursion")
+		for _, key := range keys {
+			sensor := report.Compliance.Sensors[key]
+			excursion := "none"
+			if sensor.LongestExcursion != nil {
+				excursion = label(sensor.LongestExcursion.Duration/3600) + " h"
+			}
+
+			p.row(widths, key, num(sensor.Low)+" to "+num(sensor.High), num(sensor.TimeInRange)+"%", num(sensor.MeanAbsoluteDeviation), excursion)
+		}
+	}
+
+	if report.Consumption != nil {
+		p.heading("Consumption")
+		p.cell(pdfWidth, pdfLine, "Estimated from the plan and the specs of the actuators.")
+
+		widths := []float64{45, 45, 45, 45}
+		cost := "Cost"
+		if report.Consumption.Currency != "" {
+			cost += " (" + report.Consumption.Currency + ")"
+		}
+
+		p.row(widths, "Period", "Water (L)", "Energy (kWh)", cost)
+		for _, period := range report.Consumption.Periods {
+			p.row(widths, period.Period, num(period.WaterLitres), num(period.EnergyKwh), num(period.Cost))
+		}
+
+		total := report.Consumption.Total
+		p.row(widths, "Total", num(total.WaterLitres), num(total.EnergyKwh), num(total.Cost))
+	}
+
+	p.heading("Notable anomalies")
+	if len(report.Anomalies) == 0 {
+		p.cell(pdfWidth, pdfLine, "None.")
+	}
+
+	for _, anomaly := range report.Anomalies {
+		pdf.MultiCell(pdfWidth, pdfLine, p.tr(anomaly.Date+"  "+anomaly.Severity+"  "+anomaly.Explanation), "", "L", false)
+	}
+
+	p.heading("Daily conditions")
+	if len(report.Charts) == 0 {
+		p.cell(pdfWidth, pdfLine, "No daily summaries in this range.")
+	}
+
+	for _, chart := range report.Charts {
+		p.chart(chart)
+	}
+
+	return pdf.Output(w)
+}
+
+func (p *pdfWriter) cell(width float64, height float64, text string) {
+	p.pdf.CellFormat(width, height, p.tr(text), "", 1, "L", false, 0, "")
+}
+
+func (p *pdfWriter) heading(text string) {
+	p.pdf.Ln(4)
+	p.pdf.SetFont("Helvetica", "B", 12)
+	p.pdf.CellFormat(pdfWidth, 7, p.tr(text), "B", 1, "L", false, 0, "")
+	p.pdf.SetFont("Helvetica", "", 9)
+	p.pdf.Ln(1)
+}
+
+func (p *pdfWriter) row(widths []float64, cells ...string) {
+	for i, text := range cells {
+		p.pdf.CellFormat(widths[i], pdfLine, p.tr(text), "", 0, "L", false, 0, "")
+	}
+
+	p.pdf.Ln(pdfLine)
+}
+
+// chart draws the same plot as Chart.SVG, starting a new page when it doesn't fit
+func (p *pdfWriter) chart(chart *Chart) {
+	_, pageHeight := p.pdf.GetPageSize()
+	if p.pdf.GetY()+pdfLine+pdfChartHeight+pdfLine > pageHeight-pdfMargin {
+		p.pdf.AddPage()
+	}
+
+	p.cell(pdfWidth, pdfLine, fmt.Sprintf("%s (%s), daily mean with min and max", chart.Title, chart.Unit))
+
+	left, top := float64(pdfMargin+pdfChartLeft), p.pdf.GetY()
+	width := float64(pdfWidth - pdfChartLeft)
+	plot := chart.plot(width, pdfChartHeight)
+
+	p.pdf.SetDrawColor(204, 204, 204)
+	p.pdf.SetLineWidth(0.2)
+	p.pdf.Rect(left, top, width, pdfChartHeight, "D")
+
+	p.pdf.SetFillColor(207, 227, 207)
+	for _, band := range plot.Bands {
+		polygon := make([]gofpdf.PointType, len(band))
+		for i, point := range band {
+			polygon[i] = gofpdf.PointType{X: left + point.X, Y: top + point.Y}
+		}
+
+		p.pdf.Polygon(polygon, "F")
+	}
+
+	p.pdf.SetDrawColor(46, 125, 50)
+	p.pdf.SetFillColor(46, 125, 50)
+	p.pdf.SetLineWidth(0.4)
+	for _, line := range plot.Lines {
+		if len(line) == 1 {
+			p.pdf.Circle(left+line[0].X, top+line[0].Y, 0.6, "F")
+			continue
+		}
+
+		for i := 1; i < len(line); i++ {
+			p.pdf.Line(left+line[i-1].X, top+line[i-1].Y, left+line[i].X, top+line[i].Y)
+		}
+	}
+
+	p.pdf.SetFont("Helvetica", "", 7)
+	p.pdf.Text(pdfMargin, top+3, label(plot.High))
+	p.pdf.Text(pdfMargin, top+pdfChartHeight, label(plot.Low))
+	p.pdf.Text(left, top+pdfChartHeight+3.5, chart.Dates[0])
+	p.pdf.Text(left+width-p.pdf.GetStringWidth(chart.Dates[len(chart.Dates)-1]), top+pdfChartHeight+3.5, chart.Dates[len(chart.Dates)-1])
+	p.pdf.SetFont("Helvetica", "", 9)
+
+	p.pdf.SetY(top + pdfChartHeight + pdfLine + 1)
+}
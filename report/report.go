@@ -0,0 +1,282 @@
+// Package report puts together a printable report of a controller over a crop cycle
+// It has the plan, compliance, consumption, notable anomalies and charts of the main metrics, as HTML or PDF
+package report
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/tPhume/ags-backend/anomaly"
+	"github.com/tPhume/ags-backend/compliance"
+	"github.com/tPhume/ags-backend/consumption"
+	"github.com/tPhume/ags-backend/lookup"
+	"github.com/tPhume/ags-backend/metric"
+	"github.com/tPhume/ags-backend/plan"
+	"github.com/tPhume/ags-backend/session"
+	"github.com/tPhume/ags-backend/summary"
+	"log"
+	"net/http"
+	"time"
+)
+
+func RegisterRoutes(handler *Handler, engine *gin.Engine, sessionHandler *session.Handler) {
+	engine.GET("api/v1/controller/:controllerId/report", sessionHandler.GetUser, handler.GetReport)
+}
+
+// Formats of a report
+const (
+	FormatHTML = "html"
+	FormatPDF  = "pdf"
+)
+
+// Longest range of one report, about two crop cycles
+const maxReportRange = 184 * 24 * time.Hour
+
+// Charts are drawn for the first sensors of the controller and the derived metrics, no more than this
+const maxCharts = 8
+
+// Controller is what reports need to know about a controller
+type Controller struct {
+	Name    string          `bson:"name"`
+	Plan    string          `bson:"plan"`
+	Sensors []metric.Sensor `bson:"sensors"`
+}
+
+// Repo
+type Repo interface {
+	// GetController returns the controller if it belongs to userId
+	GetController(ctx context.Context, userId string, controllerId string) (*Controller, error)
+
+	lookup.Plans
+	lookup.Timezones
+
+	EachSummary(ctx context.Context, userId string, controllerId string, from string, to string, fn func(*summary.Summary) error) error
+
+	ListAnomalies(ctx context.Context, userId string, controllerId string, from string, to string, severities []string) ([]*anomaly.Anomaly, error)
+}
+
+// ComplianceBuilder is compliance.Handler
+type ComplianceBuilder interface {
+	Build(ctx context.Context, userId string, controllerId string, from time.Time, to time.Time) (*compliance.Report, error)
+}
+
+// ConsumptionBuilder is consumption.Handler
+type ConsumptionBuilder interface {
+	Build(ctx context.Context, userId string, controllerId string, from time.Time, to time.Time, granularity string) (*consumption.Report, error)
+}
+
+var (
+	errControllerNotFound = lookup.ErrControllerNotFound
+	errPlanNotFound       = lookup.ErrPlanNotFound
+)
+
+// Handler for report REST API
+type Handler struct {
+	Repo        Repo
+	Compliance  ComplianceBuilder
+	Consumption ConsumptionBuilder
+}
+
+var (
+	// error message responses for handler
+	resInternal = "not your fault, don't worry"
+	resInvalid  = "invalid values"
+	resNotFound = "not found"
+)
+
+type reportQuery struct {
+	From   time.Time `form:"from" binding:"required" time_format:"2006-01-02T15:04:05Z07:00"`
+	To     time.Time `form:"to" binding:"required" time_format:"2006-01-02T15:04:05Z07:00"`
+	Format string    `form:"format" binding:"omitempty,oneof=html pdf"`
+}
+
+// Report of a controller over a range
+// Sections that need a plan are nil when the controller has none
+type Report struct {
+	ControllerId   string
+	ControllerName string
+	From           time.Time
+	To             time.Time
+	Timezone       string
+	GeneratedAt    time.Time
+
+	Plan        *plan.Entity
+	Setpoints   []*Setpoint
+	Compliance  *compliance.Report
+	Consumption *consumption.Report
+
+	// Anomalies are the medium and high ones
+	Anomalies []*anomaly.Anomaly
+
+	Charts []*Chart
+}
+
+// Setpoint of the plan for a metric
+type Setpoint struct {
+	Metric string
+	Unit   string
+	Value  float64
+}
+
+// GetReport renders the report of the controller as a download
+func (h *Handler) GetReport(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	// check controllerId
+	controllerId := ctx.Param("controllerId")
+	if _, err := uuid.Parse(controllerId); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	query := &reportQuery{}
+	if err := ctx.ShouldBindQuery(query); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	if query.Format == "" {
+		query.Format = FormatHTML
+	}
+
+	span := query.To.Sub(query.From)
+	if span <= 0 || span > maxReportRange {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	report, err := h.Build(ctx, userId, controllerId, query.From, query.To)
+	if err != nil {
+		if err == errControllerNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resNotFound})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	// Rendered whole before anything is sent, so a failure can still be answered with an error
+	buffer := &bytes.Buffer{}
+	contentType := "text/html; charset=utf-8"
+	if query.Format == FormatPDF {
+		err = writePDF(buffer, report)
+		contentType = "application/pdf"
+	} else {
+		err = writeHTML(buffer, report)
+	}
+
+	if err != nil {
+		log.Printf("report: could not render %s: %s", controllerId, err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	filename := fmt.Sprintf("report-%s-%s.%s", controllerId, query.From.In(report.location()).Format("20060102"), query.Format)
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	ctx.Data(http.StatusOK, contentType, buffer.Bytes())
+}
+
+// Build puts the report together, days are those of the timezone of the user
+func (h *Handler) Build(ctx context.Context, userId string, controllerId string, from time.Time, to time.Time) (*Report, error) {
+	controller, err := h.Repo.GetController(ctx, userId, controllerId)
+	if err != nil {
+		return nil, err
+	}
+
+	timezone, err := h.Repo.GetTimezone(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		location = time.UTC
+	}
+
+	report := &Report{
+		ControllerId:   controllerId,
+		ControllerName: controller.Name,
+		From:           from,
+		To:             to,
+		Timezone:       location.String(),
+		GeneratedAt:    time.Now().In(location),
+	}
+
+	if controller.Plan != "" {
+		if err := h.addPlan(ctx, report, userId, controller.Plan); err != nil {
+			return nil, err
+		}
+	}
+
+	first := from.In(location).Format(dateLayout)
+	last := to.Add(-time.Nanosecond).In(location).Format(dateLayout)
+
+	report.Anomalies, err = h.Repo.ListAnomalies(ctx, userId, controllerId, first, last, []string{anomaly.SeverityMedium, anomaly.SeverityHigh})
+	if err != nil {
+		return nil, err
+	}
+
+	charts := newCharts(metric.Sensors(controller.Sensors), first, last)
+	err = h.Repo.EachSummary(ctx, userId, controllerId, first, last, func(daily *summary.Summary) error {
+		charts.add(daily)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	report.Charts = charts.list()
+
+	return report, nil
+}
+
+// addPlan adds the plan and the sections worked out from it
+// A plan that was deleted since it was assigned leaves them out like no plan at all
+func (h *Handler) addPlan(ctx context.Context, report *Report, userId string, planId string) error {
+	entity, err := h.Repo.GetPlan(ctx, userId, planId)
+	if err == errPlanNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	report.Plan = entity
+	for _, m := range metric.Default.List() {
+		if value, ok := entity.Setpoint(m.Name); ok {
+			report.Setpoints = append(report.Setpoints, &Setpoint{Metric: m.Name, Unit: m.Unit, Value: value})
+		}
+	}
+
+	report.Compliance, err = h.Compliance.Build(ctx, userId, report.ControllerId, report.From, report.To)
+	if compliance.NoPlan(err) {
+		report.Compliance = nil
+	} else if err != nil {
+		return err
+	}
+
+	report.Consumption, err = h.Consumption.Build(ctx, userId, report.ControllerId, report.From, report.To, consumption.GranularityMonth)
+	if consumption.NoPlan(err) {
+		report.Consumption = nil
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (r *Report) location() *time.Location {
+	location, err := time.LoadLocation(r.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+
+	return location
+}
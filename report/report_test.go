@@ -0,0 +1,238 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/tPhume/ags-backend/anomaly"
+	"github.com/tPhume/ags-backend/compliance"
+	"github.com/tPhume/ags-backend/consumption"
+	"github.com/tPhume/ags-backend/metric"
+	"github.com/tPhume/ags-backend/plan"
+	"github.com/tPhume/ags-backend/summary"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// For our tests the grower has a north greenhouse growing tomatoes and a nursery with no plan
+// Any other controller id indicates a missing controller
+const (
+	growerId     = "ba710d48-64c8-4f1e-ae68-aea17aeb1a2d"
+	greenhouseId = "87a00c00-3fa1-40a3-82f5-f1068499f6ca"
+	nurseryId    = "a77f6bf3-bbd6-4bba-be5d-ce2d02791078"
+	unknownId    = "7751f3bc-962e-442e-bc73-5b0e7bcd9b0a"
+)
+
+var tomatoPlan = plan.Entity{
+	PlanId:    "d94658d0-dbe1-447e-9383-15795d201749",
+	UserId:    growerId,
+	Name:      "Tomato",
+	Setpoints: map[string]float64{"temperature": 24, metric.VPD: 1.1},
+	Daily:     []plan.Daily{{DailyTime: "06:00", Action: plan.Action{Type: "water", Level: 50, Duration: 120}}},
+}
+
+var controllers = map[string]*Controller{
+	greenhouseId: {Name: "North <greenhouse>", Plan: tomatoPlan.PlanId},
+	nurseryId:    {Name: "Nursery", Sensors: []metric.Sensor{{Key: "co2", Metric: "co2"}}},
+}
+
+// Repo struct for testing
+type repoStruct struct{}
+
+func (r *repoStruct) GetController(ctx context.Context, userId string, controllerId string) (*Controller, error) {
+	if controller, ok := controllers[controllerId]; ok && userId == growerId {
+		return controller, nil
+	}
+
+	return nil, errControllerNotFound
+}
+
+func (r *repoStruct) GetPlan(ctx context.Context, userId string, planId string) (*plan.Entity, error) {
+	if planId != tomatoPlan.PlanId {
+		return nil, errPlanNotFound
+	}
+
+	return &tomatoPlan, nil
+}
+
+func (r *repoStruct) GetTimezone(ctx context.Context, userId string) (string, error) {
+	return "Asia/Bangkok", nil
+}
+
+// Dailies for every other day of April 2020, the 10th has no min and max like older summaries
+func (r *repoStruct) EachSummary(ctx context.Context, userId string, controllerId string, from string, to string, fn func(*summary.Summary) error) error {
+	for day := 1; day <= 30; day += 2 {
+		date := time.Date(2020, time.April, day, 0, 0, 0, 0, time.UTC).Format(dateLayout)
+		if date < from || date > to {
+			continue
+		}
+
+		value := float64(20 + day%5)
+		stats := &summary.Stats{Mean: value, Median: value, Min: value - 3, Max: value + 3, Count: 24}
+		if day == 9 {
+			stats = &summary.Stats{Mean: value, Median: value}
+		}
+
+		if err := fn(&summary.Summary{Date: date, Metrics: map[string]*summary.Stats{"temperature": stats, "co2": stats}}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r *repoStruct) ListAnomalies(ctx context.Context, userId string, controllerId string, from string, to string, severities []string) ([]*anomaly.Anomaly, error) {
+	return []*anomaly.Anomaly{{Date: "2020-04-11", Key: "temperature", Severity: anomaly.SeverityHigh, Explanation: "median temperature was 35 °C"}}, nil
+}
+
+type complianceStruct struct{}
+
+func (c *complianceStruct) Build(ctx context.Context, userId string, controllerId string, from time.Time, to time.Time) (*compliance.Report, error) {
+	inRange := 92.5
+	return &compliance.Report{Sensors: map[string]*compliance.SensorReport{
+		"temperature": {Metric: "temperature", Setpoint: 24, Low: 22, High: 26, TimeInRange: &inRange},
+	}}, nil
+}
+
+type consumptionStruct struct{}
+
+func (c *consumptionStruct) Build(ctx context.Context, userId string, controllerId string, from time.Time, to time.Time, granularity string) (*consumption.Report, error) {
+	water := 300.0
+	return &consumption.Report{Total: &consumption.Usage{WaterLitres: &water}, Periods: []*consumption.Usage{{Period: "2020-04", WaterLitres: &water}}}, nil
+}
+
+// Setup func for handler testing
+func setUp() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+
+	engine.Use(func(ctx *gin.Context) {
+		ctx.Set("userId", growerId)
+	})
+
+	return engine
+}
+
+// Test GetReport handler
+func TestHandler_GetReport(t *testing.T) {
+	engine := setUp()
+	handler := &Handler{Repo: &repoStruct{}, Compliance: &complianceStruct{}, Consumption: &consumptionStruct{}}
+	engine.GET(":controllerId", handler.GetReport)
+
+	april := "from=2020-04-01T00:00:00%2B07:00&to=2020-05-01T00:00:00%2B07:00"
+
+	testCases := []struct {
+		controllerId string
+		query        string
+		code         int
+		contains     []string
+		missing      []string
+	}{
+		{
+			controllerId: greenhouseId,
+			query:        april,
+			code:         http.StatusOK,
+			contains:     []string{"North &lt;greenhouse&gt;", "Tomato", "daily at 06:00", "92.5%", "300", "median temperature was 35 °C", "<svg", "<polygon", "2020-04-30"},
+		}, {
+			controllerId: nurseryId,
+			query:        april + "&format=html",
+			code:         http.StatusOK,
+			contains:     []string{"The controller has no plan.", "co2"},
+			missing:      []string{"Compliance", "Consumption"},
+		}, {
+			controllerId: greenhouseId,
+			query:        april + "&format=pdf",
+			code:         http.StatusOK,
+			contains:     []string{"%PDF-"},
+		}, {
+			controllerId: greenhouseId,
+			query:        april + "&format=docx",
+			code:         http.StatusBadRequest,
+			contains:     []string{resInvalid},
+		}, {
+			controllerId: greenhouseId,
+			query:        "from=2020-01-01T00:00:00Z&to=2020-12-01T00:00:00Z",
+			code:         http.StatusBadRequest,
+			contains:     []string{resInvalid},
+		}, {
+			controllerId: "not-a-uuid",
+			query:        april,
+			code:         http.StatusBadRequest,
+			contains:     []string{resInvalid},
+		}, {
+			controllerId: unknownId,
+			query:        april,
+			code:         http.StatusNotFound,
+			contains:     []string{resNotFound},
+		},
+	}
+
+	for i, c := range testCases {
+		resp := httptest.NewRecorder()
+
+		req, _ := http.NewRequest(http.MethodGet, "/"+c.controllerId+"?"+c.query, nil)
+		engine.ServeHTTP(resp, req)
+
+		if c.code != resp.Code {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.code, resp.Code)
+		}
+
+		body := resp.Body.String()
+		for _, text := range c.contains {
+			if !strings.Contains(body, text) {
+				t.Fatalf("Case %d: expected [%v] in the report", i, text)
+			}
+		}
+
+		for _, text := range c.missing {
+			if strings.Contains(body, text) {
+				t.Fatalf("Case %d: expected no [%v] in the report", i, text)
+			}
+		}
+	}
+}
+
+// Test charts break where there are no summaries and keep the band to days with min and max
+func TestChart_Plot(t *testing.T) {
+	value := func(v float64) *float64 { return &v }
+
+	chart := &Chart{
+		Dates: []string{"2020-04-01", "2020-04-02", "2020-04-03", "2020-04-04", "2020-04-05"},
+		Mean:  []*float64{value(20), value(22), nil, value(24), value(22)},
+		Min:   []*float64{value(18), value(20), nil, nil, value(20)},
+		Max:   []*float64{value(22), value(24), nil, nil, value(26)},
+	}
+
+	p := chart.plot(100, 50)
+	if len(p.Lines) != 2 || len(p.Lines[0]) != 2 || len(p.Lines[1]) != 2 {
+		t.Fatalf("expected lines of [2 2], got = [%v]", p.Lines)
+	}
+
+	if len(p.Bands) != 2 || len(p.Bands[0]) != 4 || len(p.Bands[1]) != 2 {
+		t.Fatalf("expected bands of [4 2], got = [%v]", p.Bands)
+	}
+
+	// The highest max is at the top and the lowest min at the bottom
+	if p.Low != 18 || p.High != 26 || p.Bands[1][0].Y != 0 || p.Bands[0][3].Y != 50 || p.Lines[1][1].X != 100 {
+		t.Fatalf("expected [18 26 0 50 100], got = [%v %v %v %v %v]", p.Low, p.High, p.Bands[1][0].Y, p.Bands[0][3].Y, p.Lines[1][1].X)
+	}
+}
+
+// Test the PDF renders with every section
+func TestWritePDF(t *testing.T) {
+	handler := &Handler{Repo: &repoStruct{}, Compliance: &complianceStruct{}, Consumption: &consumptionStruct{}}
+	location, _ := time.LoadLocation("Asia/Bangkok")
+
+	report, err := handler.Build(context.Background(), growerId, greenhouseId, time.Date(2020, time.April, 1, 0, 0, 0, 0, location), time.Date(2020, time.May, 1, 0, 0, 0, 0, location))
+	if err != nil {
+		t.Fatalf("expected no error, got = [%v]", err)
+	}
+
+	buffer := &bytes.Buffer{}
+	if err := writePDF(buffer, report); err != nil || !bytes.HasPrefix(buffer.Bytes(), []byte("%PDF-")) {
+		t.Fatalf("expected a PDF, got = [%v %q]", err, buffer.Bytes()[:8])
+	}
+}
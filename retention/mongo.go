@@ -0,0 +1,132 @@
+package retention
+
+import (
+	"context"
+	"github.com/tPhume/ags-backend/data"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// Error code of collStats on a missing collection
+const namespaceNotFound = 26
+
+type MongoRepo struct {
+	// Data owns the raw and hourly tiers
+	Data *data.MongoRepo
+
+	// SummaryCol is the daily tier
+	SummaryCol *mongo.Collection
+
+	ControllerCol *mongo.Collection
+	UserCol       *mongo.Collection
+}
+
+func (m *MongoRepo) ListControllers(ctx context.Context) ([]*Controller, error) {
+	cursor, err := m.ControllerCol.Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"_id": 1, "user_id": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	controllers := make([]*Controller, 0)
+	if err := cursor.All(ctx, &controllers); err != nil {
+		return nil, err
+	}
+
+	return controllers, nil
+}
+
+type userResult struct {
+	UserId    string    `bson:"_id"`
+	Retention *Override `bson:"retention"`
+}
+
+func (m *MongoRepo) GetOverride(ctx context.Context, userId string) (*Override, error) {
+	result := m.UserCol.FindOne(ctx, bson.M{"_id": userId}, options.FindOne().SetProjection(bson.M{"retention": 1}))
+	if result.Err() != nil {
+		if result.Err() == mongo.ErrNoDocuments {
+			return nil, errUserNotFound
+		}
+
+		return nil, result.Err()
+	}
+
+	user := &userResult{}
+	if err := result.Decode(user); err != nil {
+		return nil, err
+	}
+
+	return user.Retention, nil
+}
+
+func (m *MongoRepo) SetOverride(ctx context.Context, userId string, override *Override) error {
+	result, err := m.UserCol.UpdateOne(ctx, bson.M{"_id": userId}, bson.M{"$set": bson.M{"retention": override}})
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return errUserNotFound
+	}
+
+	return nil
+}
+
+func (m *MongoRepo) ListOverrides(ctx context.Context) (map[string]*Override, error) {
+	cursor, err := m.UserCol.Find(ctx, bson.M{"retention": bson.M{"$exists": true}}, options.Find().SetProjection(bson.M{"retention": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	overrides := make(map[string]*Override)
+	for cursor.Next(ctx) {
+		user := &userResult{}
+		if err := cursor.Decode(user); err != nil {
+			return nil, err
+		}
+
+		overrides[user.UserId] = user.Retention
+	}
+
+	return overrides, cursor.Err()
+}
+
+func (m *MongoRepo) Compact(ctx context.Context, controllerId string, before time.Time) (int, error) {
+	return m.Data.Compact(ctx, controllerId, before)
+}
+
+func (m *MongoRepo) PruneRollups(ctx context.Context, controllerId string, before time.Time) (int, error) {
+	return m.Data.PruneRollups(ctx, controllerId, before)
+}
+
+func (m *MongoRepo) Storage(ctx context.Context) ([]*Tier, error) {
+	tiers := []*Tier{
+		{Name: TierRaw, Collection: m.Data.BucketCol.Name()},
+		{Name: TierHourly, Collection: m.Data.RollupCol.Name()},
+		{Name: TierDaily, Collection: m.SummaryCol.Name()},
+	}
+
+	for _, tier := range tiers {
+		stats := &struct {
+			Count       int64 `bson:"count"`
+			Size        int64 `bson:"size"`
+			StorageSize int64 `bson:"storageSize"`
+		}{}
+
+		// collStats scales sizes to bytes by default, a collection that was never written to doesn't exist yet
+		err := m.SummaryCol.Database().RunCommand(ctx, bson.D{{Key: "collStats", Value: tier.Collection}}).Decode(stats)
+		if commandError, ok := err.(mongo.CommandError); ok && commandError.Code == namespaceNotFound {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		tier.Documents, tier.Size, tier.StorageSize = stats.Count, stats.Size, stats.StorageSize
+	}
+
+	return tiers, nil
+}
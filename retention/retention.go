@@ -0,0 +1,281 @@
+// Package retention decides how long readings are kept and compacts the ones that are due
+// Raw readings are rolled up by the hour before they are deleted, and daily summaries are kept forever
+package retention
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/tPhume/ags-backend/session"
+	"log"
+	"net/http"
+	"time"
+)
+
+func RegisterRoutes(handler *Handler, engine *gin.Engine, sessionHandler *session.Handler) {
+	group := engine.Group("api/v1/admin")
+	group.Use(sessionHandler.GetUser, sessionHandler.RequireAdmin)
+
+	group.GET("/storage", handler.GetStorage)
+	group.GET("/user/:userId/retention", handler.GetRetention)
+	group.PUT("/user/:userId/retention", handler.SetRetention)
+}
+
+// Tiers of storage, from the most detailed to the least
+const (
+	TierRaw    = "raw"
+	TierHourly = "hourly"
+	TierDaily  = "daily"
+)
+
+// Policy says how long the raw and hourly tiers are kept, zero keeps a tier forever
+type Policy struct {
+	RawDays      int `json:"raw_days"`
+	HourlyMonths int `json:"hourly_months"`
+}
+
+// Override of the policy for one user, fields left out fall back to the global policy
+type Override struct {
+	RawDays      *int `json:"raw_days" bson:"raw_days,omitempty" binding:"omitempty,min=0"`
+	HourlyMonths *int `json:"hourly_months" bson:"hourly_months,omitempty" binding:"omitempty,min=0"`
+}
+
+// With returns the policy once the override is applied, a nil override changes nothing
+func (p Policy) With(override *Override) Policy {
+	if override == nil {
+		return p
+	}
+
+	if override.RawDays != nil {
+		p.RawDays = *override.RawDays
+	}
+
+	if override.HourlyMonths != nil {
+		p.HourlyMonths = *override.HourlyMonths
+	}
+
+	return p
+}
+
+// RawBefore returns the time before which raw readings are compacted, false when they are kept forever
+func (p Policy) RawBefore(now time.Time) (time.Time, bool) {
+	if p.RawDays == 0 {
+		return time.Time{}, false
+	}
+
+	return now.AddDate(0, 0, -p.RawDays), true
+}
+
+// HourlyBefore returns the time before which hourly rollups are deleted, false when they are kept forever
+func (p Policy) HourlyBefore(now time.Time) (time.Time, bool) {
+	if p.HourlyMonths == 0 {
+		return time.Time{}, false
+	}
+
+	return now.AddDate(0, -p.HourlyMonths, 0), true
+}
+
+// Controller whose readings are compacted
+type Controller struct {
+	ControllerId string `bson:"_id"`
+	UserId       string `bson:"user_id"`
+}
+
+// Tier and how much storage it uses
+type Tier struct {
+	Name        string `json:"name"`
+	Collection  string `json:"collection"`
+	Documents   int64  `json:"documents"`
+	Size        int64  `json:"size"`
+	StorageSize int64  `json:"storage_size"`
+}
+
+// Repo
+type Repo interface {
+	// ListControllers returns every controller, compaction goes through all of them
+	ListControllers(ctx context.Context) ([]*Controller, error)
+
+	// GetOverride returns the override of a user, nil when the user has none
+	GetOverride(ctx context.Context, userId string) (*Override, error)
+
+	// SetOverride replaces the override of a user
+	SetOverride(ctx context.Context, userId string, override *Override) error
+
+	// ListOverrides returns the override of every user that has one
+	ListOverrides(ctx context.Context) (map[string]*Override, error)
+
+	// Compact rolls up the raw readings of a controller that are older than before, then deletes them
+	Compact(ctx context.Context, controllerId string, before time.Time) (int, error)
+
+	// PruneRollups deletes the hourly rollups of a controller that are older than before
+	PruneRollups(ctx context.Context, controllerId string, before time.Time) (int, error)
+
+	// Storage returns the storage used by each tier
+	Storage(ctx context.Context) ([]*Tier, error)
+}
+
+var errUserNotFound = errors.New("user not found")
+
+// Compactor applies the retention policy of every user at each interval
+// Runs of several replicas can overlap, a bucket is never merged twice into its rollup
+type Compactor struct {
+	Repo     Repo
+	Policy   Policy
+	Interval time.Duration
+}
+
+// Run compacts until ctx is done, a failed run is logged and tried again at the next interval
+func (c *Compactor) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.RunOnce(ctx, time.Now()); err != nil {
+			log.Printf("retention: compaction failed: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce applies the policies as of now
+// A controller that fails is logged and skipped so the others are still compacted, the error then says how many failed
+func (c *Compactor) RunOnce(ctx context.Context, now time.Time) error {
+	controllers, err := c.Repo.ListControllers(ctx)
+	if err != nil {
+		return err
+	}
+
+	overrides, err := c.Repo.ListOverrides(ctx)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, controller := range controllers {
+		policy := c.Policy.With(overrides[controller.UserId])
+
+		if err := c.compactController(ctx, controller, policy, now); err != nil {
+			log.Printf("retention: could not compact %s: %s", controller.ControllerId, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d controllers could not be compacted", failed, len(controllers))
+	}
+
+	return nil
+}
+
+// compactController compacts the raw readings and prunes the rollups of one controller by policy
+func (c *Compactor) compactController(ctx context.Context, controller *Controller, policy Policy, now time.Time) error {
+	if before, ok := policy.RawBefore(now); ok {
+		if _, err := c.Repo.Compact(ctx, controller.ControllerId, before); err != nil {
+			return err
+		}
+	}
+
+	if before, ok := policy.HourlyBefore(now); ok {
+		if _, err := c.Repo.PruneRollups(ctx, controller.ControllerId, before); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Handler for admin retention REST API
+type Handler struct {
+	Repo Repo
+
+	// Policy applies to users without an override
+	Policy Policy
+}
+
+var (
+	// ok message responses for handler
+	resStorage      = "storage retrieved"
+	resRetention    = "retention retrieved"
+	resSetRetention = "retention updated"
+
+	// error message responses for handler
+	resInternal = "not your fault, don't worry"
+	resInvalid  = "invalid values"
+	resNotFound = "not found"
+)
+
+func (h *Handler) GetStorage(ctx *gin.Context) {
+	tiers, err := h.Repo.Storage(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resStorage, "result": gin.H{"policy": h.Policy, "tiers": tiers}})
+}
+
+func (h *Handler) GetRetention(ctx *gin.Context) {
+	userId := ctx.Param("userId")
+	if _, err := uuid.Parse(userId); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	override, err := h.Repo.GetOverride(ctx, userId)
+	if err != nil {
+		if err == errUserNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resNotFound})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	h.respond(ctx, resRetention, override)
+}
+
+// SetRetention replaces the override of a user, an empty body goes back to the global policy
+func (h *Handler) SetRetention(ctx *gin.Context) {
+	userId := ctx.Param("userId")
+	if _, err := uuid.Parse(userId); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	override := &Override{}
+	if err := ctx.ShouldBindJSON(override); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	if err := h.Repo.SetOverride(ctx, userId, override); err != nil {
+		if err == errUserNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resNotFound})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	h.respond(ctx, resSetRetention, override)
+}
+
+func (h *Handler) respond(ctx *gin.Context, message string, override *Override) {
+	if override == nil {
+		override = &Override{}
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": message, "result": gin.H{
+		"override": override,
+		"policy":   h.Policy.With(override),
+	}})
+}
@@ -0,0 +1,243 @@
+package retention
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// For our tests the hobbyist keeps the default policy and the lab keeps a week of raw readings
+// Any other user id indicates a missing user
+const (
+	hobbyistId   = "9d4cfea9-0038-40fb-b679-104bbc4c0254"
+	labId        = "8c0eb815-37cb-42a9-9fda-e5a148ed1f98"
+	unknownId    = "2da467bf-ba46-41bc-be4a-81f6f0cb6cbc"
+	windowsillId = "a27790f9-5f8d-4145-a938-fdcd0044ba8d"
+	incubatorId  = "2d4af2e4-25a4-4e77-8f03-ec7c5f511657"
+)
+
+// Repo struct for testing
+type repoStruct struct {
+	overrides map[string]*Override
+	compacted map[string]time.Time
+	pruned    map[string]time.Time
+
+	// failing is a controller whose compaction fails
+	failing string
+}
+
+func newRepo() *repoStruct {
+	days := 7
+	return &repoStruct{
+		overrides: map[string]*Override{labId: {RawDays: &days}},
+		compacted: map[string]time.Time{},
+		pruned:    map[string]time.Time{},
+	}
+}
+
+func (r *repoStruct) ListControllers(ctx context.Context) ([]*Controller, error) {
+	return []*Controller{{ControllerId: windowsillId, UserId: hobbyistId}, {ControllerId: incubatorId, UserId: labId}}, nil
+}
+
+func (r *repoStruct) GetOverride(ctx context.Context, id string) (*Override, error) {
+	if id != hobbyistId && id != labId {
+		return nil, errUserNotFound
+	}
+
+	return r.overrides[id], nil
+}
+
+func (r *repoStruct) SetOverride(ctx context.Context, id string, override *Override) error {
+	if id != hobbyistId && id != labId {
+		return errUserNotFound
+	}
+
+	r.overrides[id] = override
+	return nil
+}
+
+func (r *repoStruct) ListOverrides(ctx context.Context) (map[string]*Override, error) {
+	return r.overrides, nil
+}
+
+func (r *repoStruct) Compact(ctx context.Context, controllerId string, before time.Time) (int, error) {
+	if controllerId == r.failing {
+		return 0, errors.New("compaction failed")
+	}
+
+	r.compacted[controllerId] = before
+	return 1, nil
+}
+
+func (r *repoStruct) PruneRollups(ctx context.Context, controllerId string, before time.Time) (int, error) {
+	r.pruned[controllerId] = before
+	return 1, nil
+}
+
+func (r *repoStruct) Storage(ctx context.Context) ([]*Tier, error) {
+	return []*Tier{{Name: TierRaw, Documents: 10}, {Name: TierHourly}, {Name: TierDaily}}, nil
+}
+
+// Test each controller is compacted with the policy of its user
+func TestCompactor_RunOnce(t *testing.T) {
+	now := time.Date(2020, time.June, 15, 10, 0, 0, 0, time.UTC)
+	repo := newRepo()
+
+	compactor := &Compactor{Repo: repo, Policy: Policy{RawDays: 90, HourlyMonths: 24}}
+	if err := compactor.RunOnce(context.Background(), now); err != nil {
+		t.Fatalf("expected no error, got = [%v]", err)
+	}
+
+	testCases := []struct {
+		got      time.Time
+		expected time.Time
+	}{
+		{got: repo.compacted[windowsillId], expected: time.Date(2020, time.March, 17, 10, 0, 0, 0, time.UTC)},
+		{got: repo.compacted[incubatorId], expected: time.Date(2020, time.June, 8, 10, 0, 0, 0, time.UTC)},
+		{got: repo.pruned[windowsillId], expected: time.Date(2018, time.June, 15, 10, 0, 0, 0, time.UTC)},
+		{got: repo.pruned[incubatorId], expected: time.Date(2018, time.June, 15, 10, 0, 0, 0, time.UTC)},
+	}
+
+	for i, c := range testCases {
+		if !c.got.Equal(c.expected) {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.expected, c.got)
+		}
+	}
+
+	// Zero keeps a tier forever
+	repo = newRepo()
+	compactor = &Compactor{Repo: repo, Policy: Policy{RawDays: 90}}
+	if err := compactor.RunOnce(context.Background(), now); err != nil {
+		t.Fatalf("expected no error, got = [%v]", err)
+	}
+
+	if len(repo.pruned) != 0 {
+		t.Fatalf("expected no pruning, got = [%v]", repo.pruned)
+	}
+}
+
+// Test a controller that fails does not keep the ones after it from being compacted
+func TestCompactor_RunOnceFailing(t *testing.T) {
+	now := time.Date(2020, time.June, 15, 10, 0, 0, 0, time.UTC)
+	repo := newRepo()
+	repo.failing = windowsillId
+
+	compactor := &Compactor{Repo: repo, Policy: Policy{RawDays: 90, HourlyMonths: 24}}
+	if err := compactor.RunOnce(context.Background(), now); err == nil {
+		t.Fatalf("expected an error, got = [%v]", err)
+	}
+
+	if _, ok := repo.compacted[incubatorId]; !ok {
+		t.Fatalf("expected [%v] compacted, got = [%v]", incubatorId, repo.compacted)
+	}
+
+	if _, ok := repo.pruned[incubatorId]; !ok {
+		t.Fatalf("expected [%v] pruned, got = [%v]", incubatorId, repo.pruned)
+	}
+
+	if _, ok := repo.compacted[windowsillId]; ok {
+		t.Fatalf("expected [%v] not compacted, got = [%v]", windowsillId, repo.compacted)
+	}
+}
+
+// Setup func for handler testing
+func setUp() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	return gin.New()
+}
+
+// Test GetRetention and SetRetention handlers
+func TestHandler_Retention(t *testing.T) {
+	engine := setUp()
+
+	handler := &Handler{Repo: newRepo(), Policy: Policy{RawDays: 90, HourlyMonths: 24}}
+	engine.GET(":userId", handler.GetRetention)
+	engine.PUT(":userId", handler.SetRetention)
+
+	testCases := []struct {
+		method  string
+		userId  string
+		in      string
+		message string
+		code    int
+		policy  Policy
+	}{
+		{method: http.MethodGet, userId: hobbyistId, message: resRetention, code: http.StatusOK, policy: Policy{RawDays: 90, HourlyMonths: 24}},
+		{method: http.MethodGet, userId: labId, message: resRetention, code: http.StatusOK, policy: Policy{RawDays: 7, HourlyMonths: 24}},
+		{method: http.MethodPut, userId: hobbyistId, in: `{"hourly_months": 0}`, message: resSetRetention, code: http.StatusOK, policy: Policy{RawDays: 90}},
+		{method: http.MethodGet, userId: hobbyistId, message: resRetention, code: http.StatusOK, policy: Policy{RawDays: 90}},
+		{method: http.MethodPut, userId: hobbyistId, in: `{}`, message: resSetRetention, code: http.StatusOK, policy: Policy{RawDays: 90, HourlyMonths: 24}},
+		{method: http.MethodPut, userId: hobbyistId, in: `{"raw_days": -1}`, message: resInvalid, code: http.StatusBadRequest},
+		{method: http.MethodGet, userId: "not-a-uuid", message: resInvalid, code: http.StatusBadRequest},
+		{method: http.MethodPut, userId: unknownId, in: `{}`, message: resNotFound, code: http.StatusNotFound},
+	}
+
+	for i, c := range testCases {
+		resp := httptest.NewRecorder()
+
+		req, _ := http.NewRequest(c.method, "/"+c.userId, bytes.NewReader([]byte(c.in)))
+		engine.ServeHTTP(resp, req)
+
+		respBody := struct {
+			Message string `json:"message"`
+			Result  struct {
+				Policy Policy `json:"policy"`
+			} `json:"result"`
+		}{}
+		_ = json.Unmarshal(resp.Body.Bytes(), &respBody)
+
+		if c.code != resp.Code {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.code, resp.Code)
+		}
+
+		if c.message != respBody.Message {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.message, respBody.Message)
+		}
+
+		if c.code != http.StatusOK {
+			continue
+		}
+
+		if respBody.Result.Policy != c.policy {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.policy, respBody.Result.Policy)
+		}
+	}
+}
+
+// Test GetStorage handler
+func TestHandler_GetStorage(t *testing.T) {
+	engine := setUp()
+
+	handler := &Handler{Repo: newRepo(), Policy: Policy{RawDays: 90, HourlyMonths: 24}}
+	engine.GET("", handler.GetStorage)
+
+	resp := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	engine.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected [%v], got = [%v]", http.StatusOK, resp.Code)
+	}
+
+	respBody := struct {
+		Message string `json:"message"`
+		Result  struct {
+			Tiers []*Tier `json:"tiers"`
+		} `json:"result"`
+	}{}
+	_ = json.Unmarshal(resp.Body.Bytes(), &respBody)
+
+	if respBody.Message != resStorage {
+		t.Fatalf("expected [%v], got = [%v]", resStorage, respBody.Message)
+	}
+
+	if len(respBody.Result.Tiers) != 3 || respBody.Result.Tiers[0].Documents != 10 {
+		t.Fatalf("expected 3 tiers, got = [%v]", respBody.Result.Tiers)
+	}
+}
@@ -45,7 +45,12 @@ func (r *RedisMongo) DeleteSession(ctx context.Context, sessionId string) error
 }
 
 func (r *RedisMongo) CreateUser(ctx context.Context, userEntity *UserEntity) error {
-	_, err := r.UserDb.InsertOne(ctx, bson.M{"_id": userEntity.UserId, "name": userEntity.Name, "password": userEntity.Password})
+	_, err := r.UserDb.InsertOne(ctx, bson.M{
+		"_id":      userEntity.UserId,
+		"name":     userEntity.Name,
+		"password": userEntity.Password,
+		"timezone": userEntity.Timezone,
+	})
 	if err != nil {
 		return errConflict
 	}
@@ -70,3 +75,29 @@ func (r *RedisMongo) GetUser(ctx context.Context, sessionId string) (string, err
 
 	return result, nil
 }
+
+func (r *RedisMongo) SetTimezone(ctx context.Context, userId string, timezone string) error {
+	res, err := r.UserDb.UpdateOne(ctx, bson.M{"_id": userId}, bson.M{"$set": bson.M{"timezone": timezone}})
+	if err != nil {
+		return err
+	}
+
+	if res.MatchedCount == 0 {
+		return errUserDoesNotExist
+	}
+
+	return nil
+}
+
+func (r *RedisMongo) IsAdmin(ctx context.Context, userId string) (bool, error) {
+	res := r.UserDb.FindOne(ctx, bson.M{"_id": userId, "admin": true})
+	if res.Err() != nil {
+		if res.Err() == mongo.ErrNoDocuments {
+			return false, nil
+		}
+
+		return false, res.Err()
+	}
+
+	return true, nil
+}
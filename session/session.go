@@ -4,14 +4,21 @@ import (
 	"context"
 	"errors"
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
 	"github.com/google/uuid"
 	"net/http"
 	"strings"
+	"time"
 )
 
 func RegisterRoutes(handler *Handler, engine *gin.Engine) {
+	if err := addValidation(); err != nil {
+		panic("can't register Session endpoint routes")
+	}
 
 	engine.POST("api/v1/user", handler.CreateUser)
+	engine.PUT("api/v1/user/timezone", handler.GetUser, handler.SetTimezone)
 
 	group := engine.Group("api/v1/session")
 	group.POST("", handler.CreateSession)
@@ -23,6 +30,32 @@ type UserEntity struct {
 	UserId   string `json:"user_id" bson:"_id"`
 	Name     string `json:"name" bson:"name" binding:"required"`
 	Password string `json:"password" bson:"password" binding:"required"`
+	Timezone string `json:"timezone" bson:"timezone" binding:"omitempty,timezone"`
+}
+
+// Body for SetTimezone
+type timezoneBody struct {
+	Timezone string `json:"timezone" binding:"required,timezone"`
+}
+
+func addValidation() error {
+	validate := binding.Validator.Engine().(*validator.Validate)
+	return validate.RegisterValidation("timezone", timezone)
+}
+
+// Timezone must be an IANA name that can be loaded, e.g. Asia/Bangkok
+// Local is refused, it is whatever timezone the server runs in and can change under the user
+func timezone(fl validator.FieldLevel) bool {
+	name := fl.Field().String()
+	if name == "Local" {
+		return false
+	}
+
+	if _, err := time.LoadLocation(name); err != nil {
+		return false
+	}
+
+	return true
 }
 
 // Repo type interacts with data source that has session database
@@ -34,6 +67,11 @@ type Repo interface {
 	CreateUser(context.Context, *UserEntity) error
 
 	GetUser(context.Context, string) (string, error)
+
+	SetTimezone(context.Context, string, string) error
+
+	// IsAdmin tells whether the user can use admin endpoints, admins are marked in the data source by hand
+	IsAdmin(context.Context, string) (bool, error)
 }
 
 var (
@@ -44,12 +82,14 @@ var (
 
 // Handler message responses
 const (
-	resCreate = "session created"
-	resDelete = "session deleted"
+	resCreate   = "session created"
+	resDelete   = "session deleted"
+	resTimezone = "timezone updated"
 
 	resInvalid  = "bad format"
 	resInternal = "not your fault, internal error"
 	resNotAuth  = "not authorized"
+	resNotAdmin = "admin only"
 )
 
 // Handler stores Repo type that interacts with data source
@@ -139,3 +179,49 @@ func (h *Handler) GetUser(ctx *gin.Context) {
 
 	ctx.Set("userId", userId)
 }
+
+// RequireAdmin is the middleware that only lets admins through, it goes after GetUser
+func (h *Handler) RequireAdmin(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": resNotAuth})
+		return
+	}
+
+	admin, err := h.Repo.IsAdmin(ctx, userId)
+	if err != nil {
+		ctx.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	if !admin {
+		ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": resNotAdmin})
+	}
+}
+
+// SetTimezone changes the timezone used to interpret the user's schedules
+func (h *Handler) SetTimezone(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	body := &timezoneBody{}
+	if err := ctx.ShouldBindJSON(body); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	if err := h.Repo.SetTimezone(ctx, userId, body.Timezone); err != nil {
+		if err == errUserDoesNotExist {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": "user does not exist"})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resTimezone, "timezone": body.Timezone})
+}
@@ -0,0 +1,33 @@
+package session
+
+import (
+	"github.com/go-playground/validator/v10"
+	"testing"
+)
+
+// Test timezone validation takes IANA names and refuses the timezone of the server
+func TestTimezone(t *testing.T) {
+	validate := validator.New()
+	validate.SetTagName("binding")
+	if err := validate.RegisterValidation("timezone", timezone); err != nil {
+		t.Fatalf("expected no error, got = [%v]", err)
+	}
+
+	testCases := []struct {
+		timezone string
+		valid    bool
+	}{
+		{timezone: "Asia/Bangkok", valid: true},
+		{timezone: "UTC", valid: true},
+		{timezone: "Local"},
+		{timezone: "Mars/Olympus_Mons"},
+		{timezone: ""},
+	}
+
+	for i, c := range testCases {
+		err := validate.Struct(&timezoneBody{Timezone: c.timezone})
+		if (err == nil) != c.valid {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.valid, err)
+		}
+	}
+}
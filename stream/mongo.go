@@ -0,0 +1,14 @@
+package stream
+
+import (
+	"context"
+	"github.com/tPhume/ags-backend/lookup"
+)
+
+type MongoRepo struct {
+	Lookup *lookup.MongoRepo
+}
+
+func (m *MongoRepo) ControllerExist(ctx context.Context, userId string, controllerId string) error {
+	return m.Lookup.FindController(ctx, userId, controllerId, &struct{}{})
+}
@@ -0,0 +1,92 @@
+package stream
+
+import (
+	"context"
+	"github.com/go-redis/redis/v7"
+	"time"
+)
+
+// RedisBroker uses Redis pub/sub, messages are only seen by replicas subscribed at the time
+type RedisBroker struct {
+	Client *redis.Client
+}
+
+func (r *RedisBroker) Publish(channel string, payload []byte) error {
+	return r.Client.Publish(channel, payload).Err()
+}
+
+func (r *RedisBroker) Subscribe(ctx context.Context, pattern string, fn func(channel string, payload []byte)) error {
+	pubSub := r.Client.PSubscribe(pattern)
+	defer pubSub.Close()
+
+	// Wait for the subscription to be confirmed so that a bad connection is reported
+	if _, err := pubSub.Receive(); err != nil {
+		return err
+	}
+
+	// The channel resubscribes by itself when the connection drops
+	messages := pubSub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case m, ok := <-messages:
+			if !ok {
+				return nil
+			}
+
+			fn(m.Channel, []byte(m.Payload))
+		}
+	}
+}
+
+// Open streams of a user are counted in connectionPrefix + userId
+const connectionPrefix = "ags:stream:connections:"
+
+// RedisLimiter caps the open streams of each user across replicas
+type RedisLimiter struct {
+	Client *redis.Client
+	Max    int
+
+	// TTL should be a few heartbeats, the count of a user disappears when no stream refreshes it for that long
+	TTL time.Duration
+}
+
+func (r *RedisLimiter) Acquire(userId string) (bool, error) {
+	key := connectionPrefix + userId
+
+	count, err := r.Client.Incr(key).Result()
+	if err != nil {
+		return false, err
+	}
+
+	if err := r.Client.Expire(key, r.TTL).Err(); err != nil {
+		return false, err
+	}
+
+	if count > int64(r.Max) {
+		return false, r.Client.Decr(key).Err()
+	}
+
+	return true, nil
+}
+
+func (r *RedisLimiter) Refresh(userId string) error {
+	return r.Client.Expire(connectionPrefix+userId, r.TTL).Err()
+}
+
+func (r *RedisLimiter) Release(userId string) error {
+	key := connectionPrefix + userId
+
+	count, err := r.Client.Decr(key).Result()
+	if err != nil {
+		return err
+	}
+
+	// The count expired while the stream was open, start again from nothing
+	if count < 0 {
+		return r.Client.Del(key).Err()
+	}
+
+	return nil
+}
@@ -0,0 +1,301 @@
+// Package stream pushes live events of a controller to clients over Server-Sent Events
+// Events are published to Redis so that every backend replica can deliver them to its own clients
+package stream
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/tPhume/ags-backend/bridge"
+	"github.com/tPhume/ags-backend/data"
+	"github.com/tPhume/ags-backend/lookup"
+	"github.com/tPhume/ags-backend/session"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+func RegisterRoutes(handler *Handler, engine *gin.Engine, sessionHandler *session.Handler) {
+	engine.GET("api/v1/data/:controllerId/stream", sessionHandler.GetUser, handler.GetStream)
+}
+
+// Types of events
+const (
+	EventReading = "reading"
+	EventStatus  = "status"
+	EventAck     = "ack"
+)
+
+// Events of a controller are published to channelPrefix + controllerId
+const (
+	channelPrefix  = "ags:stream:"
+	channelPattern = channelPrefix + "*"
+)
+
+// Events waiting for a slow client, a client that falls further behind is disconnected and has to reconnect
+const subscriberBuffer = 32
+
+// Event is sent to clients as the data of a Server-Sent Event named after its type
+type Event struct {
+	Type         string      `json:"type"`
+	ControllerId string      `json:"controller_id"`
+	Timestamp    time.Time   `json:"timestamp"`
+	Data         interface{} `json:"data,omitempty"`
+}
+
+// Broker carries events between replicas
+type Broker interface {
+	Publish(channel string, payload []byte) error
+
+	// Subscribe calls fn with every message published on a channel matching pattern until ctx is done
+	Subscribe(ctx context.Context, pattern string, fn func(channel string, payload []byte)) error
+}
+
+// Limiter counts the open streams of each user across replicas
+type Limiter interface {
+	// Acquire takes a connection for userId, false when the user is already at the cap
+	Acquire(userId string) (bool, error)
+
+	// Refresh is called on every heartbeat so that counts of crashed replicas expire
+	Refresh(userId string) error
+
+	Release(userId string) error
+}
+
+// Stream publishes events and delivers them to the clients connected to this replica
+// It is the Notifier of the data, controller and bridge handlers
+type Stream struct {
+	Broker Broker
+
+	mu          sync.Mutex
+	subscribers map[string]map[*subscriber]struct{}
+}
+
+type message struct {
+	event   string
+	payload []byte
+}
+
+type subscriber struct {
+	messages chan message
+
+	// closed once the subscriber fell behind and was dropped
+	dropped chan struct{}
+}
+
+// Run delivers events from the broker to local clients until ctx is done
+func (s *Stream) Run(ctx context.Context) error {
+	return s.Broker.Subscribe(ctx, channelPattern, func(channel string, payload []byte) {
+		event := &struct {
+			Type string `json:"type"`
+		}{}
+
+		if err := json.Unmarshal(payload, event); err != nil {
+			log.Printf("stream: bad event on %s: %s", channel, err)
+			return
+		}
+
+		s.deliver(strings.TrimPrefix(channel, channelPrefix), message{event: event.Type, payload: payload})
+	})
+}
+
+// Publish sends the event to every replica
+func (s *Stream) Publish(event *Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return s.Broker.Publish(channelPrefix+event.ControllerId, payload)
+}
+
+// ReadingsAdded publishes new readings as one event each
+func (s *Stream) ReadingsAdded(ctx context.Context, controllerId string, userId string, readings []*data.Reading) {
+	for _, reading := range readings {
+		s.publish(&Event{Type: EventReading, ControllerId: controllerId, Timestamp: reading.Timestamp, Data: reading})
+	}
+}
+
+// ControllerChanged publishes a status event, clients should fetch the controller again
+func (s *Stream) ControllerChanged(ctx context.Context, userId string, controllerId string) {
+	s.publish(&Event{Type: EventStatus, ControllerId: controllerId, Timestamp: time.Now()})
+}
+
+// CommandAcknowledged publishes the acknowledgement a controller sent for a command
+func (s *Stream) CommandAcknowledged(ctx context.Context, controllerId string, ack *bridge.Ack) {
+	s.publish(&Event{Type: EventAck, ControllerId: controllerId, Timestamp: time.Now(), Data: ack})
+}
+
+// publish logs failures, the event has already happened and only live clients miss it
+func (s *Stream) publish(event *Event) {
+	if err := s.Publish(event); err != nil {
+		log.Printf("stream: could not publish %s event of %s: %s", event.Type, event.ControllerId, err)
+	}
+}
+
+func (s *Stream) subscribe(controllerId string) *subscriber {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.subscribers == nil {
+		s.subscribers = make(map[string]map[*subscriber]struct{})
+	}
+
+	if s.subscribers[controllerId] == nil {
+		s.subscribers[controllerId] = make(map[*subscriber]struct{})
+	}
+
+	sub := &subscriber{messages: make(chan message, subscriberBuffer), dropped: make(chan struct{})}
+	s.subscribers[controllerId][sub] = struct{}{}
+
+	return sub
+}
+
+func (s *Stream) unsubscribe(controllerId string, sub *subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.subscribers[controllerId], sub)
+	if len(s.subscribers[controllerId]) == 0 {
+		delete(s.subscribers, controllerId)
+	}
+}
+
+// deliver never blocks, so one slow client can't hold up the others
+func (s *Stream) deliver(controllerId string, m message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for sub := range s.subscribers[controllerId] {
+		select {
+		case sub.messages <- m:
+		default:
+			close(sub.dropped)
+			delete(s.subscribers[controllerId], sub)
+		}
+	}
+}
+
+// Repo interface for data source
+// Errors that should be used with Repo interface
+var errControllerNotFound = lookup.ErrControllerNotFound
+
+type Repo interface {
+	// ControllerExist checks that the controller belongs to userId
+	ControllerExist(ctx context.Context, userId string, controllerId string) error
+}
+
+// Handler for stream REST API
+// Response messages to use
+const (
+	// Error responses
+	resInvalid            = "invalid format"
+	resInternal           = "internal error"
+	resControllerNotFound = "controller not found"
+	resTooManyStreams     = "too many open streams"
+)
+
+type Handler struct {
+	Repo    Repo
+	Stream  *Stream
+	Limiter Limiter
+
+	// Heartbeat is how often a comment is sent to keep idle connections open
+	Heartbeat time.Duration
+}
+
+// GetStream sends the events of a controller until the client goes away
+func (h *Handler) GetStream(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	controllerId := ctx.Param("controllerId")
+	if _, err := uuid.Parse(controllerId); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	if err := h.Repo.ControllerExist(ctx, userId, controllerId); err != nil {
+		if err == errControllerNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resControllerNotFound})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	ok, err := h.Limiter.Acquire(userId)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	} else if !ok {
+		ctx.JSON(http.StatusTooManyRequests, gin.H{"message": resTooManyStreams})
+		return
+	}
+
+	defer func() {
+		if err := h.Limiter.Release(userId); err != nil {
+			log.Printf("stream: could not release connection of %s: %s", userId, err)
+		}
+	}()
+
+	sub := h.Stream.subscribe(controllerId)
+	defer h.Stream.unsubscribe(controllerId, sub)
+
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("Connection", "keep-alive")
+
+	// Proxies such as nginx would otherwise hold events back
+	ctx.Header("X-Accel-Buffering", "no")
+
+	ctx.Status(http.StatusOK)
+	if !comment(ctx, "connected") {
+		return
+	}
+
+	heartbeat := time.NewTicker(h.Heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Request.Context().Done():
+			return
+		case <-sub.dropped:
+			return
+		case <-heartbeat.C:
+			if !comment(ctx, "heartbeat") {
+				return
+			}
+
+			if err := h.Limiter.Refresh(userId); err != nil {
+				log.Printf("stream: could not refresh connection of %s: %s", userId, err)
+			}
+		case m := <-sub.messages:
+			if _, err := fmt.Fprintf(ctx.Writer, "event: %s\ndata: %s\n\n", m.event, m.payload); err != nil {
+				return
+			}
+
+			ctx.Writer.Flush()
+		}
+	}
+}
+
+// comment writes an SSE comment, which clients ignore, and reports whether the client is still there
+func comment(ctx *gin.Context, text string) bool {
+	if _, err := io.WriteString(ctx.Writer, ": "+text+"\n\n"); err != nil {
+		return false
+	}
+
+	ctx.Writer.Flush()
+	return true
+}
@@ -0,0 +1,212 @@
+package stream
+
+import (
+	"bufio"
+	"context"
+	"github.com/gin-gonic/gin"
+	"github.com/tPhume/ags-backend/bridge"
+	"github.com/tPhume/ags-backend/data"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	controllerId = "f1d67e51-4ca4-4b25-a4b7-6c8f06822075"
+	userId       = "76de6d55-e457-4070-8aef-5633726d498f"
+)
+
+// Repo struct for testing, has a single controller
+type repoStruct struct{}
+
+func (r *repoStruct) ControllerExist(ctx context.Context, user string, id string) error {
+	if user == userId && id == controllerId {
+		return nil
+	}
+
+	return errControllerNotFound
+}
+
+// Broker struct for testing, delivers in process like a single Redis would
+type brokerStruct struct {
+	mu      sync.Mutex
+	fn      func(channel string, payload []byte)
+	pattern string
+	ready   chan struct{}
+}
+
+func (b *brokerStruct) Publish(channel string, payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.fn != nil && strings.HasPrefix(channel, strings.TrimSuffix(b.pattern, "*")) {
+		b.fn(channel, payload)
+	}
+
+	return nil
+}
+
+func (b *brokerStruct) Subscribe(ctx context.Context, pattern string, fn func(channel string, payload []byte)) error {
+	b.mu.Lock()
+	b.fn, b.pattern = fn, pattern
+	b.mu.Unlock()
+
+	close(b.ready)
+	<-ctx.Done()
+	return nil
+}
+
+// Limiter struct for testing, counts connections in memory
+type limiterStruct struct {
+	mu    sync.Mutex
+	max   int
+	count map[string]int
+}
+
+func (l *limiterStruct) Acquire(user string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.count[user] >= l.max {
+		return false, nil
+	}
+
+	l.count[user]++
+	return true, nil
+}
+
+func (l *limiterStruct) Refresh(user string) error {
+	return nil
+}
+
+func (l *limiterStruct) Release(user string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.count[user]--
+	return nil
+}
+
+func setUp(t *testing.T) (*Stream, *httptest.Server, func()) {
+	gin.SetMode(gin.TestMode)
+
+	broker := &brokerStruct{ready: make(chan struct{})}
+	s := &Stream{Broker: broker}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		_ = s.Run(ctx)
+	}()
+	<-broker.ready
+
+	handler := &Handler{
+		Repo:      &repoStruct{},
+		Stream:    s,
+		Limiter:   &limiterStruct{max: 1, count: map[string]int{}},
+		Heartbeat: 50 * time.Millisecond,
+	}
+
+	engine := gin.New()
+	engine.Use(func(ctx *gin.Context) {
+		ctx.Set("userId", userId)
+	})
+	engine.GET(":controllerId", handler.GetStream)
+
+	server := httptest.NewServer(engine)
+	return s, server, func() {
+		server.Close()
+		cancel()
+	}
+}
+
+// readUntil reads lines of the stream until one starts with prefix
+func readUntil(t *testing.T, reader *bufio.Reader, prefix string) string {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("expected [%v], got = [%v]", prefix, err)
+		}
+
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimSpace(line)
+		}
+	}
+}
+
+// Test events of the controller reach an open stream, with heartbeats in between
+func TestHandler_GetStream(t *testing.T) {
+	s, server, tearDown := setUp(t)
+	defer tearDown()
+
+	resp, err := http.Get(server.URL + "/" + controllerId)
+	if err != nil {
+		t.Fatalf("could not open stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected [%v], got = [%v]", http.StatusOK, resp.StatusCode)
+	}
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("expected [%v], got = [%v]", "text/event-stream", contentType)
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	readUntil(t, reader, ": connected")
+
+	s.ReadingsAdded(context.Background(), controllerId, userId, []*data.Reading{{Timestamp: time.Now(), Metrics: map[string]float64{"temperature": 25}}})
+	readUntil(t, reader, "event: reading")
+	if line := readUntil(t, reader, "data: "); !strings.Contains(line, `"temperature":25`) {
+		t.Fatalf("unexpected data [%v]", line)
+	}
+
+	// Events of other controllers are not sent
+	s.ControllerChanged(context.Background(), userId, userId)
+	s.CommandAcknowledged(context.Background(), controllerId, &bridge.Ack{CommandId: "1", Status: "done"})
+	if line := readUntil(t, reader, "event: "); line != "event: ack" {
+		t.Fatalf("expected [%v], got = [%v]", "event: ack", line)
+	}
+
+	readUntil(t, reader, ": heartbeat")
+
+	// A second stream is over the cap of one
+	second, err := http.Get(server.URL + "/" + controllerId)
+	if err != nil {
+		t.Fatalf("could not open stream: %v", err)
+	}
+	_ = second.Body.Close()
+
+	if second.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected [%v], got = [%v]", http.StatusTooManyRequests, second.StatusCode)
+	}
+}
+
+// Test streams are only opened for the user's own controllers
+func TestHandler_GetStream_NotFound(t *testing.T) {
+	_, server, tearDown := setUp(t)
+	defer tearDown()
+
+	testCases := []struct {
+		controllerId string
+		code         int
+	}{
+		{controllerId: userId, code: http.StatusNotFound},
+		{controllerId: "fewfe", code: http.StatusBadRequest},
+	}
+
+	for i, c := range testCases {
+		resp, err := http.Get(server.URL + "/" + c.controllerId)
+		if err != nil {
+			t.Fatalf("Case %d: could not open stream: %v", i, err)
+		}
+		_ = resp.Body.Close()
+
+		if c.code != resp.StatusCode {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.code, resp.StatusCode)
+		}
+	}
+}
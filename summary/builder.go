@@ -0,0 +1,317 @@
+package summary
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/tPhume/ags-backend/controller"
+	"github.com/tPhume/ags-backend/data"
+	"github.com/tPhume/ags-backend/lookup"
+	"github.com/tPhume/ags-backend/metric"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// BuildController is what the Builder needs to know about a controller
+type BuildController struct {
+	ControllerId string              `bson:"_id"`
+	UserId       string              `bson:"user_id"`
+	Sensors      []metric.Sensor     `bson:"sensors"`
+	Growing      *controller.Growing `bson:"growing"`
+}
+
+// Light readings further apart than this are a gap, nothing is added to DLI for it
+const maxLightGap = time.Hour
+
+// BuilderRepo is where the Builder reads readings from and writes summaries to
+type BuilderRepo interface {
+	ListControllers(ctx context.Context) ([]*BuildController, error)
+
+	lookup.Timezones
+
+	EachReading(ctx context.Context, userId string, controllerId string, from time.Time, to time.Time, fn func(*data.Reading) error) error
+
+	// UpsertSummary replaces the summary of the controller for its date, or adds it
+	UpsertSummary(ctx context.Context, summary *Summary) error
+}
+
+var errDateRange = errors.New("from must be a date before to")
+
+// Notifier is told about summaries once they are written
+type Notifier interface {
+	SummaryBuilt(ctx context.Context, summary *Summary)
+}
+
+// Builder computes daily summaries from stored readings
+// Days are those of the timezone of the user, and building a day again replaces its summary
+type Builder struct {
+	Repo BuilderRepo
+
+	// Notifier is optional
+	Notifier Notifier
+}
+
+// BuildYesterday builds the last whole day of every controller as of now
+func (b *Builder) BuildYesterday(ctx context.Context, now time.Time) (int, error) {
+	return b.build(ctx, func(location *time.Location) ([]string, error) {
+		return []string{now.In(location).AddDate(0, 0, -1).Format(dateLayout)}, nil
+	})
+}
+
+// Backfill builds every controller for every date from one to another inclusive
+func (b *Builder) Backfill(ctx context.Context, from string, to string) (int, error) {
+	dates, err := dateRange(from, to)
+	if err != nil {
+		return 0, err
+	}
+
+	return b.build(ctx, func(*time.Location) ([]string, error) {
+		return dates, nil
+	})
+}
+
+// build returns how many summaries were written, days without readings have none
+// A controller that fails is logged and skipped so the others are still built, the error then says how many failed
+func (b *Builder) build(ctx context.Context, datesIn func(*time.Location) ([]string, error)) (int, error) {
+	controllers, err := b.Repo.ListControllers(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	locations := make(map[string]*time.Location)
+	built, failed := 0, 0
+
+	for _, c := range controllers {
+		written, err := b.buildController(ctx, c, locations, datesIn)
+		built += written
+
+		if err != nil {
+			log.Printf("summary: could not build %s: %s", c.ControllerId, err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return built, fmt.Errorf("%d of %d controllers could not be built", failed, len(controllers))
+	}
+
+	return built, nil
+}
+
+// buildController builds the dates of one controller, locations caches the location of each user
+func (b *Builder) buildController(ctx context.Context, c *BuildController, locations map[string]*time.Location, datesIn func(*time.Location) ([]string, error)) (int, error) {
+	location, ok := locations[c.UserId]
+	if !ok {
+		timezone, err := b.Repo.GetTimezone(ctx, c.UserId)
+		if err != nil {
+			return 0, err
+		}
+
+		if location, err = time.LoadLocation(timezone); err != nil {
+			location = time.UTC
+		}
+
+		locations[c.UserId] = location
+	}
+
+	dates, err := datesIn(location)
+	if err != nil {
+		return 0, err
+	}
+
+	built := 0
+	for _, date := range dates {
+		summary, err := b.BuildDay(ctx, c, date, location)
+		if err != nil {
+			return built, err
+		}
+
+		if summary == nil {
+			continue
+		}
+
+		if err := b.Repo.UpsertSummary(ctx, summary); err != nil {
+			return built, err
+		}
+
+		if b.Notifier != nil {
+			b.Notifier.SummaryBuilt(ctx, summary)
+		}
+
+		built++
+	}
+
+	return built, nil
+}
+
+// BuildDay computes the summary of a controller for a date in location, nil when there were no good readings
+func (b *Builder) BuildDay(ctx context.Context, c *BuildController, date string, location *time.Location) (*Summary, error) {
+	start, err := time.ParseInLocation(dateLayout, date, location)
+	if err != nil {
+		return nil, err
+	}
+
+	sensors := metric.Sensors(c.Sensors)
+	keys := metric.WithDerived(sensors)
+	values := make(map[string][]float64, len(keys))
+
+	light, hasLight := metric.FirstSensor(sensors, "light")
+	dli := &integral{perUnit: c.Growing.PpfdPerLux()}
+
+	err = b.Repo.EachReading(ctx, c.UserId, c.ControllerId, start, start.AddDate(0, 0, 1), func(reading *data.Reading) error {
+		data.Derive(reading, sensors)
+
+		for _, sensor := range keys {
+			if value, ok := reading.GoodValue(sensor.Key); ok {
+				values[sensor.Key] = append(values[sensor.Key], value)
+			}
+		}
+
+		if value, ok := reading.GoodValue(light); hasLight && ok {
+			dli.add(reading.Timestamp, value)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	summary := &Summary{
+		UserId:       c.UserId,
+		ControllerId: c.ControllerId,
+		Date:         date,
+		Metrics:      make(map[string]*Stats, len(values)+2),
+	}
+
+	for key, sensorValues := range values {
+		summary.Metrics[key] = newStats(sensorValues)
+	}
+
+	// DLI and GDD are one value for the whole day, unless a sensor is keyed like them
+	if _, taken := summary.Metrics[metric.DLI]; !taken && dli.samples > 0 {
+		summary.Metrics[metric.DLI] = dailyValue(dli.sum / 1e6)
+	}
+
+	temperature, ok := metric.FirstSensor(sensors, "temperature")
+	if stats, measured := summary.Metrics[temperature]; ok && measured {
+		if _, taken := summary.Metrics[metric.GDD]; !taken {
+			summary.Metrics[metric.GDD] = dailyValue(metric.DegreeDays(stats.Min, stats.Max, c.Growing.Base()))
+		}
+	}
+
+	for key, stats := range summary.Metrics {
+		summary.setLegacy(key, stats.Mean, stats.Median)
+	}
+
+	return summary, nil
+}
+
+func newStats(values []float64) *Stats {
+	sort.Float64s(values)
+
+	sum := 0.0
+	for _, value := range values {
+		sum += value
+	}
+
+	mean := sum / float64(len(values))
+
+	squares := 0.0
+	for _, value := range values {
+		squares += (value - mean) * (value - mean)
+	}
+
+	return &Stats{
+		Mean:   mean,
+		Median: percentile(values, 0.5),
+		Min:    values[0],
+		Max:    values[len(values)-1],
+		StdDev: math.Sqrt(squares / float64(len(values))),
+		P10:    percentile(values, 0.1),
+		P90:    percentile(values, 0.9),
+		Count:  len(values),
+	}
+}
+
+// dailyValue is the statistics of a value there is one of per day
+func dailyValue(value float64) *Stats {
+	return &Stats{Mean: value, Median: value, Min: value, Max: value, P10: value, P90: value, Count: 1}
+}
+
+// integral adds up a series over time by the trapezoid rule, in units per second
+type integral struct {
+	perUnit float64
+	sum     float64
+	samples int
+
+	last      time.Time
+	lastValue float64
+}
+
+func (i *integral) add(timestamp time.Time, value float64) {
+	value *= i.perUnit
+
+	if gap := timestamp.Sub(i.last); i.samples > 0 && gap > 0 && gap <= maxLightGap {
+		i.sum += (i.lastValue + value) / 2 * gap.Seconds()
+	}
+
+	i.last, i.lastValue = timestamp, value
+	i.samples++
+}
+
+// percentile interpolates between the two closest ranks of sorted values
+func percentile(sorted []float64, q float64) float64 {
+	position := q * float64(len(sorted)-1)
+	lower := int(math.Floor(position))
+	upper := int(math.Ceil(position))
+
+	return sorted[lower] + (sorted[upper]-sorted[lower])*(position-float64(lower))
+}
+
+// setLegacy fills the fixed fields of a legacy sensor, the reverse of Stat
+func (s *Summary) setLegacy(key string, mean float64, median float64) {
+	switch key {
+	case "temperature":
+		s.MeanTemperature, s.MedianTemperature = mean, median
+	case "humidity":
+		s.MeanHumidity, s.MedianHumidity = mean, median
+	case "light":
+		s.MeanLight, s.MedianLight = mean, median
+	case "soil_moisture":
+		s.MeanSoilMoisture, s.MedianSoilMoisture = mean, median
+	case "water_level":
+		s.MeanWaterLevel, s.MedianWaterLevel = mean, median
+	}
+}
+
+// dateRange returns every date from one to another inclusive
+func dateRange(from string, to string) ([]string, error) {
+	first, err := time.Parse(dateLayout, from)
+	if err != nil {
+		return nil, err
+	}
+
+	last, err := time.Parse(dateLayout, to)
+	if err != nil {
+		return nil, err
+	}
+
+	if last.Before(first) {
+		return nil, errDateRange
+	}
+
+	dates := make([]string, 0)
+	for day := first; !day.After(last); day = day.AddDate(0, 0, 1) {
+		dates = append(dates, day.Format(dateLayout))
+	}
+
+	return dates, nil
+}
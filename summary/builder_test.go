@@ -0,0 +1,160 @@
+package summary
+
+import (
+	"context"
+	"errors"
+	"github.com/tPhume/ags-backend/controller"
+	"github.com/tPhume/ags-backend/data"
+	"github.com/tPhume/ags-backend/metric"
+	"math"
+	"testing"
+	"time"
+)
+
+type builderRepoStruct struct {
+	summaries map[string]*Summary
+
+	// broken is a controller whose readings can't be read
+	broken string
+}
+
+func (b *builderRepoStruct) ListControllers(ctx context.Context) ([]*BuildController, error) {
+	return []*BuildController{
+		{ControllerId: "legacy", UserId: "bangkok", Growing: &controller.Growing{Crop: "lettuce"}},
+		{ControllerId: "rig", UserId: "utc", Sensors: []metric.Sensor{{Key: "co2", Metric: "co2"}}},
+	}, nil
+}
+
+func (b *builderRepoStruct) GetTimezone(ctx context.Context, userId string) (string, error) {
+	if userId == "bangkok" {
+		return "Asia/Bangkok", nil
+	}
+
+	return "", nil
+}
+
+// A reading every hour of the 15th and 16th of April UTC, the temperature is the hour of the day
+func (b *builderRepoStruct) EachReading(ctx context.Context, userId string, controllerId string, from time.Time, to time.Time, fn func(*data.Reading) error) error {
+	if controllerId == b.broken {
+		return errors.New("connection reset")
+	}
+
+	first := time.Date(2020, time.April, 15, 0, 0, 0, 0, time.UTC)
+
+	for hour := 0; hour < 48; hour++ {
+		timestamp := first.Add(time.Duration(hour) * time.Hour)
+		if timestamp.Before(from) || !timestamp.Before(to) {
+			continue
+		}
+
+		reading := &data.Reading{Timestamp: timestamp, Metrics: map[string]float64{"temperature": float64(timestamp.Hour()), "humidity": 50, "light": 10000, "co2": 400}}
+
+		// A flagged value doesn't count
+		if timestamp.Hour() == 12 {
+			reading.Quality = map[string]string{"temperature": data.FlagRate, "co2": data.FlagRate}
+		}
+
+		if err := fn(reading); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (b *builderRepoStruct) UpsertSummary(ctx context.Context, summary *Summary) error {
+	b.summaries[summary.ControllerId+":"+summary.Date] = summary
+	return nil
+}
+
+// Test days are cut at midnight of the timezone of the user and backfills can be repeated
+func TestBuilder_Backfill(t *testing.T) {
+	repo := &builderRepoStruct{summaries: map[string]*Summary{}}
+	builder := &Builder{Repo: repo}
+
+	for run := 0; run < 2; run++ {
+		built, err := builder.Backfill(context.Background(), "2020-04-14", "2020-04-17")
+		if err != nil {
+			t.Fatalf("expected no error, got = [%v]", err)
+		}
+
+		// Bangkok is 7 hours ahead, so the readings span three of its days
+		if built != 5 || len(repo.summaries) != 5 {
+			t.Fatalf("Run %d: expected [5 5], got = [%v %v]", run, built, len(repo.summaries))
+		}
+	}
+
+	testCases := []struct {
+		key    string
+		mean   float64
+		median float64
+	}{
+		// 07:00 to 23:00 of the 15th in Bangkok are 0 to 16 UTC, without 12
+		{key: "legacy:2020-04-15", mean: 7.75, median: 7.5},
+		// The whole of the 16th in Bangkok is 17 to 23 and 0 to 16 UTC, without 12
+		{key: "legacy:2020-04-16", mean: 11.478260869565217, median: 11},
+	}
+
+	for i, c := range testCases {
+		summary := repo.summaries[c.key]
+		if summary.MeanTemperature != c.mean || summary.MedianTemperature != c.median {
+			t.Fatalf("Case %d: expected [%v %v], got = [%v %v]", i, c.mean, c.median, summary.MeanTemperature, summary.MedianTemperature)
+		}
+	}
+
+	// 0 to 16 without 12
+	stats := repo.summaries["legacy:2020-04-15"].Metrics["temperature"]
+	if stats.Count != 16 || stats.Min != 0 || stats.Max != 16 || stats.P10 != 1.5 || stats.P90 != 14.5 {
+		t.Fatalf("expected [16 0 16 1.5 14.5], got = [%+v]", stats)
+	}
+
+	// Sixteen hours of sunlight at 10000 lux, and a mean of 8 °C over the 4.4 °C of lettuce
+	derived := repo.summaries["legacy:2020-04-15"].Metrics
+	if math.Abs(derived[metric.DLI].Mean-10.656) > 1e-9 || math.Abs(derived[metric.GDD].Mean-3.6) > 1e-9 || derived[metric.VPD].Count != 16 {
+		t.Fatalf("expected [10.656 3.6 16], got = [%v %v %v]", derived[metric.DLI].Mean, derived[metric.GDD].Mean, derived[metric.VPD].Count)
+	}
+
+	// Controllers that declare sensors only get those
+	rig := repo.summaries["rig:2020-04-15"]
+	if _, ok := rig.Metrics["temperature"]; ok || rig.Metrics["co2"].Mean != 400 || rig.Metrics["co2"].StdDev != 0 {
+		t.Fatalf("expected only co2, got = [%v]", rig.Metrics)
+	}
+
+	if _, err := builder.Backfill(context.Background(), "2020-04-17", "2020-04-14"); err == nil {
+		t.Fatalf("expected an error for a backwards range")
+	}
+}
+
+// Test yesterday is yesterday in the timezone of the user
+func TestBuilder_BuildYesterday(t *testing.T) {
+	repo := &builderRepoStruct{summaries: map[string]*Summary{}}
+	builder := &Builder{Repo: repo}
+
+	// Already the 17th in Bangkok but still the 16th in UTC
+	now := time.Date(2020, time.April, 16, 20, 0, 0, 0, time.UTC)
+	if _, err := builder.BuildYesterday(context.Background(), now); err != nil {
+		t.Fatalf("expected no error, got = [%v]", err)
+	}
+
+	for _, key := range []string{"legacy:2020-04-16", "rig:2020-04-15"} {
+		if _, ok := repo.summaries[key]; !ok {
+			t.Fatalf("expected summary [%v], got = [%v]", key, repo.summaries)
+		}
+	}
+}
+
+// Test a controller that fails is skipped and the others are still built
+func TestBuilder_BuildSkipsFailed(t *testing.T) {
+	repo := &builderRepoStruct{summaries: map[string]*Summary{}, broken: "legacy"}
+	builder := &Builder{Repo: repo}
+
+	built, err := builder.Backfill(context.Background(), "2020-04-14", "2020-04-17")
+	if err == nil {
+		t.Fatalf("expected an error for the broken controller")
+	}
+
+	// The rig in UTC has readings on two days
+	if built != 2 || len(repo.summaries) != 2 || repo.summaries["rig:2020-04-16"] == nil {
+		t.Fatalf("expected [2 2], got = [%v %v]", built, repo.summaries)
+	}
+}
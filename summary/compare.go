@@ -0,0 +1,265 @@
+package summary
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/tPhume/ags-backend/metric"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Path of Compare under api/v1/summary
+const compareRoute = "compare"
+
+// Limits of one comparison
+const (
+	maxCompareControllers = 10
+	maxCompareDays        = 92
+)
+
+var resCompare = "comparison retrieved"
+
+// Query for Compare, controllers are comma separated ids and dates are inclusive
+type compareQuery struct {
+	Controllers string `form:"controllers" binding:"required"`
+	Metric      string `form:"metric" binding:"required"`
+	From        string `form:"from" binding:"required"`
+	To          string `form:"to" binding:"required"`
+}
+
+// Comparison lines up the daily means of a metric of several controllers
+// Values and deltas are null on days a controller has no summary or the summary doesn't have the metric
+type Comparison struct {
+	Metric string   `json:"metric"`
+	Unit   string   `json:"unit"`
+	From   string   `json:"from"`
+	To     string   `json:"to"`
+	Dates  []string `json:"dates"`
+
+	// GroupMean is the mean of the controllers that have a value on each date
+	GroupMean []*float64 `json:"group_mean"`
+
+	// Series are in the order the controllers were asked for
+	Series []*ComparedSeries `json:"series"`
+
+	// Ranking has the controllers from the highest mean to the lowest, those without values come last
+	Ranking []string `json:"ranking"`
+}
+
+// ComparedSeries of one controller
+type ComparedSeries struct {
+	ControllerId string `json:"controller_id"`
+	Name         string `json:"name"`
+
+	// Key of the sensor compared, empty when the controller doesn't measure the metric
+	Key string `json:"key"`
+
+	Values []*float64 `json:"values"`
+	Deltas []*float64 `json:"deltas"`
+
+	// Mean over the range and how far it is from the mean of the group over the same days
+	Mean      *float64 `json:"mean"`
+	MeanDelta *float64 `json:"mean_delta"`
+	Rank      int      `json:"rank"`
+}
+
+// Compare lines up the daily summaries of several controllers of the user for one metric
+func (h *Handler) Compare(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	query := &compareQuery{}
+	if err := ctx.ShouldBindQuery(query); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid, "err": err.Error()})
+		return
+	}
+
+	m, ok := metric.Default.Lookup(query.Metric)
+	if !ok {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	controllerIds, ok := parseControllers(query.Controllers)
+	if !ok {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	dates, err := dateRange(query.From, query.To)
+	if err != nil || len(dates) > maxCompareDays {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	// Every controller is checked before anything is read, a foreign one is not found like a missing one
+	series := make([]*ComparedSeries, len(controllerIds))
+	for i, controllerId := range controllerIds {
+		controller, err := h.Repo.GetController(ctx, userId, controllerId)
+		if err != nil {
+			if err == errControllerNotFound {
+				ctx.JSON(http.StatusNotFound, gin.H{"message": resNotFound, "controller_id": controllerId})
+			} else {
+				ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+			}
+
+			return
+		}
+
+		series[i] = &ComparedSeries{
+			ControllerId: controllerId,
+			Name:         controller.Name,
+			Key:          compareKey(controller, m),
+			Values:       make([]*float64, len(dates)),
+			Deltas:       make([]*float64, len(dates)),
+		}
+	}
+
+	index := make(map[string]int, len(dates))
+	for i, date := range dates {
+		index[date] = i
+	}
+
+	for _, s := range series {
+		if s.Key == "" {
+			continue
+		}
+
+		err := h.Repo.EachSummary(ctx, userId, s.ControllerId, query.From, query.To, func(daily *Summary) error {
+			i, ok := index[daily.Date]
+			if !ok {
+				return nil
+			}
+
+			if stats, ok := daily.Stat(s.Key); ok {
+				mean := stats.Mean
+				s.Values[i] = &mean
+			}
+
+			return nil
+		})
+
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+			return
+		}
+	}
+
+	comparison := &Comparison{
+		Metric: m.Name,
+		Unit:   m.Unit,
+		From:   query.From,
+		To:     query.To,
+		Dates:  dates,
+		Series: series,
+	}
+
+	comparison.compare()
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resCompare, "result": comparison})
+}
+
+// parseControllers returns the ids when they are all UUIDs, none is repeated and there aren't too many
+func parseControllers(value string) ([]string, bool) {
+	ids := strings.Split(value, ",")
+	if len(ids) > maxCompareControllers {
+		return nil, false
+	}
+
+	seen := make(map[string]bool, len(ids))
+	for i, id := range ids {
+		ids[i] = strings.TrimSpace(id)
+		if _, err := uuid.Parse(ids[i]); err != nil || seen[ids[i]] {
+			return nil, false
+		}
+
+		seen[ids[i]] = true
+	}
+
+	return ids, true
+}
+
+// compareKey returns the key of the first sensor of the controller that measures m, derived metrics are keyed by name
+func compareKey(controller *Controller, m *metric.Metric) string {
+	sensors := metric.Sensors(controller.Sensors)
+	if m.Derived {
+		for _, sensor := range sensors {
+			if sensor.Key == m.Name {
+				return ""
+			}
+		}
+
+		return m.Name
+	}
+
+	key, _ := metric.FirstSensor(sensors, m.Name)
+	return key
+}
+
+// compare works out the group mean, deltas and ranking from the values
+func (c *Comparison) compare() {
+	c.GroupMean = make([]*float64, len(c.Dates))
+	for i := range c.Dates {
+		sum, count := 0.0, 0
+		for _, s := range c.Series {
+			if s.Values[i] != nil {
+				sum += *s.Values[i]
+				count++
+			}
+		}
+
+		if count == 0 {
+			continue
+		}
+
+		mean := sum / float64(count)
+		c.GroupMean[i] = &mean
+
+		for _, s := range c.Series {
+			if s.Values[i] != nil {
+				delta := *s.Values[i] - mean
+				s.Deltas[i] = &delta
+			}
+		}
+	}
+
+	ranked := make([]*ComparedSeries, 0, len(c.Series))
+	for _, s := range c.Series {
+		sum, group, count := 0.0, 0.0, 0
+		for i, value := range s.Values {
+			if value != nil {
+				sum += *value
+				group += *c.GroupMean[i]
+				count++
+			}
+		}
+
+		if count == 0 {
+			continue
+		}
+
+		mean, delta := sum/float64(count), (sum-group)/float64(count)
+		s.Mean, s.MeanDelta = &mean, &delta
+		ranked = append(ranked, s)
+	}
+
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return *ranked[i].Mean > *ranked[j].Mean
+	})
+
+	c.Ranking = make([]string, 0, len(c.Series))
+	for i, s := range ranked {
+		s.Rank = i + 1
+		c.Ranking = append(c.Ranking, s.ControllerId)
+	}
+
+	for _, s := range c.Series {
+		if s.Mean == nil {
+			c.Ranking = append(c.Ranking, s.ControllerId)
+		}
+	}
+}
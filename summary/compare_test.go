@@ -0,0 +1,81 @@
+package summary
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test Compare handler, reached through the route of ListSummary
+func TestHandler_Compare(t *testing.T) {
+	engine := setUp()
+	handler := &Handler{Repo: &repoStruct{}}
+	engine.GET(":controllerId", handler.byController)
+
+	tooMany := strings.TrimSuffix(strings.Repeat(northId+",", maxCompareControllers+1), ",")
+
+	testCases := []struct {
+		query   string
+		message string
+		code    int
+		ranking []string
+	}{
+		{
+			query:   "controllers=" + northId + "," + southId + "," + rigId + "&metric=temperature&from=2020-04-01&to=2020-04-10",
+			message: resCompare,
+			code:    http.StatusOK,
+			ranking: []string{southId, northId, rigId},
+		},
+		{query: "controllers=" + northId + "," + unknownId + "&metric=temperature&from=2020-04-01&to=2020-04-10", message: resNotFound, code: http.StatusNotFound},
+		{query: "controllers=" + northId + "," + northId + "&metric=temperature&from=2020-04-01&to=2020-04-10", message: resInvalid, code: http.StatusBadRequest},
+		{query: "controllers=" + tooMany + "&metric=temperature&from=2020-04-01&to=2020-04-10", message: resInvalid, code: http.StatusBadRequest},
+		{query: "controllers=not-a-uuid&metric=temperature&from=2020-04-01&to=2020-04-10", message: resInvalid, code: http.StatusBadRequest},
+		{query: "controllers=" + northId + "&metric=radiation&from=2020-04-01&to=2020-04-10", message: resInvalid, code: http.StatusBadRequest},
+		{query: "controllers=" + northId + "&metric=temperature&from=2020-01-01&to=2020-06-01", message: resInvalid, code: http.StatusBadRequest},
+		{query: "controllers=" + northId + "&metric=temperature&from=2020-04-10&to=2020-04-01", message: resInvalid, code: http.StatusBadRequest},
+	}
+
+	for i, c := range testCases {
+		resp := httptest.NewRecorder()
+
+		req, _ := http.NewRequest(http.MethodGet, "/"+compareRoute+"?"+c.query, nil)
+		engine.ServeHTTP(resp, req)
+
+		respBody := struct {
+			Message string      `json:"message"`
+			Result  *Comparison `json:"result"`
+		}{}
+		_ = json.Unmarshal(resp.Body.Bytes(), &respBody)
+
+		if c.code != resp.Code {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.code, resp.Code)
+		}
+
+		if c.message != respBody.Message {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.message, respBody.Message)
+		}
+
+		if c.code != http.StatusOK {
+			continue
+		}
+
+		comparison := respBody.Result
+		for j, id := range c.ranking {
+			if comparison.Ranking[j] != id {
+				t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.ranking, comparison.Ranking)
+			}
+		}
+
+		// On the 1st the houses are at 1 and 3 degrees, one either side of the group
+		north, south, rig := comparison.Series[0], comparison.Series[1], comparison.Series[2]
+		if len(comparison.Dates) != 10 || *comparison.GroupMean[0] != 2 || *north.Deltas[0] != -1 || *south.Deltas[0] != 1 {
+			t.Fatalf("Case %d: expected [10 2 -1 1], got = [%v %v %v %v]", i, len(comparison.Dates), *comparison.GroupMean[0], *north.Deltas[0], *south.Deltas[0])
+		}
+
+		if *south.MeanDelta != 1 || south.Rank != 1 || rig.Key != "" || rig.Values[0] != nil || rig.Rank != 0 {
+			t.Fatalf("Case %d: expected [1 1 \"\" nil 0], got = [%v %v %q %v %v]", i, *south.MeanDelta, south.Rank, rig.Key, rig.Values[0], rig.Rank)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package summary
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/tPhume/ags-backend/export"
+	"github.com/tPhume/ags-backend/metric"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// Dates of summaries are kept as text in this layout
+const dateLayout = "2006-01-02"
+
+// Query for ExportSummary, from and to are dates and to is inclusive
+type exportQuery struct {
+	From   string `form:"from" binding:"required"`
+	To     string `form:"to" binding:"required"`
+	Format string `form:"format" binding:"required,oneof=csv ndjson parquet"`
+}
+
+// summaryColumns has the date and then the mean and median of every sensor of the controller
+func summaryColumns(sensors []metric.Sensor) []export.Column {
+	columns := []export.Column{{Name: "date", Type: export.TypeString}}
+	for _, sensor := range sensors {
+		unit := ""
+		if m, ok := metric.Default.Lookup(sensor.Metric); ok {
+			unit = m.Unit
+		}
+
+		columns = append(columns,
+			export.Column{Name: "mean_" + sensor.Key, Unit: unit, Type: export.TypeFloat},
+			export.Column{Name: "median_" + sensor.Key, Unit: unit, Type: export.TypeFloat},
+		)
+	}
+
+	return columns
+}
+
+// ExportSummary streams the daily summaries of the controller from one date to another as a file download
+func (h *Handler) ExportSummary(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": "internal server error from middleware"})
+		return
+	}
+
+	controllerId := ctx.Param("controllerId")
+	if _, err := uuid.Parse(controllerId); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "invalid controller id"})
+		return
+	}
+
+	query := &exportQuery{}
+	if err := ctx.ShouldBindQuery(query); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "invalid query", "err": err.Error()})
+		return
+	}
+
+	from, errFrom := time.Parse(dateLayout, query.From)
+	to, errTo := time.Parse(dateLayout, query.To)
+	if errFrom != nil || errTo != nil || to.Before(from) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "invalid query"})
+		return
+	}
+
+	controller, err := h.Repo.GetController(ctx, userId, controllerId)
+	if err != nil {
+		if err == errControllerNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": "controller not found"})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": "internal server error on retrieval"})
+		}
+
+		return
+	}
+
+	sensors := metric.Sensors(controller.Sensors)
+	header := &export.Header{
+		Title:          fmt.Sprintf("daily summaries from %s to %s", query.From, query.To),
+		ControllerId:   controllerId,
+		ControllerName: controller.Name,
+		Columns:        summaryColumns(sensors),
+	}
+
+	filename := export.Filename(fmt.Sprintf("summary-%s-%s", controllerId, from.Format("20060102")), query.Format)
+	ctx.Header("Content-Type", export.ContentType(query.Format))
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	ctx.Status(http.StatusOK)
+
+	// The status is sent with the first bytes, after that a failure can only cut the download short
+	buffered := bufio.NewWriter(ctx.Writer)
+	w, err := export.NewWriter(query.Format, buffered, header)
+	if err != nil {
+		log.Printf("summary: could not start export of %s: %s", controllerId, err)
+		return
+	}
+
+	// Sensors missing from a summary are written as empty values
+	row := make([]interface{}, 2*len(sensors)+1)
+	err = h.Repo.EachSummary(ctx, userId, controllerId, query.From, query.To, func(s *Summary) error {
+		row[0] = s.Date
+		for i, sensor := range sensors {
+			row[2*i+1], row[2*i+2] = math.NaN(), math.NaN()
+			if stats, ok := s.Stat(sensor.Key); ok {
+				row[2*i+1], row[2*i+2] = stats.Mean, stats.Median
+			}
+		}
+
+		return w.Write(row...)
+	})
+
+	if err == nil {
+		err = w.Close()
+	}
+
+	if err == nil {
+		err = buffered.Flush()
+	}
+
+	if err != nil {
+		log.Printf("summary: export of %s stopped: %s", controllerId, err)
+		_ = ctx.Error(err)
+	}
+}
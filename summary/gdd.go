@@ -0,0 +1,69 @@
+package summary
+
+import (
+	"context"
+	"github.com/tPhume/ags-backend/metric"
+	"time"
+)
+
+// gddCounter adds up the growing degree days of dailies in date order from the start of the season
+type gddCounter struct {
+	season string
+	total  float64
+}
+
+// add returns the growing degree days up to and including daily, nil for dailies before the season or without them
+func (g *gddCounter) add(daily *Summary) *float64 {
+	stats, ok := daily.Metrics[metric.GDD]
+	if !ok || daily.Date < g.season {
+		return nil
+	}
+
+	g.total += stats.Mean * float64(stats.Count)
+	total := g.total
+
+	return &total
+}
+
+// gddBefore returns a counter with the growing degree days of the season before the date of first
+func (h *Handler) gddBefore(ctx context.Context, userId string, controllerId string, season string, first string) (*gddCounter, error) {
+	counter := &gddCounter{season: season}
+	if first == "" || first <= season {
+		return counter, nil
+	}
+
+	day, err := time.Parse(dateLayout, first)
+	if err != nil {
+		return nil, err
+	}
+
+	before := day.AddDate(0, 0, -1).Format(dateLayout)
+	err = h.Repo.EachSummary(ctx, userId, controllerId, season, before, func(daily *Summary) error {
+		counter.add(daily)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return counter, nil
+}
+
+// addCumulativeGdd sets the growing degree days of the season on dailies in date order
+func (h *Handler) addCumulativeGdd(ctx context.Context, userId string, controllerId string, season string, dailies []*Summary) error {
+	if len(dailies) == 0 {
+		return nil
+	}
+
+	counter, err := h.gddBefore(ctx, userId, controllerId, season, dailies[0].Date)
+	if err != nil {
+		return err
+	}
+
+	for _, daily := range dailies {
+		daily.CumulativeGdd = counter.add(daily)
+	}
+
+	return nil
+}
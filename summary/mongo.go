@@ -2,29 +2,121 @@ package summary
 
 import (
 	"context"
+	"github.com/tPhume/ags-backend/data"
+	"github.com/tPhume/ags-backend/lookup"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
 )
 
 type Mongo struct {
-	Col *mongo.Collection
+	Col           *mongo.Collection
+	ControllerCol *mongo.Collection
+	Lookup        *lookup.MongoRepo
+
+	// Only the Builder needs this
+	Data *data.MongoRepo
 }
 
-func (m *Mongo) ListSummary(ctx context.Context, userId string, controllerId string) ([]*Summary, error) {
-	cursor, err := m.Col.Find(ctx, bson.M{"user_id": userId, "controller_id": controllerId})
+func (m *Mongo) ListSummary(ctx context.Context, userId string, controllerId string, from string, to string, after string, limit int) ([]*Summary, error) {
+	date := bson.M{}
+	if from != "" {
+		date["$gte"] = from
+	}
+
+	if to != "" {
+		date["$lte"] = to
+	}
+
+	// Dates of a controller are unique, so the last date of a page is where the next one starts
+	if after != "" && after >= from {
+		delete(date, "$gte")
+		date["$gt"] = after
+	}
+
+	filter := bson.M{"user_id": userId, "controller_id": controllerId}
+	if len(date) > 0 {
+		filter["date"] = date
+	}
+
+	opts := options.Find().SetSort(bson.M{"date": 1}).SetLimit(int64(limit))
+	cursor, err := m.Col.Find(ctx, filter, opts)
 	if err != nil {
 		return nil, err
 	}
 
 	entities := make([]*Summary, 0)
+	if err := cursor.All(ctx, &entities); err != nil {
+		return nil, err
+	}
+
+	return entities, nil
+}
+
+func (m *Mongo) GetController(ctx context.Context, userId string, controllerId string) (*Controller, error) {
+	controller := &Controller{}
+	if err := m.Lookup.FindController(ctx, userId, controllerId, controller); err != nil {
+		return nil, err
+	}
+
+	return controller, nil
+}
+
+func (m *Mongo) EachSummary(ctx context.Context, userId string, controllerId string, from string, to string, fn func(*Summary) error) error {
+	filter := bson.M{
+		"user_id":       userId,
+		"controller_id": controllerId,
+		"date":          bson.M{"$gte": from, "$lte": to},
+	}
+
+	// Dates are YYYY-MM-DD, so sorting the text sorts by date
+	cursor, err := m.Col.Find(ctx, filter, options.Find().SetSort(bson.M{"date": 1}))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
 	for cursor.Next(ctx) {
 		result := &Summary{}
 		if err := cursor.Decode(result); err != nil {
-			return nil, err
+			return err
 		}
 
-		entities = append(entities, result)
+		if err := fn(result); err != nil {
+			return err
+		}
 	}
 
-	return entities, nil
+	return cursor.Err()
+}
+
+func (m *Mongo) ListControllers(ctx context.Context) ([]*BuildController, error) {
+	cursor, err := m.ControllerCol.Find(ctx, bson.M{}, options.Find().SetProjection(bson.M{"_id": 1, "user_id": 1, "sensors": 1, "growing": 1}))
+	if err != nil {
+		return nil, err
+	}
+
+	controllers := make([]*BuildController, 0)
+	if err := cursor.All(ctx, &controllers); err != nil {
+		return nil, err
+	}
+
+	return controllers, nil
+}
+
+func (m *Mongo) GetTimezone(ctx context.Context, userId string) (string, error) {
+	return m.Lookup.GetTimezone(ctx, userId)
+}
+
+func (m *Mongo) EachReading(ctx context.Context, userId string, controllerId string, from time.Time, to time.Time, fn func(*data.Reading) error) error {
+	return m.Data.EachReading(ctx, userId, controllerId, from, to, fn)
+}
+
+// UpsertSummary keys summaries by controller and date, so building a day twice leaves one summary
+func (m *Mongo) UpsertSummary(ctx context.Context, summary *Summary) error {
+	filter := bson.M{"controller_id": summary.ControllerId, "date": summary.Date}
+	_, err := m.Col.ReplaceOne(ctx, filter, summary, options.Replace().SetUpsert(true))
+
+	return err
 }
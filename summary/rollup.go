@@ -0,0 +1,209 @@
+package summary
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+)
+
+// Keys of the sensors that summaries had fixed fields for
+var legacyKeys = []string{"temperature", "humidity", "light", "soil_moisture", "water_level"}
+
+// errPageFull stops EachSummary once a page of rollups is complete
+var errPageFull = errors.New("page full")
+
+// periodStart returns the first date of the week or month day is in
+func periodStart(day time.Time, granularity string) time.Time {
+	if granularity == GranularityMonth {
+		return day.AddDate(0, 0, 1-day.Day())
+	}
+
+	// Weekday counts from Sunday, weeks here start on Monday
+	return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+}
+
+// nextPeriod returns the first date of the week or month after the one that starts on start
+func nextPeriod(start time.Time, granularity string) time.Time {
+	if granularity == GranularityMonth {
+		return start.AddDate(0, 1, 0)
+	}
+
+	return start.AddDate(0, 0, 7)
+}
+
+// listRollups rolls the dailies of the range up into at most one more than a page of weeks or months
+// A week or month cut by from or to only has the dailies within the range
+func (h *Handler) listRollups(ctx context.Context, userId string, controllerId string, season string, query *listQuery) ([]*Summary, error) {
+	from, to := query.From, query.To
+	if query.Cursor != "" {
+		cursor, _ := time.Parse(dateLayout, query.Cursor)
+		if next := nextPeriod(periodStart(cursor, query.Granularity), query.Granularity).Format(dateLayout); next > from {
+			from = next
+		}
+	}
+
+	// Every date sorts before this one
+	if to == "" {
+		to = "9999-12-31"
+	}
+
+	gdd, err := h.gddBefore(ctx, userId, controllerId, season, from)
+	if err != nil {
+		return nil, err
+	}
+
+	rollups := make([]*Summary, 0)
+	var current *rollup
+
+	err = h.Repo.EachSummary(ctx, userId, controllerId, from, to, func(daily *Summary) error {
+		day, err := time.Parse(dateLayout, daily.Date)
+		if err != nil {
+			return err
+		}
+
+		start := periodStart(day, query.Granularity).Format(dateLayout)
+		if current == nil || current.summary.Date != start {
+			if current != nil {
+				rollups = append(rollups, current.finish())
+			}
+
+			if len(rollups) > query.Limit {
+				return errPageFull
+			}
+
+			current = newRollup(daily, start, query.Granularity)
+		}
+
+		current.add(daily)
+		if cumulative := gdd.add(daily); cumulative != nil {
+			current.summary.CumulativeGdd = cumulative
+		}
+
+		return nil
+	})
+
+	if err != nil && err != errPageFull {
+		return nil, err
+	}
+
+	if current != nil && len(rollups) <= query.Limit {
+		rollups = append(rollups, current.finish())
+	}
+
+	return rollups, nil
+}
+
+// RollupStats of one sensor over a week or month
+// Mean and standard deviation are exact, min and max too
+type RollupStats struct {
+	Mean   float64 `json:"mean"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	StdDev float64 `json:"stddev"`
+
+	// Median and percentiles can't be had from dailies, these are the means of the daily ones weighted by count
+	MeanDailyMedian float64 `json:"mean_daily_median"`
+	MeanDailyP10    float64 `json:"mean_daily_p10"`
+	MeanDailyP90    float64 `json:"mean_daily_p90"`
+
+	// Count of the good values of the dailies
+	Count int `json:"count"`
+}
+
+// rollup adds up the statistics of dailies
+type rollup struct {
+	summary *Summary
+	sums    map[string]*statsSum
+}
+
+type statsSum struct {
+	weight, mean, squares, median, p10, p90 float64
+	min, max                                float64
+	count                                   int
+}
+
+func newRollup(daily *Summary, start string, granularity string) *rollup {
+	return &rollup{
+		summary: &Summary{
+			UserId:        daily.UserId,
+			ControllerId:  daily.ControllerId,
+			Date:          start,
+			Granularity:   granularity,
+			RollupMetrics: make(map[string]*RollupStats),
+		},
+		sums: make(map[string]*statsSum),
+	}
+}
+
+func (r *rollup) add(daily *Summary) {
+	r.summary.Days++
+
+	for key, stats := range dailyStats(daily) {
+		// Old dailies have no count, each counts as one value
+		weight := float64(stats.Count)
+		if weight == 0 {
+			weight = 1
+		}
+
+		sum, ok := r.sums[key]
+		if !ok {
+			sum = &statsSum{min: math.Inf(1), max: math.Inf(-1)}
+			r.sums[key] = sum
+		}
+
+		sum.weight += weight
+		sum.mean += weight * stats.Mean
+		sum.squares += weight * (stats.StdDev*stats.StdDev + stats.Mean*stats.Mean)
+		sum.median += weight * stats.Median
+		sum.p10 += weight * stats.P10
+		sum.p90 += weight * stats.P90
+		sum.count += stats.Count
+
+		// Old dailies don't know their min and max
+		if stats.Count > 0 {
+			sum.min = math.Min(sum.min, stats.Min)
+			sum.max = math.Max(sum.max, stats.Max)
+		}
+	}
+}
+
+func (r *rollup) finish() *Summary {
+	for key, sum := range r.sums {
+		mean := sum.mean / sum.weight
+		if sum.count == 0 {
+			sum.min, sum.max = 0, 0
+		}
+
+		stats := &RollupStats{
+			Mean:            mean,
+			Min:             sum.min,
+			Max:             sum.max,
+			StdDev:          math.Sqrt(math.Max(sum.squares/sum.weight-mean*mean, 0)),
+			MeanDailyMedian: sum.median / sum.weight,
+			MeanDailyP10:    sum.p10 / sum.weight,
+			MeanDailyP90:    sum.p90 / sum.weight,
+			Count:           sum.count,
+		}
+
+		r.summary.RollupMetrics[key] = stats
+		r.summary.setLegacy(key, stats.Mean, stats.MeanDailyMedian)
+	}
+
+	return r.summary
+}
+
+// dailyStats returns the statistics of every sensor of a daily, reading the fixed fields of old ones
+func dailyStats(daily *Summary) map[string]*Stats {
+	if daily.Metrics != nil {
+		return daily.Metrics
+	}
+
+	metrics := make(map[string]*Stats, len(legacyKeys))
+	for _, key := range legacyKeys {
+		stats, _ := daily.Stat(key)
+		metrics[key] = stats
+	}
+
+	return metrics
+}
@@ -3,16 +3,21 @@ package summary
 import (
 	"context"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/tPhume/ags-backend/controller"
+	"github.com/tPhume/ags-backend/lookup"
+	"github.com/tPhume/ags-backend/metric"
 	"github.com/tPhume/ags-backend/session"
 	"net/http"
+	"time"
 )
 
 func RegisterRoutes(handler *Handler, engine *gin.Engine, sessionHandler *session.Handler) {
 	group := engine.Group("api/v1/summary")
 	group.Use(sessionHandler.GetUser)
 
-	group.GET(":controllerId", handler.ListSummary)
-
+	group.GET(":controllerId", handler.byController)
+	group.GET(":controllerId/export", handler.ExportSummary)
 }
 
 type Summary struct {
@@ -29,32 +34,215 @@ type Summary struct {
 	MedianSoilMoisture float64 `json:"median_soil_moisture" bson:"median_soil_moisture"`
 	MedianTemperature  float64 `json:"median_temperature" bson:"median_temperature"`
 	MedianWaterLevel   float64 `json:"median_water_level" bson:"median_water_level"`
+
+	// Metrics has the statistics of every sensor keyed by sensor key, the fields above are kept for the legacy sensors
+	Metrics map[string]*Stats `json:"metrics,omitempty" bson:"metrics,omitempty"`
+
+	// Only rollups have these, Date is then the first date of the week or month
+	// Rollups have RollupMetrics in place of Metrics, and the median fields above are the means of the daily medians
+	Granularity   string                  `json:"granularity,omitempty" bson:"-"`
+	Days          int                     `json:"days,omitempty" bson:"-"`
+	RollupMetrics map[string]*RollupStats `json:"rollup_metrics,omitempty" bson:"-"`
+
+	// CumulativeGdd adds up growing degree days from the start of the season to the end of the summary
+	CumulativeGdd *float64 `json:"cumulative_gdd,omitempty" bson:"-"`
+}
+
+// Stats of one sensor over a day
+// Summaries built before min and the others were added have only mean and median, and a count of zero
+type Stats struct {
+	Mean   float64 `json:"mean" bson:"mean"`
+	Median float64 `json:"median" bson:"median"`
+	Min    float64 `json:"min" bson:"min"`
+	Max    float64 `json:"max" bson:"max"`
+	StdDev float64 `json:"stddev" bson:"stddev"`
+	P10    float64 `json:"p10" bson:"p10"`
+	P90    float64 `json:"p90" bson:"p90"`
+
+	// Count of the good values the statistics are over
+	Count int `json:"count" bson:"count"`
+}
+
+// Stat returns the statistics of the sensor with key
+// Summaries written before metrics only have the fixed fields of the legacy sensors
+func (s *Summary) Stat(key string) (*Stats, bool) {
+	if stats, ok := s.Metrics[key]; ok {
+		return stats, true
+	}
+
+	if s.Metrics != nil {
+		return nil, false
+	}
+
+	switch key {
+	case "temperature":
+		return &Stats{Mean: s.MeanTemperature, Median: s.MedianTemperature}, true
+	case "humidity":
+		return &Stats{Mean: s.MeanHumidity, Median: s.MedianHumidity}, true
+	case "light":
+		return &Stats{Mean: s.MeanLight, Median: s.MedianLight}, true
+	case "soil_moisture":
+		return &Stats{Mean: s.MeanSoilMoisture, Median: s.MedianSoilMoisture}, true
+	case "water_level":
+		return &Stats{Mean: s.MeanWaterLevel, Median: s.MedianWaterLevel}, true
+	}
+
+	return nil, false
 }
 
+// Controller is what summaries need to know about a controller
+type Controller struct {
+	Name    string              `bson:"name"`
+	Sensors []metric.Sensor     `bson:"sensors"`
+	Growing *controller.Growing `bson:"growing"`
+}
+
+var errControllerNotFound = lookup.ErrControllerNotFound
+
 type Repo interface {
-	ListSummary(ctx context.Context, userId string, controllerId string) ([]*Summary, error)
+	// ListSummary returns at most limit summaries of the controller in date order
+	// They are dated from one date to another inclusive and after the date of after, an empty date leaves that side open
+	ListSummary(ctx context.Context, userId string, controllerId string, from string, to string, after string, limit int) ([]*Summary, error)
+
+	// GetController returns the controller if it belongs to userId
+	GetController(ctx context.Context, userId string, controllerId string) (*Controller, error)
+
+	// EachSummary calls fn with every summary of the controller dated from one date to another inclusive, in date order
+	// Iteration stops at the first error returned by fn
+	EachSummary(ctx context.Context, userId string, controllerId string, from string, to string, fn func(*Summary) error) error
 }
 
 type Handler struct {
 	Repo Repo
 }
 
+var (
+	// ok message responses for handler
+	resListSummary = "list of summaries retrieved"
+
+	// error message responses for handler
+	resInternal = "not your fault, don't worry"
+	resInvalid  = "invalid values"
+	resNotFound = "not found"
+)
+
+// Granularities of ListSummary, weeks start on Monday
+const (
+	GranularityDay   = "day"
+	GranularityWeek  = "week"
+	GranularityMonth = "month"
+)
+
+// Page sizes of ListSummary, a year of dailies at most
+const (
+	defaultLimit = 31
+	maxLimit     = 366
+)
+
+// Query for ListSummary, dates are inclusive and cursor is the next_cursor of the previous page
+type listQuery struct {
+	From        string `form:"from"`
+	To          string `form:"to"`
+	Limit       int    `form:"limit" binding:"omitempty,min=1,max=366"`
+	Cursor      string `form:"cursor"`
+	Granularity string `form:"granularity" binding:"omitempty,oneof=day week month"`
+}
+
+// SummaryPage is one page of ListSummary, NextCursor is empty on the last page
+type SummaryPage struct {
+	Summaries  []*Summary `json:"summaries"`
+	NextCursor string     `json:"next_cursor"`
+}
+
+// ListSummary pages through the daily summaries of the controller in date order, or through weekly or monthly rollups of them
 func (h *Handler) ListSummary(ctx *gin.Context) {
 	// Get values
 	userId := ctx.GetString("userId")
 	if userId == "" {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"message": "internal server error from middleware"})
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
 		return
 	}
 
 	controllerId := ctx.Param("controllerId")
+	if _, err := uuid.Parse(controllerId); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	query := &listQuery{}
+	if err := ctx.ShouldBindQuery(query); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid, "err": err.Error()})
+		return
+	}
+
+	if !validDates(query.From, query.To, query.Cursor) || (query.From != "" && query.To != "" && query.To < query.From) {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	if query.Limit == 0 {
+		query.Limit = defaultLimit
+	}
+
+	// Check ownership so that a foreign controller is not found rather than empty
+	c, err := h.Repo.GetController(ctx, userId, controllerId)
+	if err != nil {
+		if err == errControllerNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resNotFound})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	// One more than the page tells whether there is a next page
+	var entities []*Summary
+	season := c.Growing.Season()
+	if query.Granularity == "" || query.Granularity == GranularityDay {
+		entities, err = h.Repo.ListSummary(ctx, userId, controllerId, query.From, query.To, query.Cursor, query.Limit+1)
+		if err == nil {
+			err = h.addCumulativeGdd(ctx, userId, controllerId, season, entities)
+		}
+	} else {
+		entities, err = h.listRollups(ctx, userId, controllerId, season, query)
+	}
 
-	// Get List
-	entities, err := h.Repo.ListSummary(ctx, userId, controllerId)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"message": "internal server error on retrieval"})
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
 		return
 	}
 
-	ctx.JSON(http.StatusOK, gin.H{"summary_list": entities})
+	page := &SummaryPage{Summaries: entities}
+	if len(entities) > query.Limit {
+		page.Summaries = entities[:query.Limit]
+		page.NextCursor = page.Summaries[query.Limit-1].Date
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resListSummary, "result": page})
+}
+
+// byController hands compare to Compare, Gin can't route it next to :controllerId
+func (h *Handler) byController(ctx *gin.Context) {
+	if ctx.Param("controllerId") == compareRoute {
+		h.Compare(ctx)
+		return
+	}
+
+	h.ListSummary(ctx)
+}
+
+// validDates checks that every date is empty or in dateLayout
+func validDates(dates ...string) bool {
+	for _, date := range dates {
+		if date == "" {
+			continue
+		}
+
+		if _, err := time.Parse(dateLayout, date); err != nil {
+			return false
+		}
+	}
+
+	return true
 }
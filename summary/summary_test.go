@@ -0,0 +1,213 @@
+package summary
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/tPhume/ags-backend/controller"
+	"github.com/tPhume/ags-backend/metric"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// For our tests the grower has a north house with a season started on the 3rd, a south house two degrees warmer
+// and a rig that only measures co2, any other controller id indicates a missing controller
+const (
+	growerId  = "6f900c22-65f5-4944-b17c-be64a5f8f5c4"
+	northId   = "7d0143ca-216c-43d9-b7b7-b15f20bf4cd6"
+	southId   = "7eb03577-5404-43fe-b039-c8080ef14273"
+	rigId     = "cc94cd41-c583-4452-bd15-312876dc7bd4"
+	unknownId = "f571ccc6-c4b3-4a81-bdec-1e9aa67ad191"
+)
+
+var controllers = map[string]*Controller{
+	northId: {Name: "North", Growing: &controller.Growing{SeasonStart: "2020-04-03"}},
+	southId: {Name: "South"},
+	rigId:   {Name: "Rig", Sensors: []metric.Sensor{{Key: "co2", Metric: "co2"}}},
+}
+
+// Repo struct for testing, it has a summary for every day of April 2020, the temperature on each is the day of the month
+type repoStruct struct{}
+
+func april(user string, id string, from string, to string, after string, limit int) []*Summary {
+	entities := make([]*Summary, 0)
+	for day := time.Date(2020, time.April, 1, 0, 0, 0, 0, time.UTC); day.Month() == time.April; day = day.AddDate(0, 0, 1) {
+		date := day.Format(dateLayout)
+		if (from != "" && date < from) || (to != "" && date > to) || (after != "" && date <= after) {
+			continue
+		}
+
+		if len(entities) == limit {
+			break
+		}
+
+		// The south house is two degrees up
+		value := float64(day.Day())
+		if id == southId {
+			value += 2
+		}
+		entities = append(entities, &Summary{UserId: user, ControllerId: id, Date: date, Metrics: map[string]*Stats{
+			"temperature": {Mean: value, Median: value, Min: value - 1, Max: value + 1, StdDev: 1, P10: value - 1, P90: value + 1, Count: 24},
+			metric.GDD:    dailyValue(1),
+		}})
+	}
+
+	return entities
+}
+
+func (r *repoStruct) ListSummary(ctx context.Context, user string, id string, from string, to string, after string, limit int) ([]*Summary, error) {
+	return april(user, id, from, to, after, limit), nil
+}
+
+func (r *repoStruct) GetController(ctx context.Context, userId string, controllerId string) (*Controller, error) {
+	if c, ok := controllers[controllerId]; ok && userId == growerId {
+		return c, nil
+	}
+
+	return nil, errControllerNotFound
+}
+
+func (r *repoStruct) EachSummary(ctx context.Context, user string, id string, from string, to string, fn func(*Summary) error) error {
+	for _, entity := range april(user, id, from, to, "", -1) {
+		if err := fn(entity); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Setup func for handler testing
+func setUp() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+
+	engine.Use(func(ctx *gin.Context) {
+		ctx.Set("userId", growerId)
+	})
+
+	return engine
+}
+
+// Test ListSummary handler
+func TestHandler_ListSummary(t *testing.T) {
+	engine := setUp()
+	handler := &Handler{Repo: &repoStruct{}}
+	engine.GET(":controllerId", handler.ListSummary)
+
+	testCases := []struct {
+		controllerId string
+		query        string
+		message      string
+		code         int
+		first        string
+		count        int
+		next         string
+		gdd          float64
+	}{
+		{controllerId: northId, query: "", message: resListSummary, code: http.StatusOK, first: "2020-04-01", count: 30, next: ""},
+		{controllerId: northId, query: "limit=10", message: resListSummary, code: http.StatusOK, first: "2020-04-01", count: 10, next: "2020-04-10"},
+		{controllerId: northId, query: "limit=10&cursor=2020-04-10", message: resListSummary, code: http.StatusOK, first: "2020-04-11", count: 10, next: "2020-04-20", gdd: 9},
+		{controllerId: northId, query: "limit=10&cursor=2020-04-20", message: resListSummary, code: http.StatusOK, first: "2020-04-21", count: 10, next: ""},
+		{controllerId: northId, query: "from=2020-04-05&to=2020-04-07", message: resListSummary, code: http.StatusOK, first: "2020-04-05", count: 3, next: ""},
+		{controllerId: northId, query: "from=2020-04-07&to=2020-04-05", message: resInvalid, code: http.StatusBadRequest},
+		{controllerId: northId, query: "from=April", message: resInvalid, code: http.StatusBadRequest},
+		{controllerId: northId, query: "cursor=April", message: resInvalid, code: http.StatusBadRequest},
+		{controllerId: northId, query: "limit=-1", message: resInvalid, code: http.StatusBadRequest},
+		{controllerId: northId, query: "limit=367", message: resInvalid, code: http.StatusBadRequest},
+		{controllerId: northId, query: "granularity=week", message: resListSummary, code: http.StatusOK, first: "2020-03-30", count: 5, next: "", gdd: 3},
+		{controllerId: northId, query: "granularity=week&limit=2", message: resListSummary, code: http.StatusOK, first: "2020-03-30", count: 2, next: "2020-04-06"},
+		{controllerId: northId, query: "granularity=week&limit=2&cursor=2020-04-06", message: resListSummary, code: http.StatusOK, first: "2020-04-13", count: 2, next: "2020-04-20", gdd: 17},
+		{controllerId: northId, query: "granularity=week&limit=2&cursor=2020-04-20", message: resListSummary, code: http.StatusOK, first: "2020-04-27", count: 1, next: ""},
+		{controllerId: northId, query: "granularity=month", message: resListSummary, code: http.StatusOK, first: "2020-04-01", count: 1, next: ""},
+		{controllerId: northId, query: "granularity=year", message: resInvalid, code: http.StatusBadRequest},
+		{controllerId: "not-a-uuid", query: "", message: resInvalid, code: http.StatusBadRequest},
+		{controllerId: unknownId, query: "", message: resNotFound, code: http.StatusNotFound},
+	}
+
+	for i, c := range testCases {
+		resp := httptest.NewRecorder()
+
+		req, _ := http.NewRequest(http.MethodGet, "/"+c.controllerId+"?"+c.query, nil)
+		engine.ServeHTTP(resp, req)
+
+		respBody := struct {
+			Message string       `json:"message"`
+			Result  *SummaryPage `json:"result"`
+		}{}
+		_ = json.Unmarshal(resp.Body.Bytes(), &respBody)
+
+		if c.code != resp.Code {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.code, resp.Code)
+		}
+
+		if c.message != respBody.Message {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.message, respBody.Message)
+		}
+
+		if c.code != http.StatusOK {
+			continue
+		}
+
+		page := respBody.Result
+		if len(page.Summaries) != c.count || page.Summaries[0].Date != c.first || page.NextCursor != c.next {
+			t.Fatalf("Case %d: expected [%v %v %v], got = [%v %v %v]", i, c.count, c.first, c.next, len(page.Summaries), page.Summaries[0].Date, page.NextCursor)
+		}
+
+		// The season starts on the 3rd and every day adds one degree day
+		if c.gdd != 0 && *page.Summaries[0].CumulativeGdd != c.gdd {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.gdd, *page.Summaries[0].CumulativeGdd)
+		}
+	}
+}
+
+// Test weeks and months are rolled up from the dailies
+func TestHandler_ListSummaryRollup(t *testing.T) {
+	engine := setUp()
+	handler := &Handler{Repo: &repoStruct{}}
+	engine.GET(":controllerId", handler.ListSummary)
+
+	testCases := []struct {
+		query    string
+		days     int
+		expected *RollupStats
+	}{
+		// The 1st to the 5th, a Wednesday to a Sunday
+		{query: "granularity=week", days: 5, expected: &RollupStats{Mean: 3, Min: 0, Max: 6, StdDev: math.Sqrt(3), MeanDailyMedian: 3, MeanDailyP10: 2, MeanDailyP90: 4, Count: 120}},
+		// Only the 6th to the 8th of the next week are within range
+		{query: "granularity=week&from=2020-04-06&to=2020-04-08", days: 3, expected: &RollupStats{Mean: 7, Min: 5, Max: 9, StdDev: math.Sqrt(5.0 / 3), MeanDailyMedian: 7, MeanDailyP10: 6, MeanDailyP90: 8, Count: 72}},
+		{query: "granularity=month", days: 30, expected: &RollupStats{Mean: 15.5, Min: 0, Max: 31, StdDev: math.Sqrt(1 + 899.0/12), MeanDailyMedian: 15.5, MeanDailyP10: 14.5, MeanDailyP90: 16.5, Count: 720}},
+	}
+
+	for i, c := range testCases {
+		resp := httptest.NewRecorder()
+
+		req, _ := http.NewRequest(http.MethodGet, "/"+northId+"?"+c.query, nil)
+		engine.ServeHTTP(resp, req)
+
+		respBody := struct {
+			Result *SummaryPage `json:"result"`
+		}{}
+		_ = json.Unmarshal(resp.Body.Bytes(), &respBody)
+
+		first := respBody.Result.Summaries[0]
+		got := first.RollupMetrics["temperature"]
+		if first.Metrics != nil || first.Days != c.days || got.Count != c.expected.Count || got.Min != c.expected.Min || got.Max != c.expected.Max {
+			t.Fatalf("Case %d: expected [%v %+v], got = [%v %+v]", i, c.days, c.expected, first.Days, got)
+		}
+
+		pairs := [][2]float64{{got.Mean, c.expected.Mean}, {got.StdDev, c.expected.StdDev}, {got.MeanDailyMedian, c.expected.MeanDailyMedian}, {got.MeanDailyP10, c.expected.MeanDailyP10}, {got.MeanDailyP90, c.expected.MeanDailyP90}}
+		for _, pair := range pairs {
+			if math.Abs(pair[0]-pair[1]) > 1e-9 {
+				t.Fatalf("Case %d: expected [%+v], got = [%+v]", i, c.expected, got)
+			}
+		}
+
+		if first.MeanTemperature != got.Mean {
+			t.Fatalf("Case %d: expected legacy mean [%v], got = [%v]", i, got.Mean, first.MeanTemperature)
+		}
+	}
+}
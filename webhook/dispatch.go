@@ -0,0 +1,367 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/tPhume/ags-backend/data"
+	"github.com/tPhume/ags-backend/outbound"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Headers of a delivery
+// The signature is the HMAC-SHA256 of the timestamp, a dot and the body, keyed by the secret of the webhook
+const (
+	HeaderEvent     = "X-AGS-Event"
+	HeaderDelivery  = "X-AGS-Delivery"
+	HeaderTimestamp = "X-AGS-Timestamp"
+	HeaderSignature = "X-AGS-Signature"
+)
+
+// Attempts of a delivery before it fails, the last is about four hours after the first
+const maxAttempts = 10
+
+// Wait before the second attempt, it doubles after each attempt up to maxBackoff
+const (
+	baseBackoff = 30 * time.Second
+	maxBackoff  = 2 * time.Hour
+)
+
+// How long a claimed delivery is left alone for, longer than an attempt can take
+const claimLease = 2 * time.Minute
+
+// Most deliveries attempted by one run
+const maxDeliveriesPerRun = 100
+
+// Attempts made at once by a run unless Workers says otherwise, and at most to one webhook
+// so that a slow receiver cannot hold up the others
+const (
+	defaultWorkers = 8
+	maxPerWebhook  = 2
+)
+
+// How long finished deliveries are kept for unless Retention says otherwise
+const defaultRetention = 30 * 24 * time.Hour
+
+// Dispatcher turns events into deliveries and attempts deliveries that are due, it is a data.Notifier
+// Every replica can run it, each delivery is claimed by one at a time
+type Dispatcher struct {
+	Repo Repo
+
+	// Client is optional, the default one does not connect to private addresses
+	Client *http.Client
+
+	Interval time.Duration
+
+	// Workers and Retention are optional
+	Workers   int
+	Retention time.Duration
+}
+
+var defaultClient = outbound.NewClient(10 * time.Second)
+
+// Publish queues a delivery of the event to every webhook of the user that subscribes to it, failures are logged
+func (d *Dispatcher) Publish(ctx context.Context, userId string, event string, data interface{}) {
+	if err := d.publish(ctx, userId, event, data, time.Now()); err != nil {
+		log.Printf("webhook: could not publish %s of %s: %s", event, userId, err)
+	}
+}
+
+// ReadingsAdded publishes one event for the readings
+func (d *Dispatcher) ReadingsAdded(ctx context.Context, controllerId string, userId string, readings []*data.Reading) {
+	d.Publish(ctx, userId, EventReadingReceived, &struct {
+		ControllerId string          `json:"controller_id"`
+		Readings     []*data.Reading `json:"readings"`
+	}{ControllerId: controllerId, Readings: readings})
+}
+
+func (d *Dispatcher) publish(ctx context.Context, userId string, event string, data interface{}, now time.Time) error {
+	webhooks, err := d.Repo.Subscribers(ctx, userId, event)
+	if err != nil || len(webhooks) == 0 {
+		return err
+	}
+
+	eventId := uuid.New().String()
+	payload, err := json.Marshal(&Event{EventId: eventId, Type: event, CreatedAt: now, Data: data})
+	if err != nil {
+		return err
+	}
+
+	deliveries := make([]*Delivery, len(webhooks))
+	for i, webhook := range webhooks {
+		deliveries[i] = &Delivery{
+			DeliveryId:  uuid.New().String(),
+			WebhookId:   webhook.WebhookId,
+			UserId:      userId,
+			EventId:     eventId,
+			Event:       event,
+			Payload:     string(payload),
+			Status:      StatusPending,
+			NextAttempt: now,
+			CreatedAt:   now,
+		}
+	}
+
+	return d.Repo.AddDeliveries(ctx, deliveries)
+}
+
+// Run attempts due deliveries until ctx is done, a failed run is logged and tried again at the next interval
+func (d *Dispatcher) Run(ctx context.Context) error {
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.RunOnce(ctx, time.Now()); err != nil {
+			log.Printf("webhook: delivery run failed: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce attempts the deliveries that are due as of now, the first error stops claiming more
+func (d *Dispatcher) RunOnce(ctx context.Context, now time.Time) error {
+	workers := d.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+
+	claims := &claims{repo: d.Repo, now: now, busy: make(map[string]int)}
+	errs := make(chan error, workers)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			errs <- d.work(ctx, claims)
+		}()
+	}
+
+	var err error
+	for i := 0; i < workers; i++ {
+		if workerErr := <-errs; workerErr != nil && err == nil {
+			err = workerErr
+		}
+	}
+
+	return err
+}
+
+// work attempts claimed deliveries until there are none left to claim
+func (d *Dispatcher) work(ctx context.Context, claims *claims) error {
+	for {
+		delivery, err := claims.next(ctx)
+		if err != nil || delivery == nil {
+			return err
+		}
+
+		d.attempt(ctx, delivery)
+		err = d.Repo.FinishAttempt(ctx, delivery)
+		claims.done(delivery)
+
+		if err != nil {
+			claims.stop()
+			return err
+		}
+	}
+}
+
+// claims hands out the deliveries of one run, no more than maxPerWebhook to a webhook at a time
+type claims struct {
+	repo Repo
+	now  time.Time
+
+	mu      sync.Mutex
+	claimed int
+	stopped bool
+	busy    map[string]int
+}
+
+// next claims a due delivery of a webhook that is not at its limit, nil when there are none or the run is over
+func (c *claims) next(ctx context.Context) (*Delivery, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopped || c.claimed >= maxDeliveriesPerRun {
+		return nil, nil
+	}
+
+	full := make([]string, 0)
+	for webhookId, busy := range c.busy {
+		if busy >= maxPerWebhook {
+			full = append(full, webhookId)
+		}
+	}
+
+	delivery, err := c.repo.ClaimDelivery(ctx, c.now, time.Now().Add(claimLease), full)
+	if err != nil || delivery == nil {
+		return nil, err
+	}
+
+	c.claimed++
+	c.busy[delivery.WebhookId]++
+	return delivery, nil
+}
+
+func (c *claims) done(delivery *Delivery) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.busy[delivery.WebhookId]--
+}
+
+func (c *claims) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stopped = true
+}
+
+// attempt posts the delivery and moves it on by the outcome, a delivery that is still pending is due again after backoff
+// Times are taken as the attempt is made, the ones before it in a run may have taken a while
+func (d *Dispatcher) attempt(ctx context.Context, delivery *Delivery) {
+	now := time.Now()
+
+	delivery.Attempts++
+	delivery.LastAttemptAt = &now
+	delivery.ResponseCode = 0
+	delivery.Error = ""
+
+	webhook, err := d.Repo.GetWebhook(ctx, delivery.WebhookId)
+	switch {
+	case err == errWebhookNotFound || err == nil && webhook.Disabled:
+		// There is nowhere to post it anymore
+		d.finish(delivery, StatusFailed, now)
+		delivery.Error = "webhook removed or disabled"
+		return
+	case err == nil:
+		delivery.ResponseCode, err = d.post(ctx, webhook, delivery)
+		if err == nil {
+			d.finish(delivery, StatusSucceeded, time.Now())
+			return
+		}
+	}
+
+	delivery.Error = err.Error()
+
+	if delivery.Attempts >= maxAttempts {
+		d.finish(delivery, StatusFailed, time.Now())
+		return
+	}
+
+	delivery.Status = StatusPending
+	delivery.NextAttempt = time.Now().Add(backoff(delivery.Attempts))
+}
+
+// finish sets the status of a delivery that will not be attempted again and when it can be removed
+func (d *Dispatcher) finish(delivery *Delivery, status string, now time.Time) {
+	retention := d.Retention
+	if retention <= 0 {
+		retention = defaultRetention
+	}
+
+	expiresAt := now.Add(retention)
+	delivery.Status = status
+	delivery.ExpiresAt = &expiresAt
+}
+
+// post returns the status code of the response, it is an error unless it is 2xx
+// It is signed as of the moment it is sent, runs can take a while
+func (d *Dispatcher) post(ctx context.Context, webhook *Webhook, delivery *Delivery) (int, error) {
+	body := []byte(delivery.Payload)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, delivery.Event)
+	req.Header.Set(HeaderDelivery, delivery.DeliveryId)
+	req.Header.Set(HeaderTimestamp, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(HeaderSignature, Sign(webhook.Secret, timestamp, body))
+
+	client := d.Client
+	if client == nil {
+		client = defaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	// Drain a little so the connection can be reused
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(res.Body, 4096))
+	_ = res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("webhook responded %d", res.StatusCode)
+	}
+
+	return res.StatusCode, nil
+}
+
+// backoff is the wait after a failed attempt
+func backoff(attempts int) time.Duration {
+	wait := baseBackoff
+	for i := 1; i < attempts && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+
+	if wait > maxBackoff {
+		return maxBackoff
+	}
+
+	return wait
+}
+
+// Sign returns the signature header of a body sent at timestamp, in unix seconds
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = fmt.Fprintf(mac, "%d.", timestamp)
+	_, _ = mac.Write(body)
+
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+var (
+	ErrBadTimestamp = errors.New("timestamp is missing or too far from now")
+	ErrBadSignature = errors.New("signature does not match")
+)
+
+// Verify checks the headers of a delivery as received, it is for receivers written in Go
+// Deliveries signed more than tolerance from now are rejected so that a captured one cannot be replayed later
+// Receivers should also ignore events whose id they have already seen
+func Verify(secret string, timestamp string, signature string, body []byte, now time.Time, tolerance time.Duration) error {
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrBadTimestamp
+	}
+
+	sent := time.Unix(unix, 0)
+	if sent.Before(now.Add(-tolerance)) || sent.After(now.Add(tolerance)) {
+		return ErrBadTimestamp
+	}
+
+	if !hmac.Equal([]byte(Sign(secret, unix, body)), []byte(signature)) {
+		return ErrBadSignature
+	}
+
+	return nil
+}
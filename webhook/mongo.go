@@ -0,0 +1,213 @@
+package webhook
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+type MongoRepo struct {
+	Col         *mongo.Collection
+	DeliveryCol *mongo.Collection
+}
+
+// EnsureIndexes creates the indexes deliveries are claimed and listed by and the one that removes them once expired
+// It is safe to run on every start
+func (m *MongoRepo) EnsureIndexes(ctx context.Context) error {
+	_, err := m.DeliveryCol.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt", Value: 1}}},
+		{Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "webhook_id", Value: 1}, {Key: "created_at", Value: -1}}},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+
+	return err
+}
+
+func (m *MongoRepo) AddWebhook(ctx context.Context, webhook *Webhook) error {
+	_, err := m.Col.InsertOne(ctx, webhook)
+	return err
+}
+
+func (m *MongoRepo) ListWebhooks(ctx context.Context, userId string) ([]*Webhook, error) {
+	opts := options.Find().SetSort(bson.M{"created_at": 1}).SetProjection(bson.M{"secret": 0})
+	cursor, err := m.Col.Find(ctx, bson.M{"user_id": userId}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := make([]*Webhook, 0)
+	if err := cursor.All(ctx, &webhooks); err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+func (m *MongoRepo) UpdateWebhook(ctx context.Context, webhook *Webhook) error {
+	result := m.Col.FindOneAndUpdate(ctx, bson.M{"_id": webhook.WebhookId, "user_id": webhook.UserId}, bson.M{
+		"$set": bson.M{
+			"url":      webhook.Url,
+			"events":   webhook.Events,
+			"disabled": webhook.Disabled,
+		},
+	}, options.FindOneAndUpdate().SetReturnDocument(options.After).SetProjection(bson.M{"secret": 0}))
+
+	if result.Err() != nil {
+		if result.Err() == mongo.ErrNoDocuments {
+			return errWebhookNotFound
+		}
+
+		return result.Err()
+	}
+
+	return result.Decode(webhook)
+}
+
+func (m *MongoRepo) RemoveWebhook(ctx context.Context, userId string, webhookId string) error {
+	result := m.Col.FindOneAndDelete(ctx, bson.M{"_id": webhookId, "user_id": userId})
+	if result.Err() != nil {
+		if result.Err() == mongo.ErrNoDocuments {
+			return errWebhookNotFound
+		}
+
+		return result.Err()
+	}
+
+	return nil
+}
+
+func (m *MongoRepo) SetSecret(ctx context.Context, userId string, webhookId string, secret string) error {
+	result, err := m.Col.UpdateOne(ctx, bson.M{"_id": webhookId, "user_id": userId}, bson.M{"$set": bson.M{"secret": secret}})
+	if err != nil {
+		return err
+	}
+
+	if result.MatchedCount == 0 {
+		return errWebhookNotFound
+	}
+
+	return nil
+}
+
+func (m *MongoRepo) GetWebhook(ctx context.Context, webhookId string) (*Webhook, error) {
+	result := m.Col.FindOne(ctx, bson.M{"_id": webhookId})
+	if result.Err() != nil {
+		if result.Err() == mongo.ErrNoDocuments {
+			return nil, errWebhookNotFound
+		}
+
+		return nil, result.Err()
+	}
+
+	webhook := &Webhook{}
+	if err := result.Decode(webhook); err != nil {
+		return nil, err
+	}
+
+	return webhook, nil
+}
+
+func (m *MongoRepo) Subscribers(ctx context.Context, userId string, event string) ([]*Webhook, error) {
+	cursor, err := m.Col.Find(ctx, bson.M{"user_id": userId, "events": event, "disabled": false})
+	if err != nil {
+		return nil, err
+	}
+
+	webhooks := make([]*Webhook, 0)
+	if err := cursor.All(ctx, &webhooks); err != nil {
+		return nil, err
+	}
+
+	return webhooks, nil
+}
+
+func (m *MongoRepo) AddDeliveries(ctx context.Context, deliveries []*Delivery) error {
+	documents := make([]interface{}, len(deliveries))
+	for i, delivery := range deliveries {
+		documents[i] = delivery
+	}
+
+	_, err := m.DeliveryCol.InsertMany(ctx, documents)
+	return err
+}
+
+func (m *MongoRepo) ListDeliveries(ctx context.Context, userId string, webhookId string, before time.Time, limit int) ([]*Delivery, error) {
+	filter := bson.M{"user_id": userId, "webhook_id": webhookId, "created_at": bson.M{"$lt": before}}
+	opts := options.Find().SetSort(bson.M{"created_at": -1}).SetLimit(int64(limit))
+
+	cursor, err := m.DeliveryCol.Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make([]*Delivery, 0)
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+func (m *MongoRepo) GetDelivery(ctx context.Context, userId string, webhookId string, deliveryId string) (*Delivery, error) {
+	result := m.DeliveryCol.FindOne(ctx, bson.M{"_id": deliveryId, "user_id": userId, "webhook_id": webhookId})
+	if result.Err() != nil {
+		if result.Err() == mongo.ErrNoDocuments {
+			return nil, errDeliveryNotFound
+		}
+
+		return nil, result.Err()
+	}
+
+	delivery := &Delivery{}
+	if err := result.Decode(delivery); err != nil {
+		return nil, err
+	}
+
+	return delivery, nil
+}
+
+func (m *MongoRepo) ClaimDelivery(ctx context.Context, now time.Time, lease time.Time, skip []string) (*Delivery, error) {
+	filter := bson.M{"status": StatusPending, "next_attempt": bson.M{"$lte": now}}
+	if len(skip) > 0 {
+		filter["webhook_id"] = bson.M{"$nin": skip}
+	}
+
+	result := m.DeliveryCol.FindOneAndUpdate(ctx,
+		filter,
+		bson.M{"$set": bson.M{"next_attempt": lease}},
+		options.FindOneAndUpdate().SetSort(bson.M{"next_attempt": 1}),
+	)
+
+	if result.Err() != nil {
+		if result.Err() == mongo.ErrNoDocuments {
+			return nil, nil
+		}
+
+		return nil, result.Err()
+	}
+
+	delivery := &Delivery{}
+	if err := result.Decode(delivery); err != nil {
+		return nil, err
+	}
+
+	return delivery, nil
+}
+
+func (m *MongoRepo) FinishAttempt(ctx context.Context, delivery *Delivery) error {
+	_, err := m.DeliveryCol.UpdateOne(ctx, bson.M{"_id": delivery.DeliveryId}, bson.M{
+		"$set": bson.M{
+			"status":          delivery.Status,
+			"attempts":        delivery.Attempts,
+			"next_attempt":    delivery.NextAttempt,
+			"last_attempt_at": delivery.LastAttemptAt,
+			"response_code":   delivery.ResponseCode,
+			"error":           delivery.Error,
+			"expires_at":      delivery.ExpiresAt,
+		},
+	})
+
+	return err
+}
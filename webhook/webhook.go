@@ -0,0 +1,471 @@
+// Package webhook posts domain events to the urls users register for them
+// Deliveries are signed with the secret of the webhook and retried with exponential backoff
+package webhook
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/tPhume/ags-backend/alert"
+	"github.com/tPhume/ags-backend/controller"
+	"github.com/tPhume/ags-backend/outbound"
+	"github.com/tPhume/ags-backend/plan"
+	"github.com/tPhume/ags-backend/session"
+	"net/http"
+	"time"
+)
+
+func RegisterRoutes(handler *Handler, engine *gin.Engine, sessionHandler *session.Handler) {
+	group := engine.Group("api/v1/webhook")
+	group.Use(sessionHandler.GetUser)
+
+	group.POST("", handler.AddWebhook)
+	group.GET("", handler.ListWebhooks)
+	group.PUT("/:webhookId", handler.UpdateWebhook)
+	group.DELETE("/:webhookId", handler.RemoveWebhook)
+
+	group.POST("/:webhookId/secret", handler.RotateSecret)
+	group.GET("/:webhookId/delivery", handler.ListDeliveries)
+	group.POST("/:webhookId/delivery/:deliveryId/redeliver", handler.Redeliver)
+}
+
+// EventReadingReceived is published for every batch of readings stored for a controller
+const EventReadingReceived = "reading.received"
+
+// EventTypes a webhook can subscribe to
+var EventTypes = []string{
+	controller.EventCreated,
+	controller.EventUpdated,
+	controller.EventRemoved,
+	plan.EventCreated,
+	plan.EventReplaced,
+	plan.EventDeleted,
+	EventReadingReceived,
+	alert.EventFiring,
+	alert.EventResolved,
+}
+
+// Statuses of a delivery
+const (
+	StatusPending   = "pending"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// Most webhooks a user can register
+const maxWebhooks = 10
+
+// Webhook is a url that is posted the events it subscribes to
+type Webhook struct {
+	WebhookId string   `json:"webhook_id" bson:"_id"`
+	UserId    string   `json:"-" bson:"user_id"`
+	Url       string   `json:"url" bson:"url" binding:"required,max=2000"`
+	Events    []string `json:"events" bson:"events" binding:"required,min=1,max=20"`
+
+	// Disabled webhooks are not posted new events, pending deliveries fail
+	Disabled bool `json:"disabled" bson:"disabled"`
+
+	// Secret signs deliveries, it is only shown when the webhook is added and when it is rotated
+	Secret string `json:"secret,omitempty" bson:"secret" binding:"-"`
+
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+}
+
+// Event is the body of a delivery, Id stays the same when the event is delivered again
+type Event struct {
+	EventId   string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+// Delivery is one event to one webhook and the outcome of the attempts to post it
+type Delivery struct {
+	DeliveryId string `json:"delivery_id" bson:"_id"`
+	WebhookId  string `json:"webhook_id" bson:"webhook_id"`
+	UserId     string `json:"-" bson:"user_id"`
+	EventId    string `json:"event_id" bson:"event_id"`
+	Event      string `json:"event" bson:"event"`
+
+	// Payload is the body as it is posted on every attempt
+	Payload string `json:"payload" bson:"payload"`
+
+	Status        string     `json:"status" bson:"status"`
+	Attempts      int        `json:"attempts" bson:"attempts"`
+	NextAttempt   time.Time  `json:"next_attempt" bson:"next_attempt"`
+	LastAttemptAt *time.Time `json:"last_attempt_at,omitempty" bson:"last_attempt_at,omitempty"`
+	ResponseCode  int        `json:"response_code,omitempty" bson:"response_code,omitempty"`
+	Error         string     `json:"error,omitempty" bson:"error,omitempty"`
+
+	// RedeliveryOf is the delivery this one was asked to repeat
+	RedeliveryOf string `json:"redelivery_of,omitempty" bson:"redelivery_of,omitempty"`
+
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+
+	// ExpiresAt is when a delivery that succeeded or failed is removed, pending ones are kept
+	ExpiresAt *time.Time `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+}
+
+// Repo
+type Repo interface {
+	AddWebhook(ctx context.Context, webhook *Webhook) error
+
+	// ListWebhooks returns the webhooks of the user without their secrets
+	ListWebhooks(ctx context.Context, userId string) ([]*Webhook, error)
+
+	// UpdateWebhook sets the url, events and disabled of the webhook, the secret is kept
+	UpdateWebhook(ctx context.Context, webhook *Webhook) error
+
+	RemoveWebhook(ctx context.Context, userId string, webhookId string) error
+
+	SetSecret(ctx context.Context, userId string, webhookId string, secret string) error
+
+	// GetWebhook returns the webhook with its secret, whoever it belongs to
+	GetWebhook(ctx context.Context, webhookId string) (*Webhook, error)
+
+	// Subscribers returns the webhooks of the user that are not disabled and subscribe to event
+	Subscribers(ctx context.Context, userId string, event string) ([]*Webhook, error)
+
+	AddDeliveries(ctx context.Context, deliveries []*Delivery) error
+
+	// ListDeliveries returns up to limit deliveries of the webhook created before a time, newest first
+	ListDeliveries(ctx context.Context, userId string, webhookId string, before time.Time, limit int) ([]*Delivery, error)
+
+	GetDelivery(ctx context.Context, userId string, webhookId string, deliveryId string) (*Delivery, error)
+
+	// ClaimDelivery returns the pending delivery that is due the longest as of now and moves its next attempt to lease
+	// Deliveries to the webhooks in skip are left for later
+	// It returns nil when none is due, a claimed delivery is only tried again after lease when its attempt is never finished
+	ClaimDelivery(ctx context.Context, now time.Time, lease time.Time, skip []string) (*Delivery, error)
+
+	// FinishAttempt saves the status, attempts, outcome and expiry of the delivery
+	FinishAttempt(ctx context.Context, delivery *Delivery) error
+}
+
+var (
+	errWebhookNotFound  = errors.New("webhook not found")
+	errDeliveryNotFound = errors.New("delivery not found")
+)
+
+// Handler for webhook REST API
+type Handler struct {
+	Repo Repo
+
+	// Resolver looks up the hosts of urls, net.DefaultResolver when nil
+	Resolver outbound.Resolver
+}
+
+var (
+	// ok message responses for handler
+	resAdd        = "webhook added"
+	resList       = "list of webhooks retrieved"
+	resUpdate     = "webhook updated"
+	resRemove     = "webhook removed"
+	resSecret     = "webhook secret rotated"
+	resDeliveries = "list of deliveries retrieved"
+	resRedeliver  = "delivery queued"
+
+	// error message responses for handler
+	resInternal     = "not your fault, don't worry"
+	resInvalid      = "invalid values"
+	resNotFound     = "not found"
+	resBadUrl       = "url must be http or https"
+	resPrivateUrl   = "url must resolve to a public address"
+	resUnknownEvent = "unknown event type"
+	resTooMany      = "too many webhooks"
+)
+
+func (h *Handler) AddWebhook(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	webhook := &Webhook{}
+	if err := ctx.ShouldBindJSON(webhook); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid, "err": err.Error()})
+		return
+	}
+
+	if !h.checkWebhook(ctx, webhook) {
+		return
+	}
+
+	webhooks, err := h.Repo.ListWebhooks(ctx, userId)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	if len(webhooks) >= maxWebhooks {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resTooMany})
+		return
+	}
+
+	secret, err := newSecret()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	webhook.WebhookId = uuid.New().String()
+	webhook.UserId = userId
+	webhook.Secret = secret
+	webhook.CreatedAt = time.Now()
+
+	if err := h.Repo.AddWebhook(ctx, webhook); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, gin.H{"message": resAdd, "webhook": webhook})
+}
+
+func (h *Handler) ListWebhooks(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	webhooks, err := h.Repo.ListWebhooks(ctx, userId)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resList, "webhooks": webhooks})
+}
+
+func (h *Handler) UpdateWebhook(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	webhookId := ctx.Param("webhookId")
+	if _, err := uuid.Parse(webhookId); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	webhook := &Webhook{}
+	if err := ctx.ShouldBindJSON(webhook); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid, "err": err.Error()})
+		return
+	}
+
+	if !h.checkWebhook(ctx, webhook) {
+		return
+	}
+
+	webhook.WebhookId = webhookId
+	webhook.UserId = userId
+	webhook.Secret = ""
+
+	if err := h.Repo.UpdateWebhook(ctx, webhook); err != nil {
+		if err == errWebhookNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resNotFound})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resUpdate, "webhook": webhook})
+}
+
+func (h *Handler) RemoveWebhook(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	webhookId := ctx.Param("webhookId")
+	if _, err := uuid.Parse(webhookId); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	if err := h.Repo.RemoveWebhook(ctx, userId, webhookId); err != nil {
+		if err == errWebhookNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resNotFound})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resRemove})
+}
+
+// RotateSecret replaces the secret of the webhook, deliveries are signed with the new one from the next attempt
+func (h *Handler) RotateSecret(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	webhookId := ctx.Param("webhookId")
+	if _, err := uuid.Parse(webhookId); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	secret, err := newSecret()
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	if err := h.Repo.SetSecret(ctx, userId, webhookId, secret); err != nil {
+		if err == errWebhookNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resNotFound})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resSecret, "secret": secret})
+}
+
+// Query for ListDeliveries, before is the created_at of the last delivery of the previous page
+type deliveryQuery struct {
+	Limit  int       `form:"limit,default=20" binding:"min=1,max=100"`
+	Before time.Time `form:"before" time_format:"2006-01-02T15:04:05.999999999Z07:00"`
+}
+
+func (h *Handler) ListDeliveries(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	webhookId := ctx.Param("webhookId")
+	if _, err := uuid.Parse(webhookId); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	query := &deliveryQuery{}
+	if err := ctx.ShouldBindQuery(query); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid, "err": err.Error()})
+		return
+	}
+
+	if query.Before.IsZero() {
+		query.Before = time.Now()
+	}
+
+	deliveries, err := h.Repo.ListDeliveries(ctx, userId, webhookId, query.Before, query.Limit)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": resDeliveries, "deliveries": deliveries})
+}
+
+// Redeliver queues the payload of a delivery again as a new delivery, whatever the outcome of the first was
+func (h *Handler) Redeliver(ctx *gin.Context) {
+	userId := ctx.GetString("userId")
+	if userId == "" {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	webhookId := ctx.Param("webhookId")
+	deliveryId := ctx.Param("deliveryId")
+	_, errWebhook := uuid.Parse(webhookId)
+	_, errDelivery := uuid.Parse(deliveryId)
+	if errWebhook != nil || errDelivery != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": resInvalid})
+		return
+	}
+
+	original, err := h.Repo.GetDelivery(ctx, userId, webhookId, deliveryId)
+	if err != nil {
+		if err == errDeliveryNotFound {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": resNotFound})
+		} else {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		}
+
+		return
+	}
+
+	now := time.Now()
+	delivery := &Delivery{
+		DeliveryId:   uuid.New().String(),
+		WebhookId:    original.WebhookId,
+		UserId:       original.UserId,
+		EventId:      original.EventId,
+		Event:        original.Event,
+		Payload:      original.Payload,
+		Status:       StatusPending,
+		NextAttempt:  now,
+		RedeliveryOf: original.DeliveryId,
+		CreatedAt:    now,
+	}
+
+	if err := h.Repo.AddDeliveries(ctx, []*Delivery{delivery}); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": resInternal})
+		return
+	}
+
+	ctx.JSON(http.StatusAccepted, gin.H{"message": resRedeliver, "delivery": delivery})
+}
+
+// checkWebhook responds and returns false when the url or an event type is not valid
+func (h *Handler) checkWebhook(ctx *gin.Context, webhook *Webhook) bool {
+	if err := outbound.CheckUrl(ctx, h.Resolver, webhook.Url); err != nil {
+		if err == outbound.ErrForbiddenAddress {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": resPrivateUrl})
+		} else {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": resBadUrl})
+		}
+
+		return false
+	}
+
+	for _, event := range webhook.Events {
+		if !knownEvent(event) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": resUnknownEvent, "event": event})
+			return false
+		}
+	}
+
+	return true
+}
+
+func knownEvent(event string) bool {
+	for _, known := range EventTypes {
+		if event == known {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newSecret returns 32 random bytes as hex
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return "whsec_" + hex.EncodeToString(b), nil
+}
@@ -0,0 +1,546 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// For our tests the developer has a webhook for their CRM and an archive webhook they disabled
+// Any other webhook or delivery id indicates a missing one
+const (
+	developerId = "8cf1bfba-11ac-429f-89ab-e83fbf927164"
+	crmId       = "e820b027-b471-43d8-b8ad-32aa8ef9c10a"
+	archiveId   = "db5cbe9d-0951-4448-b2f0-90cd1c79ca7f"
+	failedId    = "5b5d19d1-5493-4a0b-b6a7-4356a6af732a"
+	unknownId   = "c230b883-6c00-4cad-9817-99d6812ff1bc"
+)
+
+// Repo struct for testing, webhooks and deliveries are kept in memory
+// Deliveries are attempted by more than one worker so they are behind a lock
+type repoStruct struct {
+	webhooks   map[string]*Webhook
+	deliveries map[string]*Delivery
+	mu         sync.Mutex
+}
+
+func (r *repoStruct) AddWebhook(ctx context.Context, webhook *Webhook) error {
+	r.webhooks[webhook.WebhookId] = webhook
+	return nil
+}
+
+func (r *repoStruct) ListWebhooks(ctx context.Context, user string) ([]*Webhook, error) {
+	webhooks := make([]*Webhook, 0)
+	for _, webhook := range r.webhooks {
+		if webhook.UserId == user {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+
+	return webhooks, nil
+}
+
+func (r *repoStruct) UpdateWebhook(ctx context.Context, webhook *Webhook) error {
+	stored, ok := r.webhooks[webhook.WebhookId]
+	if !ok || stored.UserId != webhook.UserId {
+		return errWebhookNotFound
+	}
+
+	stored.Url, stored.Events, stored.Disabled = webhook.Url, webhook.Events, webhook.Disabled
+	return nil
+}
+
+func (r *repoStruct) RemoveWebhook(ctx context.Context, user string, id string) error {
+	if stored, ok := r.webhooks[id]; !ok || stored.UserId != user {
+		return errWebhookNotFound
+	}
+
+	delete(r.webhooks, id)
+	return nil
+}
+
+func (r *repoStruct) SetSecret(ctx context.Context, user string, id string, secret string) error {
+	stored, ok := r.webhooks[id]
+	if !ok || stored.UserId != user {
+		return errWebhookNotFound
+	}
+
+	stored.Secret = secret
+	return nil
+}
+
+func (r *repoStruct) GetWebhook(ctx context.Context, id string) (*Webhook, error) {
+	webhook, ok := r.webhooks[id]
+	if !ok {
+		return nil, errWebhookNotFound
+	}
+
+	return webhook, nil
+}
+
+func (r *repoStruct) Subscribers(ctx context.Context, user string, event string) ([]*Webhook, error) {
+	webhooks := make([]*Webhook, 0)
+	for _, webhook := range r.webhooks {
+		if webhook.UserId == user && !webhook.Disabled {
+			for _, subscribed := range webhook.Events {
+				if subscribed == event {
+					webhooks = append(webhooks, webhook)
+				}
+			}
+		}
+	}
+
+	return webhooks, nil
+}
+
+func (r *repoStruct) AddDeliveries(ctx context.Context, deliveries []*Delivery) error {
+	for _, delivery := range deliveries {
+		r.deliveries[delivery.DeliveryId] = delivery
+	}
+
+	return nil
+}
+
+func (r *repoStruct) ListDeliveries(ctx context.Context, user string, id string, before time.Time, limit int) ([]*Delivery, error) {
+	deliveries := make([]*Delivery, 0)
+	for _, delivery := range r.deliveries {
+		if delivery.UserId == user && delivery.WebhookId == id && delivery.CreatedAt.Before(before) {
+			deliveries = append(deliveries, delivery)
+		}
+	}
+
+	return deliveries, nil
+}
+
+func (r *repoStruct) GetDelivery(ctx context.Context, user string, id string, deliveryId string) (*Delivery, error) {
+	delivery, ok := r.deliveries[deliveryId]
+	if !ok || delivery.UserId != user || delivery.WebhookId != id {
+		return nil, errDeliveryNotFound
+	}
+
+	return delivery, nil
+}
+
+func (r *repoStruct) ClaimDelivery(ctx context.Context, now time.Time, lease time.Time, skip []string) (*Delivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	due := make([]*Delivery, 0)
+	for _, delivery := range r.deliveries {
+		if delivery.Status == StatusPending && !delivery.NextAttempt.After(now) && !skipped(skip, delivery.WebhookId) {
+			due = append(due, delivery)
+		}
+	}
+
+	if len(due) == 0 {
+		return nil, nil
+	}
+
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].NextAttempt.Before(due[j].NextAttempt)
+	})
+
+	due[0].NextAttempt = lease
+	claimed := *due[0]
+	return &claimed, nil
+}
+
+func skipped(skip []string, webhookId string) bool {
+	for _, id := range skip {
+		if id == webhookId {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *repoStruct) FinishAttempt(ctx context.Context, delivery *Delivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	finished := *delivery
+	r.deliveries[delivery.DeliveryId] = &finished
+	return nil
+}
+
+// Resolver struct for testing, localhost is private and every other host is public
+type resolverStruct struct{}
+
+func (r resolverStruct) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if host == "localhost" {
+		return []net.IPAddr{{IP: net.IPv4(127, 0, 0, 1)}}, nil
+	}
+
+	return []net.IPAddr{{IP: net.IPv4(93, 184, 216, 34)}}, nil
+}
+
+func newRepo() *repoStruct {
+	return &repoStruct{webhooks: map[string]*Webhook{}, deliveries: map[string]*Delivery{}}
+}
+
+// Setup func for handler testing
+func setUp() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	engine := gin.New()
+
+	engine.Use(func(ctx *gin.Context) {
+		ctx.Set("userId", developerId)
+	})
+
+	return engine
+}
+
+// Test AddWebhook handler
+func TestHandler_AddWebhook(t *testing.T) {
+	engine := setUp()
+
+	repo := newRepo()
+	handler := &Handler{Repo: repo, Resolver: resolverStruct{}}
+	engine.POST("", handler.AddWebhook)
+
+	testCases := []struct {
+		body    string
+		message string
+		code    int
+	}{
+		{body: `{"url":"https://hooks.example.com/ags","events":["controller.created","plan.replaced"]}`, message: resAdd, code: http.StatusCreated},
+		{body: `{"url":"http://hooks.example.com:8080","events":["reading.received","alert.firing"]}`, message: resAdd, code: http.StatusCreated},
+		{body: `{"url":"http://localhost:8080","events":["reading.received"]}`, message: resPrivateUrl, code: http.StatusBadRequest},
+		{body: `{"url":"http://10.0.0.7/hook","events":["reading.received"]}`, message: resPrivateUrl, code: http.StatusBadRequest},
+		{body: `{"url":"ftp://hooks.example.com","events":["controller.created"]}`, message: resBadUrl, code: http.StatusBadRequest},
+		{body: `{"url":"hooks.example.com","events":["controller.created"]}`, message: resBadUrl, code: http.StatusBadRequest},
+		{body: `{"url":"https://hooks.example.com/ags","events":["controller.exploded"]}`, message: resUnknownEvent, code: http.StatusBadRequest},
+		{body: `{"url":"https://hooks.example.com/ags","events":[]}`, message: resInvalid, code: http.StatusBadRequest},
+		{body: `{"events":["controller.created"]}`, message: resInvalid, code: http.StatusBadRequest},
+	}
+
+	for i, c := range testCases {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(c.body))
+		engine.ServeHTTP(w, req)
+
+		res := struct {
+			Message string   `json:"message"`
+			Webhook *Webhook `json:"webhook"`
+		}{}
+		_ = json.Unmarshal(w.Body.Bytes(), &res)
+
+		if w.Code != c.code {
+			t.Fatalf("Case %d: expected [%v], got = [%v] %s", i, c.code, w.Code, w.Body.String())
+		}
+
+		if c.message != res.Message {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.message, res.Message)
+		}
+
+		if c.code != http.StatusCreated {
+			continue
+		}
+
+		if !strings.HasPrefix(res.Webhook.Secret, "whsec_") {
+			t.Fatalf("Case %d: expected a webhook with its secret, got = [%v]", i, w.Body.String())
+		}
+	}
+
+	// There is a limit to how many a user can have
+	for len(repo.webhooks) < maxWebhooks {
+		w := httptest.NewRecorder()
+		engine.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(testCases[0].body)))
+	}
+
+	w := httptest.NewRecorder()
+	engine.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(testCases[0].body)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), resTooMany) {
+		t.Fatalf("expected [%v %v], got = [%v] %s", http.StatusBadRequest, resTooMany, w.Code, w.Body.String())
+	}
+}
+
+// Test events are delivered signed, retried with backoff and fail after the last attempt
+func TestDispatcher_RunOnce(t *testing.T) {
+	secret := "whsec_test"
+	failures := 0
+	received := make([]string, 0)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := Verify(secret, r.Header.Get(HeaderTimestamp), r.Header.Get(HeaderSignature), body, time.Now(), 5*time.Minute); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		received = append(received, r.Header.Get(HeaderEvent))
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer server.Close()
+
+	repo := newRepo()
+	repo.webhooks[crmId] = &Webhook{WebhookId: crmId, UserId: developerId, Url: server.URL, Secret: secret,
+		Events: []string{"plan.replaced", "controller.created"}}
+	repo.webhooks[archiveId] = &Webhook{WebhookId: archiveId, UserId: developerId, Url: server.URL, Secret: "other",
+		Events: []string{"plan.replaced"}, Disabled: true}
+
+	dispatcher := &Dispatcher{Repo: repo, Client: server.Client()}
+	start := time.Date(2020, time.April, 1, 12, 0, 0, 0, time.UTC)
+
+	// Only subscribed webhooks that are not disabled get a delivery
+	dispatcher.Publish(context.Background(), developerId, "plan.deleted", nil)
+	if len(repo.deliveries) != 0 {
+		t.Fatalf("expected no deliveries, got = [%v]", len(repo.deliveries))
+	}
+
+	if err := dispatcher.publish(context.Background(), developerId, "plan.replaced", map[string]string{"plan_id": "p"}, start); err != nil {
+		t.Fatalf("expected no error, got = [%v]", err)
+	}
+
+	if len(repo.deliveries) != 1 {
+		t.Fatalf("expected [1] delivery, got = [%v]", len(repo.deliveries))
+	}
+
+	var deliveryId string
+	for id := range repo.deliveries {
+		deliveryId = id
+	}
+
+	// Fails twice then goes through, each retry waits twice as long from when it was attempted
+	failures = 2
+	now := start
+	for i, wait := range []time.Duration{30 * time.Second, time.Minute} {
+		before := time.Now()
+		if err := dispatcher.RunOnce(context.Background(), now); err != nil {
+			t.Fatalf("Case %d: expected no error, got = [%v]", i, err)
+		}
+		after := time.Now()
+
+		delivery := repo.deliveries[deliveryId]
+		if delivery.Status != StatusPending || delivery.Attempts != i+1 || delivery.ResponseCode != http.StatusServiceUnavailable {
+			t.Fatalf("Case %d: expected [pending %d 503], got = [%+v]", i, i+1, delivery)
+		}
+
+		if delivery.NextAttempt.Before(before.Add(wait)) || delivery.NextAttempt.After(after.Add(wait)) {
+			t.Fatalf("Case %d: expected next attempt [%v] after the attempt, got = [%v]", i, wait, delivery.NextAttempt.Sub(before))
+		}
+
+		if delivery.LastAttemptAt == nil || delivery.LastAttemptAt.Before(before) || delivery.ExpiresAt != nil {
+			t.Fatalf("Case %d: expected [attempted now, no expiry], got = [%+v]", i, delivery)
+		}
+
+		// Not due yet
+		if err := dispatcher.RunOnce(context.Background(), delivery.NextAttempt.Add(-time.Second)); err != nil || repo.deliveries[deliveryId].Attempts != i+1 {
+			t.Fatalf("Case %d: expected no attempt before it is due, got = [%v]", i, repo.deliveries[deliveryId].Attempts)
+		}
+
+		now = delivery.NextAttempt
+	}
+
+	if err := dispatcher.RunOnce(context.Background(), now); err != nil {
+		t.Fatalf("expected no error, got = [%v]", err)
+	}
+
+	if delivery := repo.deliveries[deliveryId]; delivery.Status != StatusSucceeded || len(received) != 1 || received[0] != "plan.replaced" {
+		t.Fatalf("expected [succeeded plan.replaced], got = [%+v] %v", delivery, received)
+	}
+
+	// Finished deliveries are removed after the retention
+	if delivery := repo.deliveries[deliveryId]; delivery.ExpiresAt == nil || delivery.ExpiresAt.Before(time.Now().Add(defaultRetention-time.Minute)) {
+		t.Fatalf("expected [expiry in %v], got = [%v]", defaultRetention, delivery.ExpiresAt)
+	}
+
+	// Fails for good after the last attempt
+	failures = maxAttempts
+	_ = dispatcher.publish(context.Background(), developerId, "controller.created", nil, now)
+	for i := 0; i < maxAttempts; i++ {
+		// Skip the backoff
+		now = time.Now()
+		for _, delivery := range repo.deliveries {
+			if delivery.Status == StatusPending {
+				delivery.NextAttempt = now
+			}
+		}
+
+		if err := dispatcher.RunOnce(context.Background(), now); err != nil {
+			t.Fatalf("expected no error, got = [%v]", err)
+		}
+	}
+
+	failed := 0
+	for _, delivery := range repo.deliveries {
+		if delivery.Status == StatusFailed && delivery.Attempts == maxAttempts {
+			failed++
+		}
+	}
+
+	if failed != 1 {
+		t.Fatalf("expected [1] failed delivery, got = [%v]", failed)
+	}
+
+	// Deliveries of a webhook that was disabled since fail at once
+	repo.webhooks[crmId].Disabled = true
+	_ = repo.AddDeliveries(context.Background(), []*Delivery{{DeliveryId: "late", WebhookId: crmId, UserId: developerId, Status: StatusPending, NextAttempt: now}})
+	_ = dispatcher.RunOnce(context.Background(), now)
+
+	if delivery := repo.deliveries["late"]; delivery.Status != StatusFailed || delivery.Attempts != 1 {
+		t.Fatalf("expected [failed 1], got = [%+v]", delivery)
+	}
+}
+
+// Test deliveries are attempted by a pool of workers, no more than maxPerWebhook to a webhook at once
+func TestDispatcher_RunOnceLimits(t *testing.T) {
+	var mu sync.Mutex
+	current := map[string]int{}
+	most := map[string]int{}
+	total, mostTotal := 0, 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		current[r.URL.Path]++
+		total++
+		if current[r.URL.Path] > most[r.URL.Path] {
+			most[r.URL.Path] = current[r.URL.Path]
+		}
+		if total > mostTotal {
+			mostTotal = total
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		current[r.URL.Path]--
+		total--
+		mu.Unlock()
+
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	defer server.Close()
+
+	repo := newRepo()
+	repo.webhooks[crmId] = &Webhook{WebhookId: crmId, UserId: developerId, Url: server.URL + "/crm", Secret: "crm",
+		Events: []string{"plan.replaced"}}
+	repo.webhooks[archiveId] = &Webhook{WebhookId: archiveId, UserId: developerId, Url: server.URL + "/archive", Secret: "archive",
+		Events: []string{"plan.replaced"}}
+
+	dispatcher := &Dispatcher{Repo: repo, Client: server.Client(), Workers: 4}
+	now := time.Now()
+
+	for i := 0; i < 6; i++ {
+		_ = dispatcher.publish(context.Background(), developerId, "plan.replaced", nil, now)
+	}
+
+	if err := dispatcher.RunOnce(context.Background(), now); err != nil {
+		t.Fatalf("expected no error, got = [%v]", err)
+	}
+
+	for _, delivery := range repo.deliveries {
+		if delivery.Status != StatusSucceeded {
+			t.Fatalf("expected [succeeded], got = [%+v]", delivery)
+		}
+	}
+
+	if most["/crm"] > maxPerWebhook || most["/archive"] > maxPerWebhook || mostTotal <= maxPerWebhook {
+		t.Fatalf("expected [at most %d to each, more in all], got = [%v %v]", maxPerWebhook, most, mostTotal)
+	}
+}
+
+// Test Redeliver handler
+func TestHandler_Redeliver(t *testing.T) {
+	engine := setUp()
+
+	repo := newRepo()
+	repo.deliveries[failedId] = &Delivery{DeliveryId: failedId, WebhookId: crmId, UserId: developerId, EventId: "event",
+		Event: "plan.replaced", Payload: `{"id":"event"}`, Status: StatusFailed, Attempts: maxAttempts}
+
+	handler := &Handler{Repo: repo}
+	engine.POST(":webhookId/delivery/:deliveryId/redeliver", handler.Redeliver)
+
+	testCases := []struct {
+		webhookId  string
+		deliveryId string
+		message    string
+		code       int
+	}{
+		{webhookId: crmId, deliveryId: failedId, message: resRedeliver, code: http.StatusAccepted},
+		{webhookId: unknownId, deliveryId: failedId, message: resNotFound, code: http.StatusNotFound},
+		{webhookId: crmId, deliveryId: unknownId, message: resNotFound, code: http.StatusNotFound},
+		{webhookId: crmId, deliveryId: "not-a-uuid", message: resInvalid, code: http.StatusBadRequest},
+	}
+
+	for i, c := range testCases {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/"+c.webhookId+"/delivery/"+c.deliveryId+"/redeliver", nil)
+		engine.ServeHTTP(w, req)
+
+		res := struct {
+			Message string `json:"message"`
+		}{}
+		_ = json.Unmarshal(w.Body.Bytes(), &res)
+
+		if w.Code != c.code {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.code, w.Code)
+		}
+
+		if c.message != res.Message {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.message, res.Message)
+		}
+	}
+
+	if len(repo.deliveries) != 2 {
+		t.Fatalf("expected [2] deliveries, got = [%v]", len(repo.deliveries))
+	}
+
+	for id, delivery := range repo.deliveries {
+		if id != failedId && (delivery.Status != StatusPending || delivery.Attempts != 0 || delivery.EventId != "event" || delivery.RedeliveryOf != failedId) {
+			t.Fatalf("expected [pending redelivery of the same event], got = [%+v]", delivery)
+		}
+	}
+}
+
+// Test signatures are checked and old ones rejected
+func TestVerify(t *testing.T) {
+	now := time.Date(2020, time.April, 1, 12, 0, 0, 0, time.UTC)
+	body := []byte(`{"id":"event"}`)
+	signature := Sign("secret", now.Unix(), body)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+
+	testCases := []struct {
+		secret    string
+		timestamp string
+		body      string
+		at        time.Time
+		expected  error
+	}{
+		{secret: "secret", timestamp: timestamp, body: string(body), at: now},
+		{secret: "secret", timestamp: timestamp, body: string(body), at: now.Add(4 * time.Minute)},
+		// Replayed later
+		{secret: "secret", timestamp: timestamp, body: string(body), at: now.Add(6 * time.Minute), expected: ErrBadTimestamp},
+		{secret: "secret", timestamp: "", body: string(body), at: now, expected: ErrBadTimestamp},
+		{secret: "other", timestamp: timestamp, body: string(body), at: now, expected: ErrBadSignature},
+		{secret: "secret", timestamp: timestamp, body: `{"id":"forged"}`, at: now, expected: ErrBadSignature},
+		// The timestamp is part of what is signed
+		{secret: "secret", timestamp: strconv.FormatInt(now.Unix()+1, 10), body: string(body), at: now, expected: ErrBadSignature},
+	}
+
+	for i, c := range testCases {
+		if err := Verify(c.secret, c.timestamp, signature, []byte(c.body), c.at, 5*time.Minute); err != c.expected {
+			t.Fatalf("Case %d: expected [%v], got = [%v]", i, c.expected, err)
+		}
+	}
+}